@@ -34,6 +34,11 @@ func CreateBootstrapConfig(opts options.AdsBootstrapperOptions) (string, error)
 	// Parse ADS connect timeout
 	connectTimeoutProto := ptypes.DurationProto(opts.AdsConnectTimeout)
 
+	apiType := corepb.ApiConfigSource_GRPC
+	if opts.EnableDeltaXds {
+		apiType = corepb.ApiConfigSource_DELTA_GRPC
+	}
+
 	bt := &bootstrappb.Bootstrap{
 		// Node info
 		Node: bt.CreateNode(opts.CommonOptions),
@@ -59,7 +64,7 @@ func CreateBootstrapConfig(opts options.AdsBootstrapperOptions) (string, error)
 				ResourceApiVersion: apiVersion,
 			},
 			AdsConfig: &corepb.ApiConfigSource{
-				ApiType:             corepb.ApiConfigSource_GRPC,
+				ApiType:             apiType,
 				TransportApiVersion: apiVersion,
 				GrpcServices: []*corepb.GrpcService{{
 					TargetSpecifier: &corepb.GrpcService_EnvoyGrpc_{
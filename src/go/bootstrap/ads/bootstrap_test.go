@@ -220,6 +220,107 @@ func TestCreateBootstrapConfig(t *testing.T) {
       ]
    }
 }
+`,
+		},
+		{
+			desc: "bootstrap with delta xds",
+			args: map[string]string{
+				// TODO(nareddyt): Remove flag from bootstrap binary in follow-up PR
+				"disable_tracing":  "true",
+				"admin_port":       "8001",
+				"node":             "test-node",
+				"enable_delta_xds": "true",
+			},
+			wantConfig: `
+{
+   "admin":{
+      "address":{
+         "socketAddress":{
+            "address":"0.0.0.0",
+            "portValue":8001
+         }
+      }
+   },
+   "dynamicResources":{
+      "adsConfig":{
+         "apiType":"DELTA_GRPC",
+         "grpcServices":[
+            {
+               "envoyGrpc":{
+                  "clusterName":"@espv2-ads-cluster"
+               }
+            }
+         ],
+         "transportApiVersion":"V3"
+      },
+      "cdsConfig":{
+         "ads":{
+            
+         },
+         "resourceApiVersion":"V3"
+      },
+      "ldsConfig":{
+         "ads":{
+            
+         },
+         "resourceApiVersion":"V3"
+      }
+   },
+   "layeredRuntime":{
+      "layers":[
+         {
+            "name": "static-runtime",
+            "staticLayer": {
+              "re2.max_program_size.error_level":1000
+            }
+         }
+      ]
+   },
+   "node":{
+      "cluster":"test-node_cluster",
+      "id":"test-node"
+   },
+   "staticResources":{
+      "clusters":[
+         {
+            "connectTimeout":"10s",
+            "typedExtensionProtocolOptions":{
+               "envoy.extensions.upstreams.http.v3.HttpProtocolOptions":{
+                  "@type":"type.googleapis.com/envoy.extensions.upstreams.http.v3.HttpProtocolOptions",
+                  "explicitHttpConfig":{
+                     "http2ProtocolOptions":{
+                       "connectionKeepalive":{
+                         "interval":"30s",
+                         "timeout":"10s"
+                       }
+                     }
+                  }
+               }
+            },
+            "loadAssignment":{
+               "clusterName":"@espv2-ads-cluster",
+               "endpoints":[
+                  {
+                     "lbEndpoints":[
+                        {
+                           "endpoint":{
+                              "address":{
+                                 "pipe":{
+                                    "path":"@espv2-ads-cluster"
+                                 }
+                              }
+                           }
+                        }
+                     ]
+                  }
+               ]
+            },
+            "name":"@espv2-ads-cluster",
+            "type":"STATIC"
+         }
+      ]
+   }
+}
 `,
 		},
 	}
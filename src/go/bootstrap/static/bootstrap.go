@@ -36,6 +36,8 @@ func ServiceToBootstrapConfig(serviceConfig *confpb.Service, id string, opts opt
 		LayeredRuntime: bootstrap.CreateLayeredRuntime(),
 	}
 
+	// There is no RDS server for the static bootstrap, routes are always inlined.
+	opts.EnableRds = false
 	serviceInfo, err := sc.NewServiceInfoFromServiceConfig(serviceConfig, id, opts)
 	if err != nil {
 		return nil, fmt.Errorf("fail to initialize ServiceInfo, %s", err)
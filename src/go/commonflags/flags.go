@@ -33,6 +33,8 @@ var (
 	AdminPort                       = flag.Int("admin_port", defaults.AdminPort, "Enables envoy's admin interface on this port if it is not 0. Not recommended for production use-cases, as the admin port is unauthenticated.")
 	HttpRequestTimeoutS             = flag.Int("http_request_timeout_s", int(defaults.HttpRequestTimeout.Seconds()), `Set the timeout in second for all requests. Must be > 0 and the default is 30 seconds if not set.`)
 	Node                            = flag.String("node", defaults.Node, "envoy node id")
+	EnableDeltaXds                  = flag.Bool("enable_delta_xds", defaults.EnableDeltaXds, "Use the incremental (delta) xDS protocol between envoy and config manager, so a rollout only sends the changed resources. Must be set for both the ADS bootstrapper and the config manager.")
+	EnableRds                       = flag.Bool("enable_rds", defaults.EnableRds, "Serve routes over RDS instead of inlining them in the listener, so route changes do not drain the listener. Routes are fetched over the same ADS stream as listeners and clusters.")
 	NonGCP                          = flag.Bool("non_gcp", defaults.NonGCP, `By default, the proxy tries to talk to GCP metadata server to get VM location in the first few requests. Setting this flag to true to skip this step`)
 	GeneratedHeaderPrefix           = flag.String("generated_header_prefix", defaults.GeneratedHeaderPrefix, "Set the header prefix for the generated headers. By default, it is `X-Endpoint-`")
 	TracingProjectId                = flag.String("tracing_project_id", defaults.TracingProjectId, "The Google project id required for Stack driver tracing. If not set, will automatically use fetch it from GCP Metadata server")
@@ -73,6 +75,8 @@ func DefaultCommonOptionsFromFlags() options.CommonOptions {
 		DisableTracing:                     *DisableTracing,
 		HttpRequestTimeout:                 time.Duration(*HttpRequestTimeoutS) * time.Second,
 		Node:                               *Node,
+		EnableRds:                          *EnableRds,
+		EnableDeltaXds:                     *EnableDeltaXds,
 		NonGCP:                             *NonGCP,
 		GeneratedHeaderPrefix:              *GeneratedHeaderPrefix,
 		TracingProjectId:                   *TracingProjectId,
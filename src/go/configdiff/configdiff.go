@@ -0,0 +1,341 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package configdiff compares the Envoy configs generated from two service
+// configs, see configdiff/main/main.go.
+package configdiff
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	gen "github.com/GoogleCloudPlatform/esp-v2/src/go/configgenerator"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+// The kinds of a Change.
+const (
+	Added   = "added"
+	Removed = "removed"
+	Changed = "changed"
+)
+
+// ConfigDiff is the difference between two generated Envoy configs.
+type ConfigDiff struct {
+	// Keyed by the operation name, or the span name of the routes without
+	// operation, e.g. the 405 routes.
+	Routes []*Change `json:"routes,omitempty"`
+	// Keyed by the cluster name.
+	Clusters []*Change `json:"clusters,omitempty"`
+	// Keyed by the filter name. The JWT providers and requirements, and the
+	// Service Control services and requirements are keyed separately, e.g.
+	// "envoy.filters.http.jwt_authn requirementMap OPERATION".
+	Filters []*Change `json:"filters,omitempty"`
+}
+
+// Change is an added, removed or changed config.
+type Change struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// The changed fields, only set for Changed.
+	Fields []*FieldChange `json:"fields,omitempty"`
+}
+
+// FieldChange is a changed JSON field, identified by its path such as
+// "route.timeout" or "headers[0].name". Old or New is nil if the field is
+// added or removed.
+type FieldChange struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// Empty returns whether the two configs are the same.
+func (d *ConfigDiff) Empty() bool {
+	return len(d.Routes) == 0 && len(d.Clusters) == 0 && len(d.Filters) == 0
+}
+
+// Text formats the diff for humans.
+func (d *ConfigDiff) Text() string {
+	if d.Empty() {
+		return "no difference\n"
+	}
+	var b strings.Builder
+	for _, section := range []struct {
+		title   string
+		changes []*Change
+	}{
+		{"Routes", d.Routes},
+		{"Clusters", d.Clusters},
+		{"Filters", d.Filters},
+	} {
+		if len(section.changes) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "%s:\n", section.title)
+		for _, c := range section.changes {
+			fmt.Fprintf(&b, "  %s %s\n", map[string]string{Added: "+", Removed: "-", Changed: "~"}[c.Kind], c.Name)
+			for _, f := range c.Fields {
+				fmt.Fprintf(&b, "      %s: %s -> %s\n", f.Path, jsonString(f.Old), jsonString(f.New))
+			}
+		}
+	}
+	return b.String()
+}
+
+func jsonString(v interface{}) string {
+	if v == nil {
+		return "<none>"
+	}
+	bytes, _ := json.Marshal(v)
+	return string(bytes)
+}
+
+// Diff generates the Envoy configs of the two service configs with opts,
+// and compares them.
+func Diff(oldConfig, newConfig *confpb.Service, opts options.ConfigGeneratorOptions) (*ConfigDiff, error) {
+	oldResources, err := makeResources(oldConfig, opts)
+	if err != nil {
+		return nil, fmt.Errorf("fail to generate config for the old service config %s: %v", oldConfig.GetId(), err)
+	}
+	newResources, err := makeResources(newConfig, opts)
+	if err != nil {
+		return nil, fmt.Errorf("fail to generate config for the new service config %s: %v", newConfig.GetId(), err)
+	}
+	return &ConfigDiff{
+		Routes:   diffConfigs(oldResources.routes, newResources.routes),
+		Clusters: diffConfigs(oldResources.clusters, newResources.clusters),
+		Filters:  diffConfigs(oldResources.filters, newResources.filters),
+	}, nil
+}
+
+// resources are the generated configs in JSON, keyed by their names in the
+// diff.
+type resources struct {
+	routes, clusters, filters map[string]interface{}
+}
+
+func makeResources(serviceConfig *confpb.Service, opts options.ConfigGeneratorOptions) (*resources, error) {
+	// The routes are made separately to compare them by operation.
+	opts.EnableRds = true
+	serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(serviceConfig, serviceConfig.GetId(), opts)
+	if err != nil {
+		return nil, fmt.Errorf("fail to initialize ServiceInfo, %s", err)
+	}
+	r := &resources{
+		routes:   make(map[string]interface{}),
+		clusters: make(map[string]interface{}),
+		filters:  make(map[string]interface{}),
+	}
+
+	clusters, err := gen.MakeClusters(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	for _, cluster := range clusters {
+		if r.clusters[cluster.Name], err = toJson(cluster); err != nil {
+			return nil, err
+		}
+	}
+
+	listeners, err := gen.MakeListeners(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	for _, listener := range listeners {
+		for _, filterChain := range listener.FilterChains {
+			for _, filter := range filterChain.Filters {
+				if filter.Name != util.HTTPConnectionManager {
+					continue
+				}
+				hcm := &hcmpb.HttpConnectionManager{}
+				if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), hcm); err != nil {
+					return nil, err
+				}
+				if err := r.addHttpFilters(listener.Name, hcm.HttpFilters); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	routeConfigs, err := gen.MakeRouteConfigs([]*configinfo.ServiceInfo{serviceInfo})
+	if err != nil {
+		return nil, err
+	}
+	// An operation has a route per HTTP rule, they are compared together.
+	routes := make(map[string][]interface{})
+	for _, routeConfig := range routeConfigs {
+		for _, host := range routeConfig.VirtualHosts {
+			for _, route := range host.Routes {
+				name := route.Name
+				if name == "" {
+					name = route.GetDecorator().GetOperation()
+				}
+				config, err := toJson(route)
+				if err != nil {
+					return nil, err
+				}
+				routes[name] = append(routes[name], config)
+			}
+		}
+	}
+	for name, configs := range routes {
+		r.routes[name] = configs
+	}
+	return r, nil
+}
+
+// filterItems are the fields of the filter configs compared item by item:
+// the filter name mapped to the field and, for a list, the key of the items.
+var filterItems = map[string]map[string]string{
+	util.JwtAuthn: {
+		"providers":      "",
+		"requirementMap": "",
+	},
+	util.ServiceControl: {
+		"requirements": "operationName",
+		"services":     "serviceName",
+	},
+}
+
+func (r *resources) addHttpFilters(listenerName string, filters []*hcmpb.HttpFilter) error {
+	for _, filter := range filters {
+		name := filter.Name
+		if listenerName != util.IngressListenerName {
+			name = listenerName + " " + name
+		}
+		config, err := toJson(filter)
+		if err != nil {
+			return err
+		}
+
+		typedConfig, _ := config.(map[string]interface{})["typedConfig"].(map[string]interface{})
+		for field, key := range filterItems[filter.Name] {
+			switch items := typedConfig[field].(type) {
+			case map[string]interface{}:
+				for itemName, item := range items {
+					r.filters[fmt.Sprintf("%s %s %s", name, field, itemName)] = item
+				}
+			case []interface{}:
+				for _, item := range items {
+					itemName, _ := item.(map[string]interface{})[key].(string)
+					r.filters[fmt.Sprintf("%s %s %s", name, field, itemName)] = item
+				}
+			}
+			delete(typedConfig, field)
+		}
+		r.filters[name] = config
+	}
+	return nil
+}
+
+func toJson(msg proto.Message) (interface{}, error) {
+	marshaler := &jsonpb.Marshaler{
+		AnyResolver: util.Resolver,
+	}
+	str, err := marshaler.MarshalToString(msg)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(str), &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// diffConfigs compares the configs by name, sorted by name.
+func diffConfigs(oldConfigs, newConfigs map[string]interface{}) []*Change {
+	var changes []*Change
+	for name, oldConfig := range oldConfigs {
+		newConfig, ok := newConfigs[name]
+		if !ok {
+			changes = append(changes, &Change{Kind: Removed, Name: name})
+			continue
+		}
+		if fields := diffJson("", oldConfig, newConfig); len(fields) > 0 {
+			changes = append(changes, &Change{Kind: Changed, Name: name, Fields: fields})
+		}
+	}
+	for name := range newConfigs {
+		if _, ok := oldConfigs[name]; !ok {
+			changes = append(changes, &Change{Kind: Added, Name: name})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+// diffJson returns the changed fields between two JSON values, sorted by
+// path.
+func diffJson(path string, oldValue, newValue interface{}) []*FieldChange {
+	oldObject, oldIsObject := oldValue.(map[string]interface{})
+	newObject, newIsObject := newValue.(map[string]interface{})
+	if oldIsObject && newIsObject {
+		keys := make(map[string]bool)
+		for key := range oldObject {
+			keys[key] = true
+		}
+		for key := range newObject {
+			keys[key] = true
+		}
+		var sortedKeys []string
+		for key := range keys {
+			sortedKeys = append(sortedKeys, key)
+		}
+		sort.Strings(sortedKeys)
+
+		var fields []*FieldChange
+		for _, key := range sortedKeys {
+			fieldPath := key
+			if path != "" {
+				fieldPath = path + "." + key
+			}
+			fields = append(fields, diffJson(fieldPath, oldObject[key], newObject[key])...)
+		}
+		return fields
+	}
+
+	oldList, oldIsList := oldValue.([]interface{})
+	newList, newIsList := newValue.([]interface{})
+	if oldIsList && newIsList && len(oldList) == len(newList) {
+		var fields []*FieldChange
+		for i := range oldList {
+			fields = append(fields, diffJson(fmt.Sprintf("%s[%d]", path, i), oldList[i], newList[i])...)
+		}
+		return fields
+	}
+
+	if reflect.DeepEqual(oldValue, newValue) {
+		return nil
+	}
+	if path == "" {
+		path = "(all)"
+	}
+	return []*FieldChange{{Path: path, Old: oldValue, New: newValue}}
+}
@@ -0,0 +1,116 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configdiff
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+const testApiName = "endpoints.examples.bookstore.Bookstore"
+
+func makeServiceConfig(id string, methods map[string]string, deadline float64) *confpb.Service {
+	serviceConfig := &confpb.Service{
+		Name: "bookstore.endpoints.project123.cloud.goog",
+		Id:   id,
+		Apis: []*apipb.Api{{Name: testApiName}},
+		Http: &annotationspb.Http{},
+		Control: &confpb.Control{
+			Environment: "servicecontrol.googleapis.com",
+		},
+		Backend: &confpb.Backend{
+			Rules: []*confpb.BackendRule{
+				{
+					Selector: testApiName + ".ListShelves",
+					Deadline: deadline,
+				},
+			},
+		},
+	}
+	for name, path := range methods {
+		serviceConfig.Apis[0].Methods = append(serviceConfig.Apis[0].Methods, &apipb.Method{Name: name})
+		serviceConfig.Http.Rules = append(serviceConfig.Http.Rules, &annotationspb.HttpRule{
+			Selector: testApiName + "." + name,
+			Pattern:  &annotationspb.HttpRule_Get{Get: path},
+		})
+	}
+	return serviceConfig
+}
+
+func TestDiff(t *testing.T) {
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.DisableTracing = true
+
+	oldConfig := makeServiceConfig("2023-01-01r0", map[string]string{"ListShelves": "/v1/shelves", "DeleteShelf": "/v1/shelves/{shelf}/delete"}, 10)
+	newConfig := makeServiceConfig("2023-01-02r0", map[string]string{"ListShelves": "/v1/shelves", "GetShelf": "/v1/shelves/{shelf}"}, 20)
+
+	diff, err := Diff(oldConfig, newConfig, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kinds := func(changes []*Change) map[string]string {
+		got := make(map[string]string)
+		for _, c := range changes {
+			got[c.Name] = c.Kind
+		}
+		return got
+	}
+	wantRoutes := map[string]string{
+		testApiName + ".DeleteShelf": Removed,
+		testApiName + ".GetShelf":    Added,
+		testApiName + ".ListShelves": Changed,
+	}
+	if got := kinds(diff.Routes); !reflect.DeepEqual(got, wantRoutes) {
+		t.Errorf("got route changes %v, want %v", got, wantRoutes)
+	}
+
+	gotFilters := kinds(diff.Filters)
+	for name, kind := range map[string]string{
+		"com.google.espv2.filters.http.service_control requirements " + testApiName + ".DeleteShelf": Removed,
+		"com.google.espv2.filters.http.service_control requirements " + testApiName + ".GetShelf":    Added,
+	} {
+		if gotFilters[name] != kind {
+			t.Errorf("got filter changes %v, want %s %s", gotFilters, kind, name)
+		}
+	}
+	if _, ok := gotFilters["com.google.espv2.filters.http.service_control requirements "+testApiName+".ListShelves"]; ok {
+		t.Errorf("the service control requirement of ListShelves should not change, got filter changes %v", gotFilters)
+	}
+
+	text := diff.Text()
+	for _, want := range []string{
+		"Routes:\n",
+		"  - " + testApiName + ".DeleteShelf\n",
+		"  + " + testApiName + ".GetShelf\n",
+		"  ~ " + testApiName + ".ListShelves\n",
+		`[0].route.timeout: "10s" -> "20s"`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("text diff does not contain %q:\n%s", want, text)
+		}
+	}
+
+	if diff, err := Diff(oldConfig, oldConfig, opts); err != nil || !diff.Empty() {
+		t.Errorf("same service configs should have no diff, got %v, error %v", diff.Text(), err)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// configdiff prints what ESPv2 changes in Envoy when a service config
+// changes. It accepts the same flags as the Config Manager. The two service
+// configs are files, or config ids fetched from Service Management if
+// --service is set:
+//
+//	configdiff old_service.json new_service.json
+//	configdiff --service=bookstore.endpoints.project123.cloud.goog --format=json 2023-01-01r0 2023-01-02r0
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configdiff"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configgen"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configmanager/flags"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/metadata"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/tokengenerator"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/glog"
+
+	sc "github.com/GoogleCloudPlatform/esp-v2/src/go/serviceconfig"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+var (
+	service    = flag.String("service", "", "if set, the two arguments are config ids of this service fetched from Service Management, instead of files")
+	format     = flag.String("format", "text", `the output format, "text" or "json"`)
+	failOnDiff = flag.Bool("fail_on_diff", false, "exit with status 1 if the configs differ")
+)
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 2 {
+		glog.Exitf("want the old and new service configs as arguments, got %d arguments", flag.NArg())
+	}
+	opts := flags.EnvoyConfigOptionsFromFlags()
+
+	oldConfig, err := readServiceConfig(flag.Arg(0), opts)
+	if err != nil {
+		glog.Exitf("fail to read the old service config: %v", err)
+	}
+	newConfig, err := readServiceConfig(flag.Arg(1), opts)
+	if err != nil {
+		glog.Exitf("fail to read the new service config: %v", err)
+	}
+
+	diff, err := configdiff.Diff(oldConfig, newConfig, opts)
+	if err != nil {
+		glog.Exitf("fail to diff the service configs: %v", err)
+	}
+	switch *format {
+	case "text":
+		fmt.Print(diff.Text())
+	case "json":
+		bytes, err := json.MarshalIndent(diff, "", "  ")
+		if err != nil {
+			glog.Exitf("fail to marshal the diff: %v", err)
+		}
+		fmt.Println(string(bytes))
+	default:
+		glog.Exitf(`unknown format %q, must be "text" or "json"`, *format)
+	}
+
+	if *failOnDiff && !diff.Empty() {
+		os.Exit(1)
+	}
+}
+
+func readServiceConfig(arg string, opts options.ConfigGeneratorOptions) (*confpb.Service, error) {
+	if *service == "" {
+		return configgen.ReadServiceConfig(arg)
+	}
+
+	var accessToken util.GetAccessTokenFunc
+	if opts.ServiceAccountKey != "" {
+		accessToken = func() (string, time.Duration, error) {
+			return tokengenerator.GenerateAccessTokenFromFile(opts.ServiceAccountKey)
+		}
+	} else if !opts.NonGCP {
+		accessToken = metadata.NewMetadataFetcher(opts.CommonOptions).FetchAccessToken
+	} else {
+		return nil, fmt.Errorf("if flag --non_gcp is specified, flag --service_account_key must be specified")
+	}
+	client := &http.Client{Timeout: opts.HttpRequestTimeout}
+	return sc.NewServiceConfigFetcher(client, opts.ServiceManagementURL, *service, accessToken).FetchConfig(context.Background(), arg)
+}
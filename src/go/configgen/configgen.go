@@ -0,0 +1,140 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package configgen renders the Envoy config of a service config offline,
+// see configgen/main/main.go.
+package configgen
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/bootstrap/static"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+
+	gen "github.com/GoogleCloudPlatform/esp-v2/src/go/configgenerator"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+// The outputs of Render.
+const (
+	OutputBootstrap = "bootstrap"
+	OutputListeners = "listeners"
+	OutputClusters  = "clusters"
+	OutputRoutes    = "routes"
+)
+
+// ReadServiceConfig reads a service config file in JSON, YAML or binary
+// proto, chosen by the file extension: .json, .yaml or .yml, .pb or .bin.
+// Other files are read as JSON.
+func ReadServiceConfig(path string) (*confpb.Service, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read service config file: %s, error: %s", path, err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".pb", ".bin":
+		serviceConfig := &confpb.Service{}
+		if err := proto.Unmarshal(data, serviceConfig); err != nil {
+			return nil, fmt.Errorf("fail to unmarshal serviceConfig: %v", err)
+		}
+		return serviceConfig, nil
+	case ".yaml", ".yml":
+		if data, err = util.YamlToJson(data); err != nil {
+			return nil, err
+		}
+	}
+	return util.UnmarshalServiceConfig(bytes.NewReader(data))
+}
+
+// Render renders the Envoy config of serviceConfig as JSON. The output is
+// the static bootstrap, or the listeners, clusters or routes served by the
+// Config Manager.
+func Render(serviceConfig *confpb.Service, opts options.ConfigGeneratorOptions, output string) (string, error) {
+	if output == OutputBootstrap {
+		bt, err := static.ServiceToBootstrapConfig(serviceConfig, serviceConfig.GetId(), opts)
+		if err != nil {
+			return "", err
+		}
+		return marshalJson(bt)
+	}
+
+	// Routes are only made separately with RDS, otherwise they are in the listeners.
+	if output == OutputRoutes {
+		opts.EnableRds = true
+	}
+	serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(serviceConfig, serviceConfig.GetId(), opts)
+	if err != nil {
+		return "", fmt.Errorf("fail to initialize ServiceInfo, %s", err)
+	}
+
+	var resources []proto.Message
+	switch output {
+	case OutputClusters:
+		clusters, err := gen.MakeClusters(serviceInfo)
+		if err != nil {
+			return "", err
+		}
+		for _, cluster := range clusters {
+			resources = append(resources, cluster)
+		}
+	case OutputListeners, OutputRoutes:
+		listeners, err := gen.MakeListeners(serviceInfo)
+		if err != nil {
+			return "", err
+		}
+		if output == OutputListeners {
+			for _, listener := range listeners {
+				resources = append(resources, listener)
+			}
+			break
+		}
+		// Routes must be made after listeners, which add the per-route configs.
+		routes, err := gen.MakeRouteConfigs([]*configinfo.ServiceInfo{serviceInfo})
+		if err != nil {
+			return "", err
+		}
+		for _, route := range routes {
+			resources = append(resources, route)
+		}
+	default:
+		return "", fmt.Errorf("unknown output %q, must be one of %q, %q, %q or %q", output, OutputBootstrap, OutputListeners, OutputClusters, OutputRoutes)
+	}
+
+	var jsons []string
+	for _, resource := range resources {
+		json, err := marshalJson(resource)
+		if err != nil {
+			return "", err
+		}
+		jsons = append(jsons, json)
+	}
+	return "[\n" + strings.Join(jsons, ",\n") + "\n]", nil
+}
+
+func marshalJson(msg proto.Message) (string, error) {
+	marshaler := &jsonpb.Marshaler{
+		Indent:      "  ",
+		AnyResolver: util.Resolver,
+	}
+	return marshaler.MarshalToString(msg)
+}
@@ -0,0 +1,175 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgen
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/golang/protobuf/proto"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+var testServiceConfig = &confpb.Service{
+	Name: "bookstore.endpoints.project123.cloud.goog",
+	Id:   "2023-01-01r0",
+	Apis: []*apipb.Api{
+		{
+			Name:    "endpoints.examples.bookstore.Bookstore",
+			Methods: []*apipb.Method{{Name: "ListShelves"}},
+		},
+	},
+}
+
+func TestReadServiceConfig(t *testing.T) {
+	bin, err := proto.Marshal(testServiceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testData := []struct {
+		desc      string
+		fileName  string
+		content   string
+		wantError string
+	}{
+		{
+			desc:     "json",
+			fileName: "service.json",
+			content: `{
+  "name": "bookstore.endpoints.project123.cloud.goog",
+  "id": "2023-01-01r0",
+  "apis": [{"name": "endpoints.examples.bookstore.Bookstore", "methods": [{"name": "ListShelves"}]}]
+}`,
+		},
+		{
+			desc:     "yaml",
+			fileName: "service.yaml",
+			content: `
+name: bookstore.endpoints.project123.cloud.goog
+id: 2023-01-01r0
+apis:
+- name: endpoints.examples.bookstore.Bookstore
+  methods:
+  - name: ListShelves
+`,
+		},
+		{
+			desc:     "binary proto",
+			fileName: "service.pb",
+			content:  string(bin),
+		},
+		{
+			desc:      "invalid json",
+			fileName:  "service.json",
+			content:   `{"name": `,
+			wantError: "fail to unmarshal serviceConfig",
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "configgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			path := filepath.Join(dir, tc.fileName)
+			if err := ioutil.WriteFile(path, []byte(tc.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadServiceConfig(path)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("want error: %v, got error: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(got, testServiceConfig) {
+				t.Errorf("got service config: %v, want: %v", got, testServiceConfig)
+			}
+		})
+	}
+}
+
+func TestRender(t *testing.T) {
+	testData := []struct {
+		desc      string
+		output    string
+		wantKey   string
+		wantError string
+	}{
+		{
+			desc:    "bootstrap has the static resources",
+			output:  OutputBootstrap,
+			wantKey: "staticResources",
+		},
+		{
+			desc:    "listeners",
+			output:  OutputListeners,
+			wantKey: "filterChains",
+		},
+		{
+			desc:    "clusters",
+			output:  OutputClusters,
+			wantKey: "connectTimeout",
+		},
+		{
+			desc:    "routes",
+			output:  OutputRoutes,
+			wantKey: "virtualHosts",
+		},
+		{
+			desc:      "unknown output",
+			output:    "secrets",
+			wantError: `unknown output "secrets"`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.DisableTracing = true
+			got, err := Render(testServiceConfig, opts, tc.output)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("want error: %v, got error: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var gotJson interface{}
+			if err := json.Unmarshal([]byte(got), &gotJson); err != nil {
+				t.Fatalf("rendered config is not JSON: %v\n%s", err, got)
+			}
+			if !strings.Contains(got, `"`+tc.wantKey+`"`) {
+				t.Errorf("rendered %s config has no %s: %s", tc.output, tc.wantKey, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// configgen renders the Envoy config of a service config offline, e.g. to
+// review the generated config in CI and diff it between ESPv2 versions. It
+// accepts the same flags as the Config Manager.
+//
+//	configgen --service_config=service.yaml --output=listeners --backend_address=grpc://127.0.0.1:8082
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configgen"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configmanager/flags"
+	"github.com/golang/glog"
+)
+
+var (
+	serviceConfigPath = flag.String("service_config", "", "path to the service config in JSON, YAML (.yaml, .yml) or binary proto (.pb, .bin)")
+	output            = flag.String("output", configgen.OutputBootstrap, `the config to render: "bootstrap", "listeners", "clusters" or "routes"`)
+	outputPath        = flag.String("output_path", "", "file to write the config to, stdout if empty")
+)
+
+func main() {
+	flag.Parse()
+	if *serviceConfigPath == "" {
+		glog.Exitf("flag --service_config is required")
+	}
+
+	serviceConfig, err := configgen.ReadServiceConfig(*serviceConfigPath)
+	if err != nil {
+		glog.Exitf("fail to read service config: %v", err)
+	}
+	config, err := configgen.Render(serviceConfig, flags.EnvoyConfigOptionsFromFlags(), *output)
+	if err != nil {
+		glog.Exitf("fail to render %s config: %v", *output, err)
+	}
+
+	if *outputPath == "" {
+		fmt.Println(config)
+		return
+	}
+	if err := ioutil.WriteFile(*outputPath, []byte(config+"\n"), 0644); err != nil {
+		glog.Exitf("failed to write config to %v, error: %v", *outputPath, err)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoregistry"
+
+	anypb "github.com/golang/protobuf/ptypes/any"
+)
+
+// canonicalizeResource re-marshals the messages packed in the Any fields of
+// a resource with sorted map entries. ptypes.MarshalAny encodes maps, i.e.
+// the jwt providers and the per-route configs of the route config in the
+// http connection manager, in random order, so the same config would have
+// different bytes on each generation.
+func canonicalizeResource(kind, name string, resource proto.Message) error {
+	if err := walkAnyFields(resource.ProtoReflect(), "", canonicalizeAny); err != nil {
+		return fmt.Errorf("fail to canonicalize %s %q: %v", kind, name, err)
+	}
+	return nil
+}
+
+func canonicalizeAny(any *anypb.Any, path string) error {
+	packed, err := any.UnmarshalNew()
+	if errors.Is(err, protoregistry.NotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: fail to unmarshal %s: %v", path, any.GetTypeUrl(), err)
+	}
+	// Inner Anys first, their bytes are part of the packed message.
+	if err := walkAnyFields(packed.ProtoReflect(), fmt.Sprintf("%s<%s>", path, packed.ProtoReflect().Descriptor().Name()), canonicalizeAny); err != nil {
+		return err
+	}
+	value, err := proto.MarshalOptions{Deterministic: true}.Marshal(packed)
+	if err != nil {
+		return fmt.Errorf("%s: fail to marshal %s: %v", path, any.GetTypeUrl(), err)
+	}
+	any.Value = value
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes"
+
+	listenerpb "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	jwtpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/jwt_authn/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	anypb "github.com/golang/protobuf/ptypes/any"
+)
+
+func TestCanonicalizeResource(t *testing.T) {
+	// A listener with maps in the packed messages of two levels: the jwt
+	// providers in the http filter, and the per-route configs of the routes.
+	makeListener := func() *listenerpb.Listener {
+		jwtAuthn := &jwtpb.JwtAuthentication{
+			Providers: make(map[string]*jwtpb.JwtProvider),
+		}
+		perRouteConfig := make(map[string]*anypb.Any)
+		for i := 0; i < 20; i++ {
+			jwtAuthn.Providers[fmt.Sprintf("provider-%d", i)] = &jwtpb.JwtProvider{
+				Issuer: fmt.Sprintf("https://issuer-%d.com", i),
+			}
+			config, err := ptypes.MarshalAny(&jwtpb.PerRouteConfig{
+				RequirementSpecifier: &jwtpb.PerRouteConfig_RequirementName{
+					RequirementName: fmt.Sprintf("requirement-%d", i),
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			perRouteConfig[fmt.Sprintf("filter-%d", i)] = config
+		}
+		jwtAuthnConfig, err := ptypes.MarshalAny(jwtAuthn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hcm, err := ptypes.MarshalAny(&hcmpb.HttpConnectionManager{
+			StatPrefix: "ingress_http",
+			RouteSpecifier: &hcmpb.HttpConnectionManager_RouteConfig{
+				RouteConfig: &routepb.RouteConfiguration{
+					VirtualHosts: []*routepb.VirtualHost{
+						{
+							Routes: []*routepb.Route{
+								{TypedPerFilterConfig: perRouteConfig},
+							},
+						},
+					},
+				},
+			},
+			HttpFilters: []*hcmpb.HttpFilter{
+				{
+					Name:       "envoy.filters.http.jwt_authn",
+					ConfigType: &hcmpb.HttpFilter_TypedConfig{TypedConfig: jwtAuthnConfig},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &listenerpb.Listener{
+			Name: "ingress_listener",
+			FilterChains: []*listenerpb.FilterChain{
+				{
+					Filters: []*listenerpb.Filter{
+						{
+							Name:       "envoy.filters.network.http_connection_manager",
+							ConfigType: &listenerpb.Filter_TypedConfig{TypedConfig: hcm},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	want := makeListener()
+	if err := canonicalizeResource("listener", want.Name, want); err != nil {
+		t.Fatal(err)
+	}
+	wantValue := want.FilterChains[0].Filters[0].GetTypedConfig().GetValue()
+	for i := 0; i < 10; i++ {
+		got := makeListener()
+		if err := canonicalizeResource("listener", got.Name, got); err != nil {
+			t.Fatal(err)
+		}
+		if gotValue := got.FilterChains[0].Filters[0].GetTypedConfig().GetValue(); !bytes.Equal(gotValue, wantValue) {
+			t.Fatalf("got different bytes for the same listener on generation %d", i)
+		}
+	}
+}
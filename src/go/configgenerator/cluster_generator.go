@@ -16,17 +16,20 @@ package configgenerator
 
 import (
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 	wrappers "github.com/golang/protobuf/ptypes/wrappers"
 
 	sc "github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
 	clusterpb "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	typepb "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 )
 
 // MakeClusters provides dynamic cluster settings for Envoy
@@ -113,10 +116,97 @@ func MakeClusters(serviceInfo *sc.ServiceInfo) ([]*clusterpb.Cluster, error) {
 		}
 	}
 
+	for _, cluster := range clusters {
+		if err := canonicalizeResource("cluster", cluster.Name, cluster); err != nil {
+			return nil, err
+		}
+		if err := validateResource("cluster", cluster.Name, cluster); err != nil {
+			return nil, err
+		}
+	}
+
 	glog.Infof("generate clusters: %v", clusters)
 	return clusters, nil
 }
 
+// MakeClustersForServices provides dynamic cluster settings for Envoy serving
+// multiple services. Clusters shared by the services, i.e. the service control
+// cluster, are only added once. The clusters of the traffic split configs of
+// each service are added as well.
+// This must be called before MakeListenersForServices.
+func MakeClustersForServices(serviceInfos []*sc.ServiceInfo) ([]*clusterpb.Cluster, error) {
+	var clusterLists [][]*clusterpb.Cluster
+	for _, serviceInfo := range serviceInfos {
+		clusters, err := MakeClusters(serviceInfo)
+		if err != nil {
+			return nil, fmt.Errorf("fail to make clusters for service %s: %v", serviceInfo.Name, err)
+		}
+		clusterLists = append(clusterLists, clusters)
+
+		for _, split := range serviceInfo.TrafficSplits {
+			clusters, err := makeTrafficSplitClusters(split.ServiceInfo, clusterLists)
+			if err != nil {
+				return nil, fmt.Errorf("fail to make clusters for service %s config %s: %v", serviceInfo.Name, split.ServiceInfo.ConfigID, err)
+			}
+			clusterLists = append(clusterLists, clusters)
+		}
+	}
+	return mergeClusters(clusterLists)
+}
+
+// makeTrafficSplitClusters makes the clusters of a traffic split config. Its
+// backend clusters with different settings from the same-named clusters made
+// before, i.e. by the config with the most traffic, are renamed with the config
+// id as suffix, so each config keeps its own backend settings.
+func makeTrafficSplitClusters(serviceInfo *sc.ServiceInfo, clusterLists [][]*clusterpb.Cluster) ([]*clusterpb.Cluster, error) {
+	clusters, err := MakeClusters(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]*clusterpb.Cluster)
+	for _, list := range clusterLists {
+		for _, cluster := range list {
+			seen[cluster.Name] = cluster
+		}
+	}
+	renamed := false
+	for _, cluster := range clusters {
+		if existing, ok := seen[cluster.Name]; !ok || proto.Equal(existing, cluster) {
+			continue
+		}
+		newName := fmt.Sprintf("%s_%s", cluster.Name, serviceInfo.ConfigID)
+		if serviceInfo.RenameBackendCluster(cluster.Name, newName) {
+			glog.Infof("backend cluster %s of config %s differs from the one of other configs, renamed to %s", cluster.Name, serviceInfo.ConfigID, newName)
+			renamed = true
+		}
+	}
+	if !renamed {
+		return clusters, nil
+	}
+	return MakeClusters(serviceInfo)
+}
+
+// mergeClusters dedups the clusters by name. Clusters with the same name must
+// have the same config.
+func mergeClusters(clusterLists [][]*clusterpb.Cluster) ([]*clusterpb.Cluster, error) {
+	var merged []*clusterpb.Cluster
+	seen := make(map[string]*clusterpb.Cluster)
+	for _, clusters := range clusterLists {
+		for _, cluster := range clusters {
+			if existing, ok := seen[cluster.Name]; ok {
+				if !proto.Equal(existing, cluster) {
+					return nil, fmt.Errorf("cluster %s has conflicting configs across services", cluster.Name)
+				}
+				continue
+			}
+			seen[cluster.Name] = cluster
+			merged = append(merged, cluster)
+		}
+	}
+	return merged, nil
+}
+
 func addDnsResolversToClusters(dnsResolverAddresses string, clusters []*clusterpb.Cluster) error {
 	dnsResolvers, err := util.DnsResolvers(dnsResolverAddresses)
 	if err != nil {
@@ -249,6 +339,10 @@ func makeJwtProviderClusters(serviceInfo *sc.ServiceInfo) ([]*clusterpb.Cluster,
 
 		providerClusters = append(providerClusters, c)
 	}
+	// Sorted so that reordering the providers does not change the config.
+	sort.Slice(providerClusters, func(i, j int) bool {
+		return providerClusters[i].Name < providerClusters[j].Name
+	})
 	return providerClusters, nil
 }
 
@@ -296,6 +390,17 @@ func makeBackendCluster(opt *options.ConfigGeneratorOptions, brc *sc.BackendRout
 		c.TypedExtensionProtocolOptions = util.CreateUpstreamProtocolOptions()
 	}
 
+	if err := setBackendClusterLoadBalancing(c, brc); err != nil {
+		return nil, err
+	}
+
+	if brc.HealthCheck != nil {
+		c.HealthChecks = []*corepb.HealthCheck{makeBackendHealthCheck(brc)}
+	}
+	if brc.OutlierDetection != nil {
+		c.OutlierDetection = makeBackendOutlierDetection(brc.OutlierDetection)
+	}
+
 	switch opt.BackendDnsLookupFamily {
 	case "auto":
 		c.DnsLookupFamily = clusterpb.Cluster_AUTO
@@ -313,36 +418,106 @@ func makeBackendCluster(opt *options.ConfigGeneratorOptions, brc *sc.BackendRout
 	return c, nil
 }
 
+// setBackendClusterLoadBalancing sets the endpoints and the load balancing
+// policy of the backend policies on the cluster.
+func setBackendClusterLoadBalancing(c *clusterpb.Cluster, brc *sc.BackendRoutingCluster) error {
+	if len(brc.Localities) > 0 {
+		c.LoadAssignment = util.CreateLocalityLoadAssignment(brc.Hostname, brc.Localities)
+		// The localities have either all or none of the weights.
+		if brc.Localities[0].Weight > 0 {
+			c.CommonLbConfig = &clusterpb.Cluster_CommonLbConfig{
+				LocalityConfigSpecifier: &clusterpb.Cluster_CommonLbConfig_LocalityWeightedLbConfig_{
+					LocalityWeightedLbConfig: &clusterpb.Cluster_CommonLbConfig_LocalityWeightedLbConfig{},
+				},
+			}
+		}
+	}
+	if brc.StrictDNS {
+		c.ClusterDiscoveryType = &clusterpb.Cluster_Type{Type: clusterpb.Cluster_STRICT_DNS}
+	}
+
+	switch brc.LbPolicy {
+	case "", sc.LbPolicyRoundRobin:
+	case sc.LbPolicyLeastRequest:
+		c.LbPolicy = clusterpb.Cluster_LEAST_REQUEST
+	case sc.LbPolicyRingHash:
+		c.LbPolicy = clusterpb.Cluster_RING_HASH
+	case sc.LbPolicyMaglev:
+		c.LbPolicy = clusterpb.Cluster_MAGLEV
+	default:
+		return fmt.Errorf("unknown lb policy %q of cluster %s", brc.LbPolicy, brc.ClusterName)
+	}
+	return nil
+}
+
 func makeLocalHTTPBackendCluster(serviceInfo *sc.ServiceInfo) (*clusterpb.Cluster, error) {
 	return makeBackendCluster(&serviceInfo.Options, serviceInfo.LocalHTTPBackendCluster)
 }
 
 func makeLocalBackendCluster(serviceInfo *sc.ServiceInfo) (*clusterpb.Cluster, error) {
-	c, err := makeBackendCluster(&serviceInfo.Options, serviceInfo.LocalBackendCluster)
-	if err != nil {
-		return nil, err
+	return makeBackendCluster(&serviceInfo.Options, serviceInfo.LocalBackendCluster)
+}
+
+func makeBackendHealthCheck(brc *sc.BackendRoutingCluster) *corepb.HealthCheck {
+	hc := brc.HealthCheck
+	healthCheck := &corepb.HealthCheck{
+		Timeout:            ptypes.DurationProto(hc.Timeout),
+		Interval:           ptypes.DurationProto(hc.Interval),
+		UnhealthyThreshold: &wrappers.UInt32Value{Value: hc.UnhealthyThreshold},
+		HealthyThreshold:   &wrappers.UInt32Value{Value: hc.HealthyThreshold},
+	}
+	if hc.NoTrafficInterval > 0 {
+		healthCheck.NoTrafficInterval = ptypes.DurationProto(hc.NoTrafficInterval)
 	}
 
-	if serviceInfo.Options.HealthCheckGrpcBackend {
-		intervalProto := ptypes.DurationProto(serviceInfo.Options.HealthCheckGrpcBackendInterval)
-		c.HealthChecks = []*corepb.HealthCheck{
-			&corepb.HealthCheck{
-				// Set the timeout as Interval
-				Timeout:            intervalProto,
-				Interval:           intervalProto,
-				NoTrafficInterval:  ptypes.DurationProto(serviceInfo.Options.HealthCheckGrpcBackendNoTrafficInterval),
-				UnhealthyThreshold: &wrappers.UInt32Value{Value: 3},
-				HealthyThreshold:   &wrappers.UInt32Value{Value: 3},
-				HealthChecker: &corepb.HealthCheck_GrpcHealthCheck_{
-					GrpcHealthCheck: &corepb.HealthCheck_GrpcHealthCheck{
-						ServiceName: serviceInfo.Options.HealthCheckGrpcBackendService,
-					},
-				},
+	if hc.Grpc {
+		healthCheck.HealthChecker = &corepb.HealthCheck_GrpcHealthCheck_{
+			GrpcHealthCheck: &corepb.HealthCheck_GrpcHealthCheck{
+				ServiceName: hc.GrpcService,
 			},
 		}
+		return healthCheck
 	}
 
-	return c, nil
+	httpHealthCheck := &corepb.HealthCheck_HttpHealthCheck{
+		// The remote backends may route by the host, not the cluster name.
+		Host: brc.Hostname,
+		Path: hc.Path,
+	}
+	if brc.Protocol == util.HTTP2 {
+		httpHealthCheck.CodecClientType = typepb.CodecClientType_HTTP2
+	}
+	healthCheck.HealthChecker = &corepb.HealthCheck_HttpHealthCheck_{
+		HttpHealthCheck: httpHealthCheck,
+	}
+	return healthCheck
+}
+
+func makeBackendOutlierDetection(od *sc.BackendOutlierDetection) *clusterpb.OutlierDetection {
+	// Envoy enforces both the consecutive 5xx and the success rate ejections
+	// by default, the disabled one is not enforced.
+	outlierDetection := &clusterpb.OutlierDetection{
+		EnforcingConsecutive_5Xx: &wrappers.UInt32Value{Value: 0},
+		EnforcingSuccessRate:     &wrappers.UInt32Value{Value: 0},
+		BaseEjectionTime:         ptypes.DurationProto(od.BaseEjectionTime),
+	}
+	if od.Consecutive5xx > 0 {
+		outlierDetection.Consecutive_5Xx = &wrappers.UInt32Value{Value: od.Consecutive5xx}
+		outlierDetection.EnforcingConsecutive_5Xx.Value = 100
+	}
+	if od.SuccessRate {
+		outlierDetection.EnforcingSuccessRate.Value = 100
+		if od.SuccessRateMinimumHosts > 0 {
+			outlierDetection.SuccessRateMinimumHosts = &wrappers.UInt32Value{Value: od.SuccessRateMinimumHosts}
+		}
+		if od.SuccessRateRequestVolume > 0 {
+			outlierDetection.SuccessRateRequestVolume = &wrappers.UInt32Value{Value: od.SuccessRateRequestVolume}
+		}
+	}
+	if od.MaxEjectionPercent > 0 {
+		outlierDetection.MaxEjectionPercent = &wrappers.UInt32Value{Value: od.MaxEjectionPercent}
+	}
+	return outlierDetection
 }
 
 func makeServiceControlCluster(serviceInfo *sc.ServiceInfo) (*clusterpb.Cluster, error) {
@@ -407,5 +582,9 @@ func makeRemoteBackendClusters(serviceInfo *sc.ServiceInfo) ([]*clusterpb.Cluste
 		brClusters = append(brClusters, c)
 
 	}
+	// Sorted so that reordering the backend rules does not change the config.
+	sort.Slice(brClusters, func(i, j int) bool {
+		return brClusters[i].Name < brClusters[j].Name
+	})
 	return brClusters, nil
 }
@@ -16,11 +16,14 @@ package configgenerator
 
 import (
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configgenerator/filterconfig"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
@@ -31,6 +34,7 @@ import (
 
 	clusterpb "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointpb "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
 	apipb "google.golang.org/genproto/protobuf/api"
@@ -749,6 +753,239 @@ func TestMakeRemoteBackendRoutingCluster(t *testing.T) {
 	}
 }
 
+// makeServiceInfoWithBackendPolicy returns the ServiceInfo of a service
+// whose methods ListShelves and GetShelf, in that order, are routed to
+// backendAddresses, with the backend policy file of content policy.
+func makeServiceInfoWithBackendPolicy(t *testing.T, opts options.ConfigGeneratorOptions, policy string, backendAddresses ...string) *configinfo.ServiceInfo {
+	t.Helper()
+	methods := []struct {
+		name string
+		path string
+	}{
+		{name: "ListShelves", path: "/v1/shelves"},
+		{name: "GetShelf", path: "/v1/shelves/{shelf}"},
+	}
+	if len(backendAddresses) > len(methods) {
+		t.Fatalf("got %d backend addresses, want at most %d", len(backendAddresses), len(methods))
+	}
+	serviceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+			},
+		},
+		Http:    &annotationspb.Http{},
+		Backend: &confpb.Backend{},
+	}
+	for i, address := range backendAddresses {
+		selector := testApiName + "." + methods[i].name
+		serviceConfig.Apis[0].Methods = append(serviceConfig.Apis[0].Methods, &apipb.Method{Name: methods[i].name})
+		serviceConfig.Http.Rules = append(serviceConfig.Http.Rules, &annotationspb.HttpRule{
+			Selector: selector,
+			Pattern:  &annotationspb.HttpRule_Get{Get: methods[i].path},
+		})
+		serviceConfig.Backend.Rules = append(serviceConfig.Backend.Rules, &confpb.BackendRule{
+			Selector:        selector,
+			Address:         address,
+			PathTranslation: confpb.BackendRule_APPEND_PATH_TO_ADDRESS,
+			Deadline:        10,
+		})
+	}
+
+	policyPath := filepath.Join(t.TempDir(), "backend_policy.yaml")
+	if err := ioutil.WriteFile(policyPath, []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts.BackendPolicyPath = policyPath
+	serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(serviceConfig, testConfigID, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filterGenerators, err := filterconfig.MakeFilterGenerators(serviceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetFilterConfigAndAddPerRouteConfigGen(serviceInfo, filterGenerators); err != nil {
+		t.Fatal(err)
+	}
+	return serviceInfo
+}
+
+func TestMakeRemoteBackendClustersWithHealthCheckAndOutlierDetection(t *testing.T) {
+	policy := `
+clusters:
+- address: grpcs://green.example.com
+  health_check:
+    type: grpc
+    grpc_service: green.Health
+    interval: 10s
+  outlier_detection:
+    consecutive_5xx: 0
+    success_rate: true
+    success_rate_minimum_hosts: 3
+`
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendHealthCheckHTTPPath = "/healthz"
+	opts.BackendOutlierConsecutive5xx = 5
+	serviceInfo := makeServiceInfoWithBackendPolicy(t, opts, policy, "https://blue.example.com", "grpcs://green.example.com")
+
+	clusters, err := makeRemoteBackendClusters(serviceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testData := []struct {
+		desc                 string
+		wantHealthCheck      *corepb.HealthCheck
+		wantOutlierDetection *clusterpb.OutlierDetection
+	}{
+		{
+			desc: "http health check and consecutive 5xx of the flags",
+			wantHealthCheck: &corepb.HealthCheck{
+				Timeout:            ptypes.DurationProto(1 * time.Second),
+				Interval:           ptypes.DurationProto(5 * time.Second),
+				UnhealthyThreshold: &wrappers.UInt32Value{Value: 3},
+				HealthyThreshold:   &wrappers.UInt32Value{Value: 3},
+				HealthChecker: &corepb.HealthCheck_HttpHealthCheck_{
+					HttpHealthCheck: &corepb.HealthCheck_HttpHealthCheck{
+						Host: "blue.example.com",
+						Path: "/healthz",
+					},
+				},
+			},
+			wantOutlierDetection: &clusterpb.OutlierDetection{
+				Consecutive_5Xx:          &wrappers.UInt32Value{Value: 5},
+				EnforcingConsecutive_5Xx: &wrappers.UInt32Value{Value: 100},
+				EnforcingSuccessRate:     &wrappers.UInt32Value{Value: 0},
+				BaseEjectionTime:         ptypes.DurationProto(30 * time.Second),
+			},
+		},
+		{
+			desc: "grpc health check and success rate of the cluster policy",
+			wantHealthCheck: &corepb.HealthCheck{
+				Timeout:            ptypes.DurationProto(1 * time.Second),
+				Interval:           ptypes.DurationProto(10 * time.Second),
+				UnhealthyThreshold: &wrappers.UInt32Value{Value: 3},
+				HealthyThreshold:   &wrappers.UInt32Value{Value: 3},
+				HealthChecker: &corepb.HealthCheck_GrpcHealthCheck_{
+					GrpcHealthCheck: &corepb.HealthCheck_GrpcHealthCheck{
+						ServiceName: "green.Health",
+					},
+				},
+			},
+			wantOutlierDetection: &clusterpb.OutlierDetection{
+				EnforcingConsecutive_5Xx: &wrappers.UInt32Value{Value: 0},
+				EnforcingSuccessRate:     &wrappers.UInt32Value{Value: 100},
+				SuccessRateMinimumHosts:  &wrappers.UInt32Value{Value: 3},
+				BaseEjectionTime:         ptypes.DurationProto(30 * time.Second),
+			},
+		},
+	}
+	if len(clusters) != len(testData) {
+		t.Fatalf("got %d clusters, want %d", len(clusters), len(testData))
+	}
+	for i, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := clusters[i]
+			if len(c.HealthChecks) != 1 || !proto.Equal(c.HealthChecks[0], tc.wantHealthCheck) {
+				t.Errorf("got health checks %v, want %v", c.HealthChecks, tc.wantHealthCheck)
+			}
+			if !proto.Equal(c.OutlierDetection, tc.wantOutlierDetection) {
+				t.Errorf("got outlier detection %v, want %v", c.OutlierDetection, tc.wantOutlierDetection)
+			}
+		})
+	}
+}
+
+func TestMakeRemoteBackendClustersWithLoadBalancing(t *testing.T) {
+	policy := `
+clusters:
+- address: https://vms.example.com
+  lb_policy: ring_hash
+  hash_header: x-user-id
+  localities:
+  - region: us-central1
+    zone: us-central1-a
+    weight: 80
+    hosts: [10.0.0.1, 10.0.0.2]
+  - region: us-east1
+    zone: us-east1-b
+    weight: 20
+    hosts: ["10.1.0.1:8443"]
+- address: https://dns.example.com
+  dns_discovery: strict
+  lb_policy: least_request
+`
+	serviceInfo := makeServiceInfoWithBackendPolicy(t, options.DefaultConfigGeneratorOptions(), policy, "https://vms.example.com", "https://dns.example.com")
+
+	clusters, err := makeRemoteBackendClusters(serviceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testData := []struct {
+		desc               string
+		wantLbPolicy       clusterpb.Cluster_LbPolicy
+		wantDiscoveryType  clusterpb.Cluster_DiscoveryType
+		wantLoadAssignment *endpointpb.ClusterLoadAssignment
+		wantCommonLbConfig *clusterpb.Cluster_CommonLbConfig
+	}{
+		{
+			desc:               "strict dns of the single host of the address",
+			wantLbPolicy:       clusterpb.Cluster_LEAST_REQUEST,
+			wantDiscoveryType:  clusterpb.Cluster_STRICT_DNS,
+			wantLoadAssignment: util.CreateLoadAssignment("dns.example.com", 443),
+		},
+		{
+			desc:              "weighted localities with several hosts",
+			wantLbPolicy:      clusterpb.Cluster_RING_HASH,
+			wantDiscoveryType: clusterpb.Cluster_STRICT_DNS,
+			wantLoadAssignment: util.CreateLocalityLoadAssignment("vms.example.com", []*util.LoadAssignmentLocality{
+				{
+					Region: "us-central1",
+					Zone:   "us-central1-a",
+					Weight: 80,
+					Endpoints: []*util.LoadAssignmentEndpoint{
+						{Hostname: "10.0.0.1", Port: 443},
+						{Hostname: "10.0.0.2", Port: 443},
+					},
+				},
+				{
+					Region: "us-east1",
+					Zone:   "us-east1-b",
+					Weight: 20,
+					Endpoints: []*util.LoadAssignmentEndpoint{
+						{Hostname: "10.1.0.1", Port: 8443},
+					},
+				},
+			}),
+			wantCommonLbConfig: &clusterpb.Cluster_CommonLbConfig{
+				LocalityConfigSpecifier: &clusterpb.Cluster_CommonLbConfig_LocalityWeightedLbConfig_{
+					LocalityWeightedLbConfig: &clusterpb.Cluster_CommonLbConfig_LocalityWeightedLbConfig{},
+				},
+			},
+		},
+	}
+	if len(clusters) != len(testData) {
+		t.Fatalf("got %d clusters, want %d", len(clusters), len(testData))
+	}
+	for i, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := clusters[i]
+			if c.GetLbPolicy() != tc.wantLbPolicy || c.GetType() != tc.wantDiscoveryType {
+				t.Errorf("got lb policy %v and discovery type %v, want %v and %v", c.GetLbPolicy(), c.GetType(), tc.wantLbPolicy, tc.wantDiscoveryType)
+			}
+			if !proto.Equal(c.GetLoadAssignment(), tc.wantLoadAssignment) {
+				t.Errorf("got load assignment %v, want %v", c.GetLoadAssignment(), tc.wantLoadAssignment)
+			}
+			if !proto.Equal(c.GetCommonLbConfig(), tc.wantCommonLbConfig) {
+				t.Errorf("got common lb config %v, want %v", c.GetCommonLbConfig(), tc.wantCommonLbConfig)
+			}
+		})
+	}
+}
+
 func TestMakeJwtProviderClusters(t *testing.T) {
 	testData := []struct {
 		desc            string
@@ -1033,3 +1270,148 @@ func TestMakeClusters(t *testing.T) {
 		})
 	}
 }
+
+func TestMakeClustersForServicesWithTrafficSplit(t *testing.T) {
+	makeServiceInfo := func(configId, address string) *configinfo.ServiceInfo {
+		serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(&confpb.Service{
+			Name: testProjectName,
+			Apis: []*apipb.Api{
+				{
+					Name: testApiName,
+					Methods: []*apipb.Method{
+						{Name: "ListShelves"},
+					},
+				},
+			},
+			Backend: &confpb.Backend{
+				Rules: []*confpb.BackendRule{
+					{
+						Selector: testApiName + ".ListShelves",
+						Address:  address,
+					},
+				},
+			},
+		}, configId, options.DefaultConfigGeneratorOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return serviceInfo
+	}
+
+	testData := []struct {
+		desc                  string
+		canaryAddress         string
+		wantClusterNames      []string
+		wantCanaryClusterName string
+	}{
+		{
+			desc:          "same backend settings share the cluster",
+			canaryAddress: "https://blue.example.com",
+			wantClusterNames: []string{
+				"backend-cluster-bookstore.endpoints.project123.cloud.goog_local",
+				"metadata-cluster",
+				"service-control-cluster",
+				"backend-cluster-blue.example.com:443",
+			},
+			wantCanaryClusterName: "backend-cluster-blue.example.com:443",
+		},
+		{
+			desc:          "different backend settings get a cluster for the canary config",
+			canaryAddress: "grpcs://blue.example.com",
+			wantClusterNames: []string{
+				"backend-cluster-bookstore.endpoints.project123.cloud.goog_local",
+				"metadata-cluster",
+				"service-control-cluster",
+				"backend-cluster-blue.example.com:443",
+				"backend-cluster-blue.example.com:443_canary-config",
+			},
+			wantCanaryClusterName: "backend-cluster-blue.example.com:443_canary-config",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			serviceInfo := makeServiceInfo(testConfigID, "https://blue.example.com")
+			canary := makeServiceInfo("canary-config", tc.canaryAddress)
+			serviceInfo.TrafficSplits = []*configinfo.TrafficSplit{{ServiceInfo: canary, Percentage: 10}}
+
+			gotClusters, err := MakeClustersForServices([]*configinfo.ServiceInfo{serviceInfo})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotClusterNames []string
+			for _, c := range gotClusters {
+				gotClusterNames = append(gotClusterNames, c.GetName())
+			}
+			if !reflect.DeepEqual(gotClusterNames, tc.wantClusterNames) {
+				t.Errorf("MakeClustersForServices got cluster names %v, want %v", gotClusterNames, tc.wantClusterNames)
+			}
+			if got := canary.Methods[testApiName+".ListShelves"].BackendInfo.ClusterName; got != tc.wantCanaryClusterName {
+				t.Errorf("got canary backend cluster %s, want %s", got, tc.wantCanaryClusterName)
+			}
+		})
+	}
+}
+
+func TestMergeClusters(t *testing.T) {
+	testData := []struct {
+		desc             string
+		clusterLists     [][]*clusterpb.Cluster
+		wantClusterNames []string
+		wantError        string
+	}{
+		{
+			desc: "Success, shared clusters are added once",
+			clusterLists: [][]*clusterpb.Cluster{
+				{
+					{Name: "backend-cluster-a.com_local"},
+					{Name: "service-control-cluster"},
+				},
+				{
+					{Name: "backend-cluster-b.com_local"},
+					{Name: "service-control-cluster"},
+				},
+			},
+			wantClusterNames: []string{
+				"backend-cluster-a.com_local",
+				"service-control-cluster",
+				"backend-cluster-b.com_local",
+			},
+		},
+		{
+			desc: "Failure, clusters with the same name have different configs",
+			clusterLists: [][]*clusterpb.Cluster{
+				{
+					{Name: "service-control-cluster", LbPolicy: clusterpb.Cluster_ROUND_ROBIN},
+				},
+				{
+					{Name: "service-control-cluster", LbPolicy: clusterpb.Cluster_RANDOM},
+				},
+			},
+			wantError: "cluster service-control-cluster has conflicting configs across services",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			gotClusters, err := mergeClusters(tc.clusterLists)
+			if tc.wantError != "" {
+				if err == nil || err.Error() != tc.wantError {
+					t.Fatalf("mergeClusters got error: %v, want error: %v", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var gotClusterNames []string
+			for _, c := range gotClusters {
+				gotClusterNames = append(gotClusterNames, c.GetName())
+			}
+			if !reflect.DeepEqual(gotClusterNames, tc.wantClusterNames) {
+				t.Errorf("mergeClusters got cluster names %v, want %v", gotClusterNames, tc.wantClusterNames)
+			}
+		})
+	}
+}
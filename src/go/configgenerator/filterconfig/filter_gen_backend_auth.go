@@ -30,6 +30,10 @@ import (
 )
 
 var baPerRouteFilterConfigGen = func(method *ci.MethodInfo, httpRule *httppattern.Pattern) (*anypb.Any, error) {
+	// Only one of the weighted backends of a method may need backend auth.
+	if method.BackendInfo.JwtAudience == "" {
+		return nil, nil
+	}
 	auPerRoute := &bapb.PerRouteFilterConfig{
 		JwtAudience: method.BackendInfo.JwtAudience,
 	}
@@ -45,8 +49,18 @@ var baFilterGenFunc = func(serviceInfo *ci.ServiceInfo) (*hcmpb.HttpFilter, []*c
 	var perRouteConfigRequiredMethods []*ci.MethodInfo
 	audMap := make(map[string]bool)
 	for _, method := range serviceInfo.Methods {
+		required := false
 		if method.BackendInfo != nil && method.BackendInfo.JwtAudience != "" {
 			audMap[method.BackendInfo.JwtAudience] = true
+			required = true
+		}
+		for _, bi := range method.PolicyBackendInfos() {
+			if bi.JwtAudience != "" {
+				audMap[bi.JwtAudience] = true
+				required = true
+			}
+		}
+		if required {
 			perRouteConfigRequiredMethods = append(perRouteConfigRequiredMethods, method)
 		}
 	}
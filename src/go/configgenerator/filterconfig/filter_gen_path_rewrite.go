@@ -65,6 +65,15 @@ func needPathRewrite(serviceInfo *ci.ServiceInfo) ([]*ci.MethodInfo, bool) {
 				perRouteConfigRequiredMethods = append(perRouteConfigRequiredMethods, method)
 			}
 		}
+		// The path of each backend of the backend policies is rewritten by the
+		// per-route config of its cluster or route.
+		for _, bi := range method.PolicyBackendInfos() {
+			if bi.Path != "" && bi.TranslationType != confpb.BackendRule_PATH_TRANSLATION_UNSPECIFIED {
+				needed = true
+				perRouteConfigRequiredMethods = append(perRouteConfigRequiredMethods, method)
+				break
+			}
+		}
 	}
 	return perRouteConfigRequiredMethods, needed
 }
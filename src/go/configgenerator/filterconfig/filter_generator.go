@@ -385,6 +385,14 @@ func makeHealthCheckFilter(serviceInfo *ci.ServiceInfo) (*hcmpb.HttpFilter, erro
 			serviceInfo.LocalBackendCluster.ClusterName: &envoytypepb.Percent{Value: 100.0},
 		}
 	}
+	if serviceInfo.Options.Draining {
+		// Envoy fails the health checks if a cluster in the list does not
+		// exist, and this one never does.
+		if hcFilterConfig.ClusterMinHealthyPercentages == nil {
+			hcFilterConfig.ClusterMinHealthyPercentages = make(map[string]*envoytypepb.Percent)
+		}
+		hcFilterConfig.ClusterMinHealthyPercentages[util.DrainingHealthCheckCluster] = &envoytypepb.Percent{Value: 100.0}
+	}
 
 	hcFilterConfigStruc, err := ptypes.MarshalAny(hcFilterConfig)
 	if err != nil {
@@ -359,6 +359,7 @@ func TestHealthCheckFilter(t *testing.T) {
 		BackendAddress         string
 		healthz                string
 		healthCheckGrpcBackend bool
+		draining               bool
 		wantHealthCheckFilter  string
 	}{
 		{
@@ -399,6 +400,28 @@ func TestHealthCheckFilter(t *testing.T) {
               "backend-cluster-bookstore.endpoints.project123.cloud.goog_local": { "value": 100.0 }
           }
         }
+      }`,
+		},
+		{
+			desc:           "Success, generate health check filter failing the health checks while draining",
+			BackendAddress: "http://127.0.0.1:80",
+			healthz:        "healthz",
+			draining:       true,
+			wantHealthCheckFilter: `{
+        "name": "envoy.filters.http.health_check",
+        "typedConfig": {
+          "@type":"type.googleapis.com/envoy.extensions.filters.http.health_check.v3.HealthCheck",
+          "passThroughMode":false,
+          "headers": [
+            {
+              "stringMatch":{"exact":"/healthz"},
+              "name":":path"
+            }
+          ],
+          "clusterMinHealthyPercentages": {
+              "draining-health-check-cluster": { "value": 100.0 }
+          }
+        }
       }`,
 		},
 		{
@@ -440,6 +463,7 @@ func TestHealthCheckFilter(t *testing.T) {
 		opts.BackendAddress = tc.BackendAddress
 		opts.Healthz = tc.healthz
 		opts.HealthCheckGrpcBackend = tc.healthCheckGrpcBackend
+		opts.Draining = tc.draining
 		fakeServiceInfo, err := configinfo.NewServiceInfoFromServiceConfig(fakeServiceConfig, testConfigID, opts)
 		if err != nil {
 			t.Fatal(err)
@@ -0,0 +1,360 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filterconfig
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	bapb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v11/http/backend_auth"
+	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v11/http/service_control"
+	transcoderpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/grpc_json_transcoder/v3"
+	hcpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/health_check/v3"
+	jwtpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/jwt_authn/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	envoytypepb "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// filterMergeFunc merges the config of src into dst, both filters have the same name.
+// srcServiceName is the name of the service that src is generated for.
+type filterMergeFunc func(dst, src *hcmpb.HttpFilter, srcServiceName string) (*hcmpb.HttpFilter, error)
+
+// Filters not listed here must have the same config across all services.
+var filterMergeFuncs = map[string]filterMergeFunc{
+	util.HealthCheck:        mergeHealthCheckFilters,
+	util.JwtAuthn:           mergeJwtAuthnFilters,
+	util.ServiceControl:     mergeServiceControlFilters,
+	util.GRPCJSONTranscoder: mergeTranscoderFilters,
+	util.BackendAuth:        mergeBackendAuthFilters,
+}
+
+// Merge rules of the filters of the configs in a traffic split, which are
+// generated for the same service.
+var trafficSplitFilterMergeFuncs = map[string]filterMergeFunc{
+	util.HealthCheck:        mergeHealthCheckFilters,
+	util.JwtAuthn:           mergeTrafficSplitJwtAuthnFilters,
+	util.ServiceControl:     mergeTrafficSplitServiceControlFilters,
+	util.GRPCJSONTranscoder: mergeTranscoderFilters,
+	util.BackendAuth:        mergeBackendAuthFilters,
+}
+
+// MergeHttpFilters merges the http filters generated for multiple services
+// into a single filter chain.
+//
+// Filters with the same name are merged into one. A filter only generated for
+// some services is placed after the filter preceding it in the first service
+// that has it, so the relative order of each service's filters is kept.
+func MergeHttpFilters(serviceNames []string, filterLists [][]*hcmpb.HttpFilter) ([]*hcmpb.HttpFilter, error) {
+	if len(serviceNames) != len(filterLists) {
+		return nil, fmt.Errorf("got %d service names for %d filter lists", len(serviceNames), len(filterLists))
+	}
+	return mergeHttpFilters(serviceNames, filterLists, filterMergeFuncs)
+}
+
+// MergeTrafficSplitHttpFilters merges the http filters generated for the
+// configs of one service in a traffic split, the first config serves the
+// requests not assigned to the others.
+//
+// The jwt requirements of the other configs are renamed by
+// TrafficSplitRequirementName. Service control requirements are reported
+// under the operation name, so an operation defined by several configs must
+// have the same requirement in all of them.
+func MergeTrafficSplitHttpFilters(configIds []string, filterLists [][]*hcmpb.HttpFilter) ([]*hcmpb.HttpFilter, error) {
+	if len(configIds) != len(filterLists) {
+		return nil, fmt.Errorf("got %d config ids for %d filter lists", len(configIds), len(filterLists))
+	}
+	return mergeHttpFilters(configIds, filterLists, trafficSplitFilterMergeFuncs)
+}
+
+// TrafficSplitRequirementName is the name of the jwt requirement of the
+// operation in a config serving a traffic split.
+func TrafficSplitRequirementName(operation, configId string) string {
+	return fmt.Sprintf("%s@%s", operation, configId)
+}
+
+func mergeHttpFilters(names []string, filterLists [][]*hcmpb.HttpFilter, mergeFuncs map[string]filterMergeFunc) ([]*hcmpb.HttpFilter, error) {
+
+	var merged []*hcmpb.HttpFilter
+	indexOf := func(name string) int {
+		for i, filter := range merged {
+			if filter.GetName() == name {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for i, filters := range filterLists {
+		// Position in the merged list after which a new filter is inserted.
+		insertAt := 0
+		for _, filter := range filters {
+			idx := indexOf(filter.GetName())
+			if idx < 0 {
+				merged = append(merged, nil)
+				copy(merged[insertAt+1:], merged[insertAt:])
+				merged[insertAt] = filter
+				insertAt++
+				continue
+			}
+
+			mergeFunc, ok := mergeFuncs[filter.GetName()]
+			if ok {
+				mergedFilter, err := mergeFunc(merged[idx], filter, names[i])
+				if err != nil {
+					return nil, fmt.Errorf("fail to merge filter %q of service %s: %v", filter.GetName(), names[i], err)
+				}
+				merged[idx] = mergedFilter
+			} else if !proto.Equal(merged[idx], filter) {
+				return nil, fmt.Errorf("filter %q of service %s conflicts with the one of other services", filter.GetName(), names[i])
+			}
+			insertAt = idx + 1
+		}
+	}
+	return merged, nil
+}
+
+func unmarshalFilterConfigs(dst, src *hcmpb.HttpFilter, dstConfig, srcConfig proto.Message) error {
+	if err := ptypes.UnmarshalAny(dst.GetTypedConfig(), dstConfig); err != nil {
+		return err
+	}
+	return ptypes.UnmarshalAny(src.GetTypedConfig(), srcConfig)
+}
+
+func marshalFilterConfig(name string, config proto.Message) (*hcmpb.HttpFilter, error) {
+	a, err := ptypes.MarshalAny(config)
+	if err != nil {
+		return nil, err
+	}
+	return &hcmpb.HttpFilter{
+		Name:       name,
+		ConfigType: &hcmpb.HttpFilter_TypedConfig{TypedConfig: a},
+	}, nil
+}
+
+func mergeHealthCheckFilters(dst, src *hcmpb.HttpFilter, _ string) (*hcmpb.HttpFilter, error) {
+	dstConfig, srcConfig := &hcpb.HealthCheck{}, &hcpb.HealthCheck{}
+	if err := unmarshalFilterConfigs(dst, src, dstConfig, srcConfig); err != nil {
+		return nil, err
+	}
+
+	for cluster, percent := range srcConfig.GetClusterMinHealthyPercentages() {
+		if dstConfig.ClusterMinHealthyPercentages == nil {
+			dstConfig.ClusterMinHealthyPercentages = make(map[string]*envoytypepb.Percent)
+		}
+		dstConfig.ClusterMinHealthyPercentages[cluster] = percent
+	}
+	return marshalFilterConfig(util.HealthCheck, dstConfig)
+}
+
+func mergeJwtAuthnFilters(dst, src *hcmpb.HttpFilter, srcServiceName string) (*hcmpb.HttpFilter, error) {
+	return mergeJwtAuthnConfigs(dst, src, srcServiceName, func(selector string) string {
+		return selector
+	})
+}
+
+func mergeTrafficSplitJwtAuthnFilters(dst, src *hcmpb.HttpFilter, srcConfigId string) (*hcmpb.HttpFilter, error) {
+	return mergeJwtAuthnConfigs(dst, src, srcConfigId, func(selector string) string {
+		return TrafficSplitRequirementName(selector, srcConfigId)
+	})
+}
+
+// mergeJwtAuthnConfigs merges the jwt providers and requirements of src into
+// dst, the requirements of src are renamed by requirementName.
+func mergeJwtAuthnConfigs(dst, src *hcmpb.HttpFilter, srcName string, requirementName func(string) string) (*hcmpb.HttpFilter, error) {
+	dstConfig, srcConfig := &jwtpb.JwtAuthentication{}, &jwtpb.JwtAuthentication{}
+	if err := unmarshalFilterConfigs(dst, src, dstConfig, srcConfig); err != nil {
+		return nil, err
+	}
+
+	// Providers with the same id but different configs, i.e. the default
+	// audiences, are renamed with the service name as suffix.
+	renamed := make(map[string]string)
+	for id, provider := range srcConfig.GetProviders() {
+		if existing, ok := dstConfig.Providers[id]; ok && !proto.Equal(existing, provider) {
+			newId := fmt.Sprintf("%s-%s", id, srcName)
+			renamed[id] = newId
+			id = newId
+		}
+		if dstConfig.Providers == nil {
+			dstConfig.Providers = make(map[string]*jwtpb.JwtProvider)
+		}
+		dstConfig.Providers[id] = provider
+	}
+
+	for selector, requirement := range srcConfig.GetRequirementMap() {
+		selector = requirementName(selector)
+		if _, ok := dstConfig.RequirementMap[selector]; ok {
+			return nil, fmt.Errorf("duplicated jwt requirement for operation %s", selector)
+		}
+		renameJwtProviders(requirement, renamed)
+		if dstConfig.RequirementMap == nil {
+			dstConfig.RequirementMap = make(map[string]*jwtpb.JwtRequirement)
+		}
+		dstConfig.RequirementMap[selector] = requirement
+	}
+	return marshalFilterConfig(util.JwtAuthn, dstConfig)
+}
+
+func renameJwtProviders(requirement *jwtpb.JwtRequirement, renamed map[string]string) {
+	if len(renamed) == 0 || requirement == nil {
+		return
+	}
+	switch r := requirement.RequiresType.(type) {
+	case *jwtpb.JwtRequirement_ProviderName:
+		if newId, ok := renamed[r.ProviderName]; ok {
+			r.ProviderName = newId
+		}
+	case *jwtpb.JwtRequirement_ProviderAndAudiences:
+		if newId, ok := renamed[r.ProviderAndAudiences.GetProviderName()]; ok {
+			r.ProviderAndAudiences.ProviderName = newId
+		}
+	case *jwtpb.JwtRequirement_RequiresAny:
+		for _, sub := range r.RequiresAny.GetRequirements() {
+			renameJwtProviders(sub, renamed)
+		}
+	case *jwtpb.JwtRequirement_RequiresAll:
+		for _, sub := range r.RequiresAll.GetRequirements() {
+			renameJwtProviders(sub, renamed)
+		}
+	}
+}
+
+func mergeServiceControlFilters(dst, src *hcmpb.HttpFilter, _ string) (*hcmpb.HttpFilter, error) {
+	dstConfig, srcConfig := &scpb.FilterConfig{}, &scpb.FilterConfig{}
+	if err := unmarshalFilterConfigs(dst, src, dstConfig, srcConfig); err != nil {
+		return nil, err
+	}
+
+	dstConfig.Services = append(dstConfig.Services, srcConfig.GetServices()...)
+
+	operations := make(map[string]bool)
+	for _, requirement := range dstConfig.GetRequirements() {
+		operations[requirement.GetOperationName()] = true
+	}
+	for _, requirement := range srcConfig.GetRequirements() {
+		if operations[requirement.GetOperationName()] {
+			// Operations generated for the deployment, i.e. health check, are
+			// the same for all services, the first one wins.
+			if strings.HasPrefix(requirement.GetOperationName(), util.EspOperation+".") {
+				continue
+			}
+			return nil, fmt.Errorf("duplicated service control requirement for operation %s", requirement.GetOperationName())
+		}
+		operations[requirement.GetOperationName()] = true
+		dstConfig.Requirements = append(dstConfig.Requirements, requirement)
+	}
+	return marshalFilterConfig(util.ServiceControl, dstConfig)
+}
+
+func mergeTrafficSplitServiceControlFilters(dst, src *hcmpb.HttpFilter, srcConfigId string) (*hcmpb.HttpFilter, error) {
+	dstConfig, srcConfig := &scpb.FilterConfig{}, &scpb.FilterConfig{}
+	if err := unmarshalFilterConfigs(dst, src, dstConfig, srcConfig); err != nil {
+		return nil, err
+	}
+
+	// All the configs belong to one service, so do their reports.
+	requirements := make(map[string]*scpb.Requirement)
+	for _, requirement := range dstConfig.GetRequirements() {
+		requirements[requirement.GetOperationName()] = requirement
+	}
+	for _, requirement := range srcConfig.GetRequirements() {
+		if existing, ok := requirements[requirement.GetOperationName()]; ok {
+			// The service control filter looks up the requirement by the
+			// reported operation name, so a config cannot change it.
+			if !proto.Equal(existing, requirement) && !strings.HasPrefix(requirement.GetOperationName(), util.EspOperation+".") {
+				return nil, fmt.Errorf("service control requirement of operation %s differs in config %s, i.e. its api key, quota or skip service control settings, which cannot change in a traffic split",
+					requirement.GetOperationName(), srcConfigId)
+			}
+			continue
+		}
+		requirements[requirement.GetOperationName()] = requirement
+		dstConfig.Requirements = append(dstConfig.Requirements, requirement)
+	}
+	return marshalFilterConfig(util.ServiceControl, dstConfig)
+}
+
+func mergeTranscoderFilters(dst, src *hcmpb.HttpFilter, _ string) (*hcmpb.HttpFilter, error) {
+	dstConfig, srcConfig := &transcoderpb.GrpcJsonTranscoder{}, &transcoderpb.GrpcJsonTranscoder{}
+	if err := unmarshalFilterConfigs(dst, src, dstConfig, srcConfig); err != nil {
+		return nil, err
+	}
+
+	dstFds, srcFds := &descpb.FileDescriptorSet{}, &descpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(dstConfig.GetProtoDescriptorBin(), dstFds); err != nil {
+		return nil, fmt.Errorf("fail to unmarshal proto descriptor: %v", err)
+	}
+	if err := proto.Unmarshal(srcConfig.GetProtoDescriptorBin(), srcFds); err != nil {
+		return nil, fmt.Errorf("fail to unmarshal proto descriptor: %v", err)
+	}
+
+	files := make(map[string]*descpb.FileDescriptorProto)
+	for _, file := range dstFds.GetFile() {
+		files[file.GetName()] = file
+	}
+	for _, file := range srcFds.GetFile() {
+		if existing, ok := files[file.GetName()]; ok {
+			if !proto.Equal(existing, file) {
+				return nil, fmt.Errorf("proto file %s differs across services", file.GetName())
+			}
+			continue
+		}
+		files[file.GetName()] = file
+		dstFds.File = append(dstFds.File, file)
+	}
+	descriptorBin, err := proto.Marshal(dstFds)
+	if err != nil {
+		return nil, fmt.Errorf("fail to marshal proto descriptor: %v", err)
+	}
+	dstConfig.DescriptorSet = &transcoderpb.GrpcJsonTranscoder_ProtoDescriptorBin{
+		ProtoDescriptorBin: descriptorBin,
+	}
+
+	dstConfig.Services = unionStrings(dstConfig.GetServices(), srcConfig.GetServices())
+	dstConfig.IgnoredQueryParameters = unionStrings(dstConfig.GetIgnoredQueryParameters(), srcConfig.GetIgnoredQueryParameters())
+	sort.Strings(dstConfig.IgnoredQueryParameters)
+	return marshalFilterConfig(util.GRPCJSONTranscoder, dstConfig)
+}
+
+func mergeBackendAuthFilters(dst, src *hcmpb.HttpFilter, _ string) (*hcmpb.HttpFilter, error) {
+	dstConfig, srcConfig := &bapb.FilterConfig{}, &bapb.FilterConfig{}
+	if err := unmarshalFilterConfigs(dst, src, dstConfig, srcConfig); err != nil {
+		return nil, err
+	}
+
+	dstConfig.JwtAudienceList = unionStrings(dstConfig.GetJwtAudienceList(), srcConfig.GetJwtAudienceList())
+	sort.Strings(dstConfig.JwtAudienceList)
+	return marshalFilterConfig(util.BackendAuth, dstConfig)
+}
+
+// unionStrings appends the strings of b not found in a, keeping their order.
+func unionStrings(a, b []string) []string {
+	seen := make(map[string]bool)
+	for _, s := range a {
+		seen[s] = true
+	}
+	for _, s := range b {
+		if !seen[s] {
+			seen[s] = true
+			a = append(a, s)
+		}
+	}
+	return a
+}
@@ -0,0 +1,343 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filterconfig
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+
+	bapb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v11/http/backend_auth"
+	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v11/http/service_control"
+	corspb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/cors/v3"
+	jwtpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/jwt_authn/v3"
+	routerpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+)
+
+func TestMergeHttpFilters(t *testing.T) {
+	mustMakeFilter := func(name string, config proto.Message) *hcmpb.HttpFilter {
+		filter, err := marshalFilterConfig(name, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return filter
+	}
+
+	testData := []struct {
+		desc        string
+		filterLists [][]*hcmpb.HttpFilter
+		wantFilters string
+		wantError   string
+	}{
+		{
+			desc: "Success, filters only in the second service are kept in order",
+			filterLists: [][]*hcmpb.HttpFilter{
+				{
+					mustMakeFilter(util.BackendAuth, &bapb.FilterConfig{JwtAudienceList: []string{"aud-b"}}),
+					mustMakeFilter(util.Router, &routerpb.Router{}),
+				},
+				{
+					mustMakeFilter(util.CORS, &corspb.Cors{}),
+					mustMakeFilter(util.BackendAuth, &bapb.FilterConfig{JwtAudienceList: []string{"aud-a", "aud-b"}}),
+					mustMakeFilter(util.Router, &routerpb.Router{}),
+				},
+			},
+			wantFilters: `[
+  {
+    "name": "envoy.filters.http.cors",
+    "typedConfig": {
+      "@type": "type.googleapis.com/envoy.extensions.filters.http.cors.v3.Cors"
+    }
+  },
+  {
+    "name": "com.google.espv2.filters.http.backend_auth",
+    "typedConfig": {
+      "@type": "type.googleapis.com/espv2.api.envoy.v11.http.backend_auth.FilterConfig",
+      "jwtAudienceList": ["aud-a", "aud-b"]
+    }
+  },
+  {
+    "name": "envoy.filters.http.router",
+    "typedConfig": {
+      "@type": "type.googleapis.com/envoy.extensions.filters.http.router.v3.Router"
+    }
+  }
+]`,
+		},
+		{
+			desc: "Success, service control services and requirements are merged",
+			filterLists: [][]*hcmpb.HttpFilter{
+				{
+					mustMakeFilter(util.ServiceControl, &scpb.FilterConfig{
+						Services: []*scpb.Service{{ServiceName: "a.com"}},
+						Requirements: []*scpb.Requirement{
+							{ServiceName: "a.com", OperationName: "api.a.Get"},
+							{ServiceName: "a.com", OperationName: "espv2_deployment.ESPv2_Autogenerated_HealthCheck"},
+						},
+					}),
+				},
+				{
+					mustMakeFilter(util.ServiceControl, &scpb.FilterConfig{
+						Services: []*scpb.Service{{ServiceName: "b.com"}},
+						Requirements: []*scpb.Requirement{
+							{ServiceName: "b.com", OperationName: "api.b.Get"},
+							{ServiceName: "b.com", OperationName: "espv2_deployment.ESPv2_Autogenerated_HealthCheck"},
+						},
+					}),
+				},
+			},
+			wantFilters: `[
+  {
+    "name": "com.google.espv2.filters.http.service_control",
+    "typedConfig": {
+      "@type": "type.googleapis.com/espv2.api.envoy.v11.http.service_control.FilterConfig",
+      "services": [
+        {"serviceName": "a.com"},
+        {"serviceName": "b.com"}
+      ],
+      "requirements": [
+        {"serviceName": "a.com", "operationName": "api.a.Get"},
+        {"serviceName": "a.com", "operationName": "espv2_deployment.ESPv2_Autogenerated_HealthCheck"},
+        {"serviceName": "b.com", "operationName": "api.b.Get"}
+      ]
+    }
+  }
+]`,
+		},
+		{
+			desc: "Success, conflicting jwt providers are renamed",
+			filterLists: [][]*hcmpb.HttpFilter{
+				{
+					mustMakeFilter(util.JwtAuthn, &jwtpb.JwtAuthentication{
+						Providers: map[string]*jwtpb.JwtProvider{
+							"auth0": {Issuer: "issuer", Audiences: []string{"https://a.com"}},
+						},
+						RequirementMap: map[string]*jwtpb.JwtRequirement{
+							"api.a.Get": {RequiresType: &jwtpb.JwtRequirement_ProviderName{ProviderName: "auth0"}},
+						},
+					}),
+				},
+				{
+					mustMakeFilter(util.JwtAuthn, &jwtpb.JwtAuthentication{
+						Providers: map[string]*jwtpb.JwtProvider{
+							"auth0": {Issuer: "issuer", Audiences: []string{"https://b.com"}},
+						},
+						RequirementMap: map[string]*jwtpb.JwtRequirement{
+							"api.b.Get": {RequiresType: &jwtpb.JwtRequirement_ProviderName{ProviderName: "auth0"}},
+						},
+					}),
+				},
+			},
+			wantFilters: `[
+  {
+    "name": "envoy.filters.http.jwt_authn",
+    "typedConfig": {
+      "@type": "type.googleapis.com/envoy.extensions.filters.http.jwt_authn.v3.JwtAuthentication",
+      "providers": {
+        "auth0": {"issuer": "issuer", "audiences": ["https://a.com"]},
+        "auth0-b.com": {"issuer": "issuer", "audiences": ["https://b.com"]}
+      },
+      "requirementMap": {
+        "api.a.Get": {"providerName": "auth0"},
+        "api.b.Get": {"providerName": "auth0-b.com"}
+      }
+    }
+  }
+]`,
+		},
+		{
+			desc: "Failure, duplicated service control operation",
+			filterLists: [][]*hcmpb.HttpFilter{
+				{
+					mustMakeFilter(util.ServiceControl, &scpb.FilterConfig{
+						Requirements: []*scpb.Requirement{{ServiceName: "a.com", OperationName: "api.Get"}},
+					}),
+				},
+				{
+					mustMakeFilter(util.ServiceControl, &scpb.FilterConfig{
+						Requirements: []*scpb.Requirement{{ServiceName: "b.com", OperationName: "api.Get"}},
+					}),
+				},
+			},
+			wantError: "duplicated service control requirement for operation api.Get",
+		},
+		{
+			desc: "Failure, filter without merge rule has different configs",
+			filterLists: [][]*hcmpb.HttpFilter{
+				{
+					mustMakeFilter(util.Router, &routerpb.Router{}),
+				},
+				{
+					mustMakeFilter(util.Router, &routerpb.Router{SuppressEnvoyHeaders: true}),
+				},
+			},
+			wantError: `filter "envoy.filters.http.router" of service b.com conflicts with the one of other services`,
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			gotFilters, err := MergeHttpFilters([]string{"a.com", "b.com"}, tc.filterLists)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("MergeHttpFilters got error: %v, want error: %v", err, tc.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			marshaler := &jsonpb.Marshaler{}
+			var gotJsons []string
+			for _, filter := range gotFilters {
+				gotJson, err := marshaler.MarshalToString(filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				gotJsons = append(gotJsons, gotJson)
+			}
+			if err := util.JsonEqual(tc.wantFilters, "["+strings.Join(gotJsons, ",")+"]"); err != nil {
+				t.Errorf("MergeHttpFilters failed,\n%v", err)
+			}
+		})
+	}
+}
+
+func TestMergeTrafficSplitHttpFilters(t *testing.T) {
+	mustMakeFilter := func(name string, config proto.Message) *hcmpb.HttpFilter {
+		filter, err := marshalFilterConfig(name, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return filter
+	}
+	primaryFilters := []*hcmpb.HttpFilter{
+		mustMakeFilter(util.JwtAuthn, &jwtpb.JwtAuthentication{
+			Providers: map[string]*jwtpb.JwtProvider{
+				"auth0": {Issuer: "issuer"},
+			},
+			RequirementMap: map[string]*jwtpb.JwtRequirement{
+				"api.Get": {RequiresType: &jwtpb.JwtRequirement_ProviderName{ProviderName: "auth0"}},
+			},
+		}),
+		mustMakeFilter(util.ServiceControl, &scpb.FilterConfig{
+			Services: []*scpb.Service{{ServiceName: "a.com", ServiceConfigId: "config-1"}},
+			Requirements: []*scpb.Requirement{
+				{ServiceName: "a.com", OperationName: "api.Get", ApiKey: &scpb.ApiKeyRequirement{AllowWithoutApiKey: true}},
+			},
+		}),
+	}
+
+	testData := []struct {
+		desc          string
+		canaryFilters []*hcmpb.HttpFilter
+		wantFilters   string
+		wantError     string
+	}{
+		{
+			desc: "jwt requirements are renamed, service control requirements are merged",
+			canaryFilters: []*hcmpb.HttpFilter{
+				mustMakeFilter(util.JwtAuthn, &jwtpb.JwtAuthentication{
+					Providers: map[string]*jwtpb.JwtProvider{
+						"auth0": {Issuer: "new-issuer"},
+					},
+					RequirementMap: map[string]*jwtpb.JwtRequirement{
+						"api.Get": {RequiresType: &jwtpb.JwtRequirement_ProviderName{ProviderName: "auth0"}},
+					},
+				}),
+				mustMakeFilter(util.ServiceControl, &scpb.FilterConfig{
+					Services: []*scpb.Service{{ServiceName: "a.com", ServiceConfigId: "config-2"}},
+					Requirements: []*scpb.Requirement{
+						{ServiceName: "a.com", OperationName: "api.Get", ApiKey: &scpb.ApiKeyRequirement{AllowWithoutApiKey: true}},
+						{ServiceName: "a.com", OperationName: "api.List"},
+					},
+				}),
+			},
+			wantFilters: `[
+  {
+    "name": "envoy.filters.http.jwt_authn",
+    "typedConfig": {
+      "@type": "type.googleapis.com/envoy.extensions.filters.http.jwt_authn.v3.JwtAuthentication",
+      "providers": {
+        "auth0": {"issuer": "issuer"},
+        "auth0-config-2": {"issuer": "new-issuer"}
+      },
+      "requirementMap": {
+        "api.Get": {"providerName": "auth0"},
+        "api.Get@config-2": {"providerName": "auth0-config-2"}
+      }
+    }
+  },
+  {
+    "name": "com.google.espv2.filters.http.service_control",
+    "typedConfig": {
+      "@type": "type.googleapis.com/espv2.api.envoy.v11.http.service_control.FilterConfig",
+      "services": [
+        {"serviceName": "a.com", "serviceConfigId": "config-1"}
+      ],
+      "requirements": [
+        {"serviceName": "a.com", "operationName": "api.Get", "apiKey": {"allowWithoutApiKey": true}},
+        {"serviceName": "a.com", "operationName": "api.List"}
+      ]
+    }
+  }
+]`,
+		},
+		{
+			desc: "service control requirement of an operation differs across configs",
+			canaryFilters: []*hcmpb.HttpFilter{
+				mustMakeFilter(util.ServiceControl, &scpb.FilterConfig{
+					Services: []*scpb.Service{{ServiceName: "a.com", ServiceConfigId: "config-2"}},
+					Requirements: []*scpb.Requirement{
+						{ServiceName: "a.com", OperationName: "api.Get"},
+					},
+				}),
+			},
+			wantError: "service control requirement of operation api.Get differs in config config-2",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			gotFilters, err := MergeTrafficSplitHttpFilters([]string{"config-1", "config-2"}, [][]*hcmpb.HttpFilter{primaryFilters, tc.canaryFilters})
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("want error: %v, got error: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			marshaler := &jsonpb.Marshaler{}
+			var gotJsons []string
+			for _, filter := range gotFilters {
+				gotJson, err := marshaler.MarshalToString(filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				gotJsons = append(gotJsons, gotJson)
+			}
+			if err := util.JsonEqual(tc.wantFilters, "["+strings.Join(gotJsons, ",")+"]"); err != nil {
+				t.Errorf("MergeTrafficSplitHttpFilters failed,\n%v", err)
+			}
+		})
+	}
+}
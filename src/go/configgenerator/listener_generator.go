@@ -50,6 +50,101 @@ func MakeListeners(serviceInfo *sc.ServiceInfo) ([]*listenerpb.Listener, error)
 	return []*listenerpb.Listener{listener}, nil
 }
 
+// MakeListenersForServices provides dynamic listeners for Envoy serving
+// multiple services. All services share one listener, each service gets its
+// own virtual host and the http filters of all services are merged.
+//
+// The listener options are taken from the first service.
+func MakeListenersForServices(serviceInfos []*sc.ServiceInfo) ([]*listenerpb.Listener, error) {
+	if len(serviceInfos) == 0 {
+		return nil, fmt.Errorf("no service is provided to make listeners")
+	}
+	// ServiceInfo may be reused across snapshots, drop the per-route
+	// generators added by a previous generation.
+	for _, serviceInfo := range serviceInfos {
+		resetPerRouteConfigGens(serviceInfo)
+		for _, split := range serviceInfo.TrafficSplits {
+			resetPerRouteConfigGens(split.ServiceInfo)
+		}
+	}
+	if len(serviceInfos) == 1 {
+		return MakeListeners(serviceInfos[0])
+	}
+
+	var serviceNames []string
+	var filterLists [][]*hcmpb.HttpFilter
+	for _, serviceInfo := range serviceInfos {
+		filterGenerators, err := filterconfig.MakeFilterGenerators(serviceInfo)
+		if err != nil {
+			return nil, err
+		}
+		httpFilters, err := GetFilterConfigAndAddPerRouteConfigGen(serviceInfo, filterGenerators)
+		if err != nil {
+			return nil, err
+		}
+		if httpFilters, err = addTrafficSplitFilters(serviceInfo, httpFilters); err != nil {
+			return nil, err
+		}
+		serviceNames = append(serviceNames, serviceInfo.Name)
+		filterLists = append(filterLists, httpFilters)
+	}
+
+	httpFilters, err := filterconfig.MergeHttpFilters(serviceNames, filterLists)
+	if err != nil {
+		return nil, fmt.Errorf("fail to merge http filters: %v", err)
+	}
+
+	// With RDS, the routes are made by MakeRouteConfigs.
+	var route *routepb.RouteConfiguration
+	if !serviceInfos[0].Options.EnableRds {
+		route, err = makeRouteConfigForServices(serviceInfos)
+		if err != nil {
+			return nil, fmt.Errorf("makeHttpConnectionManagerRouteConfig got err: %s", err)
+		}
+	}
+
+	listener, err := makeListener(serviceInfos[0], httpFilters, route, nil)
+	if err != nil {
+		return nil, err
+	}
+	return []*listenerpb.Listener{listener}, nil
+}
+
+func resetPerRouteConfigGens(serviceInfo *sc.ServiceInfo) {
+	for _, method := range serviceInfo.Methods {
+		method.PerRouteConfigGens = nil
+	}
+}
+
+// addTrafficSplitFilters merges the http filters of the traffic split configs
+// of serviceInfo into httpFilters, the filters generated for serviceInfo.
+func addTrafficSplitFilters(serviceInfo *sc.ServiceInfo, httpFilters []*hcmpb.HttpFilter) ([]*hcmpb.HttpFilter, error) {
+	if len(serviceInfo.TrafficSplits) == 0 {
+		return httpFilters, nil
+	}
+
+	configIds := []string{serviceInfo.ConfigID}
+	filterLists := [][]*hcmpb.HttpFilter{httpFilters}
+	for _, split := range serviceInfo.TrafficSplits {
+		filterGenerators, err := filterconfig.MakeFilterGenerators(split.ServiceInfo)
+		if err != nil {
+			return nil, err
+		}
+		splitFilters, err := GetFilterConfigAndAddPerRouteConfigGen(split.ServiceInfo, filterGenerators)
+		if err != nil {
+			return nil, fmt.Errorf("fail to make filters for config %s: %v", split.ServiceInfo.ConfigID, err)
+		}
+		configIds = append(configIds, split.ServiceInfo.ConfigID)
+		filterLists = append(filterLists, splitFilters)
+	}
+
+	merged, err := filterconfig.MergeTrafficSplitHttpFilters(configIds, filterLists)
+	if err != nil {
+		return nil, fmt.Errorf("fail to merge http filters of the traffic split configs: %v", err)
+	}
+	return merged, nil
+}
+
 // AddPerRouteConfigGenToMethods adds the filterGenerator functions to all the methods in place.
 func AddPerRouteConfigGenToMethods(methods []*sc.MethodInfo, filterGen *filterconfig.FilterGenerator) error {
 	if filterGen.PerRouteConfigGenFunc == nil {
@@ -97,12 +192,23 @@ func MakeListener(serviceInfo *sc.ServiceInfo, filterGenerators []*filterconfig.
 	if err != nil {
 		return nil, err
 	}
+	if httpFilters, err = addTrafficSplitFilters(serviceInfo, httpFilters); err != nil {
+		return nil, err
+	}
 
-	route, err := makeRouteConfig(serviceInfo)
-	if err != nil {
-		return nil, fmt.Errorf("makeHttpConnectionManagerRouteConfig got err: %s", err)
+	// With RDS, the routes are made by MakeRouteConfigs.
+	var route *routepb.RouteConfiguration
+	if !serviceInfo.Options.EnableRds {
+		route, err = makeRouteConfig(serviceInfo)
+		if err != nil {
+			return nil, fmt.Errorf("makeHttpConnectionManagerRouteConfig got err: %s", err)
+		}
 	}
 
+	return makeListener(serviceInfo, httpFilters, route, localReplyConfig)
+}
+
+func makeListener(serviceInfo *sc.ServiceInfo, httpFilters []*hcmpb.HttpFilter, route *routepb.RouteConfiguration, localReplyConfig *hcmpb.LocalReplyConfig) (*listenerpb.Listener, error) {
 	httpConMgr, err := makeHTTPConMgr(&serviceInfo.Options, route, localReplyConfig)
 	if err != nil {
 		return nil, fmt.Errorf("makeHttpConnectionManager got err: %s", err)
@@ -163,6 +269,12 @@ func MakeListener(serviceInfo *sc.ServiceInfo, filterGenerators []*filterconfig.
 		}
 	}
 
+	if err := canonicalizeResource("listener", listener.Name, listener); err != nil {
+		return nil, err
+	}
+	if err := validateResource("listener", listener.Name, listener); err != nil {
+		return nil, err
+	}
 	return listener, nil
 }
 
@@ -200,11 +312,8 @@ func makeHTTPConMgr(opts *options.ConfigGeneratorOptions, route *routepb.RouteCo
 				UpgradeType: "websocket",
 			},
 		},
-		CodecType:  hcmpb.HttpConnectionManager_AUTO,
-		StatPrefix: util.StatPrefix,
-		RouteSpecifier: &hcmpb.HttpConnectionManager_RouteConfig{
-			RouteConfig: route,
-		},
+		CodecType:         hcmpb.HttpConnectionManager_AUTO,
+		StatPrefix:        util.StatPrefix,
 		UseRemoteAddress:  &wrapperspb.BoolValue{Value: opts.EnvoyUseRemoteAddress},
 		XffNumTrustedHops: uint32(opts.EnvoyXffNumTrustedHops),
 
@@ -213,6 +322,26 @@ func makeHTTPConMgr(opts *options.ConfigGeneratorOptions, route *routepb.RouteCo
 		MergeSlashes:  opts.MergeSlashesInPath,
 	}
 
+	if opts.EnableRds {
+		// Routes are fetched over the ADS stream, so a route change does not
+		// drain the listener.
+		httpConMgr.RouteSpecifier = &hcmpb.HttpConnectionManager_Rds{
+			Rds: &hcmpb.Rds{
+				RouteConfigName: routeName,
+				ConfigSource: &corepb.ConfigSource{
+					ConfigSourceSpecifier: &corepb.ConfigSource_Ads{
+						Ads: &corepb.AggregatedConfigSource{},
+					},
+					ResourceApiVersion: corepb.ApiVersion_V3,
+				},
+			},
+		}
+	} else {
+		httpConMgr.RouteSpecifier = &hcmpb.HttpConnectionManager_RouteConfig{
+			RouteConfig: route,
+		}
+	}
+
 	if localReplyConfig != nil {
 		httpConMgr.LocalReplyConfig = localReplyConfig
 	} else {
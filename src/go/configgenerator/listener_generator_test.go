@@ -238,6 +238,45 @@ func TestMakeHTTPConMgr(t *testing.T) {
 				"useRemoteAddress": false
 			}`,
 		},
+		{
+			desc: "Generate HttpConMgr with routes served over RDS",
+			opts: options.ConfigGeneratorOptions{
+				CommonOptions: options.CommonOptions{
+					DisableTracing: true,
+					EnableRds:      true,
+				},
+			},
+			wantHTTPConnMgr: `
+			{
+				"commonHttpProtocolOptions": {
+					"headersWithUnderscoresAction": "REJECT_REQUEST"
+				},
+				"localReplyConfig": {
+					"bodyFormat": {
+						"jsonFormat": {
+							"code": "%RESPONSE_CODE%",
+							"message": "%LOCAL_REPLY_BODY%"
+						}
+					}
+				},
+				"normalizePath": false,
+				"pathWithEscapedSlashesAction": "KEEP_UNCHANGED",
+				"rds": {
+					"configSource": {
+						"ads": {},
+						"resourceApiVersion": "V3"
+					},
+					"routeConfigName": "local_route"
+				},
+				"statPrefix": "ingress_http",
+				"upgradeConfigs": [
+					{
+						"upgradeType": "websocket"
+					}
+				],
+				"useRemoteAddress": false
+			}`,
+		},
 		{
 			desc: "Generate HttpConMgr with custom local reply config",
 			opts: options.ConfigGeneratorOptions{
@@ -16,17 +16,21 @@ package configgenerator
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/openapi"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util/httppattern"
 	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	corspb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/cors/v3"
 	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	typepb "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	"github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
@@ -37,6 +41,10 @@ import (
 const (
 	routeName       = "local_route"
 	virtualHostName = "backend"
+
+	// The max size of a direct response body if the route config does not
+	// set one.
+	defaultMaxDirectResponseBodySize = 4096
 )
 
 func makeRouteConfig(serviceInfo *configinfo.ServiceInfo) (*routepb.RouteConfiguration, error) {
@@ -48,6 +56,8 @@ func makeRouteConfig(serviceInfo *configinfo.ServiceInfo) (*routepb.RouteConfigu
 
 	// The router will use the first matched route, so the order of routes is important.
 	// Right now, the order of routes are:
+	// - the exported OpenAPI document, if --openapi_export_path is set
+	// - routes of the traffic split configs, only matching their requests
 	// - backend routes
 	// - cors routes
 	// - fallback `method not allowed` routes
@@ -59,7 +69,21 @@ func makeRouteConfig(serviceInfo *configinfo.ServiceInfo) (*routepb.RouteConfigu
 	if err != nil {
 		return nil, err
 	}
-	host.Routes = backendRoutes
+	trafficSplitRoutes, err := makeTrafficSplitRoutes(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	host.Routes = append(trafficSplitRoutes, backendRoutes...)
+
+	var maxDirectResponseBodySize int
+	if serviceInfo.Options.OpenAPIExportPath != "" {
+		openAPIRoute, err := makeOpenAPIExportRoute(serviceInfo)
+		if err != nil {
+			return nil, err
+		}
+		host.Routes = append([]*routepb.Route{openAPIRoute}, host.Routes...)
+		maxDirectResponseBodySize = len(openAPIRoute.GetDirectResponse().GetBody().GetInlineString())
+	}
 
 	cors, corsRoutes, err := makeRouteCors(serviceInfo)
 	if err != nil {
@@ -95,12 +119,64 @@ func makeRouteConfig(serviceInfo *configinfo.ServiceInfo) (*routepb.RouteConfigu
 	if err != nil {
 		return nil, err
 	}
-	return &routepb.RouteConfiguration{
+	routeConfig := &routepb.RouteConfiguration{
 		Name:                 routeName,
 		VirtualHosts:         virtualHosts,
 		RequestHeadersToAdd:  requestHeaders,
 		ResponseHeadersToAdd: responseHeaders,
-	}, nil
+	}
+	if maxDirectResponseBodySize > defaultMaxDirectResponseBodySize {
+		routeConfig.MaxDirectResponseBodySizeBytes = &wrapperspb.UInt32Value{
+			Value: uint32(maxDirectResponseBodySize),
+		}
+	}
+	return routeConfig, nil
+}
+
+// MakeRouteConfigs provides the route configs served over RDS.
+// This must be called after MakeListenersForServices, which adds the per-route
+// config generators to the methods.
+func MakeRouteConfigs(serviceInfos []*configinfo.ServiceInfo) ([]*routepb.RouteConfiguration, error) {
+	route, err := makeRouteConfigForServices(serviceInfos)
+	if err != nil {
+		return nil, err
+	}
+	if err := canonicalizeResource("route config", route.Name, route); err != nil {
+		return nil, err
+	}
+	if err := validateResource("route config", route.Name, route); err != nil {
+		return nil, err
+	}
+	return []*routepb.RouteConfiguration{route}, nil
+}
+
+// makeRouteConfigForServices combines the route configs of several services
+// into one. The first service keeps the default virtual host and catches all
+// unmatched domains, the others are matched by their service name.
+func makeRouteConfigForServices(serviceInfos []*configinfo.ServiceInfo) (*routepb.RouteConfiguration, error) {
+	var combined *routepb.RouteConfiguration
+	for i, serviceInfo := range serviceInfos {
+		route, err := makeRouteConfig(serviceInfo)
+		if err != nil {
+			return nil, fmt.Errorf("fail to make route config for service %s: %v", serviceInfo.Name, err)
+		}
+		if i == 0 {
+			combined = route
+			continue
+		}
+		if route.GetMaxDirectResponseBodySizeBytes().GetValue() > combined.GetMaxDirectResponseBodySizeBytes().GetValue() {
+			combined.MaxDirectResponseBodySizeBytes = route.MaxDirectResponseBodySizeBytes
+		}
+		for _, host := range route.VirtualHosts {
+			host.Name = fmt.Sprintf("%s_%s", virtualHostName, serviceInfo.Name)
+			host.Domains = []string{serviceInfo.Name, serviceInfo.Name + ":*"}
+			combined.VirtualHosts = append(combined.VirtualHosts, host)
+		}
+	}
+	if combined == nil {
+		return nil, fmt.Errorf("no service is provided to make route config")
+	}
+	return combined, nil
 }
 
 func makeHeaders(headers string, a bool) ([]*corepb.HeaderValueOption, error) {
@@ -316,6 +392,9 @@ func makePerRouteFilterConfig(operation string, method *configinfo.MethodInfo, h
 		if err != nil {
 			return perFilterConfig, err
 		}
+		if perRouteFilterConfig == nil {
+			continue
+		}
 
 		perFilterConfig[perRouteConfigGen.FilterName] = perRouteFilterConfig
 	}
@@ -356,61 +435,230 @@ func MakeRouteTable(serviceInfo *configinfo.ServiceInfo) ([]*routepb.Route, []*r
 		}
 
 		for _, routeMatcher := range routeMatchers {
-			bi := method.BackendInfo
 			useLocalHTTPBackend := !method.IsGRPCPath(routeMatcher.GetPath()) && !configinfo.IsDiscoveryAPI(method.Operation()) && method.HttpBackendInfo != nil
-			if useLocalHTTPBackend {
-				bi = method.HttpBackendInfo
+
+			// The routes of the alternate backends are more specific than the
+			// route of the method, so they go first.
+			if !useLocalHTTPBackend {
+				for _, alternate := range method.AlternateBackends {
+					alternateMethod := *method
+					alternateMethod.BackendInfo = alternate.BackendInfo
+					alternateMethod.WeightedBackends = nil
+					// Only the requests to the backend of the method are mirrored.
+					alternateMethod.MirrorBackend = nil
+					r, err := makeBackendRoute(serviceInfo, &alternateMethod, makeAlternateRouteMatcher(routeMatcher, alternate), httpRule, false)
+					if err != nil {
+						return nil, nil, fmt.Errorf("fail to make alternate backend route for operation (%v): %v", operation, err)
+					}
+					backendRoutes = append(backendRoutes, r)
+				}
 			}
-			r := makeRoute(routeMatcher, method, useLocalHTTPBackend)
 
-			r.TypedPerFilterConfig, err = makePerRouteFilterConfig(operation, method, httpRule)
+			r, err := makeBackendRoute(serviceInfo, method, routeMatcher, httpRule, useLocalHTTPBackend)
 			if err != nil {
-				return nil, nil, fmt.Errorf("fail to make per-route filter config for operation (%v): %v", operation, err)
+				return nil, nil, err
 			}
+			backendRoutes = append(backendRoutes, r)
+		}
+	}
 
-			if bi.Hostname != "" {
-				// For routing to remote backends.
-				r.GetRoute().HostRewriteSpecifier = &routepb.RouteAction_HostRewriteLiteral{
-					HostRewriteLiteral: bi.Hostname,
-				}
-			}
+	return backendRoutes, methodNotAllowedRoutes, nil
+}
 
-			if serviceInfo.Options.EnableHSTS {
-				r.ResponseHeadersToAdd = []*corepb.HeaderValueOption{
-					{
-						Header: &corepb.HeaderValue{
-							Key:   util.HSTSHeaderKey,
-							Value: util.HSTSHeaderValue,
-						},
+// makeBackendRoute makes the route of the route matcher to the backend of the
+// method, with its per-route filter configs.
+func makeBackendRoute(serviceInfo *configinfo.ServiceInfo, method *configinfo.MethodInfo, routeMatcher *routepb.RouteMatch, httpRule *httppattern.Pattern, useLocalHTTPBackend bool) (*routepb.Route, error) {
+	operation := method.Operation()
+	bi := method.BackendInfo
+	if useLocalHTTPBackend {
+		bi = method.HttpBackendInfo
+	}
+	r := makeRoute(routeMatcher, method, useLocalHTTPBackend)
+
+	var err error
+	r.TypedPerFilterConfig, err = makePerRouteFilterConfig(operation, method, httpRule)
+	if err != nil {
+		return nil, fmt.Errorf("fail to make per-route filter config for operation (%v): %v", operation, err)
+	}
+
+	if !useLocalHTTPBackend && len(method.WeightedBackends) > 0 {
+		if err := addWeightedClusters(r, method, httpRule); err != nil {
+			return nil, fmt.Errorf("fail to make weighted clusters for operation (%v): %v", operation, err)
+		}
+	} else if bi.Hostname != "" {
+		// For routing to remote backends.
+		r.GetRoute().HostRewriteSpecifier = &routepb.RouteAction_HostRewriteLiteral{
+			HostRewriteLiteral: bi.Hostname,
+		}
+	}
+	r.GetRoute().HashPolicy = makeHashPolicies(serviceInfo, r.GetRoute())
+
+	if serviceInfo.Options.EnableHSTS {
+		r.ResponseHeadersToAdd = []*corepb.HeaderValueOption{
+			{
+				Header: &corepb.HeaderValue{
+					Key:   util.HSTSHeaderKey,
+					Value: util.HSTSHeaderValue,
+				},
+			},
+		}
+	}
+
+	if serviceInfo.Options.EnableOperationNameHeader {
+		r.RequestHeadersToAdd = []*corepb.HeaderValueOption{
+			{
+				Header: &corepb.HeaderValue{
+					Key:   serviceInfo.Options.GeneratedHeaderPrefix + util.OperationHeaderSuffix,
+					Value: operation,
+				},
+				Append: &wrapperspb.BoolValue{
+					Value: false,
+				},
+			},
+		}
+	}
+
+	jsonStr, err := util.ProtoToJson(r)
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("adding route: %v", jsonStr)
+	return r, nil
+}
+
+// makeHashPolicies makes the hash policies of the ring hash and maglev
+// clusters of the route action, by the hash header of each cluster.
+func makeHashPolicies(serviceInfo *configinfo.ServiceInfo, action *routepb.RouteAction) []*routepb.RouteAction_HashPolicy {
+	clusterNames := []string{action.GetCluster()}
+	for _, c := range action.GetWeightedClusters().GetClusters() {
+		clusterNames = append(clusterNames, c.GetName())
+	}
+
+	var hashPolicies []*routepb.RouteAction_HashPolicy
+	seenHeaders := make(map[string]bool)
+	for _, clusterName := range clusterNames {
+		header := serviceInfo.BackendClusterHashHeader(clusterName)
+		if header == "" || seenHeaders[header] {
+			continue
+		}
+		seenHeaders[header] = true
+		hashPolicies = append(hashPolicies, &routepb.RouteAction_HashPolicy{
+			PolicySpecifier: &routepb.RouteAction_HashPolicy_Header_{
+				Header: &routepb.RouteAction_HashPolicy_Header{
+					HeaderName: header,
+				},
+			},
+		})
+	}
+	return hashPolicies
+}
+
+// makeAlternateRouteMatcher makes a copy of the route matcher which also
+// matches the headers and query parameters of the alternate backend. A match
+// without value only requires the header or query parameter to be present.
+func makeAlternateRouteMatcher(routeMatcher *routepb.RouteMatch, alternate *configinfo.AlternateBackendInfo) *routepb.RouteMatch {
+	m := proto.Clone(routeMatcher).(*routepb.RouteMatch)
+	for _, header := range alternate.Headers {
+		headerMatcher := &routepb.HeaderMatcher{
+			Name: header.Name,
+		}
+		if header.Value == "" {
+			headerMatcher.HeaderMatchSpecifier = &routepb.HeaderMatcher_PresentMatch{
+				PresentMatch: true,
+			}
+		} else {
+			headerMatcher.HeaderMatchSpecifier = &routepb.HeaderMatcher_StringMatch{
+				StringMatch: &matcher.StringMatcher{
+					MatchPattern: &matcher.StringMatcher_Exact{
+						Exact: header.Value,
 					},
-				}
+				},
 			}
-
-			if serviceInfo.Options.EnableOperationNameHeader {
-				r.RequestHeadersToAdd = []*corepb.HeaderValueOption{
-					{
-						Header: &corepb.HeaderValue{
-							Key:   serviceInfo.Options.GeneratedHeaderPrefix + util.OperationHeaderSuffix,
-							Value: operation,
-						},
-						Append: &wrapperspb.BoolValue{
-							Value: false,
-						},
+		}
+		m.Headers = append(m.Headers, headerMatcher)
+	}
+	for _, param := range alternate.QueryParameters {
+		paramMatcher := &routepb.QueryParameterMatcher{
+			Name: param.Name,
+		}
+		if param.Value == "" {
+			paramMatcher.QueryParameterMatchSpecifier = &routepb.QueryParameterMatcher_PresentMatch{
+				PresentMatch: true,
+			}
+		} else {
+			paramMatcher.QueryParameterMatchSpecifier = &routepb.QueryParameterMatcher_StringMatch{
+				StringMatch: &matcher.StringMatcher{
+					MatchPattern: &matcher.StringMatcher_Exact{
+						Exact: param.Value,
 					},
-				}
+				},
 			}
+		}
+		m.QueryParameters = append(m.QueryParameters, paramMatcher)
+	}
+	return m
+}
 
-			backendRoutes = append(backendRoutes, r)
+// The filters with per-route configs depending on the backend. For the
+// weighted clusters, they are set on each cluster instead of the route.
+var backendPerRouteConfigFilters = map[string]bool{
+	util.BackendAuth: true,
+	util.PathRewrite: true,
+}
 
-			jsonStr, err := util.ProtoToJson(r)
+// addWeightedClusters splits the traffic of route r across the weighted
+// backends of the method. Each cluster has the host rewrite and the backend
+// auth and path rewrite configs of its backend.
+func addWeightedClusters(r *routepb.Route, method *configinfo.MethodInfo, httpRule *httppattern.Pattern) error {
+	weightedClusters := &routepb.WeightedCluster{}
+	var totalWeight uint32
+	for _, backend := range method.WeightedBackends {
+		clusterWeight := &routepb.WeightedCluster_ClusterWeight{
+			Name: backend.BackendInfo.ClusterName,
+			Weight: &wrapperspb.UInt32Value{
+				Value: backend.Weight,
+			},
+		}
+		if backend.BackendInfo.Hostname != "" {
+			clusterWeight.HostRewriteSpecifier = &routepb.WeightedCluster_ClusterWeight_HostRewriteLiteral{
+				HostRewriteLiteral: backend.BackendInfo.Hostname,
+			}
+		}
+
+		backendMethod := *method
+		backendMethod.BackendInfo = backend.BackendInfo
+		for _, perRouteConfigGen := range method.PerRouteConfigGens {
+			if !backendPerRouteConfigFilters[perRouteConfigGen.FilterName] {
+				continue
+			}
+			perRouteFilterConfig, err := perRouteConfigGen.PerRouteConfigGenFunc(&backendMethod, httpRule)
 			if err != nil {
-				return nil, nil, err
+				return err
+			}
+			if perRouteFilterConfig == nil {
+				continue
+			}
+			if clusterWeight.TypedPerFilterConfig == nil {
+				clusterWeight.TypedPerFilterConfig = make(map[string]*anypb.Any)
 			}
-			glog.Infof("adding route: %v", jsonStr)
+			clusterWeight.TypedPerFilterConfig[perRouteConfigGen.FilterName] = perRouteFilterConfig
 		}
+
+		weightedClusters.Clusters = append(weightedClusters.Clusters, clusterWeight)
+		totalWeight += backend.Weight
+	}
+	weightedClusters.TotalWeight = &wrapperspb.UInt32Value{
+		Value: totalWeight,
 	}
 
-	return backendRoutes, methodNotAllowedRoutes, nil
+	// The route configs are for the backend of the backend rule.
+	for filterName := range backendPerRouteConfigFilters {
+		delete(r.TypedPerFilterConfig, filterName)
+	}
+	r.GetRoute().ClusterSpecifier = &routepb.RouteAction_WeightedClusters{
+		WeightedClusters: weightedClusters,
+	}
+	return nil
 }
 
 func makeRoute(routeMatcher *routepb.RouteMatch, method *configinfo.MethodInfo, useLocalHTTPBackend bool) *routepb.Route {
@@ -431,18 +679,39 @@ func makeRoute(routeMatcher *routepb.RouteMatch, method *configinfo.MethodInfo,
 		retryPolicy.PerTryTimeout = ptypes.DurationProto(bi.PerTryTimeout)
 	}
 
+	routeAction := &routepb.RouteAction{
+		ClusterSpecifier: &routepb.RouteAction_Cluster{
+			Cluster: bi.ClusterName,
+		},
+		Timeout:     ptypes.DurationProto(bi.Deadline),
+		IdleTimeout: ptypes.DurationProto(bi.IdleTimeout),
+		RetryPolicy: retryPolicy,
+	}
+
+	// The router copies the request after the other filters, so the copy does
+	// not call service control or backend auth again, but carries the token of
+	// backend auth and the host of the primary backend, suffixed by "-shadow".
+	// The mirror is rejected for backend auth unless its policy sets
+	// share_audience, and for another hostname than the primary backend.
+	if mb := method.MirrorBackend; mb != nil && !useLocalHTTPBackend {
+		routeAction.RequestMirrorPolicies = []*routepb.RouteAction_RequestMirrorPolicy{
+			{
+				Cluster: mb.ClusterName,
+				RuntimeFraction: &corepb.RuntimeFractionalPercent{
+					DefaultValue: &typepb.FractionalPercent{
+						Numerator:   uint32(math.Round(mb.Percent * 10000)),
+						Denominator: typepb.FractionalPercent_MILLION,
+					},
+				},
+			},
+		}
+	}
+
 	return &routepb.Route{
 		Name:  method.Operation(),
 		Match: routeMatcher,
 		Action: &routepb.Route_Route{
-			Route: &routepb.RouteAction{
-				ClusterSpecifier: &routepb.RouteAction_Cluster{
-					Cluster: bi.ClusterName,
-				},
-				Timeout:     ptypes.DurationProto(bi.Deadline),
-				IdleTimeout: ptypes.DurationProto(bi.IdleTimeout),
-				RetryPolicy: retryPolicy,
-			},
+			Route: routeAction,
 		},
 		Decorator: &routepb.Decorator{
 			// TODO(taoxuy@): check if the generated span name length less than the limit.
@@ -472,6 +741,83 @@ func makeMethodNotAllowedRoute(methodNotAllowedRouteMatcher *routepb.RouteMatch,
 		},
 	}
 }
+
+// makeOpenAPIExportRoute makes the route serving the OpenAPI document of the
+// service on GET requests to --openapi_export_path. It has no per-route
+// filter config, so no auth is required.
+func makeOpenAPIExportRoute(serviceInfo *configinfo.ServiceInfo) (*routepb.Route, error) {
+	if err := validateOpenAPIExportPath(serviceInfo); err != nil {
+		return nil, err
+	}
+	doc, err := openapi.FromServiceInfo(serviceInfo)
+	if err != nil {
+		return nil, fmt.Errorf("fail to export OpenAPI document: %v", err)
+	}
+
+	routeMatcher := makeHttpExactPathRouteMatcher(serviceInfo.Options.OpenAPIExportPath)
+	routeMatcher.Headers = []*routepb.HeaderMatcher{
+		{
+			Name: ":method",
+			HeaderMatchSpecifier: &routepb.HeaderMatcher_StringMatch{
+				StringMatch: &matcher.StringMatcher{
+					MatchPattern: &matcher.StringMatcher_Exact{
+						Exact: http.MethodGet,
+					},
+				},
+			},
+		},
+	}
+	return &routepb.Route{
+		Match: routeMatcher,
+		Action: &routepb.Route_DirectResponse{
+			DirectResponse: &routepb.DirectResponseAction{
+				Status: http.StatusOK,
+				Body: &corepb.DataSource{
+					Specifier: &corepb.DataSource_InlineString{
+						InlineString: string(doc),
+					},
+				},
+			},
+		},
+		ResponseHeadersToAdd: []*corepb.HeaderValueOption{
+			{
+				Header: &corepb.HeaderValue{
+					Key:   "content-type",
+					Value: "application/json",
+				},
+				Append: &wrapperspb.BoolValue{
+					Value: false,
+				},
+			},
+		},
+		Decorator: &routepb.Decorator{
+			Operation: fmt.Sprintf("%s OpenAPIDocument", util.SpanNamePrefix),
+		},
+	}, nil
+}
+
+// validateOpenAPIExportPath fails if the export path matches the uri template
+// of a method, whose requests would be answered by the export route instead.
+func validateOpenAPIExportPath(serviceInfo *configinfo.ServiceInfo) error {
+	exportPath := serviceInfo.Options.OpenAPIExportPath
+	for _, operation := range serviceInfo.Operations {
+		method := serviceInfo.Methods[operation]
+		for _, httpRule := range method.HttpRule {
+			if httpRule.UriTemplate == nil {
+				continue
+			}
+			re, err := regexp.Compile(httpRule.UriTemplate.Regex(serviceInfo.Options.DisallowColonInWildcardPathSegment))
+			if err != nil {
+				return fmt.Errorf("fail to compile uri template %s of operation %s, %v", httpRule.UriTemplate, operation, err)
+			}
+			if re.MatchString(exportPath) {
+				return fmt.Errorf("openapi export path %s conflicts with the uri template %s %s of operation %s", exportPath, httpRule.HttpMethod, httpRule.UriTemplate, operation)
+			}
+		}
+	}
+	return nil
+}
+
 func makeCatchAllNotFoundRoute() *routepb.Route {
 	return &routepb.Route{
 		Match: &routepb.RouteMatch{
@@ -16,6 +16,8 @@ package configgenerator
 
 import (
 	"fmt"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -27,9 +29,12 @@ import (
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 
+	bapb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v11/http/backend_auth"
 	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	corspb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/cors/v3"
 	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	typepb "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
 	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
@@ -4746,6 +4751,95 @@ func TestHeadersToAdd(t *testing.T) {
 	}
 }
 
+func TestMakeOpenAPIExportRoute(t *testing.T) {
+	testData := []struct {
+		desc               string
+		openAPIExportPath  string
+		methodCount        int
+		wantExportRoute    bool
+		wantMaxBodySizeSet bool
+		wantError          string
+	}{
+		{
+			desc:        "not exported by default",
+			methodCount: 1,
+		},
+		{
+			desc:              "small document within the default body size",
+			openAPIExportPath: "/openapi.json",
+			methodCount:       1,
+			wantExportRoute:   true,
+		},
+		{
+			desc:               "large document raises the max body size",
+			openAPIExportPath:  "/openapi.json",
+			methodCount:        50,
+			wantExportRoute:    true,
+			wantMaxBodySizeSet: true,
+		},
+		{
+			desc:              "export path shadows a method",
+			openAPIExportPath: "/v1/shelves0",
+			methodCount:       1,
+			wantError:         "openapi export path /v1/shelves0 conflicts with the uri template GET /v1/shelves0 of operation endpoints.examples.bookstore.Bookstore.ListShelves0",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			serviceConfig := &confpb.Service{
+				Name: "bookstore.endpoints.project123.cloud.goog",
+				Apis: []*apipb.Api{{Name: testApiName}},
+				Http: &annotationspb.Http{},
+			}
+			for i := 0; i < tc.methodCount; i++ {
+				name := fmt.Sprintf("ListShelves%d", i)
+				serviceConfig.Apis[0].Methods = append(serviceConfig.Apis[0].Methods, &apipb.Method{Name: name})
+				serviceConfig.Http.Rules = append(serviceConfig.Http.Rules, &annotationspb.HttpRule{
+					Selector: fmt.Sprintf("%s.%s", testApiName, name),
+					Pattern:  &annotationspb.HttpRule_Get{Get: fmt.Sprintf("/v1/shelves%d", i)},
+				})
+			}
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "http://127.0.0.1:8082"
+			opts.OpenAPIExportPath = tc.openAPIExportPath
+			serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(serviceConfig, "test-config-id", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotRouteConfig, err := makeRouteConfig(serviceInfo)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("want error: %v, got error: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			firstRoute := gotRouteConfig.VirtualHosts[0].Routes[0]
+			body := firstRoute.GetDirectResponse().GetBody().GetInlineString()
+			if gotExportRoute := firstRoute.GetMatch().GetPath() == tc.openAPIExportPath; gotExportRoute != tc.wantExportRoute {
+				t.Fatalf("got the export route first: %v, want: %v", gotExportRoute, tc.wantExportRoute)
+			}
+			if !tc.wantExportRoute {
+				return
+			}
+			if !strings.Contains(body, fmt.Sprintf(`"/v1/shelves%d"`, tc.methodCount-1)) {
+				t.Errorf("exported document does not have all the paths: %s", body)
+			}
+			wantMaxBodySize := uint32(0)
+			if tc.wantMaxBodySizeSet {
+				wantMaxBodySize = uint32(len(body))
+			}
+			if got := gotRouteConfig.GetMaxDirectResponseBodySizeBytes().GetValue(); got != wantMaxBodySize {
+				t.Errorf("got max direct response body size: %v, want: %v", got, wantMaxBodySize)
+			}
+		})
+	}
+}
+
 // Used to generate a oversize cors origin regex or a oversize uri template.
 func getOverSizeRegexForTest() string {
 	overSizeRegex := ""
@@ -4755,3 +4849,281 @@ func getOverSizeRegexForTest() string {
 	}
 	return overSizeRegex
 }
+
+func TestMakeRouteTableWithWeightedBackends(t *testing.T) {
+	policy := `
+rules:
+- selector: endpoints.examples.bookstore.Bookstore.ListShelves
+  weighted_backends:
+  - address: https://blue.example.com
+    weight: 90
+  - address: https://green.example.com/v2
+    weight: 10
+    disable_auth: true
+`
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "http://127.0.0.1:8082"
+	serviceInfo := makeServiceInfoWithBackendPolicy(t, opts, policy, "https://blue.example.com")
+
+	routes, _, err := MakeRouteTable(serviceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := routes[0]
+	if _, ok := route.GetTypedPerFilterConfig()[util.BackendAuth]; ok {
+		t.Errorf("got backend auth config on the route, want it on the clusters")
+	}
+	if got := route.GetRoute().GetTimeout().GetSeconds(); got != 10 {
+		t.Errorf("got route timeout %vs, want the deadline of the backend rule", got)
+	}
+
+	gotClusters := route.GetRoute().GetWeightedClusters()
+	if got := gotClusters.GetTotalWeight().GetValue(); got != 100 {
+		t.Errorf("got total weight %v, want 100", got)
+	}
+	testData := []struct {
+		desc            string
+		wantName        string
+		wantWeight      uint32
+		wantHostRewrite string
+		wantFilters     []string
+	}{
+		{
+			desc:            "backend auth with the audience of the address",
+			wantName:        "backend-cluster-blue.example.com:443",
+			wantWeight:      90,
+			wantHostRewrite: "blue.example.com",
+			wantFilters:     []string{util.BackendAuth},
+		},
+		{
+			desc:            "path rewrite without backend auth",
+			wantName:        "backend-cluster-green.example.com:443",
+			wantWeight:      10,
+			wantHostRewrite: "green.example.com",
+			wantFilters:     []string{util.PathRewrite},
+		},
+	}
+	if len(gotClusters.GetClusters()) != len(testData) {
+		t.Fatalf("got weighted clusters %v, want %d clusters", gotClusters, len(testData))
+	}
+	for i, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			got := gotClusters.GetClusters()[i]
+			if got.GetName() != tc.wantName || got.GetWeight().GetValue() != tc.wantWeight || got.GetHostRewriteLiteral() != tc.wantHostRewrite {
+				t.Errorf("got cluster %v, want name %s, weight %d, host rewrite %s", got, tc.wantName, tc.wantWeight, tc.wantHostRewrite)
+			}
+			var gotFilters []string
+			for name := range got.GetTypedPerFilterConfig() {
+				gotFilters = append(gotFilters, name)
+			}
+			if !reflect.DeepEqual(gotFilters, tc.wantFilters) {
+				t.Errorf("got per-filter configs of %v, want %v", gotFilters, tc.wantFilters)
+			}
+		})
+	}
+}
+
+func TestMakeRouteTableWithAlternateBackends(t *testing.T) {
+	policy := `
+rules:
+- selector: endpoints.examples.bookstore.Bookstore.ListShelves
+  alternate_backends:
+  - address: https://canary.example.com
+    headers:
+    - name: x-canary
+      value: "true"
+  - address: https://v2.example.com
+    query_parameters:
+    - name: api_version
+`
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "http://127.0.0.1:8082"
+	serviceInfo := makeServiceInfoWithBackendPolicy(t, opts, policy, "https://stable.example.com")
+
+	routes, _, err := MakeRouteTable(serviceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testData := []struct {
+		desc                string
+		wantHeaders         []*routepb.HeaderMatcher
+		wantQueryParameters []*routepb.QueryParameterMatcher
+		wantCluster         string
+		wantHostRewrite     string
+	}{
+		{
+			desc: "header match goes first",
+			wantHeaders: []*routepb.HeaderMatcher{
+				{
+					Name: "x-canary",
+					HeaderMatchSpecifier: &routepb.HeaderMatcher_StringMatch{
+						StringMatch: &matcher.StringMatcher{
+							MatchPattern: &matcher.StringMatcher_Exact{
+								Exact: "true",
+							},
+						},
+					},
+				},
+			},
+			wantCluster:     "backend-cluster-canary.example.com:443",
+			wantHostRewrite: "canary.example.com",
+		},
+		{
+			desc: "query parameter presence match",
+			wantQueryParameters: []*routepb.QueryParameterMatcher{
+				{
+					Name: "api_version",
+					QueryParameterMatchSpecifier: &routepb.QueryParameterMatcher_PresentMatch{
+						PresentMatch: true,
+					},
+				},
+			},
+			wantCluster:     "backend-cluster-v2.example.com:443",
+			wantHostRewrite: "v2.example.com",
+		},
+		{
+			desc:            "default route of the operation",
+			wantCluster:     "backend-cluster-stable.example.com:443",
+			wantHostRewrite: "stable.example.com",
+		},
+	}
+	if len(routes) != len(testData) {
+		t.Fatalf("got %d routes, want %d", len(routes), len(testData))
+	}
+	wantFilters := perFilterConfigNames(routes[len(routes)-1])
+	for i, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			got := routes[i]
+			// The first header matcher is the ":method" of the http rule.
+			gotHeaders := got.GetMatch().GetHeaders()[1:]
+			if len(gotHeaders) != len(tc.wantHeaders) {
+				t.Fatalf("got header matchers %v, want %v", gotHeaders, tc.wantHeaders)
+			}
+			for j, want := range tc.wantHeaders {
+				if !proto.Equal(gotHeaders[j], want) {
+					t.Errorf("got header matcher %v, want %v", gotHeaders[j], want)
+				}
+			}
+			gotQueryParameters := got.GetMatch().GetQueryParameters()
+			if len(gotQueryParameters) != len(tc.wantQueryParameters) {
+				t.Fatalf("got query parameter matchers %v, want %v", gotQueryParameters, tc.wantQueryParameters)
+			}
+			for j, want := range tc.wantQueryParameters {
+				if !proto.Equal(gotQueryParameters[j], want) {
+					t.Errorf("got query parameter matcher %v, want %v", gotQueryParameters[j], want)
+				}
+			}
+			if got.GetRoute().GetCluster() != tc.wantCluster || got.GetRoute().GetHostRewriteLiteral() != tc.wantHostRewrite {
+				t.Errorf("got route action %v, want cluster %s, host rewrite %s", got.GetRoute(), tc.wantCluster, tc.wantHostRewrite)
+			}
+			if gotFilters := perFilterConfigNames(got); !reflect.DeepEqual(gotFilters, wantFilters) {
+				t.Errorf("got per-filter configs of %v, want %v", gotFilters, wantFilters)
+			}
+		})
+	}
+}
+
+func perFilterConfigNames(r *routepb.Route) []string {
+	var names []string
+	for name := range r.GetTypedPerFilterConfig() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestMakeRouteTableWithHashPolicy(t *testing.T) {
+	policy := `
+clusters:
+- address: https://vms.example.com
+  hosts: [10.0.0.1, 10.0.0.2]
+  lb_policy: maglev
+  hash_header: x-user-id
+`
+	serviceInfo := makeServiceInfoWithBackendPolicy(t, options.DefaultConfigGeneratorOptions(), policy, "https://vms.example.com")
+
+	routes, _, err := MakeRouteTable(serviceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*routepb.RouteAction_HashPolicy{
+		{
+			PolicySpecifier: &routepb.RouteAction_HashPolicy_Header_{
+				Header: &routepb.RouteAction_HashPolicy_Header{
+					HeaderName: "x-user-id",
+				},
+			},
+		},
+	}
+	got := routes[0].GetRoute().GetHashPolicy()
+	if len(got) != len(want) || !proto.Equal(got[0], want[0]) {
+		t.Errorf("got hash policies %v, want %v", got, want)
+	}
+}
+
+func TestMakeRouteTableWithMirrorBackend(t *testing.T) {
+	policy := `
+rules:
+- selector: endpoints.examples.bookstore.Bookstore.ListShelves
+  alternate_backends:
+  - address: https://canary.example.com
+    headers:
+    - name: x-canary
+  mirror:
+    address: https://stable.example.com:8443
+    percent: 12.5
+    share_audience: true
+`
+	serviceInfo := makeServiceInfoWithBackendPolicy(t, options.DefaultConfigGeneratorOptions(), policy, "https://stable.example.com")
+
+	clusters, err := makeRemoteBackendClusters(serviceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotClusters []string
+	for _, c := range clusters {
+		gotClusters = append(gotClusters, c.GetName())
+	}
+	wantClusters := []string{"backend-cluster-canary.example.com:443", "backend-cluster-stable.example.com:443", "backend-cluster-stable.example.com:8443"}
+	if !reflect.DeepEqual(gotClusters, wantClusters) {
+		t.Errorf("got remote backend clusters %v, want %v", gotClusters, wantClusters)
+	}
+
+	routes, _, err := MakeRouteTable(serviceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 {
+		t.Fatalf("got %d routes, want 2", len(routes))
+	}
+	// The requests routed to the alternate backend are not mirrored.
+	if got := routes[0].GetRoute().GetRequestMirrorPolicies(); len(got) != 0 {
+		t.Errorf("got request mirror policies %v on the alternate backend route, want none", got)
+	}
+	routes = routes[1:]
+	want := []*routepb.RouteAction_RequestMirrorPolicy{
+		{
+			Cluster: "backend-cluster-stable.example.com:8443",
+			RuntimeFraction: &corepb.RuntimeFractionalPercent{
+				DefaultValue: &typepb.FractionalPercent{
+					Numerator:   125000,
+					Denominator: typepb.FractionalPercent_MILLION,
+				},
+			},
+		},
+	}
+	got := routes[0].GetRoute().GetRequestMirrorPolicies()
+	if len(got) != len(want) || !proto.Equal(got[0], want[0]) {
+		t.Errorf("got request mirror policies %v, want %v", got, want)
+	}
+
+	// The backend auth of the route is only for the primary backend.
+	backendAuth := &bapb.PerRouteFilterConfig{}
+	if err := ptypes.UnmarshalAny(routes[0].GetTypedPerFilterConfig()[util.BackendAuth], backendAuth); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := backendAuth.GetJwtAudience(), "https://stable.example.com"; got != want {
+		t.Errorf("got backend auth audience %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configgenerator/filterconfig"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/ptypes"
+
+	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	jwtpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/jwt_authn/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+)
+
+const (
+	// Requests are hashed into 256 buckets, i.e. a byte taken from the
+	// client IP or the hash header.
+	trafficSplitBucketCount = 256
+
+	forwardedForHeader = "x-forwarded-for"
+)
+
+// bucketRange is the range [lo, hi) of the buckets assigned to a config.
+type bucketRange struct {
+	lo, hi int
+}
+
+// makeTrafficSplitRoutes makes the routes of the traffic split configs of
+// serviceInfo. Each route only matches the requests in the buckets of its
+// config, the requests in the other buckets fall through to the routes of
+// serviceInfo.
+func makeTrafficSplitRoutes(serviceInfo *configinfo.ServiceInfo) ([]*routepb.Route, error) {
+	var routes []*routepb.Route
+	buckets := trafficSplitBuckets(serviceInfo.TrafficSplits)
+	for i, split := range serviceInfo.TrafficSplits {
+		configId := split.ServiceInfo.ConfigID
+		if buckets[i].lo == buckets[i].hi {
+			glog.Warningf("traffic percentage %v%% of config %s is too small to get any request", split.Percentage, configId)
+			continue
+		}
+
+		headerMatcher, err := makeTrafficSplitHeaderMatcher(serviceInfo.Options.TrafficSplitHashHeader, serviceInfo.Options.EnvoyXffNumTrustedHops, buckets[i])
+		if err != nil {
+			return nil, err
+		}
+
+		route, err := makeRouteConfig(split.ServiceInfo)
+		if err != nil {
+			return nil, fmt.Errorf("fail to make routes for config %s: %v", configId, err)
+		}
+		for _, host := range route.VirtualHosts {
+			for _, r := range host.Routes {
+				r.Match.Headers = append(r.Match.Headers, headerMatcher)
+				if err := renameJwtRequirement(r, configId); err != nil {
+					return nil, fmt.Errorf("fail to make routes for config %s: %v", configId, err)
+				}
+				routes = append(routes, r)
+			}
+		}
+		glog.Infof("config %s serves the requests in buckets [%d, %d) of %d", configId, buckets[i].lo, buckets[i].hi, trafficSplitBucketCount)
+	}
+	return routes, nil
+}
+
+// trafficSplitBuckets assigns consecutive bucket ranges to the splits
+// according to their traffic percentages.
+func trafficSplitBuckets(splits []*configinfo.TrafficSplit) []bucketRange {
+	var buckets []bucketRange
+	percentage := 0.
+	lo := 0
+	for _, split := range splits {
+		percentage += split.Percentage
+		hi := int(math.Round(percentage * trafficSplitBucketCount / 100))
+		if hi > trafficSplitBucketCount {
+			hi = trafficSplitBucketCount
+		}
+		buckets = append(buckets, bucketRange{lo: lo, hi: hi})
+		lo = hi
+	}
+	return buckets
+}
+
+// makeTrafficSplitHeaderMatcher matches the requests hashed into the given
+// buckets. With a hash header, the bucket is the value of its last two hex
+// digits. Otherwise it is the last byte of the client IP address, i.e. the
+// last octet of an IPv4 address or the last two hex digits of an IPv6
+// address. The client IP is the x-forwarded-for entry Envoy trusts, the
+// (xffNumTrustedHops+1)th from the right, as the entries before it are set by
+// the client.
+func makeTrafficSplitHeaderMatcher(hashHeader string, xffNumTrustedHops int, buckets bucketRange) (*routepb.HeaderMatcher, error) {
+	header := hashHeader
+	var regex string
+	if header != "" {
+		regex = fmt.Sprintf(`^.*(%s)$`, hexByteRangeRegex(buckets.lo, buckets.hi))
+	} else {
+		header = forwardedForHeader
+		regex = fmt.Sprintf(`^(.*,)? *(%s) *`, clientIPRangeRegex(buckets.lo, buckets.hi))
+		if xffNumTrustedHops > 0 {
+			regex += fmt.Sprintf(`(,[^,]*){%d}`, xffNumTrustedHops)
+		}
+		regex += `$`
+	}
+	if err := util.ValidateRegexProgramSize(regex, util.GoogleRE2MaxProgramSize); err != nil {
+		return nil, fmt.Errorf("invalid traffic split regex: %v", err)
+	}
+
+	return &routepb.HeaderMatcher{
+		Name: header,
+		HeaderMatchSpecifier: &routepb.HeaderMatcher_StringMatch{
+			StringMatch: &matcher.StringMatcher{
+				MatchPattern: &matcher.StringMatcher_SafeRegex{
+					SafeRegex: &matcher.RegexMatcher{
+						Regex: regex,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// clientIPRangeRegex matches the IPv4 and IPv6 addresses whose last byte is
+// in [lo, hi).
+func clientIPRangeRegex(lo, hi int) string {
+	// IPv4, also embedded in IPv6 like ::ffff:10.0.0.1.
+	alternatives := []string{
+		fmt.Sprintf(`([0-9a-fA-F:]*:)?[0-9]{1,3}\.[0-9]{1,3}\.[0-9]{1,3}\.(%s)`, decimalRangeRegex(lo, hi)),
+		// IPv6 with a last group of 2 to 4 hex digits.
+		fmt.Sprintf(`[0-9a-fA-F:]*:[0-9a-fA-F]{0,2}(%s)`, hexByteRangeRegex(lo, hi)),
+	}
+	// IPv6 with a last group of a single hex digit.
+	if lo < 16 {
+		last := hi - 1
+		if last > 15 {
+			last = 15
+		}
+		alternatives = append(alternatives, `[0-9a-fA-F:]*:`+hexDigitClass(lo, last))
+	}
+	// IPv6 ending with "::", whose last byte is 0.
+	if lo == 0 {
+		alternatives = append(alternatives, `[0-9a-fA-F:]*::`)
+	}
+	return strings.Join(alternatives, "|")
+}
+
+// hexByteRangeRegex matches the two digit hex numbers in [lo, hi), in any case.
+func hexByteRangeRegex(lo, hi int) string {
+	var alternatives []string
+	for high := lo >> 4; high <= (hi-1)>>4; high++ {
+		lowStart, lowEnd := 0, 15
+		if high == lo>>4 {
+			lowStart = lo & 0xf
+		}
+		if high == (hi-1)>>4 {
+			lowEnd = (hi - 1) & 0xf
+		}
+		alternatives = append(alternatives, hexDigitClass(high, high)+hexDigitClass(lowStart, lowEnd))
+	}
+	return strings.Join(alternatives, "|")
+}
+
+// hexDigitClass matches a hex digit in [lo, hi], in any case.
+func hexDigitClass(lo, hi int) string {
+	charRange := func(from, to byte) string {
+		if from == to {
+			return string(from)
+		}
+		return fmt.Sprintf("%c-%c", from, to)
+	}
+
+	class := ""
+	if lo <= 9 {
+		digitHi := hi
+		if digitHi > 9 {
+			digitHi = 9
+		}
+		class += charRange(byte('0'+lo), byte('0'+digitHi))
+	}
+	if hi >= 10 {
+		letterLo := lo - 10
+		if letterLo < 0 {
+			letterLo = 0
+		}
+		class += charRange(byte('a'+letterLo), byte('a'+hi-10)) + charRange(byte('A'+letterLo), byte('A'+hi-10))
+	}
+	return "[" + class + "]"
+}
+
+// decimalRangeRegex matches the decimal numbers in [lo, hi) without leading zeros.
+func decimalRangeRegex(lo, hi int) string {
+	var alternatives []string
+	for v := lo; v < hi; {
+		prefix := ""
+		if v >= 10 {
+			prefix = strconv.Itoa(v / 10)
+		}
+		// The numbers sharing the prefix, up to the last digit 9.
+		end := v - v%10 + 9
+		if end >= hi {
+			end = hi - 1
+		}
+		if v == end {
+			alternatives = append(alternatives, fmt.Sprintf("%s%d", prefix, v%10))
+		} else {
+			alternatives = append(alternatives, fmt.Sprintf("%s[%d-%d]", prefix, v%10, end%10))
+		}
+		v = end + 1
+	}
+	return strings.Join(alternatives, "|")
+}
+
+// renameJwtRequirement points the jwt per-route config of a traffic split
+// route to the requirement renamed for its config.
+func renameJwtRequirement(route *routepb.Route, configId string) error {
+	perRouteConfig, ok := route.TypedPerFilterConfig[util.JwtAuthn]
+	if !ok {
+		return nil
+	}
+	jwtPerRoute := &jwtpb.PerRouteConfig{}
+	if err := ptypes.UnmarshalAny(perRouteConfig, jwtPerRoute); err != nil {
+		return err
+	}
+	name, ok := jwtPerRoute.RequirementSpecifier.(*jwtpb.PerRouteConfig_RequirementName)
+	if !ok {
+		return nil
+	}
+	name.RequirementName = filterconfig.TrafficSplitRequirementName(name.RequirementName, configId)
+
+	renamed, err := ptypes.MarshalAny(jwtPerRoute)
+	if err != nil {
+		return err
+	}
+	route.TypedPerFilterConfig[util.JwtAuthn] = renamed
+	return nil
+}
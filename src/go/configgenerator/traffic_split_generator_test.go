@@ -0,0 +1,146 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+)
+
+func TestTrafficSplitBuckets(t *testing.T) {
+	testData := []struct {
+		desc        string
+		percentages []float64
+		wantBuckets []bucketRange
+	}{
+		{
+			desc:        "one split",
+			percentages: []float64{25},
+			wantBuckets: []bucketRange{{lo: 0, hi: 64}},
+		},
+		{
+			desc:        "splits are consecutive",
+			percentages: []float64{10, 30},
+			wantBuckets: []bucketRange{{lo: 0, hi: 26}, {lo: 26, hi: 102}},
+		},
+		{
+			desc:        "split too small to get a bucket",
+			percentages: []float64{0.1, 50},
+			wantBuckets: []bucketRange{{lo: 0, hi: 0}, {lo: 0, hi: 128}},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			var splits []*configinfo.TrafficSplit
+			for _, percentage := range tc.percentages {
+				splits = append(splits, &configinfo.TrafficSplit{Percentage: percentage})
+			}
+			if got := trafficSplitBuckets(splits); !reflect.DeepEqual(got, tc.wantBuckets) {
+				t.Errorf("trafficSplitBuckets got: %v, want: %v", got, tc.wantBuckets)
+			}
+		})
+	}
+}
+
+func TestMakeTrafficSplitHeaderMatcher(t *testing.T) {
+	testData := []struct {
+		desc              string
+		hashHeader        string
+		xffNumTrustedHops int
+		wantHeader        string
+		// Formats the header value hashed into the bucket.
+		formatValue func(bucket int) string
+		noMatch     []string
+	}{
+		{
+			desc:        "client IPv4",
+			wantHeader:  "x-forwarded-for",
+			formatValue: func(bucket int) string { return fmt.Sprintf("10.0.1.%d", bucket) },
+			noMatch:     []string{"", "10.0.1.007", "10.0.1.1000"},
+		},
+		{
+			desc:              "client IPv4 before the trusted hops",
+			xffNumTrustedHops: 2,
+			wantHeader:        "x-forwarded-for",
+			formatValue:       func(bucket int) string { return fmt.Sprintf("spoofed, 10.0.1.%d, 35.1.1.1, 130.211.0.1", bucket) },
+			// Requests with fewer entries than the trusted hops.
+			noMatch: []string{"", "35.1.1.1, 130.211.0.1"},
+		},
+		{
+			desc:        "client IPv4 embedded in IPv6",
+			wantHeader:  "x-forwarded-for",
+			formatValue: func(bucket int) string { return fmt.Sprintf("::ffff:10.0.1.%d", bucket) },
+		},
+		{
+			desc:              "client IPv6",
+			xffNumTrustedHops: 1,
+			wantHeader:        "x-forwarded-for",
+			formatValue:       func(bucket int) string { return fmt.Sprintf("2001:db8::1a%02x, 2001:db8::ffff", bucket) },
+			noMatch:           []string{"2001:db8::1a01", "2001:db8::1a0g, 2001:db8::ffff"},
+		},
+		{
+			desc:              "client IPv6 with a short last group",
+			xffNumTrustedHops: 1,
+			wantHeader:        "x-forwarded-for",
+			formatValue:       func(bucket int) string { return fmt.Sprintf("2001:db8::%x, 10.0.0.1", bucket) },
+		},
+		{
+			desc:        "hash header, lower case",
+			hashHeader:  "x-session-hash",
+			wantHeader:  "x-session-hash",
+			formatValue: func(bucket int) string { return fmt.Sprintf("5f3c1a%02x", bucket) },
+			noMatch:     []string{"", "a", "5f3c1azz"},
+		},
+		{
+			desc:        "hash header, upper case",
+			hashHeader:  "x-session-hash",
+			wantHeader:  "x-session-hash",
+			formatValue: func(bucket int) string { return fmt.Sprintf("%02X", bucket) },
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			for _, buckets := range []bucketRange{{lo: 0, hi: 1}, {lo: 0, hi: 64}, {lo: 7, hi: 183}, {lo: 100, hi: 256}, {lo: 0, hi: 256}} {
+				headerMatcher, err := makeTrafficSplitHeaderMatcher(tc.hashHeader, tc.xffNumTrustedHops, buckets)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if headerMatcher.GetName() != tc.wantHeader {
+					t.Errorf("got header: %s, want: %s", headerMatcher.GetName(), tc.wantHeader)
+				}
+				re := regexp.MustCompile(headerMatcher.GetStringMatch().GetSafeRegex().GetRegex())
+
+				for bucket := 0; bucket < trafficSplitBucketCount; bucket++ {
+					value := tc.formatValue(bucket)
+					wantMatch := bucket >= buckets.lo && bucket < buckets.hi
+					if re.MatchString(value) != wantMatch {
+						t.Errorf("buckets %v, regex %s: header value %q want match: %v", buckets, re, value, wantMatch)
+					}
+				}
+				for _, value := range tc.noMatch {
+					if re.MatchString(value) {
+						t.Errorf("buckets %v, regex %s: header value %q should not match", buckets, re, value)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+
+	anypb "github.com/golang/protobuf/ptypes/any"
+)
+
+// validator is implemented by the messages generated with protoc-gen-validate.
+type validator interface {
+	Validate() error
+}
+
+// validateResource runs the validate.rules of a resource, so that an invalid
+// config fails the generation instead of being NACKed by Envoy. Validate does
+// not look into google.protobuf.Any, so the typed configs of the filters and
+// the per-route configs are unpacked and validated too. The error has the
+// path to the invalid message, such as
+// filter_chains[0].filters[0].typed_config<HttpConnectionManager>.http_filters[2].typed_config<FilterConfig>.
+func validateResource(kind, name string, resource proto.Message) error {
+	if err := validateMessage(proto.MessageReflect(resource), ""); err != nil {
+		return fmt.Errorf("invalid %s %q: %v", kind, name, err)
+	}
+	return nil
+}
+
+func validateMessage(m protoreflect.Message, path string) error {
+	if v, ok := m.Interface().(validator); ok {
+		if err := v.Validate(); err != nil {
+			if path == "" {
+				return err
+			}
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return walkAnyFields(m, path, validateAny)
+}
+
+// validateAny validates the message packed in an Any, the nested messages of
+// other types are already validated by the Validate of their parent.
+func validateAny(any *anypb.Any, path string) error {
+	packed, err := any.UnmarshalNew()
+	if errors.Is(err, protoregistry.NotFound) {
+		// Not linked into the binary, so not generated here either.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: fail to unmarshal %s: %v", path, any.GetTypeUrl(), err)
+	}
+	return validateMessage(packed.ProtoReflect(), fmt.Sprintf("%s<%s>", path, packed.ProtoReflect().Descriptor().Name()))
+}
+
+// walkAnyFields calls visit for the Any fields of m and of its nested
+// messages, with their paths from m. The packed messages are not walked.
+func walkAnyFields(m protoreflect.Message, path string, visit func(any *anypb.Any, path string) error) error {
+	walkNested := func(nested protoreflect.Message, path string) error {
+		if any, ok := nested.Interface().(*anypb.Any); ok {
+			return visit(any, path)
+		}
+		return walkAnyFields(nested, path, visit)
+	}
+
+	var err error
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		fieldPath := string(fd.Name())
+		if path != "" {
+			fieldPath = path + "." + fieldPath
+		}
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Message() == nil {
+				return true
+			}
+			// Sorted so that the same error is reported for the same config.
+			var keys []protoreflect.MapKey
+			v.Map().Range(func(key protoreflect.MapKey, _ protoreflect.Value) bool {
+				keys = append(keys, key)
+				return true
+			})
+			sort.Slice(keys, func(i, j int) bool {
+				return keys[i].String() < keys[j].String()
+			})
+			for _, key := range keys {
+				if err = walkNested(v.Map().Get(key).Message(), fmt.Sprintf("%s[%q]", fieldPath, key.String())); err != nil {
+					return false
+				}
+			}
+		case fd.Message() == nil:
+		case fd.IsList():
+			for i := 0; i < v.List().Len(); i++ {
+				if err = walkNested(v.List().Get(i).Message(), fmt.Sprintf("%s[%d]", fieldPath, i)); err != nil {
+					return false
+				}
+			}
+		default:
+			err = walkNested(v.Message(), fieldPath)
+		}
+		return err == nil
+	})
+	return err
+}
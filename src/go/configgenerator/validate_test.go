@@ -0,0 +1,199 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configgenerator
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	clusterpb "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	listenerpb "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	anypb "github.com/golang/protobuf/ptypes/any"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestValidateResource(t *testing.T) {
+	makeListener := func(httpFilter *hcmpb.HttpFilter) *listenerpb.Listener {
+		hcm, err := ptypes.MarshalAny(&hcmpb.HttpConnectionManager{
+			StatPrefix: "ingress_http",
+			RouteSpecifier: &hcmpb.HttpConnectionManager_RouteConfig{
+				RouteConfig: &routepb.RouteConfiguration{},
+			},
+			HttpFilters: []*hcmpb.HttpFilter{httpFilter},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &listenerpb.Listener{
+			Name: "ingress_listener",
+			FilterChains: []*listenerpb.FilterChain{
+				{
+					Filters: []*listenerpb.Filter{
+						{
+							Name: "envoy.filters.network.http_connection_manager",
+							ConfigType: &listenerpb.Filter_TypedConfig{
+								TypedConfig: hcm,
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	testData := []struct {
+		desc      string
+		kind      string
+		resource  proto.Message
+		wantError string
+	}{
+		{
+			desc: "valid cluster",
+			kind: "cluster",
+			resource: &clusterpb.Cluster{
+				Name: "backend-cluster-127.0.0.1:8082",
+				ClusterDiscoveryType: &clusterpb.Cluster_Type{
+					Type: clusterpb.Cluster_STATIC,
+				},
+			},
+		},
+		{
+			desc:      "cluster without name",
+			kind:      "cluster",
+			resource:  &clusterpb.Cluster{},
+			wantError: `invalid cluster "": invalid Cluster.Name: value length must be at least 1 runes`,
+		},
+		{
+			desc: "valid listener",
+			kind: "listener",
+			resource: makeListener(&hcmpb.HttpFilter{
+				Name: "envoy.filters.http.router",
+			}),
+		},
+		{
+			desc: "invalid http filter in the typed config of the listener",
+			kind: "listener",
+			resource: makeListener(&hcmpb.HttpFilter{
+				Name: "",
+			}),
+			wantError: `invalid listener "ingress_listener": filter_chains[0].filters[0].typed_config<HttpConnectionManager>: invalid HttpConnectionManager.HttpFilters[0]`,
+		},
+		{
+			desc: "typed config of an unknown type is not validated",
+			kind: "listener",
+			resource: &listenerpb.Listener{
+				Name: "ingress_listener",
+				FilterChains: []*listenerpb.FilterChain{
+					{
+						Filters: []*listenerpb.Filter{
+							{
+								Name: "custom",
+								ConfigType: &listenerpb.Filter_TypedConfig{
+									TypedConfig: &anypb.Any{
+										TypeUrl: "type.googleapis.com/custom.FilterConfig",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			var name string
+			switch r := tc.resource.(type) {
+			case *clusterpb.Cluster:
+				name = r.Name
+			case *listenerpb.Listener:
+				name = r.Name
+			}
+			err := validateResource(tc.kind, name, tc.resource)
+			if tc.wantError == "" {
+				if err != nil {
+					t.Fatalf("want no error, got error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("want error: %v, got error: %v", tc.wantError, err)
+			}
+		})
+	}
+}
+
+func TestMakeListenersValidatesFilterConfigs(t *testing.T) {
+	serviceConfig := &confpb.Service{
+		Name:              testProjectName,
+		ProducerProjectId: "project123",
+		Apis: []*apipb.Api{
+			{
+				Name:    testApiName,
+				Methods: []*apipb.Method{{Name: "ListShelves"}},
+			},
+		},
+		Control: &confpb.Control{
+			Environment: testServiceControlEnv,
+		},
+	}
+	makeListeners := func(logRequestHeaders string) ([]*listenerpb.Listener, error) {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.DisableTracing = true
+		opts.LogRequestHeaders = logRequestHeaders
+		serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(serviceConfig, testConfigID, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return MakeListeners(serviceInfo)
+	}
+
+	// The index of the service control filter, in the listener of valid
+	// headers.
+	listeners, err := makeListeners("x-request-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hcm := &hcmpb.HttpConnectionManager{}
+	if err := ptypes.UnmarshalAny(listeners[0].GetFilterChains()[0].GetFilters()[0].GetTypedConfig(), hcm); err != nil {
+		t.Fatal(err)
+	}
+	scIndex := -1
+	for i, filter := range hcm.GetHttpFilters() {
+		if filter.GetName() == util.ServiceControl {
+			scIndex = i
+		}
+	}
+	if scIndex < 0 {
+		t.Fatalf("got no service control filter in http filters %v", hcm.GetHttpFilters())
+	}
+
+	_, err = makeListeners("x-request-id,bad header")
+	wantError := fmt.Sprintf(`invalid listener %q: filter_chains[0].filters[0].typed_config<HttpConnectionManager>.http_filters[%d].typed_config<FilterConfig>: invalid FilterConfig.Services[0]: embedded message failed validation | caused by: invalid Service.LogRequestHeaders[1]`, util.IngressListenerName, scIndex)
+	if err == nil || !strings.Contains(err.Error(), wantError) {
+		t.Errorf("want error: %v, got error: %v", wantError, err)
+	}
+}
@@ -0,0 +1,489 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configinfo
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/glog"
+)
+
+const (
+	healthCheckTypeHTTP = "http"
+	healthCheckTypeGrpc = "grpc"
+	healthCheckTypeNone = "none"
+
+	defaultHealthCheckThreshold = 3
+
+	dnsDiscoveryLogical = "logical"
+	dnsDiscoveryStrict  = "strict"
+)
+
+// The load balancing policies of the backend clusters.
+const (
+	LbPolicyRoundRobin   = "round_robin"
+	LbPolicyLeastRequest = "least_request"
+	LbPolicyRingHash     = "ring_hash"
+	LbPolicyMaglev       = "maglev"
+)
+
+// BackendClusterPolicy overrides the health check and the outlier detection
+// of the flags for the backend clusters of an address, and sets their
+// endpoints and load balancing.
+type BackendClusterPolicy struct {
+	Address          string                  `json:"address"`
+	HealthCheck      *HealthCheckPolicy      `json:"health_check,omitempty"`
+	OutlierDetection *OutlierDetectionPolicy `json:"outlier_detection,omitempty"`
+
+	// The endpoints instead of the host of the address, either hosts or
+	// localities. Each host is "host" or "host:port", with the port of the
+	// address by default. The host of the address is still used for TLS and
+	// the health checks.
+	Hosts      []string          `json:"hosts,omitempty"`
+	Localities []*LocalityPolicy `json:"localities,omitempty"`
+	// "logical" or "strict", "strict" resolves all the addresses of each
+	// host. "logical" by default, unless there are several hosts.
+	DnsDiscovery string `json:"dns_discovery,omitempty"`
+	// "round_robin", "least_request", "ring_hash" or "maglev". The ring hash
+	// and maglev policies require the header to hash the requests by.
+	LbPolicy   string `json:"lb_policy,omitempty"`
+	HashHeader string `json:"hash_header,omitempty"`
+}
+
+// LocalityPolicy is a group of hosts in a zone. If set, the weights of the
+// localities split the traffic across them.
+type LocalityPolicy struct {
+	Region string   `json:"region,omitempty"`
+	Zone   string   `json:"zone,omitempty"`
+	Weight uint32   `json:"weight,omitempty"`
+	Hosts  []string `json:"hosts"`
+}
+
+// HealthCheckPolicy is the active health check of a backend cluster, the
+// fields left empty keep the values of the flags.
+type HealthCheckPolicy struct {
+	// One of "http", "grpc" or "none" to disable the health check.
+	Type        string `json:"type,omitempty"`
+	Path        string `json:"path,omitempty"`
+	GrpcService string `json:"grpc_service,omitempty"`
+	// Durations such as "5s".
+	Interval           string `json:"interval,omitempty"`
+	Timeout            string `json:"timeout,omitempty"`
+	HealthyThreshold   uint32 `json:"healthy_threshold,omitempty"`
+	UnhealthyThreshold uint32 `json:"unhealthy_threshold,omitempty"`
+}
+
+// OutlierDetectionPolicy is the outlier detection of a backend cluster, the
+// fields left empty keep the values of the flags.
+type OutlierDetectionPolicy struct {
+	// 0 disables the ejection on consecutive 5xx.
+	Consecutive5xx           *uint32 `json:"consecutive_5xx,omitempty"`
+	SuccessRate              *bool   `json:"success_rate,omitempty"`
+	SuccessRateMinimumHosts  uint32  `json:"success_rate_minimum_hosts,omitempty"`
+	SuccessRateRequestVolume uint32  `json:"success_rate_request_volume,omitempty"`
+	MaxEjectionPercent       uint32  `json:"max_ejection_percent,omitempty"`
+	BaseEjectionTime         string  `json:"base_ejection_time,omitempty"`
+}
+
+// BackendHealthCheck is the active health check of a backend cluster.
+type BackendHealthCheck struct {
+	// The gRPC Health service is checked if true, else the HTTP path.
+	Grpc        bool
+	GrpcService string
+	Path        string
+
+	Interval time.Duration
+	Timeout  time.Duration
+	// Zero for the default of Envoy.
+	NoTrafficInterval  time.Duration
+	HealthyThreshold   uint32
+	UnhealthyThreshold uint32
+}
+
+// BackendOutlierDetection ejects the failing hosts of a backend cluster.
+type BackendOutlierDetection struct {
+	// Zero disables the ejection on consecutive 5xx.
+	Consecutive5xx uint32
+	SuccessRate    bool
+	// Zero for the defaults of Envoy.
+	SuccessRateMinimumHosts  uint32
+	SuccessRateRequestVolume uint32
+	MaxEjectionPercent       uint32
+	BaseEjectionTime         time.Duration
+}
+
+func (s *ServiceInfo) processBackendClusterPolicies(policies []*BackendClusterPolicy) error {
+	clusters := s.backendRoutingClusters()
+	for _, c := range clusters {
+		c.HealthCheck = s.defaultBackendHealthCheck(c)
+		c.OutlierDetection = s.defaultBackendOutlierDetection()
+	}
+
+	for _, policy := range policies {
+		_, hostname, port, _, err := util.ParseURI(policy.Address)
+		if err != nil {
+			return fmt.Errorf("error parsing address of backend cluster policy %s, %v", policy.Address, err)
+		}
+
+		matched := false
+		for _, c := range clusters {
+			if c.Hostname != hostname || c.Port != port {
+				continue
+			}
+			matched = true
+			if err := applyEndpointPolicy(c, policy); err != nil {
+				return fmt.Errorf("invalid endpoints of backend cluster policy %s, %v", policy.Address, err)
+			}
+			if err := applyLbPolicy(c, policy); err != nil {
+				return fmt.Errorf("invalid load balancing of backend cluster policy %s, %v", policy.Address, err)
+			}
+			if policy.HealthCheck != nil {
+				if c.HealthCheck, err = s.applyHealthCheckPolicy(c.HealthCheck, policy.HealthCheck); err != nil {
+					return fmt.Errorf("invalid health check of backend cluster policy %s, %v", policy.Address, err)
+				}
+			}
+			if policy.OutlierDetection != nil {
+				if c.OutlierDetection, err = s.applyOutlierDetectionPolicy(c.OutlierDetection, policy.OutlierDetection); err != nil {
+					return fmt.Errorf("invalid outlier detection of backend cluster policy %s, %v", policy.Address, err)
+				}
+			}
+		}
+		if !matched {
+			// The policies may be shared by the services of a Config Manager.
+			glog.Warningf("Skip backend cluster policy %q because no backend cluster of service %s has the address.", policy.Address, s.Name)
+		}
+	}
+	return nil
+}
+
+// backendRoutingClusters returns the local and remote backend clusters.
+func (s *ServiceInfo) backendRoutingClusters() []*BackendRoutingCluster {
+	var clusters []*BackendRoutingCluster
+	if s.LocalBackendCluster != nil {
+		clusters = append(clusters, s.LocalBackendCluster)
+	}
+	if s.LocalHTTPBackendCluster != nil {
+		clusters = append(clusters, s.LocalHTTPBackendCluster)
+	}
+	return append(clusters, s.RemoteBackendClusters...)
+}
+
+// BackendClusterHashHeader returns the header hashing the requests to the
+// backend cluster, empty unless the cluster is ring hash or maglev.
+func (s *ServiceInfo) BackendClusterHashHeader(clusterName string) string {
+	for _, c := range s.backendRoutingClusters() {
+		if c.ClusterName == clusterName {
+			return c.HashHeader
+		}
+	}
+	return ""
+}
+
+// RenameBackendCluster renames the backend cluster and points the backends of
+// the methods to the new name. It returns false if the service has no backend
+// cluster of the name.
+func (s *ServiceInfo) RenameBackendCluster(oldName, newName string) bool {
+	found := false
+	for _, c := range s.backendRoutingClusters() {
+		if c.ClusterName == oldName {
+			c.ClusterName = newName
+			found = true
+		}
+	}
+	if !found {
+		return false
+	}
+
+	for _, method := range s.Methods {
+		backends := append([]*backendInfo{method.BackendInfo, method.HttpBackendInfo}, method.PolicyBackendInfos()...)
+		for _, backend := range backends {
+			if backend != nil && backend.ClusterName == oldName {
+				backend.ClusterName = newName
+			}
+		}
+		if method.MirrorBackend != nil && method.MirrorBackend.ClusterName == oldName {
+			method.MirrorBackend.ClusterName = newName
+		}
+	}
+	return true
+}
+
+func applyEndpointPolicy(c *BackendRoutingCluster, policy *BackendClusterPolicy) error {
+	if len(policy.Hosts) > 0 && len(policy.Localities) > 0 {
+		return fmt.Errorf("hosts and localities are exclusive")
+	}
+
+	var localities []*util.LoadAssignmentLocality
+	if len(policy.Hosts) > 0 {
+		endpoints, err := parseEndpointHosts(policy.Hosts, c.Port)
+		if err != nil {
+			return err
+		}
+		localities = append(localities, &util.LoadAssignmentLocality{
+			Endpoints: endpoints,
+		})
+	}
+	for i, locality := range policy.Localities {
+		if len(locality.Hosts) == 0 {
+			return fmt.Errorf("locality %d must have hosts", i)
+		}
+		// Envoy sends no traffic to the localities without weight.
+		if (locality.Weight > 0) != (policy.Localities[0].Weight > 0) {
+			return fmt.Errorf("either all or none of the localities must have a weight")
+		}
+		endpoints, err := parseEndpointHosts(locality.Hosts, c.Port)
+		if err != nil {
+			return fmt.Errorf("locality %d: %v", i, err)
+		}
+		localities = append(localities, &util.LoadAssignmentLocality{
+			Region:    locality.Region,
+			Zone:      locality.Zone,
+			Weight:    locality.Weight,
+			Endpoints: endpoints,
+		})
+	}
+
+	endpointCount := 1
+	if len(localities) > 0 {
+		endpointCount = 0
+		for _, locality := range localities {
+			endpointCount += len(locality.Endpoints)
+		}
+	}
+	switch policy.DnsDiscovery {
+	case "":
+		c.StrictDNS = endpointCount > 1
+	case dnsDiscoveryLogical:
+		if endpointCount > 1 {
+			return fmt.Errorf("%s dns discovery requires a single host, got %d", dnsDiscoveryLogical, endpointCount)
+		}
+		c.StrictDNS = false
+	case dnsDiscoveryStrict:
+		c.StrictDNS = true
+	default:
+		return fmt.Errorf("dns_discovery must be %s or %s, got %q", dnsDiscoveryLogical, dnsDiscoveryStrict, policy.DnsDiscovery)
+	}
+	if len(localities) > 0 {
+		c.Localities = localities
+	}
+	return nil
+}
+
+// parseEndpointHosts parses the hosts of a cluster policy, "host" or
+// "host:port" with the port of the address by default.
+func parseEndpointHosts(hosts []string, defaultPort uint32) ([]*util.LoadAssignmentEndpoint, error) {
+	var endpoints []*util.LoadAssignmentEndpoint
+	for _, host := range hosts {
+		endpoint := &util.LoadAssignmentEndpoint{
+			Hostname: host,
+			Port:     defaultPort,
+		}
+		if hostname, port, err := net.SplitHostPort(host); err == nil {
+			p, err := strconv.ParseUint(port, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port of host %s, %v", host, err)
+			}
+			endpoint.Hostname = hostname
+			endpoint.Port = uint32(p)
+		}
+		if endpoint.Hostname == "" {
+			return nil, fmt.Errorf("invalid host %q", host)
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+func applyLbPolicy(c *BackendRoutingCluster, policy *BackendClusterPolicy) error {
+	switch policy.LbPolicy {
+	case "":
+	case LbPolicyRoundRobin, LbPolicyLeastRequest, LbPolicyRingHash, LbPolicyMaglev:
+		c.LbPolicy = policy.LbPolicy
+	default:
+		return fmt.Errorf("lb_policy must be %s, %s, %s or %s, got %q", LbPolicyRoundRobin, LbPolicyLeastRequest, LbPolicyRingHash, LbPolicyMaglev, policy.LbPolicy)
+	}
+
+	hashing := c.LbPolicy == LbPolicyRingHash || c.LbPolicy == LbPolicyMaglev
+	if hashing && policy.HashHeader == "" {
+		return fmt.Errorf("%s requires a hash_header", c.LbPolicy)
+	}
+	if !hashing && policy.HashHeader != "" {
+		return fmt.Errorf("hash_header requires %s or %s", LbPolicyRingHash, LbPolicyMaglev)
+	}
+	c.HashHeader = policy.HashHeader
+	return nil
+}
+
+func (s *ServiceInfo) newBackendHealthCheck() *BackendHealthCheck {
+	return &BackendHealthCheck{
+		Interval:           s.Options.BackendHealthCheckInterval,
+		Timeout:            s.Options.BackendHealthCheckTimeout,
+		HealthyThreshold:   defaultHealthCheckThreshold,
+		UnhealthyThreshold: defaultHealthCheckThreshold,
+	}
+}
+
+func (s *ServiceInfo) defaultBackendHealthCheck(c *BackendRoutingCluster) *BackendHealthCheck {
+	if c == s.LocalBackendCluster && s.Options.HealthCheckGrpcBackend {
+		// The timeout of --health_check_grpc_backend is its interval.
+		return &BackendHealthCheck{
+			Grpc:               true,
+			GrpcService:        s.Options.HealthCheckGrpcBackendService,
+			Interval:           s.Options.HealthCheckGrpcBackendInterval,
+			Timeout:            s.Options.HealthCheckGrpcBackendInterval,
+			NoTrafficInterval:  s.Options.HealthCheckGrpcBackendNoTrafficInterval,
+			HealthyThreshold:   defaultHealthCheckThreshold,
+			UnhealthyThreshold: defaultHealthCheckThreshold,
+		}
+	}
+
+	if c.Protocol == util.GRPC {
+		if !s.Options.BackendHealthCheckGrpc {
+			return nil
+		}
+		hc := s.newBackendHealthCheck()
+		hc.Grpc = true
+		hc.GrpcService = s.Options.HealthCheckGrpcBackendService
+		return hc
+	}
+	if s.Options.BackendHealthCheckHTTPPath == "" {
+		return nil
+	}
+	hc := s.newBackendHealthCheck()
+	hc.Path = s.Options.BackendHealthCheckHTTPPath
+	return hc
+}
+
+func (s *ServiceInfo) applyHealthCheckPolicy(hc *BackendHealthCheck, policy *HealthCheckPolicy) (*BackendHealthCheck, error) {
+	if policy.Type == healthCheckTypeNone {
+		return nil, nil
+	}
+	if hc == nil {
+		if policy.Type == "" {
+			return nil, fmt.Errorf("type must be set without the health check flags")
+		}
+		hc = s.newBackendHealthCheck()
+	}
+
+	switch policy.Type {
+	case "":
+	case healthCheckTypeHTTP:
+		hc.Grpc = false
+	case healthCheckTypeGrpc:
+		hc.Grpc = true
+		if hc.GrpcService == "" {
+			hc.GrpcService = s.Options.HealthCheckGrpcBackendService
+		}
+	default:
+		return nil, fmt.Errorf("type must be %s, %s or %s, got %q", healthCheckTypeHTTP, healthCheckTypeGrpc, healthCheckTypeNone, policy.Type)
+	}
+	if policy.Path != "" {
+		hc.Path = policy.Path
+	}
+	if policy.GrpcService != "" {
+		hc.GrpcService = policy.GrpcService
+	}
+	if !hc.Grpc && hc.Path == "" {
+		hc.Path = s.Options.BackendHealthCheckHTTPPath
+		if hc.Path == "" {
+			return nil, fmt.Errorf("http health check must have a path")
+		}
+	}
+
+	var err error
+	if policy.Interval != "" {
+		if hc.Interval, err = parsePositiveDuration(policy.Interval); err != nil {
+			return nil, fmt.Errorf("invalid interval, %v", err)
+		}
+	}
+	if policy.Timeout != "" {
+		if hc.Timeout, err = parsePositiveDuration(policy.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid timeout, %v", err)
+		}
+	}
+	if policy.HealthyThreshold > 0 {
+		hc.HealthyThreshold = policy.HealthyThreshold
+	}
+	if policy.UnhealthyThreshold > 0 {
+		hc.UnhealthyThreshold = policy.UnhealthyThreshold
+	}
+	return hc, nil
+}
+
+func (s *ServiceInfo) defaultBackendOutlierDetection() *BackendOutlierDetection {
+	if s.Options.BackendOutlierConsecutive5xx <= 0 && !s.Options.BackendOutlierSuccessRate {
+		return nil
+	}
+	od := &BackendOutlierDetection{
+		SuccessRate:      s.Options.BackendOutlierSuccessRate,
+		BaseEjectionTime: s.Options.BackendOutlierBaseEjectionTime,
+	}
+	if s.Options.BackendOutlierConsecutive5xx > 0 {
+		od.Consecutive5xx = uint32(s.Options.BackendOutlierConsecutive5xx)
+	}
+	return od
+}
+
+func (s *ServiceInfo) applyOutlierDetectionPolicy(od *BackendOutlierDetection, policy *OutlierDetectionPolicy) (*BackendOutlierDetection, error) {
+	if od == nil {
+		od = &BackendOutlierDetection{
+			BaseEjectionTime: s.Options.BackendOutlierBaseEjectionTime,
+		}
+	}
+	if policy.Consecutive5xx != nil {
+		od.Consecutive5xx = *policy.Consecutive5xx
+	}
+	if policy.SuccessRate != nil {
+		od.SuccessRate = *policy.SuccessRate
+	}
+	if policy.SuccessRateMinimumHosts > 0 {
+		od.SuccessRateMinimumHosts = policy.SuccessRateMinimumHosts
+	}
+	if policy.SuccessRateRequestVolume > 0 {
+		od.SuccessRateRequestVolume = policy.SuccessRateRequestVolume
+	}
+	if policy.MaxEjectionPercent > 100 {
+		return nil, fmt.Errorf("max_ejection_percent must be at most 100, got %d", policy.MaxEjectionPercent)
+	}
+	if policy.MaxEjectionPercent > 0 {
+		od.MaxEjectionPercent = policy.MaxEjectionPercent
+	}
+	if policy.BaseEjectionTime != "" {
+		var err error
+		if od.BaseEjectionTime, err = parsePositiveDuration(policy.BaseEjectionTime); err != nil {
+			return nil, fmt.Errorf("invalid base_ejection_time, %v", err)
+		}
+	}
+
+	if od.Consecutive5xx == 0 && !od.SuccessRate {
+		return nil, nil
+	}
+	return od, nil
+}
+
+func parsePositiveDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration must be positive, got %s", s)
+	}
+	return d, nil
+}
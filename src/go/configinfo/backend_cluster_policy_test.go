@@ -0,0 +1,231 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configinfo
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestProcessBackendClusterPolicies(t *testing.T) {
+	serviceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{Name: "ListShelves"},
+				},
+			},
+		},
+		Backend: &confpb.Backend{
+			Rules: []*confpb.BackendRule{
+				{
+					Selector: testApiName + ".ListShelves",
+					Address:  "https://remote.example.com",
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc                string
+		healthCheckHTTPPath string
+		consecutive5xx      int
+		policy              string
+		wantLocal           *BackendHealthCheck
+		wantRemote          *BackendHealthCheck
+		wantRemoteOutlier   *BackendOutlierDetection
+		wantError           string
+	}{
+		{
+			desc:                "flags apply to the local and remote clusters",
+			healthCheckHTTPPath: "/healthz",
+			consecutive5xx:      5,
+			wantLocal: &BackendHealthCheck{
+				Path:               "/healthz",
+				Interval:           5 * time.Second,
+				Timeout:            1 * time.Second,
+				HealthyThreshold:   3,
+				UnhealthyThreshold: 3,
+			},
+			wantRemote: &BackendHealthCheck{
+				Path:               "/healthz",
+				Interval:           5 * time.Second,
+				Timeout:            1 * time.Second,
+				HealthyThreshold:   3,
+				UnhealthyThreshold: 3,
+			},
+			wantRemoteOutlier: &BackendOutlierDetection{
+				Consecutive5xx:   5,
+				BaseEjectionTime: 30 * time.Second,
+			},
+		},
+		{
+			desc:                "cluster policy overrides the flags of its address only",
+			healthCheckHTTPPath: "/healthz",
+			consecutive5xx:      5,
+			policy: `
+clusters:
+- address: https://remote.example.com
+  health_check:
+    type: none
+  outlier_detection:
+    consecutive_5xx: 0
+`,
+			wantLocal: &BackendHealthCheck{
+				Path:               "/healthz",
+				Interval:           5 * time.Second,
+				Timeout:            1 * time.Second,
+				HealthyThreshold:   3,
+				UnhealthyThreshold: 3,
+			},
+		},
+		{
+			desc: "cluster policy without the flags",
+			policy: `
+clusters:
+- address: https://remote.example.com
+  health_check:
+    type: http
+    path: /ready
+    timeout: 2s
+    unhealthy_threshold: 2
+  outlier_detection:
+    success_rate: true
+    base_ejection_time: 1m
+`,
+			wantRemote: &BackendHealthCheck{
+				Path:               "/ready",
+				Interval:           5 * time.Second,
+				Timeout:            2 * time.Second,
+				HealthyThreshold:   3,
+				UnhealthyThreshold: 2,
+			},
+			wantRemoteOutlier: &BackendOutlierDetection{
+				SuccessRate:      true,
+				BaseEjectionTime: time.Minute,
+			},
+		},
+		{
+			desc: "health check type is required without the flags",
+			policy: `
+clusters:
+- address: https://remote.example.com
+  health_check:
+    path: /ready
+`,
+			wantError: "type must be set without the health check flags",
+		},
+		{
+			desc: "http health check without path",
+			policy: `
+clusters:
+- address: https://remote.example.com
+  health_check:
+    type: http
+`,
+			wantError: "http health check must have a path",
+		},
+		{
+			desc: "invalid interval",
+			policy: `
+clusters:
+- address: https://remote.example.com
+  health_check:
+    type: grpc
+    interval: -1s
+`,
+			wantError: "invalid interval, duration must be positive",
+		},
+		{
+			desc: "logical dns with several hosts",
+			policy: `
+clusters:
+- address: https://remote.example.com
+  dns_discovery: logical
+  hosts: [10.0.0.1, 10.0.0.2]
+`,
+			wantError: "logical dns discovery requires a single host, got 2",
+		},
+		{
+			desc: "localities with and without weight",
+			policy: `
+clusters:
+- address: https://remote.example.com
+  localities:
+  - zone: us-central1-a
+    weight: 80
+    hosts: [10.0.0.1]
+  - zone: us-east1-b
+    hosts: [10.1.0.1]
+`,
+			wantError: "either all or none of the localities must have a weight",
+		},
+		{
+			desc: "ring hash without hash header",
+			policy: `
+clusters:
+- address: https://remote.example.com
+  lb_policy: ring_hash
+`,
+			wantError: "ring_hash requires a hash_header",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendHealthCheckHTTPPath = tc.healthCheckHTTPPath
+			opts.BackendOutlierConsecutive5xx = tc.consecutive5xx
+			if tc.policy != "" {
+				opts.BackendPolicyPath = filepath.Join(t.TempDir(), "backend_policy.yaml")
+				if err := ioutil.WriteFile(opts.BackendPolicyPath, []byte(tc.policy), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			serviceInfo, err := NewServiceInfoFromServiceConfig(serviceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("want error: %v, got error: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := serviceInfo.LocalBackendCluster.HealthCheck; !reflect.DeepEqual(got, tc.wantLocal) {
+				t.Errorf("got local health check %+v, want %+v", got, tc.wantLocal)
+			}
+			remote := serviceInfo.RemoteBackendClusters[0]
+			if !reflect.DeepEqual(remote.HealthCheck, tc.wantRemote) {
+				t.Errorf("got remote health check %+v, want %+v", remote.HealthCheck, tc.wantRemote)
+			}
+			if !reflect.DeepEqual(remote.OutlierDetection, tc.wantRemoteOutlier) {
+				t.Errorf("got remote outlier detection %+v, want %+v", remote.OutlierDetection, tc.wantRemoteOutlier)
+			}
+		})
+	}
+}
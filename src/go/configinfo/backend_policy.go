@@ -0,0 +1,332 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configinfo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/glog"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+// BackendPolicies are the ESPv2 extensions of the backend rules, which the
+// service config cannot express. They are read from the YAML or JSON file in
+// --backend_policy_path, such as:
+//
+//	rules:
+//	- selector: endpoints.examples.bookstore.Bookstore.ListShelves
+//	  weighted_backends:
+//	  - address: https://blue.example.com
+//	    weight: 90
+//	  - address: https://green.example.com
+//	    weight: 10
+//	  alternate_backends:
+//	  - address: https://canary.example.com
+//	    headers:
+//	    - name: x-canary
+//	      value: "true"
+//	- selector: endpoints.examples.bookstore.Bookstore.GetShelf
+//	  mirror:
+//	    address: https://vms.example.com:8443
+//	    percent: 5
+//	    share_audience: true
+//	clusters:
+//	- address: https://green.example.com
+//	  health_check:
+//	    type: http
+//	    path: /healthz
+//	  outlier_detection:
+//	    consecutive_5xx: 3
+//	- address: https://vms.example.com
+//	  lb_policy: ring_hash
+//	  hash_header: x-user-id
+//	  localities:
+//	  - zone: us-central1-a
+//	    weight: 80
+//	    hosts: [10.0.0.1, 10.0.0.2]
+//	  - zone: us-east1-b
+//	    weight: 20
+//	    hosts: [10.1.0.1:8443]
+type BackendPolicies struct {
+	Rules    []*BackendPolicyRule    `json:"rules,omitempty"`
+	Clusters []*BackendClusterPolicy `json:"clusters,omitempty"`
+}
+
+// BackendPolicyRule is the backend policy of the method of the selector.
+type BackendPolicyRule struct {
+	Selector string `json:"selector"`
+
+	// The backends splitting the traffic of the method. They replace the
+	// address of the backend rule of the method, its deadline and path
+	// translation apply to all of them.
+	WeightedBackends []*WeightedBackend `json:"weighted_backends,omitempty"`
+
+	// The backends serving the requests of the method with the headers or
+	// query parameters, instead of the backend of the backend rule. The first
+	// matching one is used.
+	AlternateBackends []*AlternateBackend `json:"alternate_backends,omitempty"`
+
+	// The backend receiving a copy of a percentage of the requests of the
+	// method. Its responses are discarded.
+	Mirror *MirrorBackend `json:"mirror,omitempty"`
+}
+
+// PolicyBackend is a backend address of a backend policy.
+type PolicyBackend struct {
+	Address string `json:"address"`
+
+	// As in the backend rules, the protocol is derived from the scheme of the
+	// address if empty, and the JWT audience of backend auth is derived from
+	// the address unless set or disabled.
+	Protocol    string `json:"protocol,omitempty"`
+	JwtAudience string `json:"jwt_audience,omitempty"`
+	DisableAuth bool   `json:"disable_auth,omitempty"`
+}
+
+// WeightedBackend is a backend address receiving a share of the traffic,
+// proportional to its weight.
+type WeightedBackend struct {
+	PolicyBackend
+	Weight uint32 `json:"weight"`
+}
+
+// AlternateBackend is a backend address for the requests with all of the
+// headers and query parameters.
+type AlternateBackend struct {
+	PolicyBackend
+	Headers         []*RequestMatch `json:"headers,omitempty"`
+	QueryParameters []*RequestMatch `json:"query_parameters,omitempty"`
+}
+
+// MirrorBackend is a backend address receiving a copy of the requests. The
+// copies are made by the router after all the other filters, so service
+// control and backend auth run once, for the original request, and the copy
+// has the same headers. That includes the identity token of backend auth,
+// whose audience is the primary backend, so the mirror of an operation with
+// backend auth must set ShareAudience to accept that the mirror receives it.
+// The Host of the copy is the one of the primary backend with the "-shadow"
+// suffix, e.g. stable.example.com-shadow, so the mirror of a remote backend
+// must have its hostname, with another port or other cluster hosts.
+// The requests routed to the alternate backends are not mirrored.
+type MirrorBackend struct {
+	Address  string `json:"address"`
+	Protocol string `json:"protocol,omitempty"`
+	// The percentage of the requests to copy, in (0, 100].
+	Percent float64 `json:"percent"`
+	// Allows the mirror to receive the identity token of the primary backend.
+	ShareAudience bool `json:"share_audience,omitempty"`
+}
+
+// RequestMatch matches a header or query parameter by name, and by its exact
+// value if set.
+type RequestMatch struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+}
+
+// ReadBackendPolicies reads the backend policies in a YAML or JSON file.
+func ReadBackendPolicies(path string) (*BackendPolicies, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read backend policies, %v", err)
+	}
+	return UnmarshalBackendPolicies(data)
+}
+
+// UnmarshalBackendPolicies parses backend policies in YAML or JSON, unknown
+// fields are rejected.
+func UnmarshalBackendPolicies(data []byte) (*BackendPolicies, error) {
+	jsonData, err := util.YamlToJson(data)
+	if err != nil {
+		return nil, fmt.Errorf("fail to unmarshal backend policies, %v", err)
+	}
+	policies := &BackendPolicies{}
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(policies); err != nil {
+		return nil, fmt.Errorf("fail to unmarshal backend policies, %v", err)
+	}
+	return policies, nil
+}
+
+func (s *ServiceInfo) processBackendPolicies() error {
+	policies := &BackendPolicies{}
+	if s.Options.BackendPolicyPath != "" {
+		var err error
+		if policies, err = ReadBackendPolicies(s.Options.BackendPolicyPath); err != nil {
+			return err
+		}
+	}
+	if err := s.processBackendPolicyRules(policies.Rules); err != nil {
+		return err
+	}
+	// After the rules, which may add backend clusters.
+	return s.processBackendClusterPolicies(policies.Clusters)
+}
+
+func (s *ServiceInfo) processBackendPolicyRules(rules []*BackendPolicyRule) error {
+	backendRules := make(map[string]*confpb.BackendRule)
+	for _, r := range s.ServiceConfig().GetBackend().GetRules() {
+		backendRules[r.GetSelector()] = r
+	}
+
+	for _, rule := range rules {
+		method, ok := s.Methods[rule.Selector]
+		if !ok {
+			// The policies may be shared by the services of a Config Manager.
+			glog.Warningf("Skip backend policy %q because the operation is not in service %s.", rule.Selector, s.Name)
+			continue
+		}
+		if len(rule.WeightedBackends) == 0 && len(rule.AlternateBackends) == 0 && rule.Mirror == nil {
+			continue
+		}
+		if s.Options.EnableBackendAddressOverride {
+			glog.Warningf("Skip backend policy %q because --enable_backend_address_override is set.", rule.Selector)
+			continue
+		}
+		// The policies are not in the service config, so have no path.
+		if err := s.addWeightedBackends(method, backendRules[rule.Selector], rule.WeightedBackends); err != nil {
+			if err := s.reportError(rule.Selector, "", fmt.Errorf("error processing backend policy for operation (%v), %v", rule.Selector, err)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.addAlternateBackends(method, backendRules[rule.Selector], rule.AlternateBackends); err != nil {
+			if err := s.reportError(rule.Selector, "", fmt.Errorf("error processing backend policy for operation (%v), %v", rule.Selector, err)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.addMirrorBackend(method, rule.Mirror); err != nil {
+			if err := s.reportError(rule.Selector, "", fmt.Errorf("error processing backend policy for operation (%v), %v", rule.Selector, err)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// makePolicyBackendInfo makes the backendInfo of a backend of a policy, with
+// the deadline and path translation of the backend rule of the method.
+func (s *ServiceInfo) makePolicyBackendInfo(method *MethodInfo, backendRule *confpb.BackendRule, backend *PolicyBackend) (*backendInfo, error) {
+	scheme, hostname, port, path, err := util.ParseURI(backend.Address)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing address %s, %v", backend.Address, err)
+	}
+	clusterName, err := s.addRemoteBackendCluster(scheme, hostname, port, backend.Protocol)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing protocol of address %s, %v", backend.Address, err)
+	}
+
+	r := &confpb.BackendRule{
+		Selector:        method.Operation(),
+		Address:         backend.Address,
+		Deadline:        backendRule.GetDeadline(),
+		PathTranslation: backendRule.GetPathTranslation(),
+		Protocol:        backend.Protocol,
+	}
+	if backend.JwtAudience != "" {
+		r.Authentication = &confpb.BackendRule_JwtAudience{JwtAudience: backend.JwtAudience}
+	} else if backend.DisableAuth {
+		r.Authentication = &confpb.BackendRule_DisableAuth{DisableAuth: true}
+	}
+	return s.makeBackendInfo(method, r, "", scheme, hostname, path, clusterName, port), nil
+}
+
+func (s *ServiceInfo) addWeightedBackends(method *MethodInfo, backendRule *confpb.BackendRule, backends []*WeightedBackend) error {
+	for i, backend := range backends {
+		if backend.Weight == 0 {
+			return fmt.Errorf("weighted backend %d must have a positive weight", i)
+		}
+		bi, err := s.makePolicyBackendInfo(method, backendRule, &backend.PolicyBackend)
+		if err != nil {
+			return fmt.Errorf("invalid weighted backend %d: %v", i, err)
+		}
+		method.WeightedBackends = append(method.WeightedBackends, &WeightedBackendInfo{
+			BackendInfo: bi,
+			Weight:      backend.Weight,
+		})
+	}
+	return nil
+}
+
+func (s *ServiceInfo) addAlternateBackends(method *MethodInfo, backendRule *confpb.BackendRule, backends []*AlternateBackend) error {
+	for i, backend := range backends {
+		if len(backend.Headers) == 0 && len(backend.QueryParameters) == 0 {
+			return fmt.Errorf("alternate backend %d must match headers or query parameters", i)
+		}
+		for _, match := range append(append([]*RequestMatch{}, backend.Headers...), backend.QueryParameters...) {
+			if match.Name == "" {
+				return fmt.Errorf("alternate backend %d has a match without name", i)
+			}
+		}
+		bi, err := s.makePolicyBackendInfo(method, backendRule, &backend.PolicyBackend)
+		if err != nil {
+			return fmt.Errorf("invalid alternate backend %d: %v", i, err)
+		}
+		method.AlternateBackends = append(method.AlternateBackends, &AlternateBackendInfo{
+			BackendInfo:     bi,
+			Headers:         backend.Headers,
+			QueryParameters: backend.QueryParameters,
+		})
+	}
+	return nil
+}
+
+func (s *ServiceInfo) addMirrorBackend(method *MethodInfo, mirror *MirrorBackend) error {
+	if mirror == nil {
+		return nil
+	}
+	if mirror.Percent <= 0 || mirror.Percent > 100 {
+		return fmt.Errorf("mirror percent must be in (0, 100], got %v", mirror.Percent)
+	}
+	backends := []*backendInfo{method.BackendInfo}
+	for _, backend := range method.WeightedBackends {
+		backends = append(backends, backend.BackendInfo)
+	}
+	if !mirror.ShareAudience {
+		for _, backend := range backends {
+			if backend != nil && backend.JwtAudience != "" {
+				return fmt.Errorf("mirror %s would receive the backend auth token of audience %s, set share_audience to allow it", mirror.Address, backend.JwtAudience)
+			}
+		}
+	}
+	scheme, hostname, port, _, err := util.ParseURI(mirror.Address)
+	if err != nil {
+		return fmt.Errorf("error parsing address of mirror %s, %v", mirror.Address, err)
+	}
+	for _, backend := range backends {
+		// The remote backends have a host rewrite to their hostname.
+		if backend != nil && backend.Hostname != "" && backend.Hostname != hostname {
+			return fmt.Errorf("mirror %s would receive the requests with host %s-shadow, it must have the hostname %s of the backend", mirror.Address, backend.Hostname, backend.Hostname)
+		}
+	}
+	// Through the remote backend clusters, the mirror cluster is made as the
+	// other backend clusters.
+	clusterName, err := s.addRemoteBackendCluster(scheme, hostname, port, mirror.Protocol)
+	if err != nil {
+		return fmt.Errorf("error parsing protocol of mirror %s, %v", mirror.Address, err)
+	}
+	method.MirrorBackend = &MirrorBackendInfo{
+		ClusterName: clusterName,
+		Percent:     mirror.Percent,
+	}
+	return nil
+}
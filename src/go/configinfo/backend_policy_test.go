@@ -0,0 +1,275 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configinfo
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestProcessBackendPolicies(t *testing.T) {
+	serviceConfig := &confpb.Service{
+		Name: testProjectName,
+		Apis: []*apipb.Api{
+			{
+				Name: testApiName,
+				Methods: []*apipb.Method{
+					{Name: "ListShelves"},
+				},
+			},
+		},
+		Backend: &confpb.Backend{
+			Rules: []*confpb.BackendRule{
+				{
+					Selector:        testApiName + ".ListShelves",
+					Address:         "https://blue.example.com/v1",
+					PathTranslation: confpb.BackendRule_APPEND_PATH_TO_ADDRESS,
+				},
+			},
+		},
+	}
+
+	idleTimeout := calculateStreamIdleTimeout(util.DefaultResponseDeadline, options.DefaultConfigGeneratorOptions())
+
+	testData := []struct {
+		desc                  string
+		policy                string
+		wantWeightedBackends  []*WeightedBackendInfo
+		wantAlternateBackends []*AlternateBackendInfo
+		wantClusters          []string
+		wantError             string
+	}{
+		{
+			desc: "weighted backends keep the path translation of the backend rule",
+			policy: `
+rules:
+- selector: endpoints.examples.bookstore.Bookstore.ListShelves
+  weighted_backends:
+  - address: https://blue.example.com/v1
+    weight: 80
+  - address: grpcs://green.example.com:8443/v1
+    weight: 20
+    jwt_audience: green
+`,
+			wantWeightedBackends: []*WeightedBackendInfo{
+				{
+					BackendInfo: &backendInfo{
+						ClusterName:     "backend-cluster-blue.example.com:443",
+						Path:            "/v1",
+						Hostname:        "blue.example.com",
+						TranslationType: confpb.BackendRule_APPEND_PATH_TO_ADDRESS,
+						Port:            443,
+						JwtAudience:     "https://blue.example.com",
+						Deadline:        util.DefaultResponseDeadline,
+						IdleTimeout:     idleTimeout,
+					},
+					Weight: 80,
+				},
+				{
+					BackendInfo: &backendInfo{
+						ClusterName:     "backend-cluster-green.example.com:8443",
+						Path:            "/v1",
+						Hostname:        "green.example.com",
+						TranslationType: confpb.BackendRule_APPEND_PATH_TO_ADDRESS,
+						Port:            8443,
+						JwtAudience:     "green",
+						Deadline:        util.DefaultResponseDeadline,
+						IdleTimeout:     idleTimeout,
+					},
+					Weight: 20,
+				},
+			},
+			wantClusters: []string{"backend-cluster-blue.example.com:443", "backend-cluster-green.example.com:8443"},
+		},
+		{
+			desc: "alternate backends match headers or query parameters",
+			policy: `
+rules:
+- selector: endpoints.examples.bookstore.Bookstore.ListShelves
+  alternate_backends:
+  - address: https://canary.example.com
+    disable_auth: true
+    headers:
+    - name: x-canary
+      value: "true"
+    query_parameters:
+    - name: api_version
+`,
+			wantAlternateBackends: []*AlternateBackendInfo{
+				{
+					BackendInfo: &backendInfo{
+						ClusterName:     "backend-cluster-canary.example.com:443",
+						Hostname:        "canary.example.com",
+						TranslationType: confpb.BackendRule_APPEND_PATH_TO_ADDRESS,
+						Port:            443,
+						Deadline:        util.DefaultResponseDeadline,
+						IdleTimeout:     idleTimeout,
+					},
+					Headers:         []*RequestMatch{{Name: "x-canary", Value: "true"}},
+					QueryParameters: []*RequestMatch{{Name: "api_version"}},
+				},
+			},
+			wantClusters: []string{"backend-cluster-blue.example.com:443", "backend-cluster-canary.example.com:443"},
+		},
+		{
+			desc: "alternate backend without match",
+			policy: `
+rules:
+- selector: endpoints.examples.bookstore.Bookstore.ListShelves
+  alternate_backends:
+  - address: https://canary.example.com
+`,
+			wantError: "alternate backend 0 must match headers or query parameters",
+		},
+		{
+			desc: "operations of other services are skipped",
+			policy: `
+rules:
+- selector: endpoints.examples.library.Library.ListBooks
+  weighted_backends:
+  - address: https://library.example.com
+    weight: 1
+`,
+			wantClusters: []string{"backend-cluster-blue.example.com:443"},
+		},
+		{
+			desc: "zero weight",
+			policy: `
+rules:
+- selector: endpoints.examples.bookstore.Bookstore.ListShelves
+  weighted_backends:
+  - address: https://green.example.com
+`,
+			wantError: "weighted backend 0 must have a positive weight",
+		},
+		{
+			desc: "mirror percent out of range",
+			policy: `
+rules:
+- selector: endpoints.examples.bookstore.Bookstore.ListShelves
+  mirror:
+    address: https://blue.example.com:8443
+    percent: 120
+`,
+			wantError: "mirror percent must be in (0, 100], got 120",
+		},
+		{
+			desc: "mirror of an operation with backend auth",
+			policy: `
+rules:
+- selector: endpoints.examples.bookstore.Bookstore.ListShelves
+  mirror:
+    address: https://blue.example.com:8443
+    percent: 5
+`,
+			wantError: "mirror https://blue.example.com:8443 would receive the backend auth token of audience https://blue.example.com, set share_audience to allow it",
+		},
+		{
+			desc: "mirror sharing the audience of backend auth",
+			policy: `
+rules:
+- selector: endpoints.examples.bookstore.Bookstore.ListShelves
+  mirror:
+    address: https://blue.example.com:8443
+    percent: 5
+    share_audience: true
+`,
+			wantClusters: []string{"backend-cluster-blue.example.com:443", "backend-cluster-blue.example.com:8443"},
+		},
+		{
+			desc: "mirror on another hostname than the backend",
+			policy: `
+rules:
+- selector: endpoints.examples.bookstore.Bookstore.ListShelves
+  mirror:
+    address: https://next.example.com
+    percent: 5
+    share_audience: true
+`,
+			wantError: "mirror https://next.example.com would receive the requests with host blue.example.com-shadow, it must have the hostname blue.example.com of the backend",
+		},
+		{
+			desc: "mirror on another hostname than a weighted backend",
+			policy: `
+rules:
+- selector: endpoints.examples.bookstore.Bookstore.ListShelves
+  weighted_backends:
+  - address: https://blue.example.com
+    weight: 80
+  - address: https://green.example.com
+    weight: 20
+  mirror:
+    address: https://blue.example.com:8443
+    percent: 5
+    share_audience: true
+`,
+			wantError: "mirror https://blue.example.com:8443 would receive the requests with host green.example.com-shadow, it must have the hostname green.example.com of the backend",
+		},
+		{
+			desc: "unknown field",
+			policy: `
+rules:
+- selector: endpoints.examples.bookstore.Bookstore.ListShelves
+  weighted_backend: []
+`,
+			wantError: "fail to unmarshal backend policies",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			policyPath := filepath.Join(t.TempDir(), "backend_policy.yaml")
+			if err := ioutil.WriteFile(policyPath, []byte(tc.policy), 0644); err != nil {
+				t.Fatal(err)
+			}
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendPolicyPath = policyPath
+			serviceInfo, err := NewServiceInfoFromServiceConfig(serviceConfig, testConfigID, opts)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("want error: %v, got error: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			method := serviceInfo.Methods[testApiName+".ListShelves"]
+			if !reflect.DeepEqual(method.WeightedBackends, tc.wantWeightedBackends) {
+				t.Errorf("got weighted backends %+v, want %+v", method.WeightedBackends, tc.wantWeightedBackends)
+			}
+			if !reflect.DeepEqual(method.AlternateBackends, tc.wantAlternateBackends) {
+				t.Errorf("got alternate backends %+v, want %+v", method.AlternateBackends, tc.wantAlternateBackends)
+			}
+			var gotClusters []string
+			for _, cluster := range serviceInfo.RemoteBackendClusters {
+				gotClusters = append(gotClusters, cluster.ClusterName)
+			}
+			if !reflect.DeepEqual(gotClusters, tc.wantClusters) {
+				t.Errorf("got remote backend clusters %v, want %v", gotClusters, tc.wantClusters)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configinfo
+
+import (
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/ptypes"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	smpb "google.golang.org/genproto/googleapis/api/servicemanagement/v1"
+)
+
+// Severity is how bad a Diagnostic is.
+type Severity string
+
+const (
+	// SeverityError means ESPv2 fails to start with the service config.
+	SeverityError Severity = "ERROR"
+	// SeverityWarning means ESPv2 starts, but ignores or changes part of the
+	// service config.
+	SeverityWarning Severity = "WARNING"
+)
+
+// Diagnostic is a problem of a service config found by Lint.
+type Diagnostic struct {
+	Severity Severity `json:"severity"`
+	// The operation the problem is about, empty if it is not about one.
+	Selector string `json:"selector,omitempty"`
+	// The path of the field in the service config, e.g. "backend.rules[2].deadline".
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (d *Diagnostic) String() string {
+	if d.Selector == "" {
+		return fmt.Sprintf("%s %s: %s", d.Severity, d.Path, d.Message)
+	}
+	return fmt.Sprintf("%s %s (%s): %s", d.Severity, d.Path, d.Selector, d.Message)
+}
+
+// HasError returns whether any of the diagnostics is an error.
+func HasError(diagnostics []*Diagnostic) bool {
+	for _, d := range diagnostics {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Lint checks the service config with opts like NewServiceInfoFromServiceConfig,
+// but instead of failing on the first error or only logging warnings, it
+// returns all the problems found. It does not contact the network: the JWKS
+// URIs left to OpenID Connect Discovery are not resolved.
+func Lint(serviceConfig *confpb.Service, opts options.ConfigGeneratorOptions) []*Diagnostic {
+	l := &linter{}
+	// The processing steps report the problems of the rules to l, and only
+	// return the ones of the flags and the backend policies, which stop them.
+	serviceInfo, err := newServiceInfo(serviceConfig, serviceConfig.GetId(), opts, l)
+	if err != nil {
+		l.errorf("", "", "%v", err)
+	}
+
+	// The problems NewServiceInfoFromServiceConfig leaves to the filters.
+	l.lintAuthentication(serviceConfig.GetAuthentication())
+	if serviceInfo != nil {
+		l.lintProtoDescriptor(serviceInfo)
+	}
+	return l.diagnostics
+}
+
+type linter struct {
+	diagnostics []*Diagnostic
+}
+
+func (l *linter) errorf(selector, path, format string, args ...interface{}) {
+	l.add(SeverityError, selector, path, fmt.Sprintf(format, args...))
+}
+
+func (l *linter) warningf(selector, path, format string, args ...interface{}) {
+	l.add(SeverityWarning, selector, path, fmt.Sprintf(format, args...))
+}
+
+func (l *linter) add(severity Severity, selector, path, message string) {
+	d := &Diagnostic{
+		Severity: severity,
+		Selector: selector,
+		Path:     path,
+		Message:  message,
+	}
+	// The steps may run into the same problem, e.g. for the CORS rules.
+	for _, prev := range l.diagnostics {
+		if *prev == *d {
+			return
+		}
+	}
+	l.diagnostics = append(l.diagnostics, d)
+}
+
+// reportError returns err, a problem of the rule of selector at path of the
+// service config. When linting, it records err and returns nil instead, for
+// the step to go on with the next rule.
+func (s *ServiceInfo) reportError(selector, path string, err error) error {
+	if s.lint == nil {
+		return err
+	}
+	s.lint.errorf(selector, path, "%v", err)
+	return nil
+}
+
+// warningf logs a warning about the rule of selector at path of the service
+// config, and records it when linting. An empty path is for a rule made from
+// the backend policies, which is only logged.
+func (s *ServiceInfo) warningf(selector, path, format string, args ...interface{}) {
+	glog.WarningDepth(1, fmt.Sprintf(format, args...))
+	if s.lint != nil && path != "" {
+		s.lint.warningf(selector, path, format, args...)
+	}
+}
+
+func (l *linter) lintAuthentication(authn *confpb.Authentication) {
+	providers := make(map[string]bool)
+	for i, provider := range authn.GetProviders() {
+		providers[provider.GetId()] = true
+		for j, location := range provider.GetJwtLocations() {
+			switch location.GetIn().(type) {
+			case *confpb.JwtLocation_Header, *confpb.JwtLocation_Query:
+			default:
+				l.warningf("", fmt.Sprintf("authentication.providers[%d].jwt_locations[%d]", i, j), "unsupported JwtLocation type %T, only header and query are supported; the location is ignored", location.GetIn())
+			}
+		}
+	}
+
+	for i, rule := range authn.GetRules() {
+		for j, requirement := range rule.GetRequirements() {
+			if !providers[requirement.GetProviderId()] {
+				l.errorf(rule.GetSelector(), fmt.Sprintf("authentication.rules[%d].requirements[%d].provider_id", i, j), "provider (%v) is not defined in authentication.providers", requirement.GetProviderId())
+			}
+		}
+	}
+}
+
+func (l *linter) lintProtoDescriptor(serviceInfo *ServiceInfo) {
+	if !serviceInfo.GrpcSupportRequired {
+		return
+	}
+	for _, sourceFile := range serviceInfo.ServiceConfig().GetSourceInfo().GetSourceFiles() {
+		configFile := &smpb.ConfigFile{}
+		if err := ptypes.UnmarshalAny(sourceFile, configFile); err == nil && configFile.GetFileType() == smpb.ConfigFile_FILE_DESCRIPTOR_SET_PROTO {
+			return
+		}
+	}
+	l.warningf("", "source_info.source_files", "no proto descriptor found for the gRPC backend, gRPC-JSON transcoding is disabled; "+
+		"deploy the service config with the proto descriptor, or use version 2020-01-29 (or later) of the `gcloud_build_image` script")
+}
@@ -0,0 +1,265 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configinfo
+
+import (
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/google/go-cmp/cmp"
+
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+	ptypepb "google.golang.org/genproto/protobuf/ptype"
+)
+
+func TestLint(t *testing.T) {
+	listShelves := testApiName + ".ListShelves"
+	apis := []*apipb.Api{
+		{
+			Name: testApiName,
+			Methods: []*apipb.Method{
+				{
+					Name:           "ListShelves",
+					RequestTypeUrl: "type.googleapis.com/google.protobuf.Empty",
+				},
+			},
+		},
+	}
+
+	testData := []struct {
+		desc              string
+		fakeServiceConfig *confpb.Service
+		backendAddress    string
+		disableOidc       bool
+		wantDiagnostics   []*Diagnostic
+	}{
+		{
+			desc: "valid service config",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: apis,
+				Http: &annotationspb.Http{
+					Rules: []*annotationspb.HttpRule{
+						{
+							Selector: listShelves,
+							Pattern:  &annotationspb.HttpRule_Get{Get: "/v1/shelves"},
+						},
+					},
+				},
+			},
+		},
+		{
+			desc:              "no api",
+			fakeServiceConfig: &confpb.Service{Name: testProjectName},
+			wantDiagnostics: []*Diagnostic{
+				{Severity: SeverityError, Path: "apis", Message: "service config must have one api at least"},
+			},
+		},
+		{
+			desc: "all the problems are reported",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: append(apis, &apipb.Api{
+					Name:    "google.discovery",
+					Methods: []*apipb.Method{{Name: "GetDiscoveryRest"}},
+				}),
+				Http: &annotationspb.Http{
+					Rules: []*annotationspb.HttpRule{
+						{
+							Selector: listShelves,
+							Pattern:  &annotationspb.HttpRule_Get{Get: "/v1/shelves/{shelf"},
+						},
+						{
+							Selector: testApiName + ".DeleteShelf",
+							Pattern:  &annotationspb.HttpRule_Delete{Delete: "/v1/shelves/{shelf}"},
+						},
+					},
+				},
+				Backend: &confpb.Backend{
+					Rules: []*confpb.BackendRule{
+						{
+							Selector: listShelves,
+							Deadline: -1,
+						},
+					},
+				},
+				Authentication: &confpb.Authentication{
+					Providers: []*confpb.AuthProvider{
+						{
+							Id:      "auth0",
+							Issuer:  "https://auth0.com",
+							JwksUri: "https://auth0.com/jwks",
+							JwtLocations: []*confpb.JwtLocation{
+								{
+									In:          &confpb.JwtLocation_Query{Query: "jwt"},
+									ValuePrefix: "Bearer ",
+								},
+							},
+						},
+					},
+					Rules: []*confpb.AuthenticationRule{
+						{
+							Selector:     listShelves,
+							Requirements: []*confpb.AuthRequirement{{ProviderId: "firebase"}},
+						},
+					},
+				},
+			},
+			wantDiagnostics: []*Diagnostic{
+				{
+					Severity: SeverityWarning,
+					Selector: "google.discovery",
+					Path:     "apis[1]",
+					Message:  `Skip API "google.discovery" because discovery API is not supported.`,
+				},
+				{
+					Severity: SeverityWarning,
+					Selector: listShelves,
+					Path:     "backend.rules[0].deadline",
+					Message:  "Negative deadline of -1 specified for method endpoints.examples.bookstore.Bookstore.ListShelves. Using default deadline 15s instead.",
+				},
+				{
+					Severity: SeverityError,
+					Selector: listShelves,
+					Path:     "http.rules[0]",
+					Message:  "error parsing http rule address for operation (endpoints.examples.bookstore.Bookstore.ListShelves): invalid uri template /v1/shelves/{shelf",
+				},
+				{
+					Severity: SeverityError,
+					Selector: testApiName + ".DeleteShelf",
+					Path:     "http.rules[1].selector",
+					Message:  "error processing http rule for operation (endpoints.examples.bookstore.Bookstore.DeleteShelf): selector (endpoints.examples.bookstore.Bookstore.DeleteShelf) was not defined in the API",
+				},
+				{
+					Severity: SeverityError,
+					Path:     "authentication.providers[0].jwt_locations[0].value_prefix",
+					Message:  "error processing authentication provider (auth0): JwtLocation type [Query] should be set without valuePrefix, but it was set to [Bearer ]",
+				},
+				{
+					Severity: SeverityError,
+					Selector: listShelves,
+					Path:     "authentication.rules[0].requirements[0].provider_id",
+					Message:  "provider (firebase) is not defined in authentication.providers",
+				},
+			},
+		},
+		{
+			desc: "jwks_uri left to OpenID Connect Discovery",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: apis,
+				Authentication: &confpb.Authentication{
+					Providers: []*confpb.AuthProvider{
+						{
+							Id:     "auth0",
+							Issuer: "https://auth0.com",
+						},
+					},
+				},
+			},
+			disableOidc: true,
+			wantDiagnostics: []*Diagnostic{
+				{
+					Severity: SeverityError,
+					Path:     "authentication.providers[0].jwks_uri",
+					Message:  "error processing authentication provider (auth0): jwks_uri is empty, but OpenID Connect Discovery is disabled via startup option. Consider specifying the jwks_uri in the provider config",
+				},
+			},
+		},
+		{
+			desc: "problems of the later processing steps have paths",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: apis,
+				Types: []*ptypepb.Type{
+					{
+						Name: "google.protobuf.Empty",
+						Fields: []*ptypepb.Field{
+							{Name: "shelf_id", JsonName: "shelfId"},
+							{Name: "shelf_id", JsonName: "shelf"},
+						},
+					},
+				},
+				Usage: &confpb.Usage{
+					Rules: []*confpb.UsageRule{
+						{Selector: testApiName + ".DeleteShelf"},
+					},
+				},
+				SystemParameters: &confpb.SystemParameters{
+					Rules: []*confpb.SystemParameterRule{
+						{Selector: listShelves},
+						{Selector: testApiName + ".DeleteShelf"},
+					},
+				},
+			},
+			wantDiagnostics: []*Diagnostic{
+				{
+					Severity: SeverityError,
+					Selector: testApiName + ".DeleteShelf",
+					Path:     "usage.rules[0].selector",
+					Message:  "error processing usage rule for operation (endpoints.examples.bookstore.Bookstore.DeleteShelf): selector (endpoints.examples.bookstore.Bookstore.DeleteShelf) was not defined in the API",
+				},
+				{
+					Severity: SeverityError,
+					Selector: listShelves,
+					Path:     "types[0]",
+					Message:  "error processing types for operation (endpoints.examples.bookstore.Bookstore.ListShelves): detected two types with same snake_name (shelf_id) but mistmatching json_name (shelf, shelfId)",
+				},
+				{
+					Severity: SeverityError,
+					Selector: testApiName + ".DeleteShelf",
+					Path:     "system_parameters.rules[1].selector",
+					Message:  "error processing system parameter rule for operation (endpoints.examples.bookstore.Bookstore.DeleteShelf): selector (endpoints.examples.bookstore.Bookstore.DeleteShelf) was not defined in the API",
+				},
+			},
+		},
+		{
+			desc: "gRPC backend without proto descriptor",
+			fakeServiceConfig: &confpb.Service{
+				Name: testProjectName,
+				Apis: apis,
+			},
+			backendAddress: "grpc://127.0.0.1:8082",
+			wantDiagnostics: []*Diagnostic{
+				{
+					Severity: SeverityWarning,
+					Path:     "source_info.source_files",
+					Message: "no proto descriptor found for the gRPC backend, gRPC-JSON transcoding is disabled; " +
+						"deploy the service config with the proto descriptor, or use version 2020-01-29 (or later) of the `gcloud_build_image` script",
+				},
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts := options.DefaultConfigGeneratorOptions()
+			if tc.backendAddress != "" {
+				opts.BackendAddress = tc.backendAddress
+			}
+			opts.DisableOidcDiscovery = tc.disableOidc
+
+			got := Lint(tc.fakeServiceConfig, opts)
+			if diff := cmp.Diff(tc.wantDiagnostics, got); diff != "" {
+				t.Errorf("Lint() diff (-want +got):\n%s", diff)
+			}
+			if HasError(got) != HasError(tc.wantDiagnostics) {
+				t.Errorf("HasError() got %v", HasError(got))
+			}
+		})
+	}
+}
@@ -54,6 +54,16 @@ type MethodInfo struct {
 	// url templates in config time.
 	GeneratedCorsMethod *MethodInfo
 
+	// The backends splitting the traffic of the method by weight, set by the
+	// backend policies. The route settings, i.e. deadline and retries, are
+	// still taken from BackendInfo.
+	WeightedBackends []*WeightedBackendInfo
+	// The backends of the requests matching headers or query parameters, each
+	// has its own routes ahead of the routes of the method.
+	AlternateBackends []*AlternateBackendInfo
+	// The backend receiving a copy of the requests, nil if not mirrored.
+	MirrorBackend *MirrorBackendInfo
+
 	// The PerRouteConfig generator.
 	// It should be added during making filters if the filter has the PerRouteConfig
 	// for the methods.
@@ -83,6 +93,40 @@ type backendInfo struct {
 	PerTryTimeout        time.Duration
 }
 
+// WeightedBackendInfo is a backend receiving a share of the traffic of a method.
+type WeightedBackendInfo struct {
+	BackendInfo *backendInfo
+	Weight      uint32
+}
+
+// AlternateBackendInfo is a backend for the requests of a method with all of
+// the headers and query parameters.
+type AlternateBackendInfo struct {
+	BackendInfo     *backendInfo
+	Headers         []*RequestMatch
+	QueryParameters []*RequestMatch
+}
+
+// MirrorBackendInfo is the cluster receiving a copy of a percentage of the
+// requests of a method.
+type MirrorBackendInfo struct {
+	ClusterName string
+	Percent     float64
+}
+
+// PolicyBackendInfos returns the backends of the backend policies of the
+// method, weighted or alternate.
+func (m *MethodInfo) PolicyBackendInfos() []*backendInfo {
+	var backends []*backendInfo
+	for _, backend := range m.WeightedBackends {
+		backends = append(backends, backend.BackendInfo)
+	}
+	for _, backend := range m.AlternateBackends {
+		backends = append(backends, backend.BackendInfo)
+	}
+	return backends
+}
+
 type SnakeToJsonSegments = map[string]string
 
 func (m *MethodInfo) Operation() string {
@@ -17,6 +17,7 @@ package configinfo
 import (
 	"fmt"
 	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -71,6 +72,20 @@ type ServiceInfo struct {
 	LocalBackendCluster     *BackendRoutingCluster
 	LocalHTTPBackendCluster *BackendRoutingCluster
 	RemoteBackendClusters   []*BackendRoutingCluster
+
+	// The other configs of the service in a partial rollout, each serving the
+	// requests in its share of the traffic. This ServiceInfo serves the rest.
+	TrafficSplits []*TrafficSplit
+
+	// Set by Lint to record the problems of the rules as diagnostics, instead
+	// of failing on the first one.
+	lint *linter
+}
+
+// TrafficSplit is a service config serving a percentage of the traffic.
+type TrafficSplit struct {
+	ServiceInfo *ServiceInfo
+	Percentage  float64
 }
 
 type BackendRoutingCluster struct {
@@ -79,17 +94,31 @@ type BackendRoutingCluster struct {
 	Port        uint32
 	UseTLS      bool
 	Protocol    util.BackendProtocol
+
+	// Set from the flags and the backend policies, nil if disabled.
+	HealthCheck      *BackendHealthCheck
+	OutlierDetection *BackendOutlierDetection
+
+	// Set from the backend policies. If empty, the cluster has the single
+	// endpoint of Hostname and Port, resolved by LOGICAL_DNS.
+	Localities []*util.LoadAssignmentLocality
+	StrictDNS  bool
+	// One of the LbPolicy constants, round robin if empty. The requests are
+	// hashed by the HashHeader for ring hash and maglev.
+	LbPolicy   string
+	HashHeader string
 }
 
 // NewServiceInfoFromServiceConfig returns an instance of ServiceInfo.
 func NewServiceInfoFromServiceConfig(serviceConfig *confpb.Service, id string, opts options.ConfigGeneratorOptions) (*ServiceInfo, error) {
-	if serviceConfig == nil {
-		return nil, fmt.Errorf("unexpected empty service config")
-	}
-	if len(serviceConfig.GetApis()) == 0 {
-		return nil, fmt.Errorf("service config must have one api at least")
-	}
+	return newServiceInfo(serviceConfig, id, opts, nil)
+}
 
+// newServiceInfo returns an instance of ServiceInfo. If l is set, the
+// problems of the rules are recorded in it and the processing goes on, so
+// only the problems of the flags and the backend policies are returned, and
+// the ServiceInfo is incomplete if l has errors.
+func newServiceInfo(serviceConfig *confpb.Service, id string, opts options.ConfigGeneratorOptions, l *linter) (*ServiceInfo, error) {
 	serviceInfo := &ServiceInfo{
 		Name:                             serviceConfig.GetName(),
 		ConfigID:                         id,
@@ -97,6 +126,13 @@ func NewServiceInfoFromServiceConfig(serviceConfig *confpb.Service, id string, o
 		Options:                          opts,
 		Methods:                          make(map[string]*MethodInfo),
 		AllTranscodingIgnoredQueryParams: make(map[string]bool),
+		lint:                             l,
+	}
+	if serviceConfig == nil {
+		return nil, serviceInfo.reportError("", "", fmt.Errorf("unexpected empty service config"))
+	}
+	if len(serviceConfig.GetApis()) == 0 {
+		return nil, serviceInfo.reportError("", "apis", fmt.Errorf("service config must have one api at least"))
 	}
 
 	// Calling order is required due to following variable usage
@@ -131,6 +167,9 @@ func NewServiceInfoFromServiceConfig(serviceConfig *confpb.Service, id string, o
 	if err := serviceInfo.processBackendRule(); err != nil {
 		return nil, err
 	}
+	if err := serviceInfo.processBackendPolicies(); err != nil {
+		return nil, err
+	}
 	if err := serviceInfo.processHttpRule(); err != nil {
 		return nil, err
 	}
@@ -217,16 +256,25 @@ func (s *ServiceInfo) ServiceConfig() *confpb.Service {
 
 func (s *ServiceInfo) processEmptyJwksUriByOpenID() error {
 	authn := s.serviceConfig.GetAuthentication()
-	for _, provider := range authn.GetProviders() {
+	for i, provider := range authn.GetProviders() {
 		jwksUri := provider.GetJwksUri()
+		path := fmt.Sprintf("authentication.providers[%d].jwks_uri", i)
 
 		// Note: When jwksUri is empty, proxy will try to find jwksUri using the
 		// OpenID Connect Discovery protocol.
 		if jwksUri == "" {
 			if s.Options.DisableOidcDiscovery {
-				return fmt.Errorf("error processing authentication provider (%v): "+
+				if err := s.reportError("", path, fmt.Errorf("error processing authentication provider (%v): "+
 					"jwks_uri is empty, but OpenID Connect Discovery is disabled via startup option. "+
-					"Consider specifying the jwks_uri in the provider config", provider.Id)
+					"Consider specifying the jwks_uri in the provider config", provider.Id)); err != nil {
+					return err
+				}
+				continue
+			}
+			// Linting does not contact the network.
+			if s.lint != nil {
+				s.warningf("", path, "jwks_uri is empty for provider (%v), it is resolved from issuer (%v) with OpenID Connect Discovery at startup, which fails if the discovery fails", provider.Id, provider.GetIssuer())
+				continue
 			}
 
 			glog.Infof("jwks_uri is empty for provider (%v), using OpenID Connect Discovery protocol", provider.Id)
@@ -243,18 +291,23 @@ func (s *ServiceInfo) processEmptyJwksUriByOpenID() error {
 }
 
 func (s *ServiceInfo) processApis() error {
-	for _, api := range s.serviceConfig.GetApis() {
+	for i, api := range s.serviceConfig.GetApis() {
+		apiPath := fmt.Sprintf("apis[%d]", i)
 		if s.shouldSkipDiscoveryAPI(api.GetName()) {
-			glog.Warningf("Skip API %q because discovery API is not supported.", api.GetName())
+			s.warningf(api.GetName(), apiPath, "Skip API %q because discovery API is not supported.", api.GetName())
 			continue
 		}
 		s.ApiNames = append(s.ApiNames, api.Name)
 
-		for _, method := range api.GetMethods() {
+		for j, method := range api.GetMethods() {
 			selector := fmt.Sprintf("%s.%s", api.GetName(), method.GetName())
+			path := fmt.Sprintf("%s.methods[%d]", apiPath, j)
 			mi, err := s.getOrCreateMethod(selector)
 			if err != nil {
-				return fmt.Errorf("error creating method info for operation (%v): %v", selector, err)
+				if err := s.reportError(selector, path, fmt.Errorf("error creating method info for operation (%v): %v", selector, err)); err != nil {
+					return err
+				}
+				continue
 			}
 
 			// Keep track of non-unary gRPC methods.
@@ -268,7 +321,7 @@ func (s *ServiceInfo) processApis() error {
 				requestTypeName := strings.TrimPrefix(method.RequestTypeUrl, util.TypeUrlPrefix)
 				mi.RequestTypeName = requestTypeName
 			} else {
-				glog.Warningf("For operation (%v), request type name (%v) is in an unexpected format", selector, method.RequestTypeUrl)
+				s.warningf(selector, path+".request_type_url", "For operation (%v), request type name (%v) is in an unexpected format", selector, method.RequestTypeUrl)
 			}
 		}
 	}
@@ -339,10 +392,11 @@ func (s *ServiceInfo) processAccessToken() {
 }
 
 func (s *ServiceInfo) processQuota() error {
-	for _, metricRule := range s.ServiceConfig().GetQuota().GetMetricRules() {
+	for i, metricRule := range s.ServiceConfig().GetQuota().GetMetricRules() {
 		selector := metricRule.GetSelector()
+		path := fmt.Sprintf("quota.metric_rules[%d]", i)
 		if s.shouldSkipDiscoveryAPI(selector) {
-			glog.Warningf("Skip quota metric rule %q because discovery API is not supported.", selector)
+			s.warningf(selector, path, "Skip quota metric rule %q because discovery API is not supported.", selector)
 			continue
 		}
 		var metricCosts []*scpb.MetricCost
@@ -355,7 +409,10 @@ func (s *ServiceInfo) processQuota() error {
 
 		mi, err := s.getMethod(metricRule.GetSelector())
 		if err != nil {
-			return fmt.Errorf("error processing quota metric rule: %v", err)
+			if err := s.reportError(selector, path+".selector", fmt.Errorf("error processing quota metric rule: %v", err)); err != nil {
+				return err
+			}
+			continue
 		}
 		mi.MetricCosts = metricCosts
 	}
@@ -428,27 +485,35 @@ func (s *ServiceInfo) processHttpRule() error {
 	// to avoid duplication.
 	addedRouteMatchWithOptionsSet := make(map[string]bool)
 
-	for _, rule := range s.ServiceConfig().GetHttp().GetRules() {
+	for i, rule := range s.ServiceConfig().GetHttp().GetRules() {
 		selector := rule.GetSelector()
+		path := fmt.Sprintf("http.rules[%d]", i)
 		if s.shouldSkipDiscoveryAPI(selector) {
-			glog.Warningf("Skip http rule %q because discovery API is not supported.", selector)
+			s.warningf(selector, path, "Skip http rule %q because discovery API is not supported.", selector)
 			continue
 		}
 		method, err := s.getMethod(rule.GetSelector())
 		if err != nil {
-			return fmt.Errorf("error processing http rule for operation (%v): %v", rule.Selector, err)
+			if err := s.reportError(selector, path+".selector", fmt.Errorf("error processing http rule for operation (%v): %v", rule.Selector, err)); err != nil {
+				return err
+			}
+			continue
 		}
 		if err := s.addHttpRule(method, rule, addedRouteMatchWithOptionsSet, s.Options.DisallowColonInWildcardPathSegment); err != nil {
-			return err
+			if err := s.reportError(selector, path, err); err != nil {
+				return err
+			}
 		}
 
 		// additional_bindings cannot be nested inside themselves according to
 		// https://aip.dev/127. Service Management will enforce this restriction
 		// when interpret the httprules from the descriptor. Therefore, no need to
 		// check for nested additional_bindings.
-		for _, additionalRule := range rule.AdditionalBindings {
+		for j, additionalRule := range rule.AdditionalBindings {
 			if err := s.addHttpRule(method, additionalRule, addedRouteMatchWithOptionsSet, s.Options.DisallowColonInWildcardPathSegment); err != nil {
-				return err
+				if err := s.reportError(selector, fmt.Sprintf("%s.additional_bindings[%d]", path, j), err); err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -456,17 +521,24 @@ func (s *ServiceInfo) processHttpRule() error {
 	// In order to support CORS. HTTP method OPTIONS needs to be added to all
 	// urls except the ones already with options.
 	if s.AllowCors {
-		for _, r := range s.ServiceConfig().GetHttp().GetRules() {
+		for i, r := range s.ServiceConfig().GetHttp().GetRules() {
+			path := fmt.Sprintf("http.rules[%d]", i)
 			method, err := s.getMethod(r.GetSelector())
 			if err != nil {
-				return fmt.Errorf("error processing http rule for operation (%v): %v", r.GetSelector(), err)
+				if err := s.reportError(r.GetSelector(), path+".selector", fmt.Errorf("error processing http rule for operation (%v): %v", r.GetSelector(), err)); err != nil {
+					return err
+				}
+				continue
 			}
 
 			for _, httpRule := range method.HttpRule {
 				if httpRule.HttpMethod != util.OPTIONS {
 					uriTemplate, err := httppattern.ParseUriTemplate(httpRule.UriTemplate.Origin)
 					if err != nil {
-						return fmt.Errorf("error parsing URI template for http rule for operation (%v): %v", r.Selector, err)
+						if err := s.reportError(r.GetSelector(), path, fmt.Errorf("error parsing URI template for http rule for operation (%v): %v", r.Selector, err)); err != nil {
+							return err
+						}
+						continue
 					}
 
 					newHttpRule := &httppattern.Pattern{
@@ -477,7 +549,10 @@ func (s *ServiceInfo) processHttpRule() error {
 
 					if _, exist := addedRouteMatchWithOptionsSet[routeMatch]; !exist {
 						if err := s.addOptionMethod(method, newHttpRule); err != nil {
-							return fmt.Errorf("error adding auto-generated CORS http rule for operation (%v): %v", r.Selector, err)
+							if err := s.reportError(r.GetSelector(), path, fmt.Errorf("error adding auto-generated CORS http rule for operation (%v): %v", r.Selector, err)); err != nil {
+								return err
+							}
+							continue
 						}
 
 						addedRouteMatchWithOptionsSet[routeMatch] = true
@@ -535,52 +610,42 @@ func (s *ServiceInfo) addOptionMethod(originalMethod *MethodInfo, httpRule *http
 }
 
 func (s *ServiceInfo) processBackendRule() error {
-	backendRoutingClustersMap := make(map[string]string)
-
-	for _, r := range s.ServiceConfig().Backend.GetRules() {
+	for i, r := range s.ServiceConfig().Backend.GetRules() {
 		selector := r.Selector
+		rulePath := fmt.Sprintf("backend.rules[%d]", i)
 		if s.shouldSkipDiscoveryAPI(selector) {
-			glog.Warningf("Skip backend rule %q because discovery API is not supported.", selector)
+			s.warningf(selector, rulePath, "Skip backend rule %q because discovery API is not supported.", selector)
 			continue
 		}
 		if r.Address == "" || s.Options.EnableBackendAddressOverride {
 			// Processing a backend rule associated with the local backend.
-			if err := s.addBackendInfoToMethod(r, "", "", "", s.LocalBackendClusterName(), 0); err != nil {
-				return fmt.Errorf("error processing local backend rule for operation (%v), %v", r.Selector, err)
+			if err := s.addBackendInfoToMethod(r, rulePath, "", "", "", s.LocalBackendClusterName(), 0); err != nil {
+				if err := s.reportError(selector, rulePath+".selector", fmt.Errorf("error processing local backend rule for operation (%v), %v", r.Selector, err)); err != nil {
+					return err
+				}
+				continue
 			}
 		} else {
 			// Processing a backend rule associated with a remote backend.
 			scheme, hostname, port, path, err := util.ParseURI(r.Address)
 			if err != nil {
-				return fmt.Errorf("error parsing remote backend rule's address for operation (%v), %v", r.Selector, err)
-			}
-			address := fmt.Sprintf("%v:%v", hostname, port)
-
-			if _, exist := backendRoutingClustersMap[address]; !exist {
-				// Create cluster for the remote backend.
-				protocol, tls, err := util.ParseBackendProtocol(scheme, r.Protocol)
-				if err != nil {
-					return fmt.Errorf("error parsing remote backend rule's protocol for operation (%v), %v", r.Selector, err)
+				if err := s.reportError(selector, rulePath+".address", fmt.Errorf("error parsing remote backend rule's address for operation (%v), %v", r.Selector, err)); err != nil {
+					return err
 				}
-				if protocol == util.GRPC {
-					s.GrpcSupportRequired = true
+				continue
+			}
+			backendClusterName, err := s.addRemoteBackendCluster(scheme, hostname, port, r.Protocol)
+			if err != nil {
+				if err := s.reportError(selector, rulePath+".protocol", fmt.Errorf("error parsing remote backend rule's protocol for operation (%v), %v", r.Selector, err)); err != nil {
+					return err
 				}
-
-				backendClusterName := util.BackendClusterName(address)
-				s.RemoteBackendClusters = append(s.RemoteBackendClusters,
-					&BackendRoutingCluster{
-						ClusterName: backendClusterName,
-						UseTLS:      tls,
-						Protocol:    protocol,
-						Hostname:    hostname,
-						Port:        port,
-					})
-				backendRoutingClustersMap[address] = backendClusterName
+				continue
 			}
-
-			backendClusterName := backendRoutingClustersMap[address]
-			if err := s.addBackendInfoToMethod(r, scheme, hostname, path, backendClusterName, port); err != nil {
-				return fmt.Errorf("error processing remote backend rule for operation (%v), %v", r.Selector, err)
+			if err := s.addBackendInfoToMethod(r, rulePath, scheme, hostname, path, backendClusterName, port); err != nil {
+				if err := s.reportError(selector, rulePath+".selector", fmt.Errorf("error processing remote backend rule for operation (%v), %v", r.Selector, err)); err != nil {
+					return err
+				}
+				continue
 			}
 		}
 
@@ -589,7 +654,10 @@ func (s *ServiceInfo) processBackendRule() error {
 		if s.LocalHTTPBackendCluster != nil {
 			method, err := s.getMethod(r.GetSelector())
 			if err != nil {
-				return err
+				if err := s.reportError(selector, rulePath+".selector", err); err != nil {
+					return err
+				}
+				continue
 			}
 			idleTimeout := calculateStreamIdleTimeout(util.DefaultResponseDeadline, s.Options)
 			method.HttpBackendInfo = &backendInfo{
@@ -603,12 +671,46 @@ func (s *ServiceInfo) processBackendRule() error {
 	return nil
 }
 
-func (s *ServiceInfo) addBackendInfoToMethod(r *confpb.BackendRule, scheme string, hostname string, path string, backendClusterName string, port uint32) error {
+// addRemoteBackendCluster returns the name of the cluster of a remote backend,
+// the cluster is created for the first rule with the address.
+func (s *ServiceInfo) addRemoteBackendCluster(scheme string, hostname string, port uint32, protocolName string) (string, error) {
+	backendClusterName := util.BackendClusterName(fmt.Sprintf("%v:%v", hostname, port))
+	for _, cluster := range s.RemoteBackendClusters {
+		if cluster.ClusterName == backendClusterName {
+			return backendClusterName, nil
+		}
+	}
+
+	protocol, tls, err := util.ParseBackendProtocol(scheme, protocolName)
+	if err != nil {
+		return "", err
+	}
+	if protocol == util.GRPC {
+		s.GrpcSupportRequired = true
+	}
+	s.RemoteBackendClusters = append(s.RemoteBackendClusters,
+		&BackendRoutingCluster{
+			ClusterName: backendClusterName,
+			UseTLS:      tls,
+			Protocol:    protocol,
+			Hostname:    hostname,
+			Port:        port,
+		})
+	return backendClusterName, nil
+}
+
+func (s *ServiceInfo) addBackendInfoToMethod(r *confpb.BackendRule, rulePath string, scheme string, hostname string, path string, backendClusterName string, port uint32) error {
 	method, err := s.getMethod(r.GetSelector())
 	if err != nil {
 		return err
 	}
+	method.BackendInfo = s.makeBackendInfo(method, r, rulePath, scheme, hostname, path, backendClusterName, port)
+	return nil
+}
 
+// makeBackendInfo makes the backendInfo of backend rule r, at rulePath of
+// the service config, empty if the rule is made from a backend policy.
+func (s *ServiceInfo) makeBackendInfo(method *MethodInfo, r *confpb.BackendRule, rulePath string, scheme string, hostname string, path string, backendClusterName string, port uint32) *backendInfo {
 	// For CONSTANT_ADDRESS, an empty uri will generate an empty path header.
 	// It is an invalid Http header if path is empty.
 	if path == "" && r.PathTranslation == confpb.BackendRule_CONSTANT_ADDRESS {
@@ -620,7 +722,7 @@ func (s *ServiceInfo) addBackendInfoToMethod(r *confpb.BackendRule, scheme strin
 		// If no deadline specified by the user, explicitly use default.
 		deadline = util.DefaultResponseDeadline
 	} else if r.Deadline < 0 {
-		glog.Warningf("Negative deadline of %v specified for method %v. "+
+		s.warningf(r.Selector, rulePath+".deadline", "Negative deadline of %v specified for method %v. "+
 			"Using default deadline %v instead.", r.Deadline, r.Selector, util.DefaultResponseDeadline)
 		deadline = util.DefaultResponseDeadline
 	} else {
@@ -649,7 +751,7 @@ func (s *ServiceInfo) addBackendInfoToMethod(r *confpb.BackendRule, scheme strin
 		idleTimeout = calculateStreamIdleTimeout(deadline, s.Options)
 	}
 
-	method.BackendInfo = &backendInfo{
+	bi := &backendInfo{
 		ClusterName:     backendClusterName,
 		Path:            path,
 		Hostname:        hostname,
@@ -661,15 +763,15 @@ func (s *ServiceInfo) addBackendInfoToMethod(r *confpb.BackendRule, scheme strin
 
 	jwtAud := s.determineBackendAuthJwtAud(r, scheme, hostname)
 	if jwtAud != "" && s.Options.CommonOptions.NonGCP {
-		glog.Warningf("Backend authentication is enabled for method %v, "+
+		s.warningf(r.Selector, rulePath, "Backend authentication is enabled for method %v, "+
 			"but ESPv2 is running on non-GCP. To prevent contacting GCP services, "+
 			"backend authentication is automatically being disabled for this method.",
 			r.Selector)
 		jwtAud = ""
 	}
-	method.BackendInfo.JwtAudience = jwtAud
+	bi.JwtAudience = jwtAud
 
-	return nil
+	return bi
 }
 
 func (s *ServiceInfo) determineBackendAuthJwtAud(r *confpb.BackendRule, scheme string, hostname string) string {
@@ -780,15 +882,19 @@ func (s *ServiceInfo) processUsageRule() error {
 		}
 	}
 
-	for _, r := range s.ServiceConfig().GetUsage().GetRules() {
+	for i, r := range s.ServiceConfig().GetUsage().GetRules() {
 		selector := r.GetSelector()
+		path := fmt.Sprintf("usage.rules[%d]", i)
 		if s.shouldSkipDiscoveryAPI(selector) {
-			glog.Warningf("Skip usage rule %q because discovery API is not supported.", selector)
+			s.warningf(selector, path, "Skip usage rule %q because discovery API is not supported.", selector)
 			continue
 		}
 		method, err := s.getMethod(r.GetSelector())
 		if err != nil {
-			return fmt.Errorf("error processing usage rule for operation (%v): %v", r.Selector, err)
+			if err := s.reportError(selector, path+".selector", fmt.Errorf("error processing usage rule for operation (%v): %v", r.Selector, err)); err != nil {
+				return err
+			}
+			continue
 		}
 		method.AllowUnregisteredCalls = r.GetAllowUnregisteredCalls()
 		method.SkipServiceControl = r.GetSkipServiceControl()
@@ -799,7 +905,7 @@ func (s *ServiceInfo) processUsageRule() error {
 func (s *ServiceInfo) processTranscodingIgnoredQueryParams() error {
 	// Process ignored query params from jwt locations
 	authn := s.serviceConfig.GetAuthentication()
-	for _, provider := range authn.GetProviders() {
+	for i, provider := range authn.GetProviders() {
 		// no custom JwtLocation so use default ones and set the one in query
 		// parameter for transcoder to ignore.
 		if len(provider.JwtLocations) == 0 {
@@ -807,11 +913,15 @@ func (s *ServiceInfo) processTranscodingIgnoredQueryParams() error {
 			continue
 		}
 
-		for _, jwtLocation := range provider.JwtLocations {
+		for j, jwtLocation := range provider.JwtLocations {
 			switch jwtLocation.In.(type) {
 			case *confpb.JwtLocation_Query:
 				if jwtLocation.ValuePrefix != "" {
-					return fmt.Errorf("error processing authentication provider (%v): JwtLocation type [Query] should be set without valuePrefix, but it was set to [%v]", provider.Id, jwtLocation.ValuePrefix)
+					path := fmt.Sprintf("authentication.providers[%d].jwt_locations[%d].value_prefix", i, j)
+					if err := s.reportError("", path, fmt.Errorf("error processing authentication provider (%v): JwtLocation type [Query] should be set without valuePrefix, but it was set to [%v]", provider.Id, jwtLocation.ValuePrefix)); err != nil {
+						return err
+					}
+					continue
 				}
 				// set the custom JwtLocation in query parameter for transcoder to ignore.
 				s.AllTranscodingIgnoredQueryParams[jwtLocation.GetQuery()] = true
@@ -833,10 +943,11 @@ func (s *ServiceInfo) processTranscodingIgnoredQueryParams() error {
 }
 
 func (s *ServiceInfo) processApiKeyLocations() error {
-	for _, rule := range s.ServiceConfig().GetSystemParameters().GetRules() {
+	for i, rule := range s.ServiceConfig().GetSystemParameters().GetRules() {
 		selector := rule.GetSelector()
+		path := fmt.Sprintf("system_parameters.rules[%d]", i)
 		if s.shouldSkipDiscoveryAPI(selector) {
-			glog.Warningf("Skip SystemParameterRule %q because discovery API is not supported.", selector)
+			s.warningf(selector, path, "Skip SystemParameterRule %q because discovery API is not supported.", selector)
 			continue
 		}
 		apiKeyLocationParameters := []*confpb.SystemParameter{}
@@ -849,7 +960,10 @@ func (s *ServiceInfo) processApiKeyLocations() error {
 
 		method, err := s.getMethod(rule.GetSelector())
 		if err != nil {
-			return fmt.Errorf("error processing system parameter rule for operation (%v): %v", rule.Selector, err)
+			if err := s.reportError(selector, path+".selector", fmt.Errorf("error processing system parameter rule for operation (%v): %v", rule.Selector, err)); err != nil {
+				return err
+			}
+			continue
 		}
 
 		s.extractApiKeyLocations(method, apiKeyLocationParameters)
@@ -897,12 +1011,21 @@ func (s *ServiceInfo) processTypes() error {
 
 	// Convert into map by type name for easy lookup.
 	typesByTypeName := make(map[string]*typepb.Type)
-	for _, t := range s.ServiceConfig().GetTypes() {
+	typePaths := make(map[string]string)
+	for i, t := range s.ServiceConfig().GetTypes() {
 		typesByTypeName[t.Name] = t
+		typePaths[t.Name] = fmt.Sprintf("types[%d]", i)
 	}
 
-	// For each method, lookup the request type.
-	for operation, mi := range s.Methods {
+	// For each method, lookup the request type, in the order of the operations
+	// for the problems to be reported in order.
+	var operations []string
+	for operation := range s.Methods {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+	for _, operation := range operations {
+		mi := s.Methods[operation]
 		requestTypeName := mi.RequestTypeName
 		// Only methods generated from Apis have non empty requestTypeName.
 		// Skip the methods with empty requestTypeName.
@@ -912,7 +1035,10 @@ func (s *ServiceInfo) processTypes() error {
 
 		requestType, ok := typesByTypeName[requestTypeName]
 		if !ok {
-			glog.Warningf("error processing types for operation (%v): could not find type with name (%v)", operation, requestTypeName)
+			// Without any types, no field can be mapped anyway.
+			if len(typesByTypeName) > 0 {
+				s.warningf(operation, "types", "error processing types for operation (%v): could not find type with name (%v)", operation, requestTypeName)
+			}
 			continue
 		}
 
@@ -927,8 +1053,10 @@ func (s *ServiceInfo) processTypes() error {
 						// Duplicate snake name with mismatching JSON name.
 						// This will cause an error in path matcher variable bindings.
 						// Disallow it.
-						return fmt.Errorf("error processing types for operation (%v): detected two types with same snake_name (%v) "+
-							"but mistmatching json_name (%v, %v)", operation, field.GetName(), field.GetJsonName(), prevJsonName)
+						if err := s.reportError(operation, typePaths[requestTypeName], fmt.Errorf("error processing types for operation (%v): detected two types with same snake_name (%v) "+
+							"but mistmatching json_name (%v, %v)", operation, field.GetName(), field.GetJsonName(), prevJsonName)); err != nil {
+							return err
+						}
 					}
 				}
 
@@ -1001,16 +1129,20 @@ func (s *ServiceInfo) shouldSkipDiscoveryAPI(operation string) bool {
 
 func (s *ServiceInfo) processAuthRequirement() error {
 	auth := s.serviceConfig.GetAuthentication()
-	for _, rule := range auth.GetRules() {
+	for i, rule := range auth.GetRules() {
 		selector := rule.GetSelector()
+		path := fmt.Sprintf("authentication.rules[%d]", i)
 		if s.shouldSkipDiscoveryAPI(selector) {
-			glog.Warningf("Skip Auth rule %q because discovery API is not supported.", selector)
+			s.warningf(selector, path, "Skip Auth rule %q because discovery API is not supported.", selector)
 			continue
 		}
 		if len(rule.GetRequirements()) > 0 {
 			mi, err := s.getMethod(rule.GetSelector())
 			if err != nil {
-				return fmt.Errorf("error processing authentication rule for operation (%v): selector not defined in Api.method or Http.rule", rule.GetSelector())
+				if err := s.reportError(selector, path+".selector", fmt.Errorf("error processing authentication rule for operation (%v): selector not defined in Api.method or Http.rule", rule.GetSelector())); err != nil {
+					return err
+				}
+				continue
 			}
 			mi.RequireAuth = true
 		}
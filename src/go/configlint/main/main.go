@@ -0,0 +1,73 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// configlint reports the problems ESPv2 finds in a service config, so they
+// are caught before `gcloud endpoints services deploy`. It accepts the same
+// flags as the Config Manager, and exits with status 1 if there is an error.
+//
+//	configlint --service_config=service.yaml --backend_address=grpc://127.0.0.1:8082
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configgen"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configmanager/flags"
+	"github.com/golang/glog"
+)
+
+var (
+	serviceConfigPath = flag.String("service_config", "", "path to the service config in JSON, YAML (.yaml, .yml) or binary proto (.pb, .bin)")
+	format            = flag.String("format", "text", `the output format, "text" or "json"`)
+	failOnWarning     = flag.Bool("fail_on_warning", false, "exit with status 1 if there is a warning")
+)
+
+func main() {
+	flag.Parse()
+	if *serviceConfigPath == "" {
+		glog.Exitf("flag --service_config is required")
+	}
+
+	serviceConfig, err := configgen.ReadServiceConfig(*serviceConfigPath)
+	if err != nil {
+		glog.Exitf("fail to read service config: %v", err)
+	}
+	diagnostics := configinfo.Lint(serviceConfig, flags.EnvoyConfigOptionsFromFlags())
+
+	switch *format {
+	case "text":
+		for _, d := range diagnostics {
+			fmt.Println(d)
+		}
+	case "json":
+		if diagnostics == nil {
+			diagnostics = []*configinfo.Diagnostic{}
+		}
+		bytes, err := json.MarshalIndent(diagnostics, "", "  ")
+		if err != nil {
+			glog.Exitf("fail to marshal the diagnostics: %v", err)
+		}
+		fmt.Println(string(bytes))
+	default:
+		glog.Exitf(`unknown format %q, must be "text" or "json"`, *format)
+	}
+
+	if configinfo.HasError(diagnostics) || (*failOnWarning && len(diagnostics) > 0) {
+		os.Exit(1)
+	}
+}
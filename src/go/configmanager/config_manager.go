@@ -15,14 +15,17 @@
 package configmanager
 
 import (
-	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
@@ -46,28 +49,168 @@ var (
 	checkNewRolloutInterval = flag.Duration("check_rollout_interval", 60*time.Second, `the interval periodically to call servicemanagment to check the latest rolloutil.`)
 	CheckMetadata           = flag.Bool("check_metadata", false, `enable fetching service name, config ID and rollout strategy from service metadata server`)
 	RolloutStrategy         = flag.String("rollout_strategy", "fixed", `service config rollout strategy, must be either "managed" or "fixed"`)
-	ServiceConfigId         = flag.String("service_config_id", "", "initial service config id")
-	ServiceName             = flag.String("service", "", "endpoint service name")
-	ServicePath             = flag.String("service_json_path", "", `file path to the endpoint service config.
+	ServiceConfigId         = flag.String("service_config_id", "", `initial service config id. When multiple services are specified
+					in --service, a comma separated list of config ids in the same order`)
+	ServiceName = flag.String("service", "", `endpoint service name. Multiple services can be served
+					by one proxy as a comma separated list, the first one is the
+					default service for requests not matching any service name`)
+	checkServiceJsonInterval = flag.Duration("check_service_json_interval", 5*time.Second, `the interval to check whether the files in
+					--service_json_path changed and reload them. Disabled if 0`)
+	serviceConfigCacheDir = flag.String("service_config_cache_dir", "", `directory keeping the last service configs and rollout ids
+					accepted by Envoy. They are used at startup when the service configs
+					cannot be fetched from Service Management. Disabled if empty`)
+	serviceConfigCacheMaxStaleness = flag.Duration("service_config_cache_max_staleness", 24*time.Hour, `the max age of a cached service config
+					in --service_config_cache_dir to be used at startup, counted from when a
+					rollout check last confirmed it as the latest`)
+	StatusPort = flag.Int("status_port", 0, `port of the config manager status server on localhost, serving
+					/configz, /snapshot, /serviceinfo and /healthz. Disabled if 0`)
+	DrainPeriod = flag.Duration("drain_period", 5*time.Second, `on SIGTERM, how long Envoy fails the health checks on --healthz
+					and drains its connections, while xDS is still served, before the
+					config manager server stops`)
+	ServiceConfigSource = flag.String("service_config_source", "", `URI of the endpoint service config, or a comma separated list
+					of URIs for multiple services: servicemanagement://SERVICE_NAME[/CONFIG_ID],
+					gs://BUCKET/OBJECT, https://HOST/PATH or a file path. When this flag is
+					used, the following flags are ignored; --service_json_path,
+					--service_config_id, --service, --rollout_strategy`)
+	serviceConfigSourceBearerTokenFile = flag.String("service_config_source_bearer_token_file", "", `file with the bearer token
+					sent to the https:// service config sources. The http:// sources are rejected with it`)
+	checkServiceConfigSourceInterval = flag.Duration("check_service_config_source_interval", 60*time.Second, `the interval to check
+					whether the service configs in --service_config_source changed. Disabled if 0`)
+	ServicePath = flag.String("service_json_path", "", `file path to the endpoint service config, or a comma
+					separated list of file paths for multiple services.
 					When this flag is used, fixed rollout_strategy will be used,
 					GCP metadata server will not be called to fetch access token, and
 					following flags will be ignored; --service_config_id, --service,
 					--rollout_strategy`)
+	OpenAPIPath = flag.String("openapi_path", "", `file path to an OpenAPI 2.0 or 3.x document of the endpoint
+					service, or a comma separated list of file paths for multiple services,
+					converted into service configs without Service Management. It can be
+					used with --service_json_path, and the same flags are ignored`)
+	DescriptorPath = flag.String("descriptor_path", "", `file path to a binary FileDescriptorSet of gRPC services, generated by
+					protoc with --include_imports, or a comma separated list of file paths
+					for multiple services. The service config is built from the descriptor,
+					with the http rules from the google.api.http annotations. It can be used
+					with --service_json_path, and the same flags are ignored`)
+	DescriptorRulesPath = flag.String("descriptor_rules_path", "", `file path to a service config in YAML or JSON with the name and the
+					authentication, backend and usage rules of the gRPC services in
+					--descriptor_path, or a comma separated list of file paths, one for each
+					descriptor. Empty paths in the list are allowed`)
 )
 
-// Config Manager handles service configuration fetching and updating.
-// TODO(jilinxia): handles multi service name.
-type ConfigManager struct {
-	serviceName        string
-	envoyConfigOptions options.ConfigGeneratorOptions
-	serviceInfo        *configinfo.ServiceInfo
-	cache              cache.SnapshotCache
+// serviceState holds the config state of one service served by the Config Manager.
+type serviceState struct {
+	name          string
+	serviceInfo   *configinfo.ServiceInfo
+	serviceConfig *confpb.Service
 
-	metadataFetcher         *metadata.MetadataFetcher
 	serviceConfigFetcher    *sc.ServiceConfigFetcher
 	rolloutIdChangeDetector *sc.RolloutIdChangeDetector
+	// The rollout of the service config, empty if the config is not from a rollout.
+	rolloutId string
+	// When the service config was fetched from Service Management, or last
+	// confirmed by a rollout check.
+	fetchTime time.Time
+
+	// The config of the last snapshot ACKed by Envoy, restored on NACK.
+	ackedServiceConfig *confpb.Service
+	ackedServiceInfo   *configinfo.ServiceInfo
+	ackedRolloutId     string
+	// Config ids NACKed by Envoy, mapped to the error detail.
+	rejectedConfigIds map[string]string
+
+	// Set if the service config is from --service_config_source.
+	source sc.ServiceConfigSource
+
+	// Set if the service config is read from --service_json_path, or built
+	// from --openapi_path or --descriptor_path, as told by format. The
+	// modification time and the hash cover the rules file of a descriptor.
+	format              serviceFileFormat
+	servicePath         string
+	descriptorRulesPath string
+	serviceModTime      time.Time
+	serviceHash         [sha256.Size]byte
+}
+
+// configId identifies the configs serving the service, it is followed by the
+// traffic split configs in a partial rollout, see rolloutConfigId.
+func (s *serviceState) configId() string {
+	return serviceConfigId(s.serviceConfig, s.serviceInfo)
+}
+
+func (s *serviceState) ackedConfigId() string {
+	return serviceConfigId(s.ackedServiceConfig, s.ackedServiceInfo)
+}
+
+func serviceConfigId(serviceConfig *confpb.Service, serviceInfo *configinfo.ServiceInfo) string {
+	if serviceConfig == nil {
+		return ""
+	}
+	configIds := []string{serviceConfig.Id}
+	percentages := make(map[string]float64)
+	if serviceInfo != nil {
+		for _, split := range serviceInfo.TrafficSplits {
+			configIds = append(configIds, split.ServiceInfo.ConfigID)
+			percentages[split.ServiceInfo.ConfigID] = split.Percentage
+		}
+	}
+	return rolloutConfigId(configIds, percentages)
+}
+
+// rolloutConfigId formats the config ids of a rollout ordered by
+// trafficOrderedConfigIds, e.g. "2023-01-02r0+2023-01-01r0:20" when config
+// 2023-01-01r0 gets 20% of the traffic.
+func rolloutConfigId(configIds []string, percentages map[string]float64) string {
+	rolloutId := configIds[0]
+	for _, configId := range configIds[1:] {
+		rolloutId += fmt.Sprintf("+%s:%v", configId, percentages[configId])
+	}
+	return rolloutId
+}
+
+// trafficOrderedConfigIds orders the config ids of a rollout by traffic
+// percentage, ties broken by id. The first config serves the requests not
+// assigned to the others.
+func trafficOrderedConfigIds(percentages map[string]float64) []string {
+	var configIds []string
+	for configId := range percentages {
+		configIds = append(configIds, configId)
+	}
+	sort.Slice(configIds, func(i, j int) bool {
+		if percentages[configIds[i]] != percentages[configIds[j]] {
+			return percentages[configIds[i]] > percentages[configIds[j]]
+		}
+		return configIds[i] < configIds[j]
+	})
+	return configIds
+}
 
-	curServiceConfig *confpb.Service
+// Config Manager handles service configuration fetching and updating.
+// All the services share one listener, each service has its own virtual host.
+type ConfigManager struct {
+	envoyConfigOptions options.ConfigGeneratorOptions
+	cache              cache.SnapshotCache
+	metadataFetcher    *metadata.MetadataFetcher
+	rolloutStrategy    string
+	// Set if --service_config_cache_dir is specified.
+	configCache *serviceConfigCache
+	// Cancelled by Close to stop checking the rollouts and the service config files.
+	ctx          context.Context
+	stopWatching context.CancelFunc
+
+	// mu guards all the fields below, which are updated by the rollout
+	// detectors and the xDS callbacks.
+	mu       sync.Mutex
+	services []*serviceState
+
+	// Fields tracking whether Envoy accepts the pushed snapshots, see xds_callbacks.go.
+	curSnapshot    *cache.Snapshot
+	ackedSnapshot  *cache.Snapshot
+	ackedTypes     map[string]bool
+	sentVersions   map[responseKey]string
+	rejectedConfig *RejectedConfig
+
+	// Set by Drain, the snapshots made afterwards fail the health checks.
+	draining bool
 }
 
 // NewConfigManager creates new instance of Config Manager.
@@ -76,42 +219,96 @@ func NewConfigManager(mf *metadata.MetadataFetcher, opts options.ConfigGenerator
 	m := &ConfigManager{
 		metadataFetcher:    mf,
 		envoyConfigOptions: opts,
+		rolloutStrategy:    util.FixedRolloutStrategy,
 	}
+	m.ctx, m.stopWatching = context.WithCancel(context.Background())
 	m.cache = cache.NewSnapshotCache(true, m, m)
 
+	if *ServiceConfigSource != "" {
+		if err := m.initServiceConfigSources(accessTokenFunc(mf, opts)); err != nil {
+			return nil, err
+		}
+		glog.Infof("create new Config Manager from service config sources %v", *ServiceConfigSource)
+		return m, nil
+	}
+
 	// If service config is provided as a file, just use it and disable managed rollout
-	if *ServicePath != "" {
+	if *ServicePath != "" || *OpenAPIPath != "" || *DescriptorPath != "" {
 		// Following flags will not be used
 		if *ServiceName != "" {
-			glog.Infof("flag --service is ignored when --service_json_path is specified.")
+			glog.Infof("flag --service is ignored when a service config file is specified.")
 		}
 		if *ServiceConfigId != "" {
-			glog.Infof("flag --service_config_id is ignored when --service_json_path is specified.")
+			glog.Infof("flag --service_config_id is ignored when a service config file is specified.")
 		}
 		if *RolloutStrategy != "fixed" {
-			glog.Infof("flag --rollout_strategy will be fixed when --service_json_path is specified.")
+			glog.Infof("flag --rollout_strategy will be fixed when a service config file is specified.")
 		}
 
-		if err := m.readAndApplyServiceConfig(*ServicePath); err != nil {
+		var services []*serviceState
+		for _, servicePath := range splitList(*ServicePath) {
+			services = append(services, &serviceState{
+				format:      serviceConfigJson,
+				servicePath: servicePath,
+			})
+		}
+		for _, openAPIPath := range splitList(*OpenAPIPath) {
+			services = append(services, &serviceState{
+				format:      openAPIDocument,
+				servicePath: openAPIPath,
+			})
+		}
+		descriptorPaths := splitList(*DescriptorPath)
+		// Not splitList, an empty path keeps the position of a descriptor
+		// without rules.
+		var rulesPaths []string
+		if *DescriptorRulesPath != "" {
+			rulesPaths = strings.Split(*DescriptorRulesPath, ",")
+		}
+		if len(rulesPaths) > len(descriptorPaths) {
+			return nil, fmt.Errorf("flag --descriptor_rules_path has %d paths, more than the %d of --descriptor_path", len(rulesPaths), len(descriptorPaths))
+		}
+		for i, descriptorPath := range descriptorPaths {
+			svc := &serviceState{
+				format:      protoDescriptor,
+				servicePath: descriptorPath,
+			}
+			if i < len(rulesPaths) {
+				svc.descriptorRulesPath = strings.TrimSpace(rulesPaths[i])
+			}
+			services = append(services, svc)
+		}
+
+		for _, svc := range services {
+			if err := m.readServiceConfig(svc); err != nil {
+				return nil, err
+			}
+			m.services = append(m.services, svc)
+		}
+		if err := m.updateSnapshot(); err != nil {
 			return nil, err
 		}
+		if *checkServiceJsonInterval > 0 {
+			m.watchServiceConfigFiles(*checkServiceJsonInterval)
+		}
 
-		glog.Infof("create new Config Manager from static service config json file at %v", *ServicePath)
+		glog.Infof("create new Config Manager from static service config files at %v %v %v", *ServicePath, *OpenAPIPath, *DescriptorPath)
 		return m, nil
 	}
 
-	m.serviceName = *ServiceName
+	serviceNames := splitList(*ServiceName)
 	checkMetadata := *CheckMetadata
 	var err error
 
-	if m.serviceName == "" && checkMetadata && mf != nil {
-		m.serviceName, err = mf.FetchServiceName()
-		if m.serviceName == "" || err != nil {
+	if len(serviceNames) == 0 && checkMetadata && mf != nil {
+		serviceName, err := mf.FetchServiceName()
+		if serviceName == "" || err != nil {
 			return nil, fmt.Errorf("failed to read metadata with key endpoints-service-name from metadata server: %v", err)
 		}
-	} else if m.serviceName == "" && !checkMetadata {
+		serviceNames = []string{serviceName}
+	} else if len(serviceNames) == 0 && !checkMetadata {
 		return nil, fmt.Errorf("service name is not specified, required because metadata fetching is disabled")
-	} else if m.serviceName == "" && mf == nil {
+	} else if len(serviceNames) == 0 && mf == nil {
 		return nil, fmt.Errorf("service name is not specified, required on a non-gcp deployment")
 	}
 	rolloutStrategy := *RolloutStrategy
@@ -125,6 +322,7 @@ func NewConfigManager(mf *metadata.MetadataFetcher, opts options.ConfigGenerator
 	if !(rolloutStrategy == util.FixedRolloutStrategy || rolloutStrategy == util.ManagedRolloutStrategy) {
 		return nil, fmt.Errorf(`failed to set rollout strategy. It must be either "managed" or "fixed"`)
 	}
+	m.rolloutStrategy = rolloutStrategy
 
 	// when --non_gcp  is set, instance metadata server(imds) is not defined. So
 	// accessToken is unavailable from imds and --service_account_key must be
@@ -134,25 +332,24 @@ func NewConfigManager(mf *metadata.MetadataFetcher, opts options.ConfigGenerator
 		return nil, fmt.Errorf("if flag --non_gcp is specified, flag --service_account_key must be specified")
 	}
 
-	accessToken := func() (string, time.Duration, error) {
-		if opts.ServiceAccountKey != "" {
-			return tokengenerator.GenerateAccessTokenFromFile(opts.ServiceAccountKey)
-		}
-		return mf.FetchAccessToken()
-	}
+	accessToken := accessTokenFunc(mf, opts)
 
 	client, err := httpsClient(opts)
 	if err != nil {
 		return nil, fmt.Errorf("fail to init httpsClient: %v", err)
 	}
 
-	m.serviceConfigFetcher = sc.NewServiceConfigFetcher(client, opts.ServiceManagementURL,
-		m.serviceName, accessToken)
+	if *serviceConfigCacheDir != "" {
+		if m.configCache, err = newServiceConfigCache(*serviceConfigCacheDir, *serviceConfigCacheMaxStaleness); err != nil {
+			return nil, err
+		}
+		go m.configCache.run(m.ctx)
+	}
 
-	configId := ""
+	var configIds []string
 	if rolloutStrategy == util.FixedRolloutStrategy {
-		configId = *ServiceConfigId
-		if configId == "" {
+		configIds = splitList(*ServiceConfigId)
+		if len(configIds) == 0 {
 			if mf == nil {
 				return nil, fmt.Errorf("service config id is not specified, required on a non-gcp deployment")
 			}
@@ -161,81 +358,267 @@ func NewConfigManager(mf *metadata.MetadataFetcher, opts options.ConfigGenerator
 				return nil, fmt.Errorf("service config id is not specified, required because metadata fetching is disabled")
 			}
 
-			configId, err = mf.FetchConfigId()
+			if len(serviceNames) > 1 {
+				return nil, fmt.Errorf("service config ids are not specified, required when multiple services are specified")
+			}
+
+			configId, err := mf.FetchConfigId()
 			if configId == "" || err != nil {
 				return nil, fmt.Errorf("failed to read metadata with key endpoints-service-version from metadata server: %v", err)
 			}
+			configIds = []string{configId}
 		}
-	} else if rolloutStrategy == util.ManagedRolloutStrategy {
-		configId, err = m.serviceConfigFetcher.LoadConfigIdFromRollouts()
-		if err != nil {
+		if len(configIds) != len(serviceNames) {
+			return nil, fmt.Errorf("got %d service config ids for %d services, each service requires one config id", len(configIds), len(serviceNames))
+		}
+	}
+
+	for i, serviceName := range serviceNames {
+		svc := &serviceState{
+			name:                 serviceName,
+			serviceConfigFetcher: sc.NewServiceConfigFetcher(client, opts.ServiceManagementURL, serviceName, accessToken),
+		}
+
+		var configId string
+		if rolloutStrategy == util.FixedRolloutStrategy {
+			configId = configIds[i]
+		}
+		if err = m.loadStartupServiceConfig(svc, configId); err != nil {
 			return nil, err
 		}
+		m.services = append(m.services, svc)
 	}
 
-	if err = m.fetchAndApplyServiceConfig(configId); err != nil {
-		return nil, fmt.Errorf("fail to fetch and apply the startup service config, %v", err)
+	if err = m.updateSnapshot(); err != nil {
+		return nil, fmt.Errorf("fail to apply the startup service config, %v", err)
 	}
 
 	if rolloutStrategy == util.ManagedRolloutStrategy {
-		m.rolloutIdChangeDetector = sc.NewRolloutIdChangeDetector(client, opts.ServiceControlURL, m.serviceName, accessToken)
-		m.rolloutIdChangeDetector.SetDetectRolloutIdChangeTimer(*checkNewRolloutInterval, func() {
-			latestConfigId, err := m.serviceConfigFetcher.LoadConfigIdFromRollouts()
-			if err != nil {
-				glog.Errorf("error occurred when getting configId by fetching rollout, %v", err)
-				return
-			}
-
-			if err = m.fetchAndApplyServiceConfig(latestConfigId); err != nil {
-				glog.Errorf("error occurred when fetching and applying new service config, %v", err)
-			}
-		})
+		for _, svc := range m.services {
+			svc := svc
+			svc.rolloutIdChangeDetector = sc.NewRolloutIdChangeDetector(client, opts.ServiceControlURL, svc.name, accessToken)
+			svc.rolloutIdChangeDetector.WatchRolloutIdChange(m.ctx, *checkNewRolloutInterval, func() error {
+				rolloutId, percentages, err := svc.serviceConfigFetcher.LoadTrafficPercentagesFromRollouts(m.ctx)
+				if err != nil {
+					return fmt.Errorf("error occurred when getting configId by fetching rollout for service %v, %v", svc.name, err)
+				}
+
+				if err = m.fetchAndApplyRollout(svc, rolloutId, percentages); err != nil {
+					return fmt.Errorf("error occurred when fetching and applying new service config for service %v, %v", svc.name, err)
+				}
+				return nil
+			})
+		}
 	}
 
 	glog.Infof("create new Config Manager for service (%v) with configuration id (%v), %v rollout strategy",
-		m.serviceName, m.curConfigId(), rolloutStrategy)
+		strings.Join(serviceNames, ","), m.curConfigId(), rolloutStrategy)
 	return m, nil
 }
 
-func (m *ConfigManager) fetchAndApplyServiceConfig(latestConfigId string) error {
-	if latestConfigId == m.curConfigId() {
-		glog.Infof("no new configuration to load for service %v, current configuration Id %v", m.serviceName, m.curConfigId())
+// accessTokenFunc returns the function getting the access token to call
+// Google APIs, nil if there is no way to get one.
+func accessTokenFunc(mf *metadata.MetadataFetcher, opts options.ConfigGeneratorOptions) util.GetAccessTokenFunc {
+	if opts.ServiceAccountKey != "" {
+		return func() (string, time.Duration, error) {
+			return tokengenerator.GenerateAccessTokenFromFile(opts.ServiceAccountKey)
+		}
+	}
+	if mf != nil {
+		return mf.FetchAccessToken
+	}
+	return nil
+}
+
+// loadStartupServiceConfig fetches the startup service config of svc, the
+// one of configId or, if it is empty, the ones of the latest rollout. The
+// cached service config is used if they cannot be fetched.
+func (m *ConfigManager) loadStartupServiceConfig(svc *serviceState, configId string) error {
+	var err error
+	rolloutId, percentages := "", map[string]float64{configId: 100}
+	if configId == "" {
+		rolloutId, percentages, err = svc.serviceConfigFetcher.LoadTrafficPercentagesFromRollouts(m.ctx)
+	}
+	if err == nil {
+		if svc.serviceConfig, svc.serviceInfo, err = m.fetchRollout(svc, percentages); err == nil {
+			svc.rolloutId, svc.fetchTime = rolloutId, time.Now()
+			return nil
+		}
+	}
+	fetchErr := fmt.Errorf("fail to fetch the startup service config of service %s, %v", svc.name, err)
+	if m.configCache == nil {
+		return fetchErr
+	}
+
+	glog.Errorf("%v, trying the cached service config", fetchErr)
+	entry, configs, err := m.configCache.load(svc.name)
+	if err != nil {
+		return fmt.Errorf("%v; fail to load the cached service config, %v", fetchErr, err)
+	}
+	if configId != "" {
+		if configs[0].GetId() != configId {
+			return fmt.Errorf("%v; the cached service config %s is not the required %s", fetchErr, configs[0].GetId(), configId)
+		}
+		// The fixed rollout strategy does not split the traffic.
+		configs = configs[:1]
+	}
+	if svc.serviceConfig, svc.serviceInfo, err = m.makeRolloutServiceInfo(configs, entry.Percentages); err != nil {
+		return fmt.Errorf("%v; fail to apply the cached service config, %v", fetchErr, err)
+	}
+	svc.rolloutId, svc.fetchTime = entry.RolloutId, entry.FetchTime
+	glog.Warningf("use the cached service config %v of service %v, rollout %q, fetched at %v",
+		svc.configId(), svc.name, entry.RolloutId, entry.FetchTime)
+	return nil
+}
+
+func (m *ConfigManager) fetchAndApplyServiceConfig(svc *serviceState, latestConfigId string) error {
+	return m.fetchAndApplyRollout(svc, "", map[string]float64{latestConfigId: 100})
+}
+
+// fetchAndApplyRollout applies the configs of a rollout, keyed by config id
+// with their traffic percentages.
+func (m *ConfigManager) fetchAndApplyRollout(svc *serviceState, rolloutId string, percentages map[string]float64) error {
+	if len(percentages) == 0 {
+		return fmt.Errorf("no service config in the rollout of service %v", svc.name)
+	}
+	latestConfigId := rolloutConfigId(trafficOrderedConfigIds(percentages), percentages)
+
+	m.mu.Lock()
+	curConfigId := svc.configId()
+	errorDetail, rejected := svc.rejectedConfigIds[latestConfigId]
+	m.mu.Unlock()
+	if latestConfigId == curConfigId {
+		glog.Infof("no new configuration to load for service %v, current configuration Id %v", svc.name, curConfigId)
+		m.confirmServiceConfig(svc, curConfigId)
+		return nil
+	}
+	if rejected {
+		glog.Warningf("skip configuration Id %v for service %v, it was rejected by Envoy: %v", latestConfigId, svc.name, errorDetail)
 		return nil
 	}
 
-	serviceConfig, err := m.serviceConfigFetcher.FetchConfig(latestConfigId)
+	serviceConfig, serviceInfo, err := m.fetchRollout(svc, percentages)
 	if err != nil {
 		return err
 	}
 
-	return m.applyServiceConfig(serviceConfig)
+	return m.applyServiceInfo(svc, serviceConfig, serviceInfo, rolloutId)
+}
+
+// confirmServiceConfig records that the latest rollout of svc still has the
+// config configId, which is then as fresh as a newly fetched one. The cached
+// config is refreshed too, so its staleness counts from the last check
+// instead of the last config change.
+func (m *ConfigManager) confirmServiceConfig(svc *serviceState, configId string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// The config may be rolled back since the check.
+	if svc.configId() != configId {
+		return
+	}
+	svc.fetchTime = time.Now()
+	// Only the configs accepted by Envoy are cached.
+	if m.configCache == nil || svc.ackedServiceConfig == nil || svc.ackedConfigId() != configId {
+		return
+	}
+	m.configCache.saveAsync(newServiceConfigCacheRecord(svc))
+}
+
+// fetchRollout fetches the configs of a rollout. The config with the most
+// traffic is returned, the others are its traffic splits.
+func (m *ConfigManager) fetchRollout(svc *serviceState, percentages map[string]float64) (*confpb.Service, *configinfo.ServiceInfo, error) {
+	var configs []*confpb.Service
+	for _, configId := range trafficOrderedConfigIds(percentages) {
+		config, err := svc.serviceConfigFetcher.FetchConfig(m.ctx, configId)
+		if err != nil {
+			return nil, nil, err
+		}
+		configs = append(configs, config)
+	}
+
+	serviceConfig, serviceInfo, err := m.makeRolloutServiceInfo(configs, percentages)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(serviceInfo.TrafficSplits) > 0 {
+		glog.Infof("service %v splits the traffic across configurations %v", svc.name, serviceConfigId(serviceConfig, serviceInfo))
+	}
+	return serviceConfig, serviceInfo, nil
+}
+
+// makeRolloutServiceInfo makes the ServiceInfo of the configs of a rollout,
+// ordered by trafficOrderedConfigIds. The configs after the first one are
+// its traffic splits.
+func (m *ConfigManager) makeRolloutServiceInfo(configs []*confpb.Service, percentages map[string]float64) (*confpb.Service, *configinfo.ServiceInfo, error) {
+	serviceInfo, err := m.makeServiceInfo(configs[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, splitConfig := range configs[1:] {
+		splitInfo, err := m.makeServiceInfo(splitConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		serviceInfo.TrafficSplits = append(serviceInfo.TrafficSplits, &configinfo.TrafficSplit{
+			ServiceInfo: splitInfo,
+			Percentage:  percentages[splitConfig.GetId()],
+		})
+	}
+	return configs[0], serviceInfo, nil
 }
 
-func (m *ConfigManager) readAndApplyServiceConfig(servicePath string) error {
-	config, err := ioutil.ReadFile(servicePath)
+// readServiceConfig reads the service config file of svc, whose format and
+// paths are set.
+func (m *ConfigManager) readServiceConfig(svc *serviceState) error {
+	config, err := svc.readServiceConfigFile()
 	if err != nil {
-		return fmt.Errorf("fail to read service config file: %s, error: %s", servicePath, err)
+		return err
 	}
 
-	serviceConfig, err := util.UnmarshalServiceConfig(bytes.NewReader(config))
+	serviceConfig, err := svc.unmarshalServiceConfigFile(config)
 	if err != nil {
-		return fmt.Errorf("fail to unmarshal service config with error: %s", err)
+		return err
+	}
+
+	if svc.serviceInfo, err = m.makeServiceInfo(serviceConfig); err != nil {
+		return err
+	}
+	svc.name = serviceConfig.GetName()
+	svc.serviceConfig = serviceConfig
+	return nil
+}
+
+// applyServiceConfig replaces the service config of svc and pushes a new
+// snapshot. svc is left unchanged if the snapshot cannot be made.
+func (m *ConfigManager) applyServiceConfig(svc *serviceState, serviceConfig *confpb.Service) error {
+	serviceInfo, err := m.makeServiceInfo(serviceConfig)
+	if err != nil {
+		return err
 	}
+	return m.applyServiceInfo(svc, serviceConfig, serviceInfo, "")
+}
 
-	m.serviceName = serviceConfig.GetName()
-	return m.applyServiceConfig(serviceConfig)
+func (m *ConfigManager) applyServiceInfo(svc *serviceState, serviceConfig *confpb.Service, serviceInfo *configinfo.ServiceInfo, rolloutId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldServiceConfig, oldServiceInfo, oldRolloutId, oldFetchTime := svc.serviceConfig, svc.serviceInfo, svc.rolloutId, svc.fetchTime
+	svc.serviceConfig, svc.serviceInfo, svc.rolloutId, svc.fetchTime = serviceConfig, serviceInfo, rolloutId, time.Now()
+	if err := m.updateSnapshotLocked(); err != nil {
+		svc.serviceConfig, svc.serviceInfo, svc.rolloutId, svc.fetchTime = oldServiceConfig, oldServiceInfo, oldRolloutId, oldFetchTime
+		return err
+	}
+	return nil
 }
 
-func (m *ConfigManager) applyServiceConfig(serviceConfig *confpb.Service) error {
+func (m *ConfigManager) makeServiceInfo(serviceConfig *confpb.Service) (*configinfo.ServiceInfo, error) {
 	if serviceConfig == nil {
-		return fmt.Errorf("applid service config is empty")
+		return nil, fmt.Errorf("applid service config is empty")
 	}
 
-	var err error
-	m.curServiceConfig = serviceConfig
-	m.serviceInfo, err = configinfo.NewServiceInfoFromServiceConfig(serviceConfig, serviceConfig.Id, m.envoyConfigOptions)
+	serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(serviceConfig, serviceConfig.Id, m.envoyConfigOptions)
 	if err != nil {
-		return fmt.Errorf("fail to initialize ServiceInfo, %s", err)
+		return nil, fmt.Errorf("fail to initialize ServiceInfo, %s", err)
 	}
 
 	if m.metadataFetcher != nil {
@@ -243,22 +626,86 @@ func (m *ConfigManager) applyServiceConfig(serviceConfig *confpb.Service) error
 		if err != nil {
 			m.Infof("metadata server was not reached, skipping GCP Attributes: %v", err)
 		} else {
-			m.serviceInfo.GcpAttributes = attrs
+			serviceInfo.GcpAttributes = attrs
 		}
 	}
+	return serviceInfo, nil
+}
+
+// Close stops checking the rollouts and the service config files, the
+// current snapshot is kept.
+func (m *ConfigManager) Close() {
+	m.stopWatching()
+}
+
+// Drain pushes a snapshot failing the health checks on --healthz, so that
+// Envoy is taken out of rotation and drains its connections. It is called
+// once on shutdown, there is no way back.
+func (m *ConfigManager) Drain() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.draining {
+		return nil
+	}
+	m.draining = true
+	if m.envoyConfigOptions.Healthz == "" {
+		glog.Warningf("flag --healthz is not set, Envoy has no health check to fail while draining")
+	}
+	return m.updateSnapshotLocked()
+}
+
+func (m *ConfigManager) updateSnapshot() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.updateSnapshotLocked()
+}
 
+func (m *ConfigManager) updateSnapshotLocked() error {
 	snapshot, err := m.makeSnapshot()
 	if err != nil {
 		return fmt.Errorf("fail to make a snapshot, %s", err)
 	}
-	return m.cache.SetSnapshot(context.Background(), m.envoyConfigOptions.Node, snapshot)
+	return m.setSnapshotLocked(snapshot)
+}
+
+func (m *ConfigManager) setSnapshotLocked(snapshot *cache.Snapshot) error {
+	if err := m.cache.SetSnapshot(context.Background(), m.envoyConfigOptions.Node, snapshot); err != nil {
+		return err
+	}
+	m.curSnapshot = snapshot
+	m.ackedTypes = make(map[string]bool)
+	return nil
+}
+
+// snapshotTypes returns the resource types Envoy has to ACK for the snapshot.
+func snapshotTypes(snapshot *cache.Snapshot) []string {
+	var types []string
+	for _, t := range []string{rsrc.ListenerType, rsrc.ClusterType, rsrc.RouteType} {
+		if len(snapshot.GetResources(t)) > 0 {
+			types = append(types, t)
+		}
+	}
+	return types
 }
 
 func (m *ConfigManager) makeSnapshot() (*cache.Snapshot, error) {
-	m.Infof("making configuration for api: %v", m.serviceInfo.Name)
+	var serviceInfos []*configinfo.ServiceInfo
+	for _, svc := range m.services {
+		serviceInfo := svc.serviceInfo
+		if m.draining {
+			// A shallow copy, only the options differ. The methods are shared
+			// with the applied ServiceInfo, their per-route config generators
+			// are reset and rewritten by every snapshot, draining or not.
+			drainingServiceInfo := *serviceInfo
+			drainingServiceInfo.Options.Draining = true
+			serviceInfo = &drainingServiceInfo
+		}
+		serviceInfos = append(serviceInfos, serviceInfo)
+	}
+	m.Infof("making configuration for api: %v", m.serviceNames())
 
-	var clusterResources, listenerResources []types.Resource
-	clusters, err := gen.MakeClusters(m.serviceInfo)
+	var clusterResources, listenerResources, routeResources []types.Resource
+	clusters, err := gen.MakeClustersForServices(serviceInfos)
 	if err != nil {
 		return nil, err
 	}
@@ -266,8 +713,8 @@ func (m *ConfigManager) makeSnapshot() (*cache.Snapshot, error) {
 		clusterResources = append(clusterResources, clusters[i])
 	}
 
-	m.Infof("adding Listeners configuration for api: %v", m.serviceInfo.Name)
-	listeners, err := gen.MakeListeners(m.serviceInfo)
+	m.Infof("adding Listeners configuration for api: %v", m.serviceNames())
+	listeners, err := gen.MakeListenersForServices(serviceInfos)
 	if err != nil {
 		return nil, err
 	}
@@ -275,22 +722,101 @@ func (m *ConfigManager) makeSnapshot() (*cache.Snapshot, error) {
 		listenerResources = append(listenerResources, lis)
 	}
 
-	snapshot, err := cache.NewSnapshot(m.curConfigId(), map[rsrc.Type][]types.Resource{
+	resources := map[rsrc.Type][]types.Resource{
 		rsrc.ListenerType: listenerResources,
 		rsrc.ClusterType:  clusterResources,
-	})
+	}
+	if m.envoyConfigOptions.EnableRds {
+		// Routes must be made after listeners, which add the per-route configs.
+		m.Infof("adding Routes configuration for api: %v", m.serviceNames())
+		routes, err := gen.MakeRouteConfigs(serviceInfos)
+		if err != nil {
+			return nil, err
+		}
+		for _, route := range routes {
+			routeResources = append(routeResources, route)
+		}
+		resources[rsrc.RouteType] = routeResources
+	}
+
+	version, err := snapshotVersion(m.curConfigIdLocked(), resources)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := cache.NewSnapshot(version, resources)
 	if err != nil {
 		return nil, err
 	}
-	m.Infof("Envoy Dynamic Configuration is cached for service: %v", m.serviceName)
+	m.Infof("Envoy Dynamic Configuration is cached for service: %v", m.serviceNames())
 	return snapshot, nil
 }
 
+// The separator of the config ids and the resource hash in snapshot versions.
+const snapshotVersionSeparator = "@"
+
+// snapshotVersion returns the config ids followed by a hash of the resources,
+// so that the version changes with the config pushed to Envoy, and only then,
+// i.e. when a reloaded service config keeps its id, or when draining.
+func snapshotVersion(configId string, resources map[rsrc.Type][]types.Resource) (string, error) {
+	hash := sha256.New()
+	for _, typeUrl := range []rsrc.Type{rsrc.ListenerType, rsrc.ClusterType, rsrc.RouteType} {
+		typeResources := append([]types.Resource(nil), resources[typeUrl]...)
+		sort.Slice(typeResources, func(i, j int) bool {
+			return cache.GetResourceName(typeResources[i]) < cache.GetResourceName(typeResources[j])
+		})
+		for _, resource := range typeResources {
+			data, err := cache.MarshalResource(resource)
+			if err != nil {
+				return "", fmt.Errorf("fail to marshal %s %s: %v", typeUrl, cache.GetResourceName(resource), err)
+			}
+			fmt.Fprintf(hash, "%s\n%d\n", typeUrl, len(data))
+			hash.Write(data)
+		}
+	}
+	return fmt.Sprintf("%s%s%x", configId, snapshotVersionSeparator, hash.Sum(nil)[:6]), nil
+}
+
+// versionConfigId returns the config ids of a snapshot version.
+func versionConfigId(version string) string {
+	if i := strings.LastIndex(version, snapshotVersionSeparator); i >= 0 {
+		return version[:i]
+	}
+	return version
+}
+
+func (m *ConfigManager) serviceNames() string {
+	var names []string
+	for _, svc := range m.services {
+		names = append(names, svc.name)
+	}
+	return strings.Join(names, ",")
+}
+
+// curConfigId returns the config ids of all services joined by ",",
+// it is the first part of the snapshot version.
 func (m *ConfigManager) curConfigId() string {
-	if m.curServiceConfig == nil {
-		return ""
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.curConfigIdLocked()
+}
+
+func (m *ConfigManager) curConfigIdLocked() string {
+	var ids []string
+	for _, svc := range m.services {
+		ids = append(ids, svc.configId())
+	}
+	return strings.Join(ids, ",")
+}
+
+// splitList splits a comma separated flag value, empty items are dropped.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
-	return m.curServiceConfig.Id
+	return items
 }
 
 func (m *ConfigManager) ID(node *corepb.Node) string {
@@ -17,8 +17,11 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
 	"sync"
@@ -31,6 +34,7 @@ import (
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/serviceconfig"
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
 	"github.com/GoogleCloudPlatform/esp-v2/tests/env/platform"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"github.com/golang/protobuf/jsonpb"
@@ -40,10 +44,15 @@ import (
 
 	clusterpb "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listenerpb "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
 	discoverypb "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
 	servicecontrolpb "google.golang.org/genproto/googleapis/api/servicecontrol/v1"
 	smpb "google.golang.org/genproto/googleapis/api/servicemanagement/v1"
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+	apipb "google.golang.org/genproto/protobuf/api"
 )
 
 func TestFetchListeners(t *testing.T) {
@@ -132,7 +141,7 @@ func TestFetchListeners(t *testing.T) {
 				if err != nil {
 					t.Fatal(err)
 				}
-				if version != testdata.TestFetchListenersConfigID {
+				if versionConfigId(version) != testdata.TestFetchListenersConfigID {
 					t.Fatalf("snapshot cache fetch got version: %v, want: %v", version, testdata.TestFetchListenersConfigID)
 				}
 				if !proto.Equal(resp.GetRequest(), req) {
@@ -378,7 +387,7 @@ func TestFixedModeDynamicRouting(t *testing.T) {
 			continue
 		}
 
-		if version != testdata.TestFetchListenersConfigID {
+		if versionConfigId(version) != testdata.TestFetchListenersConfigID {
 			t.Errorf("Test Desc(%d): %s, snapshot cache fetch got version: %v, want: %v", i, tc.desc, version, testdata.TestFetchListenersConfigID)
 			continue
 		}
@@ -557,13 +566,29 @@ func TestServiceConfigAutoUpdate(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if version != oldConfigID {
+		if versionConfigId(version) != oldConfigID {
 			t.Errorf("Test Desc: %s, snapshot cache fetch got version: %v, want: %v", tc.desc, version, oldConfigID)
 		}
 		if !proto.Equal(respInterface.GetRequest(), req) {
 			t.Errorf("Test Desc: %s, snapshot cache fetch got request: %v, want: %v", tc.desc, respInterface.GetRequest(), req)
 		}
 
+		// The new rollout splits the traffic with the old config, which is
+		// served by its own server from now on.
+		var fakeOldConfig safeData
+		if err = genProtoBinary(tc.fakeOldServiceConfig, new(confpb.Service), &fakeOldConfig); err != nil {
+			t.Fatalf("generate fake service config failed: %v", err)
+		}
+		mockOldConfig := initMockServer(t, &fakeOldConfig)
+		defer mockOldConfig.Close()
+		fetchConfigURL := util.FetchConfigURL
+		util.FetchConfigURL = func(serviceManagementUrl, serviceName, configId string) string {
+			if configId == oldConfigID {
+				return mockOldConfig.URL
+			}
+			return fetchConfigURL(serviceManagementUrl, serviceName, configId)
+		}
+
 		if err = genProtoBinary(tc.fakeNewScReport, new(servicecontrolpb.ReportResponse), &fakeScReport); err != nil {
 			t.Fatalf("generate fake service control report failed: %v", err)
 		}
@@ -587,8 +612,9 @@ func TestServiceConfigAutoUpdate(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		if version != newConfigID || configManager.curConfigId() != newConfigID {
-			t.Errorf("Test Desc: %s, snapshot cache fetch got version: %v, want: %v", tc.desc, version, newConfigID)
+		wantVersion := fmt.Sprintf("%s+%s:40", newConfigID, oldConfigID)
+		if versionConfigId(version) != wantVersion || configManager.curConfigId() != wantVersion {
+			t.Errorf("Test Desc: %s, snapshot cache fetch got version: %v, want: %v", tc.desc, version, wantVersion)
 		}
 
 		if !proto.Equal(respInterface.GetRequest(), req) {
@@ -597,6 +623,152 @@ func TestServiceConfigAutoUpdate(t *testing.T) {
 	})
 }
 
+func TestRollbackOnNack(t *testing.T) {
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.DisableTracing = true
+	setFlags("", "", "", "1s", platform.GetFilePath(platform.FixedDrServiceConfig))
+
+	manager, err := NewConfigManager(nil, opts)
+	if err != nil {
+		t.Fatal("fail to initialize Config Manager: ", err)
+	}
+	callbacks := manager.Callbacks()
+	ctx := context.Background()
+	nonce := 0
+
+	// sendAndReply mimics Envoy replying to the responses of all resource types.
+	sendAndReply := func(errorDetail *statuspb.Status) {
+		manager.mu.Lock()
+		versions := make(map[string]string)
+		typeUrls := snapshotTypes(manager.curSnapshot)
+		for _, typeUrl := range typeUrls {
+			versions[typeUrl] = manager.curSnapshot.GetVersion(typeUrl)
+		}
+		manager.mu.Unlock()
+
+		for _, typeUrl := range typeUrls {
+			nonce++
+			callbacks.OnStreamResponse(ctx, 1, nil, &discoverypb.DiscoveryResponse{
+				TypeUrl:     typeUrl,
+				VersionInfo: versions[typeUrl],
+				Nonce:       fmt.Sprint(nonce),
+			})
+			_ = callbacks.OnStreamRequest(1, &discoverypb.DiscoveryRequest{
+				TypeUrl:       typeUrl,
+				ResponseNonce: fmt.Sprint(nonce),
+				ErrorDetail:   errorDetail,
+			})
+		}
+	}
+
+	oldConfigId := manager.curConfigId()
+	sendAndReply(nil)
+
+	svc := manager.services[0]
+	newServiceConfig := proto.Clone(svc.serviceConfig).(*confpb.Service)
+	newServiceConfig.Id = "2017-05-01r1"
+	if err := manager.applyServiceConfig(svc, newServiceConfig); err != nil {
+		t.Fatal(err)
+	}
+	if manager.curConfigId() != newServiceConfig.Id {
+		t.Fatalf("got config id %v after applying new config, want %v", manager.curConfigId(), newServiceConfig.Id)
+	}
+
+	sendAndReply(&statuspb.Status{Message: "invalid listener"})
+
+	if manager.curConfigId() != oldConfigId {
+		t.Errorf("got config id %v after NACK, want %v", manager.curConfigId(), oldConfigId)
+	}
+	manager.mu.Lock()
+	version := manager.curSnapshot.GetVersion(resource.ListenerType)
+	manager.mu.Unlock()
+	if versionConfigId(version) != oldConfigId {
+		t.Errorf("got snapshot version %v after NACK, want %v", version, oldConfigId)
+	}
+	wantRejected := &RejectedConfig{ConfigId: newServiceConfig.Id, ErrorDetail: "invalid listener"}
+	if gotRejected := manager.LastRejectedConfig(); !reflect.DeepEqual(gotRejected, wantRejected) {
+		t.Errorf("got rejected config %v, want %v", gotRejected, wantRejected)
+	}
+	if _, ok := svc.rejectedConfigIds[newServiceConfig.Id]; !ok {
+		t.Errorf("config id %v is not marked as rejected", newServiceConfig.Id)
+	}
+	if err := manager.fetchAndApplyServiceConfig(svc, newServiceConfig.Id); err != nil || manager.curConfigId() != oldConfigId {
+		t.Errorf("rejected config id %v should not be applied again, got err: %v", newServiceConfig.Id, err)
+	}
+}
+
+func TestEnableRds(t *testing.T) {
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.DisableTracing = true
+	opts.EnableRds = true
+	setFlags("", "", "", "1s", platform.GetFilePath(platform.FixedDrServiceConfig))
+
+	manager, err := NewConfigManager(nil, opts)
+	if err != nil {
+		t.Fatal("fail to initialize Config Manager: ", err)
+	}
+
+	// The listener refers to the routes served by RDS.
+	hcm := httpConnectionManager(t, manager, opts)
+	if hcm.GetRouteConfig() != nil {
+		t.Errorf("got inline route config %v, want the routes served by RDS", hcm.GetRouteConfig())
+	}
+	routeConfigName := hcm.GetRds().GetRouteConfigName()
+	if routeConfigName != "local_route" {
+		t.Errorf("got RDS route config name %q, want %q", routeConfigName, "local_route")
+	}
+
+	version, resources := fetchResources(t, manager, opts, resource.RouteType)
+	if versionConfigId(version) != testdata.TestFetchListenersConfigID {
+		t.Errorf("got routes version %v, want config id %v", version, testdata.TestFetchListenersConfigID)
+	}
+	if len(resources) != 1 {
+		t.Fatalf("got %d route configs, want 1", len(resources))
+	}
+	routeConfig := &routepb.RouteConfiguration{}
+	if err := ptypes.UnmarshalAny(resources[0], routeConfig); err != nil {
+		t.Fatal(err)
+	}
+	if routeConfig.GetName() != routeConfigName {
+		t.Errorf("got route config %q, want %q named in the listener", routeConfig.GetName(), routeConfigName)
+	}
+	if len(routeConfig.GetVirtualHosts()) == 0 || len(routeConfig.GetVirtualHosts()[0].GetRoutes()) == 0 {
+		t.Errorf("got route config without routes: %v", routeConfig)
+	}
+
+	manager.mu.Lock()
+	typeUrls := snapshotTypes(manager.curSnapshot)
+	manager.mu.Unlock()
+	wantTypeUrls := []string{resource.ListenerType, resource.ClusterType, resource.RouteType}
+	if !reflect.DeepEqual(typeUrls, wantTypeUrls) {
+		t.Fatalf("got snapshot types %v, want %v", typeUrls, wantTypeUrls)
+	}
+
+	// The snapshot is only accepted once the routes are ACKed as well.
+	callbacks := manager.Callbacks()
+	for i, typeUrl := range typeUrls {
+		manager.mu.Lock()
+		snapshot := manager.curSnapshot
+		manager.mu.Unlock()
+		callbacks.OnStreamResponse(context.Background(), 1, nil, &discoverypb.DiscoveryResponse{
+			TypeUrl:     typeUrl,
+			VersionInfo: snapshot.GetVersion(typeUrl),
+			Nonce:       fmt.Sprint(i + 1),
+		})
+		_ = callbacks.OnStreamRequest(1, &discoverypb.DiscoveryRequest{
+			TypeUrl:       typeUrl,
+			ResponseNonce: fmt.Sprint(i + 1),
+		})
+
+		manager.mu.Lock()
+		acked := manager.ackedSnapshot == snapshot
+		manager.mu.Unlock()
+		if wantAcked := typeUrl == resource.RouteType; acked != wantAcked {
+			t.Errorf("after ACK of %v, got snapshot accepted: %v, want: %v", typeUrl, acked, wantAcked)
+		}
+	}
+}
+
 func runTest(t *testing.T, fakeScReport, fakeRollouts, fakeConfig *safeData, opts options.ConfigGeneratorOptions, f func(configManager *ConfigManager, err error)) {
 	fakeToken := `{"access_token": "ya29.new", "expires_in":3599, "token_type":"Bearer"}`
 	mockServiceControl := initMockServer(t, fakeScReport)
@@ -712,6 +884,95 @@ func genProtoBinary(input string, msg proto.Message, dest *safeData) error {
 	return nil
 }
 
+func TestRolloutConfigId(t *testing.T) {
+	testData := []struct {
+		desc         string
+		percentages  map[string]float64
+		wantConfigId string
+	}{
+		{
+			desc:         "one config",
+			percentages:  map[string]float64{"2023-01-01r0": 100},
+			wantConfigId: "2023-01-01r0",
+		},
+		{
+			desc:         "configs are ordered by traffic",
+			percentages:  map[string]float64{"2023-01-01r0": 20, "2023-01-02r0": 70, "2023-01-03r0": 10},
+			wantConfigId: "2023-01-02r0+2023-01-01r0:20+2023-01-03r0:10",
+		},
+		{
+			desc:         "ties are ordered by id",
+			percentages:  map[string]float64{"2023-01-02r0": 50, "2023-01-01r0": 50},
+			wantConfigId: "2023-01-01r0+2023-01-02r0:50",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			got := rolloutConfigId(trafficOrderedConfigIds(tc.percentages), tc.percentages)
+			if got != tc.wantConfigId {
+				t.Errorf("rolloutConfigId got: %s, want: %s", got, tc.wantConfigId)
+			}
+		})
+	}
+}
+
+func TestSnapshotVersion(t *testing.T) {
+	clusterA := &clusterpb.Cluster{Name: "backend-cluster-a.com:443"}
+	clusterB := &clusterpb.Cluster{Name: "backend-cluster-b.com:443"}
+	version, err := snapshotVersion("2023-01-01r0", map[string][]types.Resource{
+		resource.ClusterType: {clusterA, clusterB},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := versionConfigId(version); got != "2023-01-01r0" {
+		t.Errorf("got config id %s of version %s, want 2023-01-01r0", got, version)
+	}
+
+	testData := []struct {
+		desc            string
+		configId        string
+		resources       map[string][]types.Resource
+		wantSameVersion bool
+	}{
+		{
+			desc:     "same resources in another order",
+			configId: "2023-01-01r0",
+			resources: map[string][]types.Resource{
+				resource.ClusterType: {clusterB, clusterA},
+			},
+			wantSameVersion: true,
+		},
+		{
+			desc:     "changed resource",
+			configId: "2023-01-01r0",
+			resources: map[string][]types.Resource{
+				resource.ClusterType: {clusterA, &clusterpb.Cluster{Name: clusterB.Name, LbPolicy: clusterpb.Cluster_RANDOM}},
+			},
+		},
+		{
+			desc:     "same resources of another config",
+			configId: "2023-01-01r1",
+			resources: map[string][]types.Resource{
+				resource.ClusterType: {clusterA, clusterB},
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := snapshotVersion(tc.configId, tc.resources)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == version) != tc.wantSameVersion {
+				t.Errorf("got version %s, first version %s, want same version: %v", got, version, tc.wantSameVersion)
+			}
+		})
+	}
+}
+
 func setFlags(service, serviceConfigId, rolloutStrategy, checkRolloutInterval, serviceJsonPath string) {
 	_ = flag.Set("service", service)
 	_ = flag.Set("service_config_id", serviceConfigId)
@@ -719,3 +980,272 @@ func setFlags(service, serviceConfigId, rolloutStrategy, checkRolloutInterval, s
 	_ = flag.Set("check_rollout_interval", checkRolloutInterval)
 	_ = flag.Set("service_json_path", serviceJsonPath)
 }
+
+// fakeServiceManagement serves the rollout ids, the rollouts and the service
+// configs of several services, keyed by the service name in the url.
+type fakeServiceManagement struct {
+	mu        sync.Mutex
+	responses map[string]proto.Message
+}
+
+func newFakeServiceManagement(t *testing.T) *fakeServiceManagement {
+	f := &fakeServiceManagement{responses: make(map[string]proto.Message)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		resp, ok := f.responses[r.URL.Path]
+		f.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		bin, err := proto.Marshal(resp)
+		if err != nil {
+			t.Errorf("fail to marshal the response of %s: %v", r.URL.Path, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bin)
+	}))
+
+	fetchRolloutIdURL, fetchRolloutsURL, fetchConfigURL := util.FetchRolloutIdURL, util.FetchRolloutsURL, util.FetchConfigURL
+	t.Cleanup(func() {
+		server.Close()
+		util.FetchRolloutIdURL, util.FetchRolloutsURL, util.FetchConfigURL = fetchRolloutIdURL, fetchRolloutsURL, fetchConfigURL
+	})
+	util.FetchRolloutIdURL = func(serviceControlUrl, serviceName string) string {
+		return fmt.Sprintf("%s/rolloutId/%s", server.URL, serviceName)
+	}
+	util.FetchRolloutsURL = func(serviceManagementUrl, serviceName string) string {
+		return fmt.Sprintf("%s/rollouts/%s", server.URL, serviceName)
+	}
+	util.FetchConfigURL = func(serviceManagementUrl, serviceName, configId string) string {
+		return fmt.Sprintf("%s/config/%s/%s", server.URL, serviceName, configId)
+	}
+	return f
+}
+
+// setRollout makes serviceConfig the latest rollout of its service, with all
+// the traffic.
+func (f *fakeServiceManagement) setRollout(rolloutId string, serviceConfig *confpb.Service) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses["/rolloutId/"+serviceConfig.Name] = &servicecontrolpb.ReportResponse{
+		ServiceConfigId:  serviceConfig.Id,
+		ServiceRolloutId: rolloutId,
+	}
+	f.responses["/rollouts/"+serviceConfig.Name] = &smpb.ListServiceRolloutsResponse{
+		Rollouts: []*smpb.Rollout{
+			{
+				RolloutId:   rolloutId,
+				ServiceName: serviceConfig.Name,
+				Status:      smpb.Rollout_SUCCESS,
+				Strategy: &smpb.Rollout_TrafficPercentStrategy_{
+					TrafficPercentStrategy: &smpb.Rollout_TrafficPercentStrategy{
+						Percentages: map[string]float64{serviceConfig.Id: 100},
+					},
+				},
+			},
+		},
+	}
+	f.responses["/config/"+serviceConfig.Name+"/"+serviceConfig.Id] = serviceConfig
+}
+
+// fetchResources fetches the resources of a type from the snapshot cache.
+func fetchResources(t *testing.T, configManager *ConfigManager, opts options.ConfigGeneratorOptions, typeUrl string) (string, []*any.Any) {
+	t.Helper()
+	respInterface, err := configManager.cache.Fetch(context.Background(), &discoverypb.DiscoveryRequest{
+		Node: &corepb.Node{
+			Id: opts.Node,
+		},
+		TypeUrl: typeUrl,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := respInterface.GetDiscoveryResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.GetVersionInfo(), resp.GetResources()
+}
+
+// httpConnectionManager returns the HttpConnectionManager of the listener
+// in the snapshot cache.
+func httpConnectionManager(t *testing.T, configManager *ConfigManager, opts options.ConfigGeneratorOptions) *hcmpb.HttpConnectionManager {
+	t.Helper()
+	_, resources := fetchResources(t, configManager, opts, resource.ListenerType)
+	if len(resources) != 1 {
+		t.Fatalf("got %d listeners, want 1", len(resources))
+	}
+	listener := &listenerpb.Listener{}
+	if err := ptypes.UnmarshalAny(resources[0], listener); err != nil {
+		t.Fatal(err)
+	}
+	hcm := &hcmpb.HttpConnectionManager{}
+	if err := ptypes.UnmarshalAny(listener.GetFilterChains()[0].GetFilters()[0].GetTypedConfig(), hcm); err != nil {
+		t.Fatal(err)
+	}
+	return hcm
+}
+
+func TestMultipleServices(t *testing.T) {
+	makeServiceConfig := func(name, apiName, configId string) *confpb.Service {
+		return &confpb.Service{
+			Name: name,
+			Id:   configId,
+			Apis: []*apipb.Api{
+				{
+					Name:    apiName,
+					Methods: []*apipb.Method{{Name: "List"}},
+				},
+			},
+		}
+	}
+	bookstoreConfig := makeServiceConfig("bookstore.endpoints.project123.cloud.goog", "endpoints.examples.bookstore.Bookstore", "2023-01-01r0")
+	libraryConfig := makeServiceConfig("library.endpoints.project123.cloud.goog", "endpoints.examples.library.Library", "2023-02-01r0")
+	serviceNames := bookstoreConfig.Name + "," + libraryConfig.Name
+
+	// checkSnapshot checks the snapshot serves both services, the first one
+	// by the default virtual host.
+	checkSnapshot := func(t *testing.T, configManager *ConfigManager, opts options.ConfigGeneratorOptions) {
+		t.Helper()
+		var gotHosts []string
+		for _, host := range httpConnectionManager(t, configManager, opts).GetRouteConfig().GetVirtualHosts() {
+			gotHosts = append(gotHosts, host.GetName())
+		}
+		if wantHosts := []string{"backend", "backend_" + libraryConfig.Name}; !reflect.DeepEqual(gotHosts, wantHosts) {
+			t.Errorf("got virtual hosts %v, want %v", gotHosts, wantHosts)
+		}
+
+		_, clusters := fetchResources(t, configManager, opts, resource.ClusterType)
+		gotClusters := make(map[string]int)
+		for _, cluster := range clusters {
+			gotClusters[getClusterName(cluster)]++
+		}
+		for _, name := range []string{
+			util.BackendClusterName(bookstoreConfig.Name + "_local"),
+			util.BackendClusterName(libraryConfig.Name + "_local"),
+		} {
+			if gotClusters[name] != 1 {
+				t.Errorf("got %d clusters named %s, want 1 in clusters %v", gotClusters[name], name, gotClusters)
+			}
+		}
+	}
+
+	newOpts := func() options.ConfigGeneratorOptions {
+		opts := options.DefaultConfigGeneratorOptions()
+		opts.BackendAddress = "http://127.0.0.1:8082"
+		opts.DisableTracing = true
+		opts.SslSidestreamClientRootCertsPath = platform.GetFilePath(platform.TestRootCaCerts)
+		return opts
+	}
+	mockMetadataServer := util.InitMockServerFromPathResp(map[string]string{
+		util.AccessTokenPath: `{"access_token": "ya29.new", "expires_in":3599, "token_type":"Bearer"}`,
+	})
+	defer mockMetadataServer.Close()
+	metadataFetcher := metadata.NewMockMetadataFetcher(mockMetadataServer.URL, time.Now())
+
+	t.Run("fixed rollout with a config id for each service", func(t *testing.T) {
+		serviceManagement := newFakeServiceManagement(t)
+		serviceManagement.setRollout("bookstore-rollout", bookstoreConfig)
+		serviceManagement.setRollout("library-rollout", libraryConfig)
+		setFlags(serviceNames, bookstoreConfig.Id+","+libraryConfig.Id, util.FixedRolloutStrategy, "100ms", "")
+
+		opts := newOpts()
+		configManager, err := NewConfigManager(metadataFetcher, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer configManager.Close()
+
+		wantConfigId := bookstoreConfig.Id + "," + libraryConfig.Id
+		if got := configManager.curConfigId(); got != wantConfigId {
+			t.Errorf("got config id %v, want %v", got, wantConfigId)
+		}
+		checkSnapshot(t, configManager, opts)
+	})
+
+	t.Run("fixed rollout with fewer config ids than services", func(t *testing.T) {
+		setFlags(serviceNames, bookstoreConfig.Id, util.FixedRolloutStrategy, "100ms", "")
+		_, err := NewConfigManager(metadataFetcher, newOpts())
+		wantError := "got 1 service config ids for 2 services, each service requires one config id"
+		if err == nil || !strings.Contains(err.Error(), wantError) {
+			t.Errorf("want error: %v, got error: %v", wantError, err)
+		}
+	})
+
+	t.Run("service config files", func(t *testing.T) {
+		var paths []string
+		for _, serviceConfig := range []*confpb.Service{bookstoreConfig, libraryConfig} {
+			jsonStr, err := util.ProtoToJson(serviceConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "service.json")
+			if err := ioutil.WriteFile(path, []byte(jsonStr), 0644); err != nil {
+				t.Fatal(err)
+			}
+			paths = append(paths, path)
+		}
+		setFlags("", "", "", "100ms", strings.Join(paths, ","))
+		defer setFlags("", "", "", "100ms", "")
+
+		opts := newOpts()
+		configManager, err := NewConfigManager(nil, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer configManager.Close()
+		checkSnapshot(t, configManager, opts)
+	})
+
+	t.Run("managed rollout of one service leaves the other one applied", func(t *testing.T) {
+		serviceManagement := newFakeServiceManagement(t)
+		serviceManagement.setRollout("bookstore-rollout", bookstoreConfig)
+		serviceManagement.setRollout("library-rollout", libraryConfig)
+		setFlags(serviceNames, "", util.ManagedRolloutStrategy, "100ms", "")
+		defer setFlags("", "", util.FixedRolloutStrategy, "100ms", "")
+
+		opts := newOpts()
+		configManager, err := NewConfigManager(metadataFetcher, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer configManager.Close()
+		checkSnapshot(t, configManager, opts)
+
+		// rolloutIds returns the rollout id of each service.
+		rolloutIds := func() []string {
+			configManager.mu.Lock()
+			defer configManager.mu.Unlock()
+			var ids []string
+			for _, svc := range configManager.services {
+				ids = append(ids, svc.rolloutId)
+			}
+			return ids
+		}
+		if got, want := rolloutIds(), []string{"bookstore-rollout", "library-rollout"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got rollout ids %v, want %v", got, want)
+		}
+
+		newLibraryConfig := proto.Clone(libraryConfig).(*confpb.Service)
+		newLibraryConfig.Id = "2023-02-02r0"
+		serviceManagement.setRollout("library-rollout-2", newLibraryConfig)
+
+		wantConfigId := bookstoreConfig.Id + "," + newLibraryConfig.Id
+		for deadline := time.Now().Add(10 * time.Second); configManager.curConfigId() != wantConfigId; {
+			if time.Now().After(deadline) {
+				t.Fatalf("got config id %v, want %v after the rollout of service %v", configManager.curConfigId(), wantConfigId, libraryConfig.Name)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		if got, want := rolloutIds(), []string{"bookstore-rollout", "library-rollout-2"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got rollout ids %v, want %v", got, want)
+		}
+		version, _ := fetchResources(t, configManager, opts, resource.ListenerType)
+		if versionConfigId(version) != wantConfigId {
+			t.Errorf("got snapshot version %v, want config id %v", version, wantConfigId)
+		}
+		checkSnapshot(t, configManager, opts)
+	})
+}
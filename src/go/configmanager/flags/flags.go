@@ -51,10 +51,19 @@ var (
 	ServiceManagementURL         = flag.String("service_management_url", defaults.ServiceManagementURL, "url of service management server")
 	ServiceControlURL            = flag.String("service_control_url", defaults.ServiceControlURL, "url of service control server")
 	EnableBackendAddressOverride = flag.Bool("enable_backend_address_override", defaults.EnableBackendAddressOverride, "Allow the --backend flag to override the backend.rule.address for all operations.")
+	BackendPolicyPath            = flag.String("backend_policy_path", defaults.BackendPolicyPath, `YAML or JSON file with backend policies by operation selector, on top of the
+		backend rules of the service config, i.e. weighted backend addresses splitting the traffic of an operation,
+		alternate backend addresses for the requests with given headers or query parameters, or a backend address receiving
+		a copy of a percentage of the requests. The copies have the Host of the backend with the "-shadow" suffix, so the
+		mirror of a remote backend must have its hostname. The file also sets the endpoints, load balancing, health checks and outlier
+		detection of the backend clusters by address.`)
 
 	ListenerPort = flag.Int("listener_port", defaults.ListenerPort, "listener port")
 	Healthz      = flag.String("healthz", defaults.Healthz, "path for health check of ESPv2 proxy itself")
 
+	OpenAPIExportPath = flag.String("openapi_export_path", defaults.OpenAPIExportPath, `path on which ESPv2 serves an OpenAPI 3 document of the routes, their
+		auth requirements and API key locations, generated from the service config. It must not match the uri template of any method. Disabled if empty.`)
+
 	// Health check grpc backend related flags.
 	HealthCheckGrpcBackend        = flag.Bool("health_check_grpc_backend", defaults.HealthCheckGrpcBackend, `If true, ESPv2 periodically checks the gRPC Health service for the backend specified by the flag "--backend_address".`)
 	HealthCheckGrpcBackendService = flag.String("health_check_grpc_backend_service", defaults.HealthCheckGrpcBackendService, `Specify the service name in the HealthCheckRequest when calling the backend gRPC Health service.
@@ -64,6 +73,20 @@ var (
 	HealthCheckGrpcBackendNoTrafficInterval = flag.Duration("health_check_grpc_backend_no_traffic_interval", defaults.HealthCheckGrpcBackendNoTrafficInterval, `Specify the checking interval to call the backend gRPC Health service
                       when at start up or the backend did not have any traffic. Default is 60 seconds. It only applies when the flag "--health_check_grpc_backend" is used.`)
 
+	// Health check and outlier detection of all backend clusters related flags.
+	BackendHealthCheckHTTPPath = flag.String("backend_health_check_http_path", defaults.BackendHealthCheckHTTPPath, `If set, ESPv2 periodically sends GET requests on the path to the
+                      HTTP/1 and HTTP/2 backend clusters, local or remote. The clusters of the backend policies in "--backend_policy_path" can override it.`)
+	BackendHealthCheckGrpc = flag.Bool("backend_health_check_grpc", defaults.BackendHealthCheckGrpc, `If true, ESPv2 periodically checks the gRPC Health service of the gRPC
+                      backend clusters, local or remote, with the service name of "--health_check_grpc_backend_service".`)
+	BackendHealthCheckInterval   = flag.Duration("backend_health_check_interval", defaults.BackendHealthCheckInterval, `Specify the interval of the backend health checks. Default is 5 seconds.`)
+	BackendHealthCheckTimeout    = flag.Duration("backend_health_check_timeout", defaults.BackendHealthCheckTimeout, `Specify the timeout of the backend health checks. Default is 1 second.`)
+	BackendOutlierConsecutive5xx = flag.Int("backend_outlier_consecutive_5xx", defaults.BackendOutlierConsecutive5xx, `If positive, ESPv2 ejects a backend host from the load balancing after
+                      the number of consecutive 5xx responses. Default is 0, disabled.`)
+	BackendOutlierSuccessRate = flag.Bool("backend_outlier_success_rate", defaults.BackendOutlierSuccessRate, `If true, ESPv2 ejects the backend hosts with a success rate well below
+                      the success rate of the other hosts of the cluster.`)
+	BackendOutlierBaseEjectionTime = flag.Duration("backend_outlier_base_ejection_time", defaults.BackendOutlierBaseEjectionTime, `Specify the base time a backend host is ejected for,
+                      multiplied by the number of times it was ejected. Default is 30 seconds.`)
+
 	SslServerCertPath                = flag.String("ssl_server_cert_path", defaults.SslServerCertPath, "Path to the certificate and key that ESPv2 uses to act as a HTTPS server")
 	SslServerCipherSuites            = flag.String("ssl_server_cipher_suites", defaults.SslServerCipherSuites, "Cipher suites to use for downstream connections as a comma-separated list.")
 	SslServerRootCertsPath           = flag.String("ssl_server_root_cert_path", defaults.SslServerRootCertPath, "The file path of root certificates that ESPv2 uses to verify downstream client certificate. If not specified, ESPv2 doesn't verify client certificates by default")
@@ -211,6 +234,12 @@ Normally JWT based64 encode doesn’t add padding. If this flag is true, the hea
 
 	ClientIPFromForwardedHeader = flag.Bool("client_ip_from_forwarded_header", defaults.ClientIPFromForwardedHeader, `If true, extract client ip from "forwarded" header. The default false.`)
 
+	TrafficSplitHashHeader = flag.String("traffic_split_hash_header", defaults.TrafficSplitHashHeader, `The request header deciding which service config serves a request when
+	the latest rollout splits the traffic across several configs. Requests are assigned by the last two hex digits of the header value,
+	so it should be a random or hashed id, like a session or user id hash. If empty, requests are assigned by the last byte of the
+	client IPv4 or IPv6 address, the "x-forwarded-for" entry trusted by "--envoy_xff_num_trusted_hops". Requests without the header,
+	or with fewer "x-forwarded-for" entries than the trusted hops, are served by the config with the most traffic.`)
+
 	// BackendClusterMaxRequests is the maximum active requests allowed in a backend cluster.
 	BackendClusterMaxRequests = flag.Int("backend_cluster_maximum_requests", defaults.BackendClusterMaxRequests,
 		`The maximum allowed active requests for a backend cluster. If 0, or not set, default is 1024.
@@ -222,6 +251,7 @@ func EnvoyConfigOptionsFromFlags() options.ConfigGeneratorOptions {
 		CommonOptions:                                 commonflags.DefaultCommonOptionsFromFlags(),
 		BackendAddress:                                *BackendAddress,
 		EnableBackendAddressOverride:                  *EnableBackendAddressOverride,
+		BackendPolicyPath:                             *BackendPolicyPath,
 		AccessLog:                                     *AccessLog,
 		AccessLogFormat:                               *AccessLogFormat,
 		ComputePlatformOverride:                       *ComputePlatformOverride,
@@ -241,10 +271,18 @@ func EnvoyConfigOptionsFromFlags() options.ConfigGeneratorOptions {
 		ServiceControlURL:                             *ServiceControlURL,
 		ListenerPort:                                  *ListenerPort,
 		Healthz:                                       *Healthz,
+		OpenAPIExportPath:                             *OpenAPIExportPath,
 		HealthCheckGrpcBackend:                        *HealthCheckGrpcBackend,
 		HealthCheckGrpcBackendService:                 *HealthCheckGrpcBackendService,
 		HealthCheckGrpcBackendInterval:                *HealthCheckGrpcBackendInterval,
 		HealthCheckGrpcBackendNoTrafficInterval:       *HealthCheckGrpcBackendNoTrafficInterval,
+		BackendHealthCheckHTTPPath:                    *BackendHealthCheckHTTPPath,
+		BackendHealthCheckGrpc:                        *BackendHealthCheckGrpc,
+		BackendHealthCheckInterval:                    *BackendHealthCheckInterval,
+		BackendHealthCheckTimeout:                     *BackendHealthCheckTimeout,
+		BackendOutlierConsecutive5xx:                  *BackendOutlierConsecutive5xx,
+		BackendOutlierSuccessRate:                     *BackendOutlierSuccessRate,
+		BackendOutlierBaseEjectionTime:                *BackendOutlierBaseEjectionTime,
 		SslSidestreamClientRootCertsPath:              *SslSidestreamClientRootCertsPath,
 		SslBackendClientCertPath:                      *SslBackendClientCertPath,
 		SslBackendClientRootCertsPath:                 *SslBackendClientRootCertsPath,
@@ -312,6 +350,7 @@ func EnvoyConfigOptionsFromFlags() options.ConfigGeneratorOptions {
 		TranscodingCaseInsensitiveEnumParsing:         *TranscodingCaseInsensitiveEnumParsing,
 		EnableResponseCompression:                     *EnableResponseCompression,
 		ClientIPFromForwardedHeader:                   *ClientIPFromForwardedHeader,
+		TrafficSplitHashHeader:                        *TrafficSplitHashHeader,
 
 		// These options are not for ESPv2 users. They are overridden internally.
 		APIAllowList:       []string{},
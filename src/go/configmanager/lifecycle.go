@@ -0,0 +1,123 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// How long GracefulStop may wait for the xDS streams to end before they are
+// closed forcibly.
+const gracefulStopTimeout = 5 * time.Second
+
+// GrpcServer is the part of grpc.Server stopped by the LifecycleController.
+type GrpcServer interface {
+	GracefulStop()
+	Stop()
+}
+
+// LifecycleController shuts down the config manager server in order:
+//  1. Drain: Envoy fails the health checks on --healthz and drains its
+//     connections, the xDS server keeps serving.
+//  2. Wait for the drain period.
+//  3. Stop the rollout checks, cancel the xDS server context to end the xDS
+//     streams, and stop the gRPC server gracefully.
+type LifecycleController struct {
+	drain       func() error
+	cancel      context.CancelFunc
+	server      GrpcServer
+	drainPeriod time.Duration
+
+	shutdownOnce sync.Once
+	forceOnce    sync.Once
+	// Closed by Stop to skip the rest of the drain period.
+	force chan struct{}
+	// Closed once the gRPC server is stopped.
+	done chan struct{}
+}
+
+// NewLifecycleController creates a LifecycleController for the config
+// manager m, whose xDS server runs on server with the context cancelled by
+// cancel.
+func NewLifecycleController(m *ConfigManager, server GrpcServer, cancel context.CancelFunc, drainPeriod time.Duration) *LifecycleController {
+	stop := func() {
+		m.Close()
+		cancel()
+	}
+	return newLifecycleController(m.Drain, server, stop, drainPeriod)
+}
+
+func newLifecycleController(drain func() error, server GrpcServer, cancel context.CancelFunc, drainPeriod time.Duration) *LifecycleController {
+	return &LifecycleController{
+		drain:       drain,
+		cancel:      cancel,
+		server:      server,
+		drainPeriod: drainPeriod,
+		force:       make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Shutdown runs the shutdown sequence and returns once the gRPC server is
+// stopped. Only the first call runs it, the others wait for it.
+func (c *LifecycleController) Shutdown() {
+	c.shutdownOnce.Do(func() {
+		defer close(c.done)
+
+		if err := c.drain(); err != nil {
+			// Still wait for the drain period, Envoy may drain on its own.
+			glog.Errorf("fail to push the draining config to Envoy, %v", err)
+		}
+		glog.Infof("draining for %v before stopping the config manager server", c.drainPeriod)
+		select {
+		case <-time.After(c.drainPeriod):
+		case <-c.force:
+			glog.Warningf("skipping the rest of the drain period")
+		}
+
+		c.cancel()
+		stopped := make(chan struct{})
+		go func() {
+			c.server.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-c.force:
+			c.server.Stop()
+		case <-time.After(gracefulStopTimeout):
+			glog.Warningf("the config manager server is not stopped gracefully in %v, stopping it", gracefulStopTimeout)
+			c.server.Stop()
+		}
+	})
+	<-c.done
+}
+
+// Stop skips the rest of the shutdown sequence and stops the gRPC server
+// forcibly, e.g. on a second signal. Shutdown must have been started.
+func (c *LifecycleController) Stop() {
+	c.forceOnce.Do(func() {
+		close(c.force)
+	})
+}
+
+// Done is closed once the gRPC server is stopped by Shutdown.
+func (c *LifecycleController) Done() <-chan struct{} {
+	return c.done
+}
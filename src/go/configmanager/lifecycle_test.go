@@ -0,0 +1,160 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configmanager/testdata"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/tests/env/platform"
+
+	rsrc "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+// fakeGrpcServer records the shutdown steps, GracefulStop blocks until Stop
+// if blockGracefulStop is set.
+type fakeGrpcServer struct {
+	mu                sync.Mutex
+	steps             []string
+	blockGracefulStop bool
+	stopped           chan struct{}
+}
+
+func (s *fakeGrpcServer) record(step string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.steps = append(s.steps, step)
+}
+
+func (s *fakeGrpcServer) GracefulStop() {
+	s.record("GracefulStop")
+	if s.blockGracefulStop {
+		<-s.stopped
+	}
+}
+
+func (s *fakeGrpcServer) Stop() {
+	s.record("Stop")
+	close(s.stopped)
+}
+
+func TestLifecycleControllerShutdown(t *testing.T) {
+	testData := []struct {
+		desc              string
+		drainPeriod       time.Duration
+		drainErr          error
+		blockGracefulStop bool
+		forceStop         bool
+		wantSteps         []string
+	}{
+		{
+			desc:        "drain, wait, then stop gracefully",
+			drainPeriod: 10 * time.Millisecond,
+			wantSteps:   []string{"drain", "cancel", "GracefulStop"},
+		},
+		{
+			desc:        "stop even if draining fails",
+			drainPeriod: 10 * time.Millisecond,
+			drainErr:    fmt.Errorf("drain error"),
+			wantSteps:   []string{"drain", "cancel", "GracefulStop"},
+		},
+		{
+			desc:              "forced stop skips the drain period and the graceful stop",
+			drainPeriod:       time.Hour,
+			blockGracefulStop: true,
+			forceStop:         true,
+			wantSteps:         []string{"drain", "cancel", "GracefulStop", "Stop"},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			server := &fakeGrpcServer{
+				blockGracefulStop: tc.blockGracefulStop,
+				stopped:           make(chan struct{}),
+			}
+			drain := func() error {
+				server.record("drain")
+				return tc.drainErr
+			}
+			cancel := func() { server.record("cancel") }
+			lifecycle := newLifecycleController(drain, server, cancel, tc.drainPeriod)
+
+			go lifecycle.Shutdown()
+			if tc.forceStop {
+				lifecycle.Stop()
+			}
+			select {
+			case <-lifecycle.Done():
+			case <-time.After(time.Second):
+				t.Fatal("the server is not stopped in time")
+			}
+
+			// Later calls wait for the first one and run nothing.
+			lifecycle.Shutdown()
+			server.mu.Lock()
+			defer server.mu.Unlock()
+			if !reflect.DeepEqual(server.steps, tc.wantSteps) {
+				t.Errorf("got shutdown steps %v, want %v", server.steps, tc.wantSteps)
+			}
+		})
+	}
+}
+
+func TestConfigManagerDrain(t *testing.T) {
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.DisableTracing = true
+	opts.Healthz = "healthz"
+	setFlags("", "", "", "1s", platform.GetFilePath(platform.FixedDrServiceConfig))
+
+	manager, err := NewConfigManager(nil, opts)
+	if err != nil {
+		t.Fatal("fail to initialize Config Manager: ", err)
+	}
+	server := httptest.NewServer(manager.StatusHandler())
+	defer server.Close()
+
+	oldVersion := manager.curSnapshot.GetVersion(rsrc.ListenerType)
+	for i := 0; i < 2; i++ {
+		if err := manager.Drain(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The health check filter changes, so does the hash in the version.
+	gotVersion := manager.curSnapshot.GetVersion(rsrc.ListenerType)
+	if gotVersion == oldVersion || versionConfigId(gotVersion) != testdata.TestFetchListenersConfigID {
+		t.Errorf("got snapshot version %s, want a new version of config %s", gotVersion, testdata.TestFetchListenersConfigID)
+	}
+	if manager.services[0].serviceInfo.Options.Draining {
+		t.Errorf("draining should not change the options of the applied service info")
+	}
+
+	resp, err := http.Get(server.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got healthz status code %v while draining, want %v", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
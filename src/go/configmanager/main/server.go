@@ -30,6 +30,8 @@ import (
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/tokengenerator"
 	"github.com/golang/glog"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	xds "github.com/envoyproxy/go-control-plane/pkg/server/v3"
@@ -53,7 +55,12 @@ func main() {
 	if err != nil {
 		glog.Exitf("fail to initialize config manager: %v", err)
 	}
-	server := xds.NewServer(ctx, m.Cache(), nil)
+	var server xds.Server = xds.NewServer(ctx, m.Cache(), m.Callbacks())
+	if opts.EnableDeltaXds {
+		glog.Info("serving incremental (delta) xDS")
+	} else {
+		server = sotwOnlyServer{server}
+	}
 	grpcServer := grpc.NewServer()
 	lis, err := net.Listen("unix", opts.AdsNamedPipe)
 	if err != nil {
@@ -69,13 +76,27 @@ func main() {
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 
+	lifecycle := configmanager.NewLifecycleController(m, grpcServer, cancel, *configmanager.DrainPeriod)
 	go func() {
 		sig := <-signalChan
-		glog.Warningf("Server got signal %v, stopping", sig)
-		cancel()
-		grpcServer.Stop()
+		glog.Warningf("Server got signal %v, draining before stopping", sig)
+		go lifecycle.Shutdown()
+
+		sig = <-signalChan
+		glog.Warningf("Server got signal %v again, stopping now", sig)
+		lifecycle.Stop()
 	}()
 
+	if *configmanager.StatusPort != 0 {
+		// Only listen on localhost, the status may contain sensitive configs.
+		go func() {
+			err := http.ListenAndServe(fmt.Sprintf("127.0.0.1:%v", *configmanager.StatusPort), m.StatusHandler())
+			if err != nil {
+				glog.Errorf("status server fail to serve: %v", err)
+			}
+		}()
+	}
+
 	if opts.ServiceAccountKey != "" {
 		// Setup token agent server
 		r := tokengenerator.MakeTokenAgentHandler(opts.ServiceAccountKey)
@@ -93,4 +114,15 @@ func main() {
 	if err := grpcServer.Serve(lis); err != nil {
 		glog.Exitf("Server fail to serve: %v", err)
 	}
+	// Serve returns as soon as the server starts stopping.
+	<-lifecycle.Done()
+}
+
+// sotwOnlyServer rejects delta xDS streams, which are opt-in by --enable_delta_xds.
+type sotwOnlyServer struct {
+	xds.Server
+}
+
+func (sotwOnlyServer) DeltaAggregatedResources(discoverygrpc.AggregatedDiscoveryService_DeltaAggregatedResourcesServer) error {
+	return status.Errorf(codes.Unimplemented, "delta xDS is disabled, set --enable_delta_xds to enable it")
 }
@@ -0,0 +1,238 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+// serviceConfigCache keeps the last service configs accepted by Envoy on
+// disk, one file per service, so the Config Manager can start when Service
+// Management cannot be reached.
+//
+// The files are written by run, so that a slow disk does not hold the Config
+// Manager lock.
+type serviceConfigCache struct {
+	dir          string
+	maxStaleness time.Duration
+	// Overridden in tests.
+	now       func() time.Time
+	writeFile func(path string, data []byte) error
+
+	// The records queued by saveAsync and not written yet, keyed by service
+	// name. A newer record of a service replaces the queued one.
+	mu      sync.Mutex
+	pending map[string]*serviceConfigCacheRecord
+	// Signaled when a record is queued.
+	queued chan struct{}
+}
+
+// serviceConfigCacheRecord is the state of a service to cache, copied under
+// the Config Manager lock.
+type serviceConfigCacheRecord struct {
+	serviceName string
+	configId    string
+	rolloutId   string
+	fetchTime   time.Time
+	// The service config followed by its traffic splits.
+	configs     []*confpb.Service
+	percentages map[string]float64
+}
+
+// serviceConfigCacheEntry is the content of a cache file.
+type serviceConfigCacheEntry struct {
+	ServiceName string `json:"serviceName"`
+	RolloutId   string `json:"rolloutId,omitempty"`
+	// The binary service configs, the first one has the most traffic and the
+	// others are its traffic splits.
+	ServiceConfigs [][]byte `json:"serviceConfigs"`
+	// The traffic percentages of the traffic splits, keyed by config id.
+	Percentages map[string]float64 `json:"percentages,omitempty"`
+	// When the service configs were fetched from Service Management, or last
+	// confirmed as the latest rollout. The staleness is measured from it.
+	FetchTime time.Time `json:"fetchTime"`
+}
+
+func newServiceConfigCache(dir string, maxStaleness time.Duration) (*serviceConfigCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("fail to create service config cache directory %s: %v", dir, err)
+	}
+	return &serviceConfigCache{
+		dir:          dir,
+		maxStaleness: maxStaleness,
+		now:          time.Now,
+		writeFile:    writeFileAtomically,
+		pending:      make(map[string]*serviceConfigCacheRecord),
+		queued:       make(chan struct{}, 1),
+	}, nil
+}
+
+func (c *serviceConfigCache) path(serviceName string) string {
+	return filepath.Join(c.dir, serviceName+".json")
+}
+
+// newServiceConfigCacheRecord copies the state of svc to cache. The service
+// configs are not modified once applied, they are shared.
+func newServiceConfigCacheRecord(svc *serviceState) *serviceConfigCacheRecord {
+	record := &serviceConfigCacheRecord{
+		serviceName: svc.name,
+		configId:    svc.configId(),
+		rolloutId:   svc.rolloutId,
+		fetchTime:   svc.fetchTime,
+		configs:     []*confpb.Service{svc.serviceConfig},
+	}
+	for _, split := range svc.serviceInfo.TrafficSplits {
+		record.configs = append(record.configs, split.ServiceInfo.ServiceConfig())
+		if record.percentages == nil {
+			record.percentages = make(map[string]float64)
+		}
+		record.percentages[split.ServiceInfo.ConfigID] = split.Percentage
+	}
+	return record
+}
+
+// save writes the service config and its traffic splits of record. The file
+// is replaced atomically, a crash never leaves a partial file behind.
+func (c *serviceConfigCache) save(record *serviceConfigCacheRecord) error {
+	entry := &serviceConfigCacheEntry{
+		ServiceName: record.serviceName,
+		RolloutId:   record.rolloutId,
+		Percentages: record.percentages,
+		FetchTime:   record.fetchTime,
+	}
+	for _, config := range record.configs {
+		bin, err := proto.Marshal(config)
+		if err != nil {
+			return fmt.Errorf("fail to marshal service config %s: %v", config.GetId(), err)
+		}
+		entry.ServiceConfigs = append(entry.ServiceConfigs, bin)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return c.writeFile(c.path(record.serviceName), data)
+}
+
+// saveAsync queues record to be saved by run.
+func (c *serviceConfigCache) saveAsync(record *serviceConfigCacheRecord) {
+	c.mu.Lock()
+	c.pending[record.serviceName] = record
+	c.mu.Unlock()
+	select {
+	case c.queued <- struct{}{}:
+	default:
+	}
+}
+
+// run saves the queued records until ctx is done, the records queued by then
+// are still saved.
+func (c *serviceConfigCache) run(ctx context.Context) {
+	for {
+		select {
+		case <-c.queued:
+			c.flush()
+		case <-ctx.Done():
+			c.flush()
+			return
+		}
+	}
+}
+
+// flush saves the queued records in the order of the service names.
+func (c *serviceConfigCache) flush() {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = make(map[string]*serviceConfigCacheRecord)
+	c.mu.Unlock()
+
+	serviceNames := make([]string, 0, len(pending))
+	for serviceName := range pending {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	sort.Strings(serviceNames)
+	for _, serviceName := range serviceNames {
+		record := pending[serviceName]
+		if err := c.save(record); err != nil {
+			glog.Errorf("fail to cache the service config %v of service %v: %v", record.configId, serviceName, err)
+		}
+	}
+}
+
+// load reads the cached service configs of a service, failing if they are
+// older than maxStaleness.
+func (c *serviceConfigCache) load(serviceName string) (*serviceConfigCacheEntry, []*confpb.Service, error) {
+	data, err := ioutil.ReadFile(c.path(serviceName))
+	if err != nil {
+		return nil, nil, err
+	}
+	entry := &serviceConfigCacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, nil, fmt.Errorf("fail to unmarshal cache file %s: %v", c.path(serviceName), err)
+	}
+	if entry.ServiceName != serviceName || len(entry.ServiceConfigs) == 0 {
+		return nil, nil, fmt.Errorf("cache file %s is not for service %s", c.path(serviceName), serviceName)
+	}
+	if age := c.now().Sub(entry.FetchTime); age > c.maxStaleness {
+		return nil, nil, fmt.Errorf("cached service config is %v old, more than the max staleness %v", age.Round(time.Second), c.maxStaleness)
+	}
+
+	var configs []*confpb.Service
+	for _, bin := range entry.ServiceConfigs {
+		config := &confpb.Service{}
+		if err := proto.Unmarshal(bin, config); err != nil {
+			return nil, nil, fmt.Errorf("fail to unmarshal cached service config: %v", err)
+		}
+		configs = append(configs, config)
+	}
+	return entry, configs, nil
+}
+
+// writeFileAtomically writes data to a temporary file in the same directory
+// and renames it to path.
+func writeFileAtomically(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
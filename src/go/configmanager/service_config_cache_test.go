@@ -0,0 +1,311 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/golang/protobuf/proto"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+func TestServiceConfigCache(t *testing.T) {
+	makeServiceInfo := func(configId string) (*confpb.Service, *configinfo.ServiceInfo) {
+		serviceConfig := &confpb.Service{
+			Name: "bookstore.endpoints.project123.cloud.goog",
+			Id:   configId,
+			Apis: []*apipb.Api{
+				{
+					Name:    "endpoints.examples.bookstore.Bookstore",
+					Methods: []*apipb.Method{{Name: "ListShelves"}},
+				},
+			},
+		}
+		serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(serviceConfig, configId, options.DefaultConfigGeneratorOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return serviceConfig, serviceInfo
+	}
+
+	fetchTime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	serviceConfig, serviceInfo := makeServiceInfo("2023-01-02r0")
+	splitConfig, splitInfo := makeServiceInfo("2023-01-01r0")
+	serviceInfo.TrafficSplits = []*configinfo.TrafficSplit{{ServiceInfo: splitInfo, Percentage: 20}}
+	svc := &serviceState{
+		name:          serviceConfig.Name,
+		serviceConfig: serviceConfig,
+		serviceInfo:   serviceInfo,
+		rolloutId:     "2023-01-02r1",
+		fetchTime:     fetchTime,
+	}
+
+	dir, err := ioutil.TempDir("", "service-config-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := newServiceConfigCache(filepath.Join(dir, "cache"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.save(newServiceConfigCacheRecord(svc)); err != nil {
+		t.Fatal(err)
+	}
+	// Saving again replaces the file without leaving temporary files behind.
+	if err := cache.save(newServiceConfigCacheRecord(svc)); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(cache.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != svc.name+".json" {
+		t.Errorf("cache directory should only have the file of service %s, got %v", svc.name, files)
+	}
+
+	testData := []struct {
+		desc        string
+		serviceName string
+		now         time.Time
+		wantError   string
+	}{
+		{
+			desc:        "Success, the cached service config is fresh",
+			serviceName: svc.name,
+			now:         fetchTime.Add(time.Minute),
+		},
+		{
+			desc:        "Failure, the cached service config is stale",
+			serviceName: svc.name,
+			now:         fetchTime.Add(2 * time.Hour),
+			wantError:   "cached service config is 2h0m0s old, more than the max staleness 1h0m0s",
+		},
+		{
+			desc:        "Failure, no cached service config",
+			serviceName: "other.endpoints.project123.cloud.goog",
+			now:         fetchTime,
+			wantError:   "no such file or directory",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			cache.now = func() time.Time { return tc.now }
+			entry, configs, err := cache.load(tc.serviceName)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("want error: %v, got error: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if entry.RolloutId != svc.rolloutId || !entry.FetchTime.Equal(fetchTime) {
+				t.Errorf("got rollout id %s fetched at %v, want rollout id %s fetched at %v", entry.RolloutId, entry.FetchTime, svc.rolloutId, fetchTime)
+			}
+			if wantPercentages := map[string]float64{splitConfig.Id: 20}; !reflect.DeepEqual(entry.Percentages, wantPercentages) {
+				t.Errorf("got percentages %v, want %v", entry.Percentages, wantPercentages)
+			}
+			if len(configs) != 2 || !proto.Equal(configs[0], serviceConfig) || !proto.Equal(configs[1], splitConfig) {
+				t.Errorf("got service configs %v, want %v and %v", configs, serviceConfig, splitConfig)
+			}
+		})
+	}
+}
+
+func TestConfirmServiceConfigRefreshesCache(t *testing.T) {
+	serviceConfig := &confpb.Service{
+		Name: "bookstore.endpoints.project123.cloud.goog",
+		Id:   "2023-01-01r0",
+		Apis: []*apipb.Api{
+			{
+				Name:    "endpoints.examples.bookstore.Bookstore",
+				Methods: []*apipb.Method{{Name: "ListShelves"}},
+			},
+		},
+	}
+	serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(serviceConfig, serviceConfig.Id, options.DefaultConfigGeneratorOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetchTime := time.Now().Add(-2 * time.Hour)
+	svc := &serviceState{
+		name:               serviceConfig.Name,
+		serviceConfig:      serviceConfig,
+		serviceInfo:        serviceInfo,
+		ackedServiceConfig: serviceConfig,
+		ackedServiceInfo:   serviceInfo,
+		rolloutId:          "2023-01-01r1",
+		fetchTime:          fetchTime,
+	}
+
+	dir, err := ioutil.TempDir("", "service-config-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := newServiceConfigCache(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.save(newServiceConfigCacheRecord(svc)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cache.load(svc.name); err == nil {
+		t.Fatal("the cached service config fetched 2 hours ago should be stale")
+	}
+
+	// The rollout check finds the current config is still the latest.
+	m := &ConfigManager{configCache: cache}
+	if err := m.fetchAndApplyRollout(svc, "2023-01-01r1", map[string]float64{serviceConfig.Id: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if !svc.fetchTime.After(fetchTime) {
+		t.Errorf("fetch time %v is not refreshed by the rollout check", svc.fetchTime)
+	}
+	cache.flush()
+	entry, _, err := cache.load(svc.name)
+	if err != nil {
+		t.Fatalf("the cached service config should be refreshed by the rollout check, got error: %v", err)
+	}
+	if !entry.FetchTime.Equal(svc.fetchTime) {
+		t.Errorf("got cached fetch time %v, want %v", entry.FetchTime, svc.fetchTime)
+	}
+}
+
+func TestHandleRequestDoesNotWaitForCacheWrite(t *testing.T) {
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.DisableTracing = true
+	serviceConfig := &confpb.Service{
+		Name: "bookstore.endpoints.project123.cloud.goog",
+		Id:   "2023-01-01r0",
+		Apis: []*apipb.Api{
+			{
+				Name:    "endpoints.examples.bookstore.Bookstore",
+				Methods: []*apipb.Method{{Name: "ListShelves"}},
+			},
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "service-config-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configCache, err := newServiceConfigCache(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The writes are blocked until unblockWrites is closed.
+	writeStarted := make(chan struct{}, 2)
+	writeDone := make(chan struct{}, 2)
+	unblockWrites := make(chan struct{})
+	configCache.writeFile = func(path string, data []byte) error {
+		writeStarted <- struct{}{}
+		<-unblockWrites
+		defer func() { writeDone <- struct{}{} }()
+		return writeFileAtomically(path, data)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go configCache.run(ctx)
+
+	m := &ConfigManager{
+		envoyConfigOptions: opts,
+		configCache:        configCache,
+	}
+	m.cache = cache.NewSnapshotCache(true, m, m)
+	svc := &serviceState{name: serviceConfig.Name}
+	m.services = []*serviceState{svc}
+	if err := m.applyServiceConfig(svc, serviceConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := 0
+	// ack mimics Envoy ACKing the current snapshot, failing if it takes
+	// longer than the timeout.
+	ack := func() {
+		m.mu.Lock()
+		snapshot := m.curSnapshot
+		m.mu.Unlock()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for _, typeUrl := range snapshotTypes(snapshot) {
+				nonce++
+				key := responseKey{streamId: 1, nonce: fmt.Sprint(nonce)}
+				m.recordResponse(key, snapshot.GetVersion(typeUrl))
+				m.handleRequest(key, typeUrl, nil)
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("handleRequest is blocked by the cache write")
+		}
+	}
+	waitFor := func(c chan struct{}, what string) {
+		select {
+		case <-c:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for the cache %s", what)
+		}
+	}
+
+	ack()
+	waitFor(writeStarted, "write of the first config to start")
+
+	// The first write is still blocked when the next config is applied and
+	// ACKed.
+	newServiceConfig := proto.Clone(serviceConfig).(*confpb.Service)
+	newServiceConfig.Id = "2023-01-02r0"
+	if err := m.applyServiceConfig(svc, newServiceConfig); err != nil {
+		t.Fatal(err)
+	}
+	ack()
+	if got := m.configStatus().Services[0].ServiceConfigId; got != newServiceConfig.Id {
+		t.Errorf("got config id %v, want %v", got, newServiceConfig.Id)
+	}
+
+	close(unblockWrites)
+	waitFor(writeDone, "write of the first config to finish")
+	waitFor(writeStarted, "write of the second config to start")
+	waitFor(writeDone, "write of the second config to finish")
+	_, configs, err := configCache.load(svc.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configs[0].GetId() != newServiceConfig.Id {
+		t.Errorf("got cached config id %v, want %v", configs[0].GetId(), newServiceConfig.Id)
+	}
+}
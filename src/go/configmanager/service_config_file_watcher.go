@@ -0,0 +1,176 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/grpcconfig"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/openapi"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/glog"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+// The format of a service config file.
+type serviceFileFormat int
+
+const (
+	// A service config in JSON, from --service_json_path.
+	serviceConfigJson serviceFileFormat = iota
+	// An OpenAPI document, from --openapi_path.
+	openAPIDocument
+	// A FileDescriptorSet, from --descriptor_path.
+	protoDescriptor
+)
+
+// watchServiceConfigFiles polls the files in --service_json_path and applies
+// the service configs that changed. Files are polled instead of watched as
+// Kubernetes updates mounted ConfigMaps by swapping symlinks.
+func (m *ConfigManager) watchServiceConfigFiles(interval time.Duration) {
+	go func() {
+		glog.Infof("start checking service config files every %v", interval)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for _, svc := range m.services {
+				if err := m.reloadServiceConfigFile(svc); err != nil {
+					glog.Errorf("fail to reload service config file %s, keep the current config: %v", svc.servicePath, err)
+				}
+			}
+		}
+	}()
+}
+
+// reloadServiceConfigFile applies the service config file of svc if its
+// content changed. The current config is kept if the new one is invalid.
+func (m *ConfigManager) reloadServiceConfigFile(svc *serviceState) error {
+	modTime, err := svc.serviceFilesModTime()
+	if err != nil {
+		return err
+	}
+	if modTime.Equal(svc.serviceModTime) {
+		return nil
+	}
+
+	oldHash := svc.serviceHash
+	config, err := svc.readServiceConfigFile()
+	if err != nil {
+		return err
+	}
+	if svc.serviceHash == oldHash {
+		return nil
+	}
+
+	serviceConfig, err := svc.unmarshalServiceConfigFile(config)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("service config file %s changed, applying service config %v", svc.servicePath, serviceConfig.GetId())
+	return m.applyServiceConfig(svc, serviceConfig)
+}
+
+// readServiceConfigFile reads the service config file of svc, recording its
+// modification time and content hash.
+func (s *serviceState) readServiceConfigFile() ([]byte, error) {
+	modTime, err := s.serviceFilesModTime()
+	if err != nil {
+		return nil, fmt.Errorf("fail to read service config file: %s, error: %s", s.servicePath, err)
+	}
+	config, err := ioutil.ReadFile(s.servicePath)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read service config file: %s, error: %s", s.servicePath, err)
+	}
+	hash := sha256.New()
+	hash.Write(config)
+	if s.descriptorRulesPath != "" {
+		rules, err := ioutil.ReadFile(s.descriptorRulesPath)
+		if err != nil {
+			return nil, fmt.Errorf("fail to read descriptor rules file: %s, error: %s", s.descriptorRulesPath, err)
+		}
+		hash.Write(rules)
+	}
+	s.serviceModTime = modTime
+	copy(s.serviceHash[:], hash.Sum(nil))
+	return config, nil
+}
+
+// serviceFilesModTime returns the latest modification time of the service
+// config file of svc and of its descriptor rules file.
+func (s *serviceState) serviceFilesModTime() (time.Time, error) {
+	info, err := os.Stat(s.servicePath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	modTime := info.ModTime()
+	if s.descriptorRulesPath != "" {
+		rulesInfo, err := os.Stat(s.descriptorRulesPath)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if rulesInfo.ModTime().After(modTime) {
+			modTime = rulesInfo.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+// unmarshalServiceConfigFile parses the content of the service config file
+// of svc. A service config built from an OpenAPI document or a descriptor
+// gets a config id derived from the content, so that a changed file is a new
+// config.
+func (s *serviceState) unmarshalServiceConfigFile(config []byte) (*confpb.Service, error) {
+	switch s.format {
+	case openAPIDocument:
+		serviceConfig, err := openapi.ToServiceConfig(config)
+		if err != nil {
+			return nil, fmt.Errorf("fail to convert OpenAPI document %s: %v", s.servicePath, err)
+		}
+		serviceConfig.Id = fmt.Sprintf("openapi-%x", s.serviceHash[:6])
+		return serviceConfig, nil
+	case protoDescriptor:
+		var rules []byte
+		if s.descriptorRulesPath != "" {
+			var err error
+			if rules, err = ioutil.ReadFile(s.descriptorRulesPath); err != nil {
+				return nil, fmt.Errorf("fail to read descriptor rules file: %s, error: %s", s.descriptorRulesPath, err)
+			}
+		}
+		serviceConfig, err := grpcconfig.ToServiceConfig(config, rules)
+		if err != nil {
+			return nil, fmt.Errorf("fail to build service config from proto descriptor %s: %v", s.servicePath, err)
+		}
+		serviceConfig.Id = fmt.Sprintf("descriptor-%x", s.serviceHash[:6])
+		return serviceConfig, nil
+	default:
+		serviceConfig, err := util.UnmarshalServiceConfig(bytes.NewReader(config))
+		if err != nil {
+			return nil, fmt.Errorf("fail to unmarshal service config with error: %s", err)
+		}
+		return serviceConfig, nil
+	}
+}
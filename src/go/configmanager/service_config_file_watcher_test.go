@@ -0,0 +1,106 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configmanager/testdata"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/tests/env/platform"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+func TestReloadServiceConfigFile(t *testing.T) {
+	config, err := ioutil.ReadFile(platform.GetFilePath(platform.FixedDrServiceConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	servicePath := filepath.Join(t.TempDir(), "service.json")
+	if err := ioutil.WriteFile(servicePath, config, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.DisableTracing = true
+	// The file is reloaded by calling reloadServiceConfigFile in this test.
+	setFlags("", "", "", "1s", servicePath)
+	_ = flag.Set("check_service_json_interval", "0")
+	defer flag.Set("check_service_json_interval", "5s")
+
+	manager, err := NewConfigManager(nil, opts)
+	if err != nil {
+		t.Fatal("fail to initialize Config Manager: ", err)
+	}
+	svc := manager.services[0]
+
+	newConfigId := "2017-05-01r1"
+	testData := []struct {
+		desc           string
+		content        string
+		wantError      string
+		wantConfigId   string
+		wantNewVersion bool
+	}{
+		{
+			desc:         "unchanged content is not applied again",
+			content:      string(config),
+			wantConfigId: testdata.TestFetchListenersConfigID,
+		},
+		{
+			desc:           "changed content is applied with a new snapshot version",
+			content:        strings.Replace(string(config), testdata.TestFetchListenersConfigID, newConfigId, 1),
+			wantConfigId:   newConfigId,
+			wantNewVersion: true,
+		},
+		{
+			desc:         "invalid content keeps the current config",
+			content:      "{invalid json",
+			wantError:    "fail to unmarshal service config",
+			wantConfigId: newConfigId,
+		},
+	}
+
+	modTime := time.Now()
+	for _, tc := range testData {
+		oldVersion := manager.curSnapshot.GetVersion(resource.ListenerType)
+		if err := ioutil.WriteFile(servicePath, []byte(tc.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Make sure the modification time changes regardless of the file system resolution.
+		modTime = modTime.Add(time.Second)
+		if err := os.Chtimes(servicePath, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+
+		err := manager.reloadServiceConfigFile(svc)
+		if tc.wantError == "" && err != nil || tc.wantError != "" && (err == nil || !strings.Contains(err.Error(), tc.wantError)) {
+			t.Errorf("Test Desc: %s, got error: %v, want error: %v", tc.desc, err, tc.wantError)
+		}
+		if got := manager.curConfigId(); got != tc.wantConfigId {
+			t.Errorf("Test Desc: %s, got config id %v, want %v", tc.desc, got, tc.wantConfigId)
+		}
+		got := manager.curSnapshot.GetVersion(resource.ListenerType)
+		if versionConfigId(got) != tc.wantConfigId || (got != oldVersion) != tc.wantNewVersion {
+			t.Errorf("Test Desc: %s, got snapshot version %v, old version %v, want new version: %v", tc.desc, got, oldVersion, tc.wantNewVersion)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/glog"
+
+	sc "github.com/GoogleCloudPlatform/esp-v2/src/go/serviceconfig"
+)
+
+// initServiceConfigSources fetches the service configs from the sources in
+// --service_config_source and makes the first snapshot.
+func (m *ConfigManager) initServiceConfigSources(accessToken util.GetAccessTokenFunc) error {
+	client, err := httpsClient(m.envoyConfigOptions)
+	if err != nil {
+		return fmt.Errorf("fail to init httpsClient: %v", err)
+	}
+	sourceOpts := sc.ServiceConfigSourceOptions{
+		Client:               client,
+		ServiceManagementUrl: m.envoyConfigOptions.ServiceManagementURL,
+		AccessToken:          accessToken,
+		BearerTokenFile:      *serviceConfigSourceBearerTokenFile,
+	}
+
+	for _, uri := range splitList(*ServiceConfigSource) {
+		source, err := sc.NewServiceConfigSource(uri, sourceOpts)
+		if err != nil {
+			return err
+		}
+		serviceConfig, err := source.FetchServiceConfig(m.ctx)
+		if err != nil {
+			return fmt.Errorf("fail to fetch the service config from %s, %v", source, err)
+		}
+		serviceInfo, err := m.makeServiceInfo(serviceConfig)
+		if err != nil {
+			return err
+		}
+		m.services = append(m.services, &serviceState{
+			name:          serviceConfig.GetName(),
+			serviceConfig: serviceConfig,
+			serviceInfo:   serviceInfo,
+			source:        source,
+			fetchTime:     time.Now(),
+		})
+	}
+	if err := m.updateSnapshot(); err != nil {
+		return err
+	}
+	for _, svc := range m.services {
+		svc.source.Commit()
+	}
+
+	if *checkServiceConfigSourceInterval > 0 {
+		m.watchServiceConfigSources(*checkServiceConfigSourceInterval)
+	}
+	return nil
+}
+
+// watchServiceConfigSources polls the service config sources and applies the
+// service configs that changed.
+func (m *ConfigManager) watchServiceConfigSources(interval time.Duration) {
+	go func() {
+		glog.Infof("start checking service config sources every %v", interval)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for _, svc := range m.services {
+				if err := m.reloadServiceConfigSource(svc); err != nil {
+					glog.Errorf("fail to reload service config from %s, keep the current config: %v", svc.source, err)
+				}
+			}
+		}
+	}()
+}
+
+// reloadServiceConfigSource applies the service config from the source of
+// svc if it changed. The source only commits the service config once it is
+// applied, so a failed one is fetched and tried again on the next check.
+func (m *ConfigManager) reloadServiceConfigSource(svc *serviceState) error {
+	serviceConfig, err := svc.source.FetchServiceConfig(m.ctx)
+	if err != nil || serviceConfig == nil {
+		return err
+	}
+	if serviceConfig.GetName() != svc.name {
+		return fmt.Errorf("service name changed from %s to %s", svc.name, serviceConfig.GetName())
+	}
+
+	glog.Infof("service config from %s changed, applying service config %v", svc.source, serviceConfig.GetId())
+	if err := m.applyServiceConfig(svc, serviceConfig); err != nil {
+		return err
+	}
+	svc.source.Commit()
+	return nil
+}
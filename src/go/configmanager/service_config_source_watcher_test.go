@@ -0,0 +1,152 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configmanager/testdata"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/tests/env/platform"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+func TestReloadServiceConfigSource(t *testing.T) {
+	config, err := ioutil.ReadFile(platform.GetFilePath(platform.FixedDrServiceConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	content, etag, status := string(config), `"v1"`, http.StatusOK
+	notModified := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.DisableTracing = true
+	opts.SslSidestreamClientRootCertsPath = platform.GetFilePath(platform.TestRootCaCerts)
+	// The source is reloaded by calling reloadServiceConfigSource in this test.
+	setFlags("", "", "", "1s", "")
+	_ = flag.Set("service_config_source", server.URL)
+	defer flag.Set("service_config_source", "")
+	_ = flag.Set("check_service_config_source_interval", "0")
+	defer flag.Set("check_service_config_source_interval", "60s")
+
+	manager, err := NewConfigManager(nil, opts)
+	if err != nil {
+		t.Fatal("fail to initialize Config Manager: ", err)
+	}
+	svc := manager.services[0]
+
+	newConfigId := "2017-05-01r1"
+	testData := []struct {
+		desc            string
+		status          int
+		etag            string
+		content         string
+		wantError       string
+		wantConfigId    string
+		wantNewVersion  bool
+		wantNotModified bool
+	}{
+		{
+			desc:            "unchanged ETag is not applied again",
+			status:          http.StatusOK,
+			etag:            `"v1"`,
+			content:         string(config),
+			wantConfigId:    testdata.TestFetchListenersConfigID,
+			wantNotModified: true,
+		},
+		{
+			desc:           "changed content is applied with a new snapshot version",
+			status:         http.StatusOK,
+			etag:           `"v2"`,
+			content:        strings.Replace(string(config), testdata.TestFetchListenersConfigID, newConfigId, 1),
+			wantConfigId:   newConfigId,
+			wantNewVersion: true,
+		},
+		{
+			desc:         "fetch failure keeps the current config",
+			status:       http.StatusInternalServerError,
+			etag:         `"v3"`,
+			content:      string(config),
+			wantError:    "got status 500",
+			wantConfigId: newConfigId,
+		},
+		{
+			desc:         "invalid content keeps the current config",
+			status:       http.StatusOK,
+			etag:         `"v3"`,
+			content:      "{invalid json",
+			wantError:    "fail to unmarshal service config",
+			wantConfigId: newConfigId,
+		},
+		{
+			desc:           "valid content after a failure is applied",
+			status:         http.StatusOK,
+			etag:           `"v4"`,
+			content:        string(config),
+			wantConfigId:   testdata.TestFetchListenersConfigID,
+			wantNewVersion: true,
+		},
+	}
+
+	for _, tc := range testData {
+		oldVersion := manager.curSnapshot.GetVersion(resource.ListenerType)
+		mu.Lock()
+		content, etag, status = tc.content, tc.etag, tc.status
+		oldNotModified := notModified
+		mu.Unlock()
+
+		err := manager.reloadServiceConfigSource(svc)
+		if tc.wantError == "" && err != nil || tc.wantError != "" && (err == nil || !strings.Contains(err.Error(), tc.wantError)) {
+			t.Errorf("Test Desc: %s, got error: %v, want error: %v", tc.desc, err, tc.wantError)
+		}
+		mu.Lock()
+		gotNotModified := notModified != oldNotModified
+		mu.Unlock()
+		if gotNotModified != tc.wantNotModified {
+			t.Errorf("Test Desc: %s, got not modified response: %v, want: %v", tc.desc, gotNotModified, tc.wantNotModified)
+		}
+		if got := manager.curConfigId(); got != tc.wantConfigId {
+			t.Errorf("Test Desc: %s, got config id %v, want %v", tc.desc, got, tc.wantConfigId)
+		}
+		got := manager.curSnapshot.GetVersion(resource.ListenerType)
+		if versionConfigId(got) != tc.wantConfigId || (got != oldVersion) != tc.wantNewVersion {
+			t.Errorf("Test Desc: %s, got snapshot version %v, old version %v, want new version: %v", tc.desc, got, oldVersion, tc.wantNewVersion)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+
+	rsrc "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+type serviceStatus struct {
+	ServiceName     string `json:"serviceName"`
+	ServiceConfigId string `json:"serviceConfigId"`
+	RolloutId       string `json:"rolloutId,omitempty"`
+	// Set if the service config is from --service_config_source.
+	Source string `json:"source,omitempty"`
+	// Number of the rollout checks failed in a row.
+	RolloutCheckFailures int `json:"rolloutCheckFailures,omitempty"`
+	// Config ids rejected by Envoy, mapped to the error detail.
+	RejectedConfigIds map[string]string `json:"rejectedConfigIds,omitempty"`
+}
+
+type configStatus struct {
+	RolloutStrategy string           `json:"rolloutStrategy"`
+	SnapshotVersion string           `json:"snapshotVersion"`
+	Services        []*serviceStatus `json:"services"`
+	RejectedConfig  *RejectedConfig  `json:"rejectedConfig,omitempty"`
+}
+
+type snapshotStatus struct {
+	Version   string            `json:"version"`
+	Listeners []json.RawMessage `json:"listeners"`
+	Clusters  []json.RawMessage `json:"clusters"`
+	Routes    []json.RawMessage `json:"routes,omitempty"`
+}
+
+type backendStatus struct {
+	ClusterName     string `json:"clusterName"`
+	Hostname        string `json:"hostname,omitempty"`
+	Port            uint32 `json:"port,omitempty"`
+	Path            string `json:"path,omitempty"`
+	TranslationType string `json:"translationType"`
+	Deadline        string `json:"deadline"`
+	JwtAudience     string `json:"jwtAudience,omitempty"`
+}
+
+type methodStatus struct {
+	Operation              string            `json:"operation"`
+	HttpRules              []string          `json:"httpRules,omitempty"`
+	Backend                *backendStatus    `json:"backend,omitempty"`
+	HttpBackend            *backendStatus    `json:"httpBackend,omitempty"`
+	RequireAuth            bool              `json:"requireAuth"`
+	AllowUnregisteredCalls bool              `json:"allowUnregisteredCalls"`
+	SkipServiceControl     bool              `json:"skipServiceControl"`
+	IsGenerated            bool              `json:"isGenerated"`
+	ApiKeyLocations        []json.RawMessage `json:"apiKeyLocations,omitempty"`
+}
+
+type serviceInfoStatus struct {
+	ServiceName string          `json:"serviceName"`
+	Methods     []*methodStatus `json:"methods"`
+}
+
+// StatusHandler returns the handler of the status server, which serves
+//   - /configz: the config ids, rollout ids and rollout strategy.
+//   - /snapshot: the listeners, clusters and routes served to Envoy.
+//   - /serviceinfo: the processed methods of all services.
+//   - /metrics: the metrics in the Prometheus text format.
+//   - /healthz: OK once a snapshot is made, until draining.
+func (m *ConfigManager) StatusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/configz", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, m.configStatus())
+	})
+	mux.HandleFunc("/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		status, err := m.snapshotStatus()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJson(w, status)
+	})
+	mux.HandleFunc("/serviceinfo", func(w http.ResponseWriter, r *http.Request) {
+		status, err := m.serviceInfoStatus()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJson(w, status)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte(m.metrics()))
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		ready, draining := m.curSnapshot != nil, m.draining
+		m.mu.Unlock()
+		if !ready {
+			http.Error(w, "no snapshot is made yet", http.StatusServiceUnavailable)
+			return
+		}
+		if draining {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+	return mux
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		glog.Errorf("fail to write status response: %v", err)
+	}
+}
+
+func (m *ConfigManager) configStatus() *configStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// The status is encoded after the lock is released, while a NACK may
+	// update the rejected configs, so it only has copies of them.
+	status := &configStatus{
+		RolloutStrategy: m.rolloutStrategy,
+		SnapshotVersion: m.curSnapshot.GetVersion(rsrc.ListenerType),
+	}
+	if m.rejectedConfig != nil {
+		rejected := *m.rejectedConfig
+		status.RejectedConfig = &rejected
+	}
+	for _, svc := range m.services {
+		s := &serviceStatus{
+			ServiceName:     svc.name,
+			ServiceConfigId: svc.configId(),
+		}
+		if len(svc.rejectedConfigIds) > 0 {
+			s.RejectedConfigIds = make(map[string]string, len(svc.rejectedConfigIds))
+			for id, errorDetail := range svc.rejectedConfigIds {
+				s.RejectedConfigIds[id] = errorDetail
+			}
+		}
+		if svc.source != nil {
+			s.Source = svc.source.String()
+		}
+		if svc.rolloutIdChangeDetector != nil {
+			s.RolloutId = svc.rolloutIdChangeDetector.CurRolloutId()
+			s.RolloutCheckFailures = svc.rolloutIdChangeDetector.ConsecutiveFailures()
+		}
+		status.Services = append(status.Services, s)
+	}
+	return status
+}
+
+func (m *ConfigManager) snapshotStatus() (*snapshotStatus, error) {
+	m.mu.Lock()
+	snapshot := m.curSnapshot
+	m.mu.Unlock()
+	status := &snapshotStatus{}
+	if snapshot == nil {
+		return status, nil
+	}
+
+	status.Version = snapshot.GetVersion(rsrc.ListenerType)
+	for typeUrl, dest := range map[string]*[]json.RawMessage{
+		rsrc.ListenerType: &status.Listeners,
+		rsrc.ClusterType:  &status.Clusters,
+		rsrc.RouteType:    &status.Routes,
+	} {
+		resources := snapshot.GetResources(typeUrl)
+		names := make([]string, 0, len(resources))
+		for name := range resources {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			raw, err := protoToRawJson(resources[name])
+			if err != nil {
+				return nil, err
+			}
+			*dest = append(*dest, raw)
+		}
+	}
+	return status, nil
+}
+
+func (m *ConfigManager) serviceInfoStatus() ([]*serviceInfoStatus, error) {
+	m.mu.Lock()
+	var serviceInfos []*configinfo.ServiceInfo
+	for _, svc := range m.services {
+		serviceInfos = append(serviceInfos, svc.serviceInfo)
+	}
+	m.mu.Unlock()
+
+	var statuses []*serviceInfoStatus
+	for _, serviceInfo := range serviceInfos {
+		status := &serviceInfoStatus{
+			ServiceName: serviceInfo.Name,
+		}
+		for _, operation := range serviceInfo.Operations {
+			method := serviceInfo.Methods[operation]
+			ms := &methodStatus{
+				Operation:              operation,
+				RequireAuth:            method.RequireAuth,
+				AllowUnregisteredCalls: method.AllowUnregisteredCalls,
+				SkipServiceControl:     method.SkipServiceControl,
+				IsGenerated:            method.IsGenerated,
+			}
+			if b := method.BackendInfo; b != nil {
+				ms.Backend = &backendStatus{
+					ClusterName:     b.ClusterName,
+					Hostname:        b.Hostname,
+					Port:            b.Port,
+					Path:            b.Path,
+					TranslationType: b.TranslationType.String(),
+					Deadline:        b.Deadline.String(),
+					JwtAudience:     b.JwtAudience,
+				}
+			}
+			if b := method.HttpBackendInfo; b != nil {
+				ms.HttpBackend = &backendStatus{
+					ClusterName:     b.ClusterName,
+					Hostname:        b.Hostname,
+					Port:            b.Port,
+					Path:            b.Path,
+					TranslationType: b.TranslationType.String(),
+					Deadline:        b.Deadline.String(),
+					JwtAudience:     b.JwtAudience,
+				}
+			}
+			for _, httpRule := range method.HttpRule {
+				if httpRule.UriTemplate != nil {
+					ms.HttpRules = append(ms.HttpRules, httpRule.HttpMethod+" "+httpRule.UriTemplate.String())
+				}
+			}
+			for _, location := range method.ApiKeyLocations {
+				raw, err := protoToRawJson(location)
+				if err != nil {
+					return nil, err
+				}
+				ms.ApiKeyLocations = append(ms.ApiKeyLocations, raw)
+			}
+			status.Methods = append(status.Methods, ms)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func protoToRawJson(msg proto.Message) (json.RawMessage, error) {
+	jsonStr, err := util.ProtoToJson(msg)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(jsonStr), nil
+}
+
+// metrics returns the metrics of the rollout checks in the Prometheus text
+// format.
+func (m *ConfigManager) metrics() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b strings.Builder
+	b.WriteString("# HELP espv2_rollout_check_consecutive_failures Number of the rollout checks failed in a row.\n")
+	b.WriteString("# TYPE espv2_rollout_check_consecutive_failures gauge\n")
+	for _, svc := range m.services {
+		if svc.rolloutIdChangeDetector != nil {
+			fmt.Fprintf(&b, "espv2_rollout_check_consecutive_failures{service=%q} %d\n", svc.name, svc.rolloutIdChangeDetector.ConsecutiveFailures())
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,169 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configmanager/testdata"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/tests/env/platform"
+)
+
+func TestStatusHandler(t *testing.T) {
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.DisableTracing = true
+	setFlags("", "", "", "1s", platform.GetFilePath(platform.FixedDrServiceConfig))
+
+	manager, err := NewConfigManager(nil, opts)
+	if err != nil {
+		t.Fatal("fail to initialize Config Manager: ", err)
+	}
+	server := httptest.NewServer(manager.StatusHandler())
+	defer server.Close()
+
+	testData := []struct {
+		desc     string
+		path     string
+		wantCode int
+		check    func(body []byte) error
+	}{
+		{
+			desc:     "healthz is OK once the snapshot is made",
+			path:     "/healthz",
+			wantCode: http.StatusOK,
+		},
+		{
+			desc:     "metrics are in the Prometheus text format",
+			path:     "/metrics",
+			wantCode: http.StatusOK,
+			check: func(body []byte) error {
+				if !strings.Contains(string(body), "# TYPE espv2_rollout_check_consecutive_failures gauge") {
+					return fmt.Errorf("got unexpected metrics: %s", body)
+				}
+				return nil
+			},
+		},
+		{
+			desc:     "configz reports the config id and rollout strategy",
+			path:     "/configz",
+			wantCode: http.StatusOK,
+			check: func(body []byte) error {
+				got := &configStatus{}
+				if err := json.Unmarshal(body, got); err != nil {
+					return err
+				}
+				if got.RolloutStrategy != "fixed" || len(got.Services) != 1 || got.Services[0].ServiceConfigId != testdata.TestFetchListenersConfigID {
+					return fmt.Errorf("got unexpected config status: %s", body)
+				}
+				return nil
+			},
+		},
+		{
+			desc:     "snapshot has the listener and clusters",
+			path:     "/snapshot",
+			wantCode: http.StatusOK,
+			check: func(body []byte) error {
+				got := &snapshotStatus{}
+				if err := json.Unmarshal(body, got); err != nil {
+					return err
+				}
+				if versionConfigId(got.Version) != testdata.TestFetchListenersConfigID || len(got.Listeners) != 1 || len(got.Clusters) == 0 {
+					return fmt.Errorf("got unexpected snapshot status: %s", body)
+				}
+				return nil
+			},
+		},
+		{
+			desc:     "serviceinfo has the methods with backends",
+			path:     "/serviceinfo",
+			wantCode: http.StatusOK,
+			check: func(body []byte) error {
+				var got []*serviceInfoStatus
+				if err := json.Unmarshal(body, &got); err != nil {
+					return err
+				}
+				if len(got) != 1 {
+					return fmt.Errorf("got unexpected service info status: %s", body)
+				}
+				for _, method := range got[0].Methods {
+					if method.Backend != nil {
+						return nil
+					}
+				}
+				return fmt.Errorf("got no method with backend in service info status: %s", body)
+			},
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			resp, err := http.Get(server.URL + tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tc.wantCode {
+				t.Fatalf("got status code %v, want %v, body: %s", resp.StatusCode, tc.wantCode, body)
+			}
+			if tc.check != nil {
+				if err := tc.check(body); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigStatusCopiesRejectedConfigs(t *testing.T) {
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.DisableTracing = true
+	setFlags("", "", "", "1s", platform.GetFilePath(platform.FixedDrServiceConfig))
+
+	manager, err := NewConfigManager(nil, opts)
+	if err != nil {
+		t.Fatal("fail to initialize Config Manager: ", err)
+	}
+
+	manager.mu.Lock()
+	manager.rejectedConfig = &RejectedConfig{ConfigId: "rejected", ErrorDetail: "bad config"}
+	svc := manager.services[0]
+	svc.rejectedConfigIds = map[string]string{"rejected": "bad config"}
+	manager.mu.Unlock()
+
+	status := manager.configStatus()
+
+	manager.mu.Lock()
+	manager.rejectedConfig.ErrorDetail = "updated"
+	svc.rejectedConfigIds["another"] = "updated"
+	manager.mu.Unlock()
+
+	if status.RejectedConfig.ErrorDetail != "bad config" {
+		t.Errorf("got rejected config %+v, want it unchanged by a later NACK", status.RejectedConfig)
+	}
+	if got := status.Services[0].RejectedConfigIds; len(got) != 1 || got["rejected"] != "bad config" {
+		t.Errorf("got rejected config ids %v, want them unchanged by a later NACK", got)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configmanager
+
+import (
+	"context"
+
+	"github.com/golang/glog"
+
+	corepb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discoverypb "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	xds "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+)
+
+// responseKey identifies a response sent to Envoy. Nonces are only unique
+// within a stream, and state-of-the-world and delta streams are numbered
+// separately.
+type responseKey struct {
+	delta    bool
+	streamId int64
+	nonce    string
+}
+
+// RejectedConfig describes the last snapshot NACKed by Envoy.
+type RejectedConfig struct {
+	// The config ids of all services in the snapshot joined by ",".
+	ConfigId    string
+	ErrorDetail string
+}
+
+// Callbacks returns the xDS server callbacks tracking whether Envoy accepts
+// the pushed snapshots. When Envoy NACKs a snapshot, the last ACKed snapshot
+// is restored and the rejected config ids are not applied again.
+func (m *ConfigManager) Callbacks() xds.Callbacks {
+	return xds.CallbackFuncs{
+		StreamClosedFunc: func(streamId int64, _ *corepb.Node) {
+			m.closeStream(false, streamId)
+		},
+		DeltaStreamClosedFunc: func(streamId int64, _ *corepb.Node) {
+			m.closeStream(true, streamId)
+		},
+		StreamResponseFunc: func(_ context.Context, streamId int64, _ *discoverypb.DiscoveryRequest, resp *discoverypb.DiscoveryResponse) {
+			m.recordResponse(responseKey{streamId: streamId, nonce: resp.GetNonce()}, resp.GetVersionInfo())
+		},
+		StreamDeltaResponseFunc: func(streamId int64, _ *discoverypb.DeltaDiscoveryRequest, resp *discoverypb.DeltaDiscoveryResponse) {
+			m.recordResponse(responseKey{delta: true, streamId: streamId, nonce: resp.GetNonce()}, resp.GetSystemVersionInfo())
+		},
+		StreamRequestFunc: func(streamId int64, req *discoverypb.DiscoveryRequest) error {
+			m.handleRequest(responseKey{streamId: streamId, nonce: req.GetResponseNonce()}, req.GetTypeUrl(), req.GetErrorDetail())
+			return nil
+		},
+		StreamDeltaRequestFunc: func(streamId int64, req *discoverypb.DeltaDiscoveryRequest) error {
+			m.handleRequest(responseKey{delta: true, streamId: streamId, nonce: req.GetResponseNonce()}, req.GetTypeUrl(), req.GetErrorDetail())
+			return nil
+		},
+	}
+}
+
+// LastRejectedConfig returns the last snapshot NACKed by Envoy, nil if there is none.
+func (m *ConfigManager) LastRejectedConfig() *RejectedConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.rejectedConfig == nil {
+		return nil
+	}
+	rejected := *m.rejectedConfig
+	return &rejected
+}
+
+func (m *ConfigManager) closeStream(delta bool, streamId int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.sentVersions {
+		if key.delta == delta && key.streamId == streamId {
+			delete(m.sentVersions, key)
+		}
+	}
+}
+
+func (m *ConfigManager) recordResponse(key responseKey, version string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sentVersions == nil {
+		m.sentVersions = make(map[responseKey]string)
+	}
+	m.sentVersions[key] = version
+}
+
+func (m *ConfigManager) handleRequest(key responseKey, typeUrl string, errorDetail *statuspb.Status) {
+	// The initial request of a stream is neither ACK nor NACK.
+	if key.nonce == "" {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	version, ok := m.sentVersions[key]
+	if !ok {
+		return
+	}
+	delete(m.sentVersions, key)
+
+	// Only the response of the latest snapshot matters, Envoy may still be
+	// answering the ones sent before.
+	if m.curSnapshot == nil || version != m.curSnapshot.GetVersion(typeUrl) {
+		return
+	}
+
+	if errorDetail != nil {
+		m.rollbackLocked(version, errorDetail.GetMessage())
+		return
+	}
+
+	m.ackedTypes[typeUrl] = true
+	for _, t := range snapshotTypes(m.curSnapshot) {
+		if !m.ackedTypes[t] {
+			return
+		}
+	}
+	if m.ackedSnapshot != m.curSnapshot {
+		glog.Infof("Envoy accepted the configuration version %v", version)
+	}
+	m.ackedSnapshot = m.curSnapshot
+	for _, svc := range m.services {
+		// Only the state is copied under the lock, the file is written by the cache.
+		if m.configCache != nil && svc.servicePath == "" && svc.source == nil && (svc.ackedServiceConfig == nil || svc.configId() != svc.ackedConfigId()) {
+			m.configCache.saveAsync(newServiceConfigCacheRecord(svc))
+		}
+		svc.ackedServiceConfig, svc.ackedServiceInfo, svc.ackedRolloutId = svc.serviceConfig, svc.serviceInfo, svc.rolloutId
+	}
+}
+
+func (m *ConfigManager) rollbackLocked(version, errorDetail string) {
+	glog.Errorf("Envoy rejected the configuration version %v: %v", version, errorDetail)
+	m.rejectedConfig = &RejectedConfig{
+		ConfigId:    versionConfigId(version),
+		ErrorDetail: errorDetail,
+	}
+
+	// Only the services changed since the last ACKed snapshot are blamed.
+	for _, svc := range m.services {
+		if svc.ackedServiceConfig != nil && svc.configId() == svc.ackedConfigId() {
+			continue
+		}
+		if svc.rejectedConfigIds == nil {
+			svc.rejectedConfigIds = make(map[string]string)
+		}
+		svc.rejectedConfigIds[svc.configId()] = errorDetail
+	}
+
+	if m.ackedSnapshot == nil {
+		glog.Errorf("no configuration was accepted by Envoy yet, cannot roll back")
+		return
+	}
+	for _, svc := range m.services {
+		svc.serviceConfig, svc.serviceInfo, svc.rolloutId = svc.ackedServiceConfig, svc.ackedServiceInfo, svc.ackedRolloutId
+	}
+	if err := m.setSnapshotLocked(m.ackedSnapshot); err != nil {
+		glog.Errorf("fail to roll back to the last accepted configuration: %v", err)
+		return
+	}
+	glog.Warningf("rolled back to the configuration version %v", m.curConfigIdLocked())
+}
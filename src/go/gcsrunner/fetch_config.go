@@ -135,6 +135,16 @@ func FetchConfigFromGCS(opts FetchConfigOptions) error {
 	return nil
 }
 
+// ReadConfigFromGCS fetches a config from GCS without writing it to file,
+// retrying as FetchConfigFromGCS. WriteFilePath is ignored.
+func ReadConfigFromGCS(opts FetchConfigOptions) ([]byte, error) {
+	b, err := readBytes(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object: %v", err)
+	}
+	return b, nil
+}
+
 func readBytes(opts FetchConfigOptions) ([]byte, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), opts.FetchGCSObjectTimeout)
 	defer cancel()
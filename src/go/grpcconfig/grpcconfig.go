@@ -0,0 +1,160 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package grpcconfig builds service configs for gRPC services from their
+// proto descriptors, so that ESPv2 can serve them without the service config
+// being generated by Service Management.
+package grpcconfig
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/ptypes"
+
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	anypb "github.com/golang/protobuf/ptypes/any"
+	ahpb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	smpb "google.golang.org/genproto/googleapis/api/servicemanagement/v1"
+	apipb "google.golang.org/genproto/protobuf/api"
+	"google.golang.org/protobuf/proto"
+)
+
+// The file path of the descriptor in the source info, as uploaded by gcloud.
+const descriptorFilePath = "api_descriptor.pb"
+
+// ToServiceConfig builds a service config for the gRPC services in
+// descriptorSet, a binary FileDescriptorSet generated by protoc with
+// --include_imports. The http rules are the google.api.http annotations of
+// the methods, and the descriptor is added to the source info for gRPC-JSON
+// transcoding.
+//
+// rules is an optional service config in YAML or JSON, as the gRPC API
+// config passed to gcloud, with the name and the authentication, backend,
+// usage or other rules. Its http rules replace the annotations of the same
+// methods, and if it has apis, only these services are served. Without a
+// name, the service is named after its first API.
+func ToServiceConfig(descriptorSet []byte, rules []byte) (*confpb.Service, error) {
+	fds := &descpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(descriptorSet, fds); err != nil {
+		return nil, fmt.Errorf("fail to unmarshal proto descriptor: %v", err)
+	}
+
+	serviceConfig := &confpb.Service{}
+	if len(rules) > 0 {
+		data, err := util.YamlToJson(rules)
+		if err != nil {
+			return nil, err
+		}
+		if serviceConfig, err = util.UnmarshalServiceConfig(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	}
+
+	// The services to serve, all of them if the rules do not select any.
+	selected := make(map[string]bool)
+	for _, api := range serviceConfig.GetApis() {
+		selected[api.GetName()] = true
+	}
+	ruleSelectors := make(map[string]bool)
+	for _, rule := range serviceConfig.GetHttp().GetRules() {
+		ruleSelectors[rule.GetSelector()] = true
+	}
+
+	var apis []*apipb.Api
+	var httpRules []*ahpb.HttpRule
+	for _, file := range fds.GetFile() {
+		for _, service := range file.GetService() {
+			apiName := service.GetName()
+			if file.GetPackage() != "" {
+				apiName = fmt.Sprintf("%s.%s", file.GetPackage(), service.GetName())
+			}
+			if len(selected) > 0 && !selected[apiName] {
+				continue
+			}
+			delete(selected, apiName)
+
+			api := &apipb.Api{
+				Name: apiName,
+			}
+			for _, method := range service.GetMethod() {
+				api.Methods = append(api.Methods, &apipb.Method{
+					Name:              method.GetName(),
+					RequestTypeUrl:    typeUrl(method.GetInputType()),
+					RequestStreaming:  method.GetClientStreaming(),
+					ResponseTypeUrl:   typeUrl(method.GetOutputType()),
+					ResponseStreaming: method.GetServerStreaming(),
+				})
+
+				selector := fmt.Sprintf("%s.%s", apiName, method.GetName())
+				if ruleSelectors[selector] || method.GetOptions() == nil {
+					continue
+				}
+				rule, ok := proto.GetExtension(method.GetOptions(), ahpb.E_Http).(*ahpb.HttpRule)
+				if !ok || rule == nil || rule.GetPattern() == nil {
+					continue
+				}
+				rule = proto.Clone(rule).(*ahpb.HttpRule)
+				rule.Selector = selector
+				httpRules = append(httpRules, rule)
+			}
+			apis = append(apis, api)
+		}
+	}
+	if len(selected) > 0 {
+		missing := make([]string, 0, len(selected))
+		for apiName := range selected {
+			missing = append(missing, apiName)
+		}
+		sort.Strings(missing)
+		return nil, fmt.Errorf("services %s in the rules are not found in the proto descriptor", strings.Join(missing, ", "))
+	}
+	if len(apis) == 0 {
+		return nil, fmt.Errorf("proto descriptor has no service")
+	}
+
+	serviceConfig.Apis = apis
+	if serviceConfig.Name == "" {
+		serviceConfig.Name = apis[0].Name
+	}
+	if len(httpRules) > 0 {
+		if serviceConfig.Http == nil {
+			serviceConfig.Http = &ahpb.Http{}
+		}
+		serviceConfig.Http.Rules = append(serviceConfig.Http.Rules, httpRules...)
+	}
+
+	sourceFile, err := ptypes.MarshalAny(&smpb.ConfigFile{
+		FilePath:     descriptorFilePath,
+		FileContents: descriptorSet,
+		FileType:     smpb.ConfigFile_FILE_DESCRIPTOR_SET_PROTO,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fail to marshal proto descriptor into source info: %v", err)
+	}
+	serviceConfig.SourceInfo = &confpb.SourceInfo{
+		SourceFiles: []*anypb.Any{sourceFile},
+	}
+	return serviceConfig, nil
+}
+
+// typeUrl returns the type url of a fully qualified message name in a
+// descriptor, such as ".endpoints.examples.bookstore.Shelf".
+func typeUrl(typeName string) string {
+	return util.TypeUrlPrefix + strings.TrimPrefix(typeName, ".")
+}
@@ -0,0 +1,240 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcconfig
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/golang/protobuf/ptypes"
+
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	anypb "github.com/golang/protobuf/ptypes/any"
+	ahpb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	smpb "google.golang.org/genproto/googleapis/api/servicemanagement/v1"
+	apipb "google.golang.org/genproto/protobuf/api"
+	"google.golang.org/protobuf/proto"
+)
+
+func testDescriptorSet(t *testing.T) []byte {
+	listShelves := &descpb.MethodDescriptorProto{
+		Name:       proto.String("ListShelves"),
+		InputType:  proto.String(".google.protobuf.Empty"),
+		OutputType: proto.String(".endpoints.examples.bookstore.ListShelvesResponse"),
+		Options:    &descpb.MethodOptions{},
+	}
+	proto.SetExtension(listShelves.Options, ahpb.E_Http, &ahpb.HttpRule{
+		Pattern: &ahpb.HttpRule_Get{Get: "/v1/shelves"},
+	})
+	fds := &descpb.FileDescriptorSet{
+		File: []*descpb.FileDescriptorProto{
+			{
+				Name:    proto.String("bookstore.proto"),
+				Package: proto.String("endpoints.examples.bookstore"),
+				Service: []*descpb.ServiceDescriptorProto{
+					{
+						Name: proto.String("Bookstore"),
+						Method: []*descpb.MethodDescriptorProto{
+							listShelves,
+							{
+								Name:            proto.String("StreamShelves"),
+								InputType:       proto.String(".google.protobuf.Empty"),
+								OutputType:      proto.String(".endpoints.examples.bookstore.Shelf"),
+								ServerStreaming: proto.Bool(true),
+							},
+						},
+					},
+					{
+						Name: proto.String("Admin"),
+						Method: []*descpb.MethodDescriptorProto{
+							{
+								Name:       proto.String("Reset"),
+								InputType:  proto.String(".google.protobuf.Empty"),
+								OutputType: proto.String(".google.protobuf.Empty"),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	data, err := proto.Marshal(fds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestToServiceConfig(t *testing.T) {
+	descriptorSet := testDescriptorSet(t)
+	bookstoreApi := &apipb.Api{
+		Name: "endpoints.examples.bookstore.Bookstore",
+		Methods: []*apipb.Method{
+			{
+				Name:            "ListShelves",
+				RequestTypeUrl:  "type.googleapis.com/google.protobuf.Empty",
+				ResponseTypeUrl: "type.googleapis.com/endpoints.examples.bookstore.ListShelvesResponse",
+			},
+			{
+				Name:              "StreamShelves",
+				RequestTypeUrl:    "type.googleapis.com/google.protobuf.Empty",
+				ResponseTypeUrl:   "type.googleapis.com/endpoints.examples.bookstore.Shelf",
+				ResponseStreaming: true,
+			},
+		},
+	}
+	adminApi := &apipb.Api{
+		Name: "endpoints.examples.bookstore.Admin",
+		Methods: []*apipb.Method{
+			{
+				Name:            "Reset",
+				RequestTypeUrl:  "type.googleapis.com/google.protobuf.Empty",
+				ResponseTypeUrl: "type.googleapis.com/google.protobuf.Empty",
+			},
+		},
+	}
+	sourceFile, err := ptypes.MarshalAny(&smpb.ConfigFile{
+		FilePath:     descriptorFilePath,
+		FileContents: descriptorSet,
+		FileType:     smpb.ConfigFile_FILE_DESCRIPTOR_SET_PROTO,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceInfo := &confpb.SourceInfo{
+		SourceFiles: []*anypb.Any{sourceFile},
+	}
+
+	testData := []struct {
+		desc              string
+		descriptorSet     []byte
+		rules             string
+		wantServiceConfig *confpb.Service
+		wantError         string
+	}{
+		{
+			desc:          "descriptor only",
+			descriptorSet: descriptorSet,
+			wantServiceConfig: &confpb.Service{
+				Name: "endpoints.examples.bookstore.Bookstore",
+				Apis: []*apipb.Api{bookstoreApi, adminApi},
+				Http: &ahpb.Http{
+					Rules: []*ahpb.HttpRule{
+						{
+							Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
+							Pattern:  &ahpb.HttpRule_Get{Get: "/v1/shelves"},
+						},
+					},
+				},
+				SourceInfo: sourceInfo,
+			},
+		},
+		{
+			desc:          "rules select the API and replace the http rule",
+			descriptorSet: descriptorSet,
+			rules: `
+type: google.api.Service
+config_version: 3
+name: bookstore.endpoints.project123.cloud.goog
+apis:
+- name: endpoints.examples.bookstore.Bookstore
+http:
+  rules:
+  - selector: endpoints.examples.bookstore.Bookstore.ListShelves
+    get: /v2/shelves
+usage:
+  rules:
+  - selector: "*"
+    allow_unregistered_calls: true
+`,
+			wantServiceConfig: &confpb.Service{
+				Name: "bookstore.endpoints.project123.cloud.goog",
+				Apis: []*apipb.Api{bookstoreApi},
+				Http: &ahpb.Http{
+					Rules: []*ahpb.HttpRule{
+						{
+							Selector: "endpoints.examples.bookstore.Bookstore.ListShelves",
+							Pattern:  &ahpb.HttpRule_Get{Get: "/v2/shelves"},
+						},
+					},
+				},
+				Usage: &confpb.Usage{
+					Rules: []*confpb.UsageRule{
+						{
+							Selector:               "*",
+							AllowUnregisteredCalls: true,
+						},
+					},
+				},
+				SourceInfo: sourceInfo,
+			},
+		},
+		{
+			desc:          "API in the rules not in the descriptor",
+			descriptorSet: descriptorSet,
+			rules: `
+apis:
+- name: endpoints.examples.bookstore.Library
+`,
+			wantError: "services endpoints.examples.bookstore.Library in the rules are not found in the proto descriptor",
+		},
+		{
+			desc:          "APIs in the rules not in the descriptor are all reported sorted",
+			descriptorSet: descriptorSet,
+			rules: `
+apis:
+- name: endpoints.examples.bookstore.Shelves
+- name: endpoints.examples.bookstore.Library
+`,
+			wantError: "services endpoints.examples.bookstore.Library, endpoints.examples.bookstore.Shelves in the rules are not found in the proto descriptor",
+		},
+		{
+			desc:          "invalid descriptor",
+			descriptorSet: []byte("not a descriptor"),
+			wantError:     "fail to unmarshal proto descriptor",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := ToServiceConfig(tc.descriptorSet, []byte(tc.rules))
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("want error: %v, got error: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The config version of the rules is not checked.
+			got.ConfigVersion = nil
+			if !proto.Equal(got, tc.wantServiceConfig) {
+				t.Errorf("got service config: %v\nwant: %v", got, tc.wantServiceConfig)
+			}
+
+			// The service config is accepted by the Config Manager.
+			got.Id = "descriptor-test"
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "grpc://127.0.0.1:8082"
+			if _, err := configinfo.NewServiceInfoFromServiceConfig(got, "descriptor-test", opts); err != nil {
+				t.Errorf("fail to build ServiceInfo: %v", err)
+			}
+		})
+	}
+}
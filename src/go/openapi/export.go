@@ -0,0 +1,415 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util/httppattern"
+
+	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v11/http/service_control"
+	typepb "google.golang.org/genproto/protobuf/ptype"
+)
+
+// The version of the exported OpenAPI documents.
+const exportVersion = "3.0.3"
+
+// A variable binding with its sub path, such as {name=shelves/*}.
+var variableBindingRegexp = regexp.MustCompile(`\{([^}=]+)(=[^}]*)?\}`)
+
+// The API key locations checked by the Service Control filter when the
+// service config has none.
+var defaultApiKeyLocations = []*scpb.ApiKeyLocation{
+	{Key: &scpb.ApiKeyLocation_Query{Query: "key"}},
+	{Key: &scpb.ApiKeyLocation_Query{Query: "api_key"}},
+	{Key: &scpb.ApiKeyLocation_Header{Header: "x-api-key"}},
+}
+
+type exportDocument struct {
+	OpenAPI string `json:"openapi"`
+	Info    struct {
+		Title   string `json:"title"`
+		Version string `json:"version"`
+	} `json:"info"`
+	Servers    []map[string]string                    `json:"servers,omitempty"`
+	Paths      map[string]map[string]*exportOperation `json:"paths"`
+	Components struct {
+		Schemas         map[string]*schema       `json:"schemas,omitempty"`
+		SecuritySchemes map[string]*exportScheme `json:"securitySchemes,omitempty"`
+	} `json:"components"`
+}
+
+type exportOperation struct {
+	OperationId string                `json:"operationId"`
+	Parameters  []*parameter          `json:"parameters,omitempty"`
+	RequestBody *requestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*response  `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+type parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *schema `json:"schema"`
+}
+
+type requestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*mediaType `json:"content"`
+}
+
+type response struct {
+	Description string                `json:"description"`
+	Content     map[string]*mediaType `json:"content,omitempty"`
+}
+
+type mediaType struct {
+	Schema *schema `json:"schema"`
+}
+
+type schema struct {
+	Ref        string             `json:"$ref,omitempty"`
+	Type       string             `json:"type,omitempty"`
+	Format     string             `json:"format,omitempty"`
+	Items      *schema            `json:"items,omitempty"`
+	Properties map[string]*schema `json:"properties,omitempty"`
+}
+
+type exportScheme struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+	In   string `json:"in,omitempty"`
+	// An empty object, required for the oauth2 schemes.
+	Flows *struct{} `json:"flows,omitempty"`
+	Auth  *struct {
+		Issuer    string   `json:"issuer"`
+		JwksUri   string   `json:"jwksUri,omitempty"`
+		Audiences []string `json:"audiences,omitempty"`
+	} `json:"x-google-auth,omitempty"`
+}
+
+// FromServiceInfo renders the methods of a processed service as an OpenAPI
+// 3 document in JSON: the HTTP bindings, the JWT providers and API key
+// locations they require, and the request and response messages of gRPC
+// methods whose types are in the service config. The JWT providers use
+// x-google-auth, so that the document can be converted back by
+// ToServiceConfig. Methods generated by ESPv2, such as CORS preflight, are
+// left out.
+func FromServiceInfo(serviceInfo *configinfo.ServiceInfo) ([]byte, error) {
+	serviceConfig := serviceInfo.ServiceConfig()
+	doc := &exportDocument{
+		OpenAPI: exportVersion,
+		Paths:   make(map[string]map[string]*exportOperation),
+	}
+	doc.Info.Title = serviceConfig.GetTitle()
+	if doc.Info.Title == "" {
+		doc.Info.Title = serviceInfo.Name
+	}
+	doc.Info.Version = serviceInfo.ConfigID
+	if strings.Contains(serviceInfo.Name, ".") {
+		doc.Servers = []map[string]string{{"url": "https://" + serviceInfo.Name}}
+	}
+
+	e := &exporter{
+		serviceInfo:  serviceInfo,
+		doc:          doc,
+		types:        make(map[string]*typepb.Type),
+		schemas:      make(map[string]*schema),
+		schemes:      make(map[string]*exportScheme),
+		responses:    make(map[string]string),
+		jwtProviders: make(map[string][]string),
+	}
+	for _, t := range serviceConfig.GetTypes() {
+		e.types[t.GetName()] = t
+	}
+	for _, api := range serviceConfig.GetApis() {
+		for _, method := range api.GetMethods() {
+			selector := fmt.Sprintf("%s.%s", api.GetName(), method.GetName())
+			e.responses[selector] = strings.TrimPrefix(method.GetResponseTypeUrl(), util.TypeUrlPrefix)
+		}
+	}
+	for _, rule := range serviceConfig.GetAuthentication().GetRules() {
+		for _, requirement := range rule.GetRequirements() {
+			e.jwtProviders[rule.GetSelector()] = append(e.jwtProviders[rule.GetSelector()], requirement.GetProviderId())
+		}
+	}
+
+	for _, operation := range serviceInfo.Operations {
+		method := serviceInfo.Methods[operation]
+		if method.IsGenerated {
+			continue
+		}
+		var httpRules []*httppattern.Pattern
+		for _, httpRule := range method.HttpRule {
+			// The gRPC path is left out if the method has an HTTP binding.
+			if httpRule.UriTemplate != nil && httpRule.UriTemplate.Origin == method.GRPCPath() && len(method.HttpRule) > 1 {
+				continue
+			}
+			httpRules = append(httpRules, httpRule)
+		}
+		for i, httpRule := range httpRules {
+			// Operation ids are unique, the additional bindings are numbered.
+			operationId := operation
+			if i > 0 {
+				operationId = fmt.Sprintf("%s_%d", operation, i)
+			}
+			if err := e.addOperation(method, operationId, httpRule); err != nil {
+				return nil, fmt.Errorf("fail to export operation %s: %v", operation, err)
+			}
+		}
+	}
+	if len(e.schemas) > 0 {
+		doc.Components.Schemas = e.schemas
+	}
+	if len(e.schemes) > 0 {
+		doc.Components.SecuritySchemes = e.schemes
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+type exporter struct {
+	serviceInfo *configinfo.ServiceInfo
+	doc         *exportDocument
+	// The types of the service config by name.
+	types map[string]*typepb.Type
+	// The schemas and security schemes referenced by the operations.
+	schemas map[string]*schema
+	schemes map[string]*exportScheme
+	// The response type names and the JWT providers by selector.
+	responses    map[string]string
+	jwtProviders map[string][]string
+}
+
+func (e *exporter) addOperation(method *configinfo.MethodInfo, operationId string, httpRule *httppattern.Pattern) error {
+	if httpRule.UriTemplate == nil || httpRule.HttpMethod == httppattern.HttpMethodWildCard {
+		return nil
+	}
+	path, names := exportPath(httpRule.UriTemplate)
+	httpMethod := strings.ToLower(httpRule.HttpMethod)
+	if e.doc.Paths[path] == nil {
+		e.doc.Paths[path] = make(map[string]*exportOperation)
+	}
+	if _, ok := e.doc.Paths[path][httpMethod]; ok {
+		// Bound by another operation, such as a gRPC method with both a
+		// custom binding and the default one.
+		return nil
+	}
+
+	op := &exportOperation{
+		OperationId: operationId,
+		Responses: map[string]*response{
+			"200": {Description: "A successful response."},
+		},
+	}
+	for _, name := range names {
+		op.Parameters = append(op.Parameters, &parameter{
+			Name:     name,
+			In:       "path",
+			Required: true,
+			Schema:   &schema{Type: "string"},
+		})
+	}
+	if method.RequestTypeName != "" && httpMethod != "get" && httpMethod != "delete" {
+		if s := e.typeSchema(method.RequestTypeName); s != nil {
+			op.RequestBody = &requestBody{
+				Required: true,
+				Content:  map[string]*mediaType{"application/json": {Schema: s}},
+			}
+		}
+	}
+	if s := e.typeSchema(e.responses[method.Operation()]); s != nil {
+		op.Responses["200"].Content = map[string]*mediaType{"application/json": {Schema: s}}
+	}
+	if err := e.addSecurity(op, method); err != nil {
+		return err
+	}
+	e.doc.Paths[path][httpMethod] = op
+	return nil
+}
+
+// addSecurity sets the security requirements of op. Any of the JWT providers
+// and any of the API key locations is accepted.
+func (e *exporter) addSecurity(op *exportOperation, method *configinfo.MethodInfo) error {
+	var jwtSchemes []string
+	if method.RequireAuth {
+		for _, providerId := range e.jwtProviders[method.Operation()] {
+			if err := e.addJwtScheme(providerId); err != nil {
+				return err
+			}
+			jwtSchemes = append(jwtSchemes, providerId)
+		}
+	}
+
+	var apiKeySchemes []string
+	serviceControlEnabled := e.serviceInfo.ServiceConfig().GetControl().GetEnvironment() != "" && !e.serviceInfo.Options.SkipServiceControlFilter
+	if serviceControlEnabled && !method.AllowUnregisteredCalls && !method.SkipServiceControl {
+		locations := method.ApiKeyLocations
+		if len(locations) == 0 {
+			locations = defaultApiKeyLocations
+		}
+		for _, location := range locations {
+			scheme := &exportScheme{Type: "apiKey"}
+			switch key := location.GetKey().(type) {
+			case *scpb.ApiKeyLocation_Query:
+				scheme.In, scheme.Name = "query", key.Query
+			case *scpb.ApiKeyLocation_Header:
+				scheme.In, scheme.Name = "header", key.Header
+			case *scpb.ApiKeyLocation_Cookie:
+				scheme.In, scheme.Name = "cookie", key.Cookie
+			default:
+				continue
+			}
+			name := fmt.Sprintf("api_key_%s_%s", scheme.In, scheme.Name)
+			e.schemes[name] = scheme
+			apiKeySchemes = append(apiKeySchemes, name)
+		}
+	}
+
+	switch {
+	case len(jwtSchemes) > 0 && len(apiKeySchemes) > 0:
+		for _, jwtScheme := range jwtSchemes {
+			for _, apiKeyScheme := range apiKeySchemes {
+				op.Security = append(op.Security, map[string][]string{jwtScheme: {}, apiKeyScheme: {}})
+			}
+		}
+	default:
+		for _, name := range append(jwtSchemes, apiKeySchemes...) {
+			op.Security = append(op.Security, map[string][]string{name: {}})
+		}
+	}
+	return nil
+}
+
+func (e *exporter) addJwtScheme(providerId string) error {
+	if _, ok := e.schemes[providerId]; ok {
+		return nil
+	}
+	for _, provider := range e.serviceInfo.ServiceConfig().GetAuthentication().GetProviders() {
+		if provider.GetId() != providerId {
+			continue
+		}
+		scheme := &exportScheme{
+			Type:  "oauth2",
+			Flows: &struct{}{},
+		}
+		scheme.Auth = &struct {
+			Issuer    string   `json:"issuer"`
+			JwksUri   string   `json:"jwksUri,omitempty"`
+			Audiences []string `json:"audiences,omitempty"`
+		}{
+			Issuer:  provider.GetIssuer(),
+			JwksUri: provider.GetJwksUri(),
+		}
+		if provider.GetAudiences() != "" {
+			scheme.Auth.Audiences = strings.Split(provider.GetAudiences(), ",")
+		}
+		e.schemes[providerId] = scheme
+		return nil
+	}
+	return fmt.Errorf("JWT provider %s is not defined", providerId)
+}
+
+// typeSchema returns a reference to the schema of a message type, adding
+// the schemas of the type and the types of its fields. It returns nil if the
+// type is not in the service config.
+func (e *exporter) typeSchema(typeName string) *schema {
+	t, ok := e.types[typeName]
+	if !ok {
+		return nil
+	}
+	ref := &schema{Ref: "#/components/schemas/" + typeName}
+	if _, ok := e.schemas[typeName]; ok {
+		return ref
+	}
+
+	s := &schema{
+		Type:       "object",
+		Properties: make(map[string]*schema),
+	}
+	// Added before the fields for recursive types.
+	e.schemas[typeName] = s
+	for _, field := range t.GetFields() {
+		fieldSchema := e.fieldSchema(field)
+		if field.GetCardinality() == typepb.Field_CARDINALITY_REPEATED {
+			fieldSchema = &schema{Type: "array", Items: fieldSchema}
+		}
+		name := field.GetJsonName()
+		if name == "" {
+			name = field.GetName()
+		}
+		s.Properties[name] = fieldSchema
+	}
+	return ref
+}
+
+// fieldSchema returns the schema of a field in the proto3 JSON mapping.
+func (e *exporter) fieldSchema(field *typepb.Field) *schema {
+	switch field.GetKind() {
+	case typepb.Field_TYPE_BOOL:
+		return &schema{Type: "boolean"}
+	case typepb.Field_TYPE_INT32, typepb.Field_TYPE_SINT32, typepb.Field_TYPE_SFIXED32:
+		return &schema{Type: "integer", Format: "int32"}
+	case typepb.Field_TYPE_UINT32, typepb.Field_TYPE_FIXED32:
+		return &schema{Type: "integer", Format: "uint32"}
+	case typepb.Field_TYPE_INT64, typepb.Field_TYPE_SINT64, typepb.Field_TYPE_SFIXED64:
+		return &schema{Type: "string", Format: "int64"}
+	case typepb.Field_TYPE_UINT64, typepb.Field_TYPE_FIXED64:
+		return &schema{Type: "string", Format: "uint64"}
+	case typepb.Field_TYPE_FLOAT:
+		return &schema{Type: "number", Format: "float"}
+	case typepb.Field_TYPE_DOUBLE:
+		return &schema{Type: "number", Format: "double"}
+	case typepb.Field_TYPE_BYTES:
+		return &schema{Type: "string", Format: "byte"}
+	case typepb.Field_TYPE_MESSAGE:
+		if s := e.typeSchema(strings.TrimPrefix(field.GetTypeUrl(), util.TypeUrlPrefix)); s != nil {
+			return s
+		}
+		return &schema{Type: "object"}
+	default:
+		// Strings and enums.
+		return &schema{Type: "string"}
+	}
+}
+
+// exportPath returns the OpenAPI path of a URI template, with a variable
+// binding {name=shelves/*} as the path parameter {name}, and the names of
+// the path parameters.
+func exportPath(uriTemplate *httppattern.UriTemplate) (string, []string) {
+	// String recovers the end segments of the variables with a double
+	// wildcard in place, which are used later to match the paths. Use a copy.
+	copied := *uriTemplate
+	copied.Variables = uriTemplate.Variables[:0:0]
+	for _, v := range uriTemplate.Variables {
+		v := *v
+		copied.Variables = append(copied.Variables, &v)
+	}
+
+	var names []string
+	path := variableBindingRegexp.ReplaceAllStringFunc(copied.String(), func(binding string) string {
+		name := variableBindingRegexp.FindStringSubmatch(binding)[1]
+		names = append(names, name)
+		return "{" + name + "}"
+	})
+	sort.Strings(names)
+	return path, names
+}
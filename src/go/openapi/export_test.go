@@ -0,0 +1,238 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+	typepb "google.golang.org/genproto/protobuf/ptype"
+)
+
+const testExportApiName = "endpoints.examples.bookstore.Bookstore"
+
+var testExportServiceConfig = &confpb.Service{
+	Name:  "bookstore.endpoints.project123.cloud.goog",
+	Title: "Bookstore",
+	Id:    "2023-01-01r0",
+	Apis: []*apipb.Api{
+		{
+			Name: testExportApiName,
+			Methods: []*apipb.Method{
+				{
+					Name:            "ListShelves",
+					RequestTypeUrl:  "type.googleapis.com/google.protobuf.Empty",
+					ResponseTypeUrl: "type.googleapis.com/endpoints.examples.bookstore.ListShelvesResponse",
+				},
+				{
+					Name:            "CreateShelf",
+					RequestTypeUrl:  "type.googleapis.com/endpoints.examples.bookstore.CreateShelfRequest",
+					ResponseTypeUrl: "type.googleapis.com/endpoints.examples.bookstore.Shelf",
+				},
+			},
+		},
+	},
+	Http: &annotationspb.Http{
+		Rules: []*annotationspb.HttpRule{
+			{
+				Selector: testExportApiName + ".ListShelves",
+				Pattern:  &annotationspb.HttpRule_Get{Get: "/v1/shelves"},
+			},
+			{
+				Selector: testExportApiName + ".CreateShelf",
+				Pattern:  &annotationspb.HttpRule_Post{Post: "/v1/{parent=projects/*}/shelves"},
+				Body:     "shelf",
+			},
+		},
+	},
+	Types: []*typepb.Type{
+		{
+			Name: "endpoints.examples.bookstore.Shelf",
+			Fields: []*typepb.Field{
+				{
+					Name:     "id",
+					JsonName: "id",
+					Kind:     typepb.Field_TYPE_INT64,
+				},
+				{
+					Name:     "theme",
+					JsonName: "theme",
+					Kind:     typepb.Field_TYPE_STRING,
+				},
+			},
+		},
+		{
+			Name: "endpoints.examples.bookstore.ListShelvesResponse",
+			Fields: []*typepb.Field{
+				{
+					Name:        "shelves",
+					JsonName:    "shelves",
+					Kind:        typepb.Field_TYPE_MESSAGE,
+					Cardinality: typepb.Field_CARDINALITY_REPEATED,
+					TypeUrl:     "type.googleapis.com/endpoints.examples.bookstore.Shelf",
+				},
+			},
+		},
+		{
+			Name: "endpoints.examples.bookstore.CreateShelfRequest",
+			Fields: []*typepb.Field{
+				{
+					Name:     "parent",
+					JsonName: "parent",
+					Kind:     typepb.Field_TYPE_STRING,
+				},
+				{
+					Name:     "shelf",
+					JsonName: "shelf",
+					Kind:     typepb.Field_TYPE_MESSAGE,
+					TypeUrl:  "type.googleapis.com/endpoints.examples.bookstore.Shelf",
+				},
+			},
+		},
+	},
+	Authentication: &confpb.Authentication{
+		Providers: []*confpb.AuthProvider{
+			{
+				Id:        "auth0",
+				Issuer:    "https://auth0.com",
+				JwksUri:   "https://auth0.com/jwks",
+				Audiences: "a,b",
+			},
+		},
+		Rules: []*confpb.AuthenticationRule{
+			{
+				Selector:     testExportApiName + ".CreateShelf",
+				Requirements: []*confpb.AuthRequirement{{ProviderId: "auth0"}},
+			},
+		},
+	},
+	SystemParameters: &confpb.SystemParameters{
+		Rules: []*confpb.SystemParameterRule{
+			{
+				Selector: testExportApiName + ".CreateShelf",
+				Parameters: []*confpb.SystemParameter{
+					{
+						Name:       "api_key",
+						HttpHeader: "x-key",
+					},
+				},
+			},
+		},
+	},
+	Usage: &confpb.Usage{
+		Rules: []*confpb.UsageRule{
+			{
+				Selector:               testExportApiName + ".ListShelves",
+				AllowUnregisteredCalls: true,
+			},
+		},
+	},
+	Control: &confpb.Control{
+		Environment: "servicecontrol.googleapis.com",
+	},
+}
+
+func TestFromServiceInfo(t *testing.T) {
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.BackendAddress = "grpc://127.0.0.1:8082"
+	serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(testExportServiceConfig, testExportServiceConfig.Id, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := FromServiceInfo(serviceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := &exportDocument{}
+	if err := json.Unmarshal(data, doc); err != nil {
+		t.Fatalf("fail to unmarshal exported document: %v", err)
+	}
+
+	testData := []struct {
+		desc string
+		got  interface{}
+		want interface{}
+	}{
+		{
+			desc: "info",
+			got:  []string{doc.Info.Title, doc.Info.Version},
+			want: []string{"Bookstore", "2023-01-01r0"},
+		},
+		{
+			desc: "path parameter of a variable binding",
+			got:  doc.Paths["/v1/{parent}/shelves"]["post"].Parameters,
+			want: []*parameter{{Name: "parent", In: "path", Required: true, Schema: &schema{Type: "string"}}},
+		},
+		{
+			desc: "JWT provider and API key in header are both required",
+			got:  doc.Paths["/v1/{parent}/shelves"]["post"].Security,
+			want: []map[string][]string{{"auth0": {}, "api_key_header_x-key": {}}},
+		},
+		{
+			desc: "no security if unregistered calls are allowed",
+			got:  doc.Paths["/v1/shelves"]["get"].Security,
+			want: []map[string][]string(nil),
+		},
+		{
+			desc: "request body of the request type",
+			got:  doc.Paths["/v1/{parent}/shelves"]["post"].RequestBody.Content["application/json"].Schema,
+			want: &schema{Ref: "#/components/schemas/endpoints.examples.bookstore.CreateShelfRequest"},
+		},
+		{
+			desc: "repeated message field",
+			got:  doc.Components.Schemas["endpoints.examples.bookstore.ListShelvesResponse"].Properties["shelves"],
+			want: &schema{Type: "array", Items: &schema{Ref: "#/components/schemas/endpoints.examples.bookstore.Shelf"}},
+		},
+		{
+			desc: "int64 field as string",
+			got:  doc.Components.Schemas["endpoints.examples.bookstore.Shelf"].Properties["id"],
+			want: &schema{Type: "string", Format: "int64"},
+		},
+		{
+			desc: "gRPC path left out with an HTTP binding",
+			got:  doc.Paths["/"+testExportApiName+"/ListShelves"],
+			want: map[string]*exportOperation(nil),
+		},
+	}
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			if !reflect.DeepEqual(tc.got, tc.want) {
+				gotJson, _ := json.Marshal(tc.got)
+				wantJson, _ := json.Marshal(tc.want)
+				t.Errorf("got %s, want %s", gotJson, wantJson)
+			}
+		})
+	}
+
+	// The exported document is converted back into an equivalent service
+	// config.
+	serviceConfig, err := ToServiceConfig(data)
+	if err != nil {
+		t.Fatalf("fail to convert exported document: %v", err)
+	}
+	if got, want := serviceConfig.GetName(), testExportServiceConfig.GetName(); got != want {
+		t.Errorf("got service name %q, want %q", got, want)
+	}
+	if got := serviceConfig.GetAuthentication().GetProviders(); len(got) != 1 || got[0].GetIssuer() != "https://auth0.com" || got[0].GetAudiences() != "a,b" {
+		t.Errorf("got auth providers %v", got)
+	}
+}
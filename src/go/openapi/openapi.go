@@ -0,0 +1,614 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package openapi converts OpenAPI documents with the Endpoints extensions
+// into service configs, so that ESPv2 can serve them without the service
+// config being generated by Service Management.
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+const (
+	serviceControlEnvironment = "servicecontrol.googleapis.com"
+	emptyTypeUrl              = "type.googleapis.com/google.protobuf.Empty"
+)
+
+// The HTTP methods of the operations in a path item.
+var httpMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+var invalidOperationIdChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+type document struct {
+	Swagger string `json:"swagger"`
+	OpenAPI string `json:"openapi"`
+	Info    struct {
+		Title   string `json:"title"`
+		Version string `json:"version"`
+	} `json:"info"`
+
+	// OpenAPI 2.0.
+	Host                string                     `json:"host"`
+	BasePath            string                     `json:"basePath"`
+	SecurityDefinitions map[string]*securityScheme `json:"securityDefinitions"`
+	// OpenAPI 3.x.
+	Servers []struct {
+		URL string `json:"url"`
+	} `json:"servers"`
+	Components struct {
+		SecuritySchemes map[string]*securityScheme `json:"securitySchemes"`
+	} `json:"components"`
+
+	Paths    map[string]map[string]json.RawMessage `json:"paths"`
+	Security []map[string][]string                 `json:"security"`
+
+	Backend    *backend    `json:"x-google-backend"`
+	Management *management `json:"x-google-management"`
+	Endpoints  []struct {
+		Name      string `json:"name"`
+		AllowCors bool   `json:"allowCors"`
+	} `json:"x-google-endpoints"`
+}
+
+type operation struct {
+	OperationId string `json:"operationId"`
+	// Nil if not set, the document security applies.
+	Security *[]map[string][]string `json:"security"`
+	Backend  *backend               `json:"x-google-backend"`
+	Quota    *struct {
+		MetricCosts map[string]int64 `json:"metricCosts"`
+	} `json:"x-google-quota"`
+}
+
+type backend struct {
+	Address         string  `json:"address"`
+	JwtAudience     string  `json:"jwt_audience"`
+	DisableAuth     bool    `json:"disable_auth"`
+	PathTranslation string  `json:"path_translation"`
+	Deadline        float64 `json:"deadline"`
+	Protocol        string  `json:"protocol"`
+}
+
+type jwtLocation struct {
+	Header      string `json:"header"`
+	Query       string `json:"query"`
+	ValuePrefix string `json:"value_prefix"`
+}
+
+type securityScheme struct {
+	Type string `json:"type"`
+	// For the apiKey schemes.
+	Name string `json:"name"`
+	In   string `json:"in"`
+
+	// For the oauth2 schemes, as in OpenAPI 2.0.
+	Issuer       string         `json:"x-google-issuer"`
+	JwksUri      string         `json:"x-google-jwks_uri"`
+	Audiences    string         `json:"x-google-audiences"`
+	JwtLocations []*jwtLocation `json:"x-google-jwt-locations"`
+	// For the oauth2 schemes, as in OpenAPI 3.x.
+	Auth *struct {
+		Issuer       string         `json:"issuer"`
+		JwksUri      string         `json:"jwksUri"`
+		Audiences    []string       `json:"audiences"`
+		JwtLocations []*jwtLocation `json:"jwtLocations"`
+	} `json:"x-google-auth"`
+}
+
+type management struct {
+	Metrics []struct {
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+		ValueType   string `json:"valueType"`
+		MetricKind  string `json:"metricKind"`
+	} `json:"metrics"`
+	Quota struct {
+		Limits []struct {
+			Name        string           `json:"name"`
+			DisplayName string           `json:"displayName"`
+			Metric      string           `json:"metric"`
+			Unit        string           `json:"unit"`
+			Values      map[string]int64 `json:"values"`
+		} `json:"limits"`
+	} `json:"quota"`
+}
+
+// ToServiceConfig converts an OpenAPI 2.0 or 3.x document in JSON or YAML
+// into a service config. Like Service Management, it supports the
+// extensions x-google-backend, x-google-endpoints, x-google-management and
+// x-google-quota, and the apiKey and oauth2 security schemes with
+// x-google-issuer, x-google-jwks_uri, x-google-audiences and
+// x-google-jwt-locations, or x-google-auth in OpenAPI 3.x. The config id is
+// not set.
+func ToServiceConfig(data []byte) (*confpb.Service, error) {
+	data, err := util.YamlToJson(data)
+	if err != nil {
+		return nil, fmt.Errorf("fail to parse OpenAPI document: %v", err)
+	}
+	doc := &document{}
+	if err := json.Unmarshal(data, doc); err != nil {
+		return nil, fmt.Errorf("fail to parse OpenAPI document: %v", err)
+	}
+
+	name, basePath, schemes, err := doc.serviceInfo()
+	if err != nil {
+		return nil, err
+	}
+	c := &converter{
+		doc:      doc,
+		basePath: basePath,
+		schemes:  schemes,
+		apiName:  "1." + strings.ReplaceAll(name, ".", "_"),
+		serviceConfig: &confpb.Service{
+			Name:  name,
+			Title: doc.Info.Title,
+			Http:  &annotationspb.Http{},
+			Control: &confpb.Control{
+				Environment: serviceControlEnvironment,
+			},
+		},
+		operationIds: make(map[string]bool),
+	}
+	if err := c.convert(); err != nil {
+		return nil, err
+	}
+	return c.serviceConfig, nil
+}
+
+// serviceInfo returns the service name, the base path of the paths, and the
+// security schemes of the document.
+func (d *document) serviceInfo() (string, string, map[string]*securityScheme, error) {
+	switch {
+	case d.Swagger == "2.0":
+		if d.Host == "" {
+			return "", "", nil, fmt.Errorf("OpenAPI 2.0 document has no host, which is the service name")
+		}
+		return d.Host, strings.TrimSuffix(d.BasePath, "/"), d.SecurityDefinitions, nil
+	case strings.HasPrefix(d.OpenAPI, "3."):
+		if len(d.Servers) == 0 {
+			return "", "", nil, fmt.Errorf("OpenAPI %s document has no servers, the host of the first one is the service name", d.OpenAPI)
+		}
+		u, err := url.Parse(d.Servers[0].URL)
+		if err != nil || u.Hostname() == "" {
+			return "", "", nil, fmt.Errorf("fail to get the service name from server url %q of OpenAPI document", d.Servers[0].URL)
+		}
+		return u.Hostname(), strings.TrimSuffix(u.Path, "/"), d.Components.SecuritySchemes, nil
+	default:
+		return "", "", nil, fmt.Errorf("unsupported OpenAPI document, want swagger 2.0 or openapi 3.x, got swagger %q, openapi %q", d.Swagger, d.OpenAPI)
+	}
+}
+
+type converter struct {
+	doc           *document
+	basePath      string
+	schemes       map[string]*securityScheme
+	apiName       string
+	serviceConfig *confpb.Service
+	operationIds  map[string]bool
+}
+
+func (c *converter) convert() error {
+	api := &apipb.Api{
+		Name:    c.apiName,
+		Version: c.doc.Info.Version,
+	}
+	c.serviceConfig.Apis = []*apipb.Api{api}
+
+	for _, endpoint := range c.doc.Endpoints {
+		c.serviceConfig.Endpoints = append(c.serviceConfig.Endpoints, &confpb.Endpoint{
+			Name:      endpoint.Name,
+			AllowCors: endpoint.AllowCors,
+		})
+	}
+	if err := c.convertSecuritySchemes(); err != nil {
+		return err
+	}
+	if err := c.convertManagement(); err != nil {
+		return err
+	}
+
+	// Sorted for stable service configs.
+	var paths []string
+	for path := range c.doc.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		pathItem := c.doc.Paths[path]
+		for _, httpMethod := range httpMethods {
+			raw, ok := pathItem[httpMethod]
+			if !ok {
+				continue
+			}
+			op := &operation{}
+			if err := json.Unmarshal(raw, op); err != nil {
+				return fmt.Errorf("fail to parse operation %s %s: %v", strings.ToUpper(httpMethod), path, err)
+			}
+			if err := c.convertOperation(api, path, httpMethod, op); err != nil {
+				return fmt.Errorf("fail to convert operation %s %s: %v", strings.ToUpper(httpMethod), path, err)
+			}
+		}
+	}
+	if len(api.Methods) == 0 {
+		return fmt.Errorf("OpenAPI document has no operation")
+	}
+	return nil
+}
+
+func (c *converter) convertOperation(api *apipb.Api, path, httpMethod string, op *operation) error {
+	operationId := op.OperationId
+	if operationId == "" {
+		operationId = strings.Title(httpMethod) + path
+	}
+	operationId = invalidOperationIdChars.ReplaceAllString(operationId, "_")
+	if c.operationIds[operationId] {
+		return fmt.Errorf("duplicated operationId %q", operationId)
+	}
+	c.operationIds[operationId] = true
+
+	selector := fmt.Sprintf("%s.%s", c.apiName, operationId)
+	api.Methods = append(api.Methods, &apipb.Method{
+		Name:            operationId,
+		RequestTypeUrl:  emptyTypeUrl,
+		ResponseTypeUrl: emptyTypeUrl,
+	})
+
+	rule := &annotationspb.HttpRule{Selector: selector}
+	fullPath := c.basePath + path
+	switch httpMethod {
+	case "get":
+		rule.Pattern = &annotationspb.HttpRule_Get{Get: fullPath}
+	case "put":
+		rule.Pattern = &annotationspb.HttpRule_Put{Put: fullPath}
+	case "post":
+		rule.Pattern = &annotationspb.HttpRule_Post{Post: fullPath}
+	case "delete":
+		rule.Pattern = &annotationspb.HttpRule_Delete{Delete: fullPath}
+	case "patch":
+		rule.Pattern = &annotationspb.HttpRule_Patch{Patch: fullPath}
+	default:
+		rule.Pattern = &annotationspb.HttpRule_Custom{
+			Custom: &annotationspb.CustomHttpPattern{
+				Kind: strings.ToUpper(httpMethod),
+				Path: fullPath,
+			},
+		}
+	}
+	c.serviceConfig.Http.Rules = append(c.serviceConfig.Http.Rules, rule)
+
+	if err := c.convertSecurity(selector, op); err != nil {
+		return err
+	}
+	if err := c.convertBackend(selector, op); err != nil {
+		return err
+	}
+	if op.Quota != nil && len(op.Quota.MetricCosts) > 0 {
+		if c.serviceConfig.Quota == nil {
+			c.serviceConfig.Quota = &confpb.Quota{}
+		}
+		c.serviceConfig.Quota.MetricRules = append(c.serviceConfig.Quota.MetricRules, &confpb.MetricRule{
+			Selector:    selector,
+			MetricCosts: op.Quota.MetricCosts,
+		})
+	}
+	return nil
+}
+
+func (c *converter) convertSecuritySchemes() error {
+	var names []string
+	for name := range c.schemes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		scheme := c.schemes[name]
+		switch scheme.Type {
+		case "apiKey":
+			if scheme.In != "query" && scheme.In != "header" {
+				return fmt.Errorf("security scheme %s: apiKey must be in query or header, got %q", name, scheme.In)
+			}
+		case "oauth2":
+			provider, err := scheme.authProvider(name)
+			if err != nil {
+				return fmt.Errorf("security scheme %s: %v", name, err)
+			}
+			if c.serviceConfig.Authentication == nil {
+				c.serviceConfig.Authentication = &confpb.Authentication{}
+			}
+			c.serviceConfig.Authentication.Providers = append(c.serviceConfig.Authentication.Providers, provider)
+		}
+	}
+	return nil
+}
+
+func (s *securityScheme) authProvider(id string) (*confpb.AuthProvider, error) {
+	provider := &confpb.AuthProvider{
+		Id:        id,
+		Issuer:    s.Issuer,
+		JwksUri:   s.JwksUri,
+		Audiences: s.Audiences,
+	}
+	locations := s.JwtLocations
+	if s.Auth != nil {
+		provider.Issuer = s.Auth.Issuer
+		provider.JwksUri = s.Auth.JwksUri
+		provider.Audiences = strings.Join(s.Auth.Audiences, ",")
+		locations = s.Auth.JwtLocations
+	}
+	if provider.Issuer == "" {
+		return nil, fmt.Errorf("oauth2 scheme has no issuer")
+	}
+
+	for _, location := range locations {
+		switch {
+		case location.Header != "" && location.Query == "":
+			provider.JwtLocations = append(provider.JwtLocations, &confpb.JwtLocation{
+				In:          &confpb.JwtLocation_Header{Header: location.Header},
+				ValuePrefix: location.ValuePrefix,
+			})
+		case location.Query != "" && location.Header == "":
+			provider.JwtLocations = append(provider.JwtLocations, &confpb.JwtLocation{
+				In:          &confpb.JwtLocation_Query{Query: location.Query},
+				ValuePrefix: location.ValuePrefix,
+			})
+		default:
+			return nil, fmt.Errorf("a JWT location must have either header or query")
+		}
+	}
+	return provider, nil
+}
+
+// convertSecurity converts the security requirements of an operation. Each
+// requirement is an alternative, a JWT of any of their providers is
+// accepted, and an API key in any of their locations. The service config
+// requires the JWT and the API key independently of each other, so the
+// alternatives must all have an API key or none, and all have a JWT or none.
+// Otherwise, such as for [{api_key: []}, {google_id_token: []}], they are
+// rejected rather than converted into a requirement of both.
+func (c *converter) convertSecurity(selector string, op *operation) error {
+	security := c.doc.Security
+	if op.Security != nil {
+		security = *op.Security
+	}
+
+	// The apiKey and oauth2 schemes of each alternative, empty if it has none.
+	apiKeyNames := make([]string, len(security))
+	oauth2Names := make([]string, len(security))
+	for i, alternative := range security {
+		var names []string
+		for name := range alternative {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			scheme, ok := c.schemes[name]
+			if !ok {
+				return fmt.Errorf("security scheme %s is not defined", name)
+			}
+			var schemeName *string
+			switch scheme.Type {
+			case "apiKey":
+				schemeName = &apiKeyNames[i]
+			case "oauth2":
+				schemeName = &oauth2Names[i]
+			default:
+				return fmt.Errorf("security scheme %s has unsupported type %q, must be apiKey or oauth2", name, scheme.Type)
+			}
+			if *schemeName != "" {
+				return fmt.Errorf("security requirement #%d requires both %s and %s, only one %s scheme is supported in a requirement", i, *schemeName, name, scheme.Type)
+			}
+			*schemeName = name
+		}
+	}
+	if err := checkSecurityAlternatives(apiKeyNames, oauth2Names); err != nil {
+		return err
+	}
+
+	var requirements []*confpb.AuthRequirement
+	var apiKeyParameters []*confpb.SystemParameter
+	seen := make(map[string]bool)
+	for i := range security {
+		if name := apiKeyNames[i]; name != "" && !seen[name] {
+			seen[name] = true
+			scheme := c.schemes[name]
+			parameter := &confpb.SystemParameter{Name: util.ApiKeyParameterName}
+			if scheme.In == "header" {
+				parameter.HttpHeader = scheme.Name
+			} else {
+				parameter.UrlQueryParameter = scheme.Name
+			}
+			apiKeyParameters = append(apiKeyParameters, parameter)
+		}
+		if name := oauth2Names[i]; name != "" && !seen[name] {
+			seen[name] = true
+			scheme := c.schemes[name]
+			requirement := &confpb.AuthRequirement{ProviderId: name}
+			if scheme.Auth != nil {
+				requirement.Audiences = strings.Join(scheme.Auth.Audiences, ",")
+			} else {
+				requirement.Audiences = scheme.Audiences
+			}
+			requirements = append(requirements, requirement)
+		}
+	}
+
+	if len(requirements) > 0 {
+		c.serviceConfig.Authentication.Rules = append(c.serviceConfig.Authentication.Rules, &confpb.AuthenticationRule{
+			Selector:     selector,
+			Requirements: requirements,
+		})
+	}
+	if len(apiKeyParameters) > 0 {
+		if c.serviceConfig.SystemParameters == nil {
+			c.serviceConfig.SystemParameters = &confpb.SystemParameters{}
+		}
+		c.serviceConfig.SystemParameters.Rules = append(c.serviceConfig.SystemParameters.Rules, &confpb.SystemParameterRule{
+			Selector:   selector,
+			Parameters: apiKeyParameters,
+		})
+	}
+	if c.serviceConfig.Usage == nil {
+		c.serviceConfig.Usage = &confpb.Usage{}
+	}
+	c.serviceConfig.Usage.Rules = append(c.serviceConfig.Usage.Rules, &confpb.UsageRule{
+		Selector:               selector,
+		AllowUnregisteredCalls: len(apiKeyParameters) == 0,
+	})
+	return nil
+}
+
+// checkSecurityAlternatives checks that the alternatives of the security
+// requirements, given by their apiKey and oauth2 schemes, are the same as an
+// API key of any of the apiKey schemes and a JWT of any of the oauth2 schemes.
+func checkSecurityAlternatives(apiKeyNames, oauth2Names []string) error {
+	if len(apiKeyNames) < 2 {
+		return nil
+	}
+	for i := range apiKeyNames {
+		if (apiKeyNames[i] == "") != (apiKeyNames[0] == "") || (oauth2Names[i] == "") != (oauth2Names[0] == "") {
+			return fmt.Errorf("security requirements %s and %s are alternatives, which is not supported as the API key and the JWT are required independently, all or none of the alternatives must require each of them", describeSecurityRequirement(apiKeyNames[0], oauth2Names[0]), describeSecurityRequirement(apiKeyNames[i], oauth2Names[i]))
+		}
+	}
+	if apiKeyNames[0] == "" || oauth2Names[0] == "" {
+		return nil
+	}
+	// With both, the alternatives must pair every apiKey scheme with every
+	// oauth2 scheme, as exported by addSecurity, e.g. (key AND jwt1) OR
+	// (key AND jwt2) is key AND (jwt1 OR jwt2), but (key1 AND jwt1) OR
+	// (key2 AND jwt2) cannot be split.
+	apiKeys, oauth2s, pairs := make(map[string]bool), make(map[string]bool), make(map[[2]string]bool)
+	for i := range apiKeyNames {
+		apiKeys[apiKeyNames[i]], oauth2s[oauth2Names[i]] = true, true
+		pairs[[2]string{apiKeyNames[i], oauth2Names[i]}] = true
+	}
+	if len(pairs) != len(apiKeys)*len(oauth2s) {
+		return fmt.Errorf("security requirements requiring both an API key and a JWT are alternatives, which is not supported unless they pair each of their apiKey schemes with each of their oauth2 schemes")
+	}
+	return nil
+}
+
+func describeSecurityRequirement(apiKeyName, oauth2Name string) string {
+	var names []string
+	for _, name := range []string{apiKeyName, oauth2Name} {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return "{" + strings.Join(names, ", ") + "}"
+}
+
+// convertBackend converts the x-google-backend of an operation, or of the
+// document. Like Service Management, the path translation defaults to
+// CONSTANT_ADDRESS for an operation, and APPEND_PATH_TO_ADDRESS for the
+// document.
+func (c *converter) convertBackend(selector string, op *operation) error {
+	b, pathTranslation := op.Backend, confpb.BackendRule_CONSTANT_ADDRESS
+	if b == nil {
+		b, pathTranslation = c.doc.Backend, confpb.BackendRule_APPEND_PATH_TO_ADDRESS
+	}
+	if b == nil {
+		return nil
+	}
+
+	rule := &confpb.BackendRule{
+		Selector: selector,
+		Address:  b.Address,
+		Deadline: b.Deadline,
+		Protocol: b.Protocol,
+	}
+	if b.Address != "" {
+		if b.PathTranslation != "" {
+			value, ok := confpb.BackendRule_PathTranslation_value[b.PathTranslation]
+			if !ok {
+				return fmt.Errorf("x-google-backend has invalid path_translation %q", b.PathTranslation)
+			}
+			pathTranslation = confpb.BackendRule_PathTranslation(value)
+		}
+		rule.PathTranslation = pathTranslation
+	}
+	if b.JwtAudience != "" && b.DisableAuth {
+		return fmt.Errorf("x-google-backend cannot set both jwt_audience and disable_auth")
+	}
+	if b.JwtAudience != "" {
+		rule.Authentication = &confpb.BackendRule_JwtAudience{JwtAudience: b.JwtAudience}
+	} else if b.DisableAuth {
+		rule.Authentication = &confpb.BackendRule_DisableAuth{DisableAuth: true}
+	}
+
+	if c.serviceConfig.Backend == nil {
+		c.serviceConfig.Backend = &confpb.Backend{}
+	}
+	c.serviceConfig.Backend.Rules = append(c.serviceConfig.Backend.Rules, rule)
+	return nil
+}
+
+func (c *converter) convertManagement() error {
+	m := c.doc.Management
+	if m == nil {
+		return nil
+	}
+	for _, metric := range m.Metrics {
+		descriptor := &metricpb.MetricDescriptor{
+			Name:        metric.Name,
+			DisplayName: metric.DisplayName,
+			Type:        metric.Name,
+			MetricKind:  metricpb.MetricDescriptor_DELTA,
+			ValueType:   metricpb.MetricDescriptor_INT64,
+		}
+		if metric.MetricKind != "" {
+			value, ok := metricpb.MetricDescriptor_MetricKind_value[metric.MetricKind]
+			if !ok {
+				return fmt.Errorf("metric %s has invalid metricKind %q", metric.Name, metric.MetricKind)
+			}
+			descriptor.MetricKind = metricpb.MetricDescriptor_MetricKind(value)
+		}
+		if metric.ValueType != "" {
+			value, ok := metricpb.MetricDescriptor_ValueType_value[metric.ValueType]
+			if !ok {
+				return fmt.Errorf("metric %s has invalid valueType %q", metric.Name, metric.ValueType)
+			}
+			descriptor.ValueType = metricpb.MetricDescriptor_ValueType(value)
+		}
+		c.serviceConfig.Metrics = append(c.serviceConfig.Metrics, descriptor)
+	}
+
+	for _, limit := range m.Quota.Limits {
+		if c.serviceConfig.Quota == nil {
+			c.serviceConfig.Quota = &confpb.Quota{}
+		}
+		c.serviceConfig.Quota.Limits = append(c.serviceConfig.Quota.Limits, &confpb.QuotaLimit{
+			Name:        limit.Name,
+			DisplayName: limit.DisplayName,
+			Metric:      limit.Metric,
+			Unit:        limit.Unit,
+			Values:      limit.Values,
+		})
+	}
+	return nil
+}
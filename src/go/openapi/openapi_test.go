@@ -0,0 +1,502 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapi
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/protobuf/proto"
+
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+const testSwagger = `
+swagger: "2.0"
+info:
+  title: Bookstore
+  version: 1.0.0
+host: bookstore.endpoints.project123.cloud.goog
+basePath: /v1
+x-google-backend:
+  address: https://books.run.app
+  deadline: 10
+securityDefinitions:
+  api_key:
+    type: apiKey
+    name: key
+    in: query
+  auth0:
+    type: oauth2
+    flow: implicit
+    authorizationUrl: ""
+    x-google-issuer: https://auth0.com
+    x-google-jwks_uri: https://auth0.com/jwks
+    x-google-audiences: bookstore
+paths:
+  /shelves:
+    get:
+      operationId: ListShelves
+      security:
+      - api_key: []
+      x-google-quota:
+        metricCosts:
+          read-requests: 1
+      responses:
+        200:
+          description: OK
+  /shelves/{shelf}:
+    delete:
+      operationId: delete.shelf
+      security:
+      - auth0: []
+      x-google-backend:
+        address: https://books.run.app/deleteShelf
+        disable_auth: true
+      responses:
+        204:
+          description: Deleted
+x-google-management:
+  metrics:
+  - name: read-requests
+    displayName: Read requests
+    valueType: INT64
+    metricKind: DELTA
+  quota:
+    limits:
+    - name: read-limit
+      metric: read-requests
+      unit: 1/min/{project}
+      values:
+        STANDARD: 100
+`
+
+const testOpenAPI3 = `{
+  "openapi": "3.0.3",
+  "info": {"title": "Bookstore", "version": "1.0.0"},
+  "servers": [{"url": "https://bookstore.example.com/v1/"}],
+  "components": {
+    "securitySchemes": {
+      "auth0": {
+        "type": "oauth2",
+        "flows": {},
+        "x-google-auth": {
+          "issuer": "https://auth0.com",
+          "jwksUri": "https://auth0.com/jwks",
+          "audiences": ["a", "b"],
+          "jwtLocations": [{"header": "x-jwt", "value_prefix": "Bearer "}]
+        }
+      }
+    }
+  },
+  "security": [{"auth0": []}],
+  "paths": {
+    "/shelves": {
+      "get": {"operationId": "ListShelves"},
+      "options": {}
+    }
+  }
+}`
+
+func TestToServiceConfig(t *testing.T) {
+	testData := []struct {
+		desc              string
+		document          string
+		wantServiceConfig *confpb.Service
+		wantError         string
+	}{
+		{
+			desc:     "OpenAPI 2.0 with backends, API key, JWT and quota",
+			document: testSwagger,
+			wantServiceConfig: &confpb.Service{
+				Name:  "bookstore.endpoints.project123.cloud.goog",
+				Title: "Bookstore",
+				Apis: []*apipb.Api{
+					{
+						Name:    "1.bookstore_endpoints_project123_cloud_goog",
+						Version: "1.0.0",
+						Methods: []*apipb.Method{
+							{
+								Name:            "ListShelves",
+								RequestTypeUrl:  emptyTypeUrl,
+								ResponseTypeUrl: emptyTypeUrl,
+							},
+							{
+								Name:            "delete_shelf",
+								RequestTypeUrl:  emptyTypeUrl,
+								ResponseTypeUrl: emptyTypeUrl,
+							},
+						},
+					},
+				},
+				Http: &annotationspb.Http{
+					Rules: []*annotationspb.HttpRule{
+						{
+							Selector: "1.bookstore_endpoints_project123_cloud_goog.ListShelves",
+							Pattern:  &annotationspb.HttpRule_Get{Get: "/v1/shelves"},
+						},
+						{
+							Selector: "1.bookstore_endpoints_project123_cloud_goog.delete_shelf",
+							Pattern:  &annotationspb.HttpRule_Delete{Delete: "/v1/shelves/{shelf}"},
+						},
+					},
+				},
+				Authentication: &confpb.Authentication{
+					Providers: []*confpb.AuthProvider{
+						{
+							Id:        "auth0",
+							Issuer:    "https://auth0.com",
+							JwksUri:   "https://auth0.com/jwks",
+							Audiences: "bookstore",
+						},
+					},
+					Rules: []*confpb.AuthenticationRule{
+						{
+							Selector: "1.bookstore_endpoints_project123_cloud_goog.delete_shelf",
+							Requirements: []*confpb.AuthRequirement{
+								{
+									ProviderId: "auth0",
+									Audiences:  "bookstore",
+								},
+							},
+						},
+					},
+				},
+				SystemParameters: &confpb.SystemParameters{
+					Rules: []*confpb.SystemParameterRule{
+						{
+							Selector: "1.bookstore_endpoints_project123_cloud_goog.ListShelves",
+							Parameters: []*confpb.SystemParameter{
+								{
+									Name:              util.ApiKeyParameterName,
+									UrlQueryParameter: "key",
+								},
+							},
+						},
+					},
+				},
+				Usage: &confpb.Usage{
+					Rules: []*confpb.UsageRule{
+						{
+							Selector: "1.bookstore_endpoints_project123_cloud_goog.ListShelves",
+						},
+						{
+							Selector:               "1.bookstore_endpoints_project123_cloud_goog.delete_shelf",
+							AllowUnregisteredCalls: true,
+						},
+					},
+				},
+				Backend: &confpb.Backend{
+					Rules: []*confpb.BackendRule{
+						{
+							Selector:        "1.bookstore_endpoints_project123_cloud_goog.ListShelves",
+							Address:         "https://books.run.app",
+							Deadline:        10,
+							PathTranslation: confpb.BackendRule_APPEND_PATH_TO_ADDRESS,
+						},
+						{
+							Selector:        "1.bookstore_endpoints_project123_cloud_goog.delete_shelf",
+							Address:         "https://books.run.app/deleteShelf",
+							PathTranslation: confpb.BackendRule_CONSTANT_ADDRESS,
+							Authentication:  &confpb.BackendRule_DisableAuth{DisableAuth: true},
+						},
+					},
+				},
+				Metrics: []*metricpb.MetricDescriptor{
+					{
+						Name:        "read-requests",
+						Type:        "read-requests",
+						DisplayName: "Read requests",
+						MetricKind:  metricpb.MetricDescriptor_DELTA,
+						ValueType:   metricpb.MetricDescriptor_INT64,
+					},
+				},
+				Quota: &confpb.Quota{
+					Limits: []*confpb.QuotaLimit{
+						{
+							Name:   "read-limit",
+							Metric: "read-requests",
+							Unit:   "1/min/{project}",
+							Values: map[string]int64{"STANDARD": 100},
+						},
+					},
+					MetricRules: []*confpb.MetricRule{
+						{
+							Selector:    "1.bookstore_endpoints_project123_cloud_goog.ListShelves",
+							MetricCosts: map[string]int64{"read-requests": 1},
+						},
+					},
+				},
+				Control: &confpb.Control{
+					Environment: serviceControlEnvironment,
+				},
+			},
+		},
+		{
+			desc:     "OpenAPI 3.x with x-google-auth and custom method",
+			document: testOpenAPI3,
+			wantServiceConfig: &confpb.Service{
+				Name:  "bookstore.example.com",
+				Title: "Bookstore",
+				Apis: []*apipb.Api{
+					{
+						Name:    "1.bookstore_example_com",
+						Version: "1.0.0",
+						Methods: []*apipb.Method{
+							{
+								Name:            "ListShelves",
+								RequestTypeUrl:  emptyTypeUrl,
+								ResponseTypeUrl: emptyTypeUrl,
+							},
+							{
+								Name:            "Options_shelves",
+								RequestTypeUrl:  emptyTypeUrl,
+								ResponseTypeUrl: emptyTypeUrl,
+							},
+						},
+					},
+				},
+				Http: &annotationspb.Http{
+					Rules: []*annotationspb.HttpRule{
+						{
+							Selector: "1.bookstore_example_com.ListShelves",
+							Pattern:  &annotationspb.HttpRule_Get{Get: "/v1/shelves"},
+						},
+						{
+							Selector: "1.bookstore_example_com.Options_shelves",
+							Pattern: &annotationspb.HttpRule_Custom{
+								Custom: &annotationspb.CustomHttpPattern{
+									Kind: "OPTIONS",
+									Path: "/v1/shelves",
+								},
+							},
+						},
+					},
+				},
+				Authentication: &confpb.Authentication{
+					Providers: []*confpb.AuthProvider{
+						{
+							Id:        "auth0",
+							Issuer:    "https://auth0.com",
+							JwksUri:   "https://auth0.com/jwks",
+							Audiences: "a,b",
+							JwtLocations: []*confpb.JwtLocation{
+								{
+									In:          &confpb.JwtLocation_Header{Header: "x-jwt"},
+									ValuePrefix: "Bearer ",
+								},
+							},
+						},
+					},
+					Rules: []*confpb.AuthenticationRule{
+						{
+							Selector: "1.bookstore_example_com.ListShelves",
+							Requirements: []*confpb.AuthRequirement{
+								{
+									ProviderId: "auth0",
+									Audiences:  "a,b",
+								},
+							},
+						},
+						{
+							Selector: "1.bookstore_example_com.Options_shelves",
+							Requirements: []*confpb.AuthRequirement{
+								{
+									ProviderId: "auth0",
+									Audiences:  "a,b",
+								},
+							},
+						},
+					},
+				},
+				Usage: &confpb.Usage{
+					Rules: []*confpb.UsageRule{
+						{
+							Selector:               "1.bookstore_example_com.ListShelves",
+							AllowUnregisteredCalls: true,
+						},
+						{
+							Selector:               "1.bookstore_example_com.Options_shelves",
+							AllowUnregisteredCalls: true,
+						},
+					},
+				},
+				Control: &confpb.Control{
+					Environment: serviceControlEnvironment,
+				},
+			},
+		},
+		{
+			desc:      "unsupported version",
+			document:  `{"swagger": "1.2", "paths": {}}`,
+			wantError: `unsupported OpenAPI document, want swagger 2.0 or openapi 3.x, got swagger "1.2"`,
+		},
+		{
+			desc: "undefined security scheme",
+			document: `{"swagger": "2.0", "host": "a.com", "paths": {
+				"/a": {"get": {"security": [{"auth0": []}]}}}}`,
+			wantError: "fail to convert operation GET /a: security scheme auth0 is not defined",
+		},
+		{
+			desc: "API key or JWT",
+			document: `{"swagger": "2.0", "host": "a.com",
+				"securityDefinitions": {
+					"api_key": {"type": "apiKey", "name": "key", "in": "query"},
+					"google_id_token": {"type": "oauth2", "flow": "implicit", "authorizationUrl": "", "x-google-issuer": "https://accounts.google.com", "x-google-jwks_uri": "https://www.googleapis.com/oauth2/v3/certs"}},
+				"paths": {"/a": {"get": {"security": [{"api_key": []}, {"google_id_token": []}]}}}}`,
+			wantError: "security requirements {api_key} and {google_id_token} are alternatives, which is not supported",
+		},
+		{
+			desc: "two JWTs in a requirement",
+			document: `{"swagger": "2.0", "host": "a.com",
+				"securityDefinitions": {
+					"auth0": {"type": "oauth2", "flow": "implicit", "authorizationUrl": "", "x-google-issuer": "https://auth0.com"},
+					"google_id_token": {"type": "oauth2", "flow": "implicit", "authorizationUrl": "", "x-google-issuer": "https://accounts.google.com"}},
+				"paths": {"/a": {"get": {"security": [{"auth0": [], "google_id_token": []}]}}}}`,
+			wantError: "security requirement #0 requires both auth0 and google_id_token, only one oauth2 scheme is supported",
+		},
+		{
+			desc: "duplicated operationId",
+			document: `{"swagger": "2.0", "host": "a.com", "paths": {
+				"/a": {"get": {"operationId": "op"}},
+				"/b": {"get": {"operationId": "op"}}}}`,
+			wantError: `fail to convert operation GET /b: duplicated operationId "op"`,
+		},
+		{
+			desc: "both jwt_audience and disable_auth",
+			document: `{"swagger": "2.0", "host": "a.com", "paths": {
+				"/a": {"get": {"x-google-backend": {"address": "https://b.com", "jwt_audience": "b", "disable_auth": true}}}}}`,
+			wantError: "x-google-backend cannot set both jwt_audience and disable_auth",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := ToServiceConfig([]byte(tc.document))
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("want error: %v, got error: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(got, tc.wantServiceConfig) {
+				t.Errorf("got service config: %v\nwant: %v", got, tc.wantServiceConfig)
+			}
+
+			// The converted service config is accepted by the Config Manager.
+			got.Id = "openapi-test"
+			opts := options.DefaultConfigGeneratorOptions()
+			opts.BackendAddress = "http://127.0.0.1:8082"
+			if _, err := configinfo.NewServiceInfoFromServiceConfig(got, "openapi-test", opts); err != nil {
+				t.Errorf("fail to build ServiceInfo: %v", err)
+			}
+		})
+	}
+}
+
+func TestConvertSecurityAlternatives(t *testing.T) {
+	const securityDefinitions = `"securityDefinitions": {
+		"api_key": {"type": "apiKey", "name": "key", "in": "query"},
+		"api_key_header": {"type": "apiKey", "name": "x-api-key", "in": "header"},
+		"auth0": {"type": "oauth2", "flow": "implicit", "authorizationUrl": "", "x-google-issuer": "https://auth0.com"},
+		"google_id_token": {"type": "oauth2", "flow": "implicit", "authorizationUrl": "", "x-google-issuer": "https://accounts.google.com"}}`
+
+	testData := []struct {
+		desc             string
+		security         string
+		wantProviders    []string
+		wantApiKeyParams []string
+		wantError        string
+	}{
+		{
+			desc:          "a JWT of either provider",
+			security:      `[{"auth0": []}, {"google_id_token": []}]`,
+			wantProviders: []string{"auth0", "google_id_token"},
+		},
+		{
+			desc:             "an API key in either location",
+			security:         `[{"api_key": []}, {"api_key_header": []}]`,
+			wantApiKeyParams: []string{"key", "x-api-key"},
+		},
+		{
+			desc:             "an API key and a JWT of either provider",
+			security:         `[{"api_key": [], "auth0": []}, {"api_key": [], "google_id_token": []}]`,
+			wantProviders:    []string{"auth0", "google_id_token"},
+			wantApiKeyParams: []string{"key"},
+		},
+		{
+			desc:             "an API key in either location and a JWT of either provider",
+			security:         `[{"api_key": [], "auth0": []}, {"api_key_header": [], "auth0": []}, {"api_key": [], "google_id_token": []}, {"api_key_header": [], "google_id_token": []}]`,
+			wantProviders:    []string{"auth0", "google_id_token"},
+			wantApiKeyParams: []string{"key", "x-api-key"},
+		},
+		{
+			desc:      "a JWT with or without an API key",
+			security:  `[{"api_key": [], "auth0": []}, {"auth0": []}]`,
+			wantError: "security requirements {api_key, auth0} and {auth0} are alternatives",
+		},
+		{
+			desc:      "API keys and JWTs in pairs",
+			security:  `[{"api_key": [], "auth0": []}, {"api_key_header": [], "google_id_token": []}]`,
+			wantError: "not supported unless they pair each of their apiKey schemes with each of their oauth2 schemes",
+		},
+	}
+
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			document := `{"swagger": "2.0", "host": "a.com", ` + securityDefinitions + `,
+				"paths": {"/a": {"get": {"operationId": "op", "security": ` + tc.security + `}}}}`
+			got, err := ToServiceConfig([]byte(document))
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("want error: %v, got error: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var gotProviders []string
+			for _, rule := range got.GetAuthentication().GetRules() {
+				for _, requirement := range rule.GetRequirements() {
+					gotProviders = append(gotProviders, requirement.GetProviderId())
+				}
+			}
+			if !reflect.DeepEqual(gotProviders, tc.wantProviders) {
+				t.Errorf("got providers %v, want %v", gotProviders, tc.wantProviders)
+			}
+			var gotApiKeyParams []string
+			for _, rule := range got.GetSystemParameters().GetRules() {
+				for _, parameter := range rule.GetParameters() {
+					gotApiKeyParams = append(gotApiKeyParams, parameter.GetUrlQueryParameter()+parameter.GetHttpHeader())
+				}
+			}
+			if !reflect.DeepEqual(gotApiKeyParams, tc.wantApiKeyParams) {
+				t.Errorf("got API key parameters %v, want %v", gotApiKeyParams, tc.wantApiKeyParams)
+			}
+		})
+	}
+}
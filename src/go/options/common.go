@@ -27,6 +27,10 @@ type CommonOptions struct {
 	AdsNamedPipe          string
 	Node                  string
 	GeneratedHeaderPrefix string
+	// Whether routes are served over RDS instead of being inlined in the listener.
+	EnableRds bool
+	// Whether Envoy uses the incremental (delta) xDS protocol to talk to the config manager.
+	EnableDeltaXds bool
 
 	// Flags for tracing
 	DisableTracing                  bool
@@ -49,6 +49,9 @@ type ConfigGeneratorOptions struct {
 	BackendAddress               string
 	EnableBackendAddressOverride bool
 	TestOnlyHTTPBackendAddress   string
+	// YAML or JSON file with the ESPv2 backend policies by selector, on top
+	// of the backend rules of the service config.
+	BackendPolicyPath string
 
 	// Health check related
 	Healthz                                 string
@@ -56,6 +59,22 @@ type ConfigGeneratorOptions struct {
 	HealthCheckGrpcBackendService           string
 	HealthCheckGrpcBackendInterval          time.Duration
 	HealthCheckGrpcBackendNoTrafficInterval time.Duration
+	// Active health checks and outlier detection of all the backend
+	// clusters, the backend policies override them by cluster.
+	BackendHealthCheckHTTPPath     string
+	BackendHealthCheckGrpc         bool
+	BackendHealthCheckInterval     time.Duration
+	BackendHealthCheckTimeout      time.Duration
+	BackendOutlierConsecutive5xx   int
+	BackendOutlierSuccessRate      bool
+	BackendOutlierBaseEjectionTime time.Duration
+	// Set by the Config Manager while shutting down, not by a flag. The
+	// health checks on Healthz fail so that Envoy is taken out of rotation.
+	Draining bool
+
+	// Path on which Envoy serves the OpenAPI document exported from the
+	// service config. Disabled if empty.
+	OpenAPIExportPath string
 
 	// Network related configurations.
 	ListenerAddress                  string
@@ -142,6 +161,7 @@ type ConfigGeneratorOptions struct {
 	ComputePlatformOverride     string
 	EnableResponseCompression   bool
 	ClientIPFromForwardedHeader bool
+	TrafficSplitHashHeader      string
 
 	TranscodingAlwaysPrintPrimitiveFields         bool
 	TranscodingAlwaysPrintEnumsAsInts             bool
@@ -206,6 +226,9 @@ func DefaultConfigGeneratorOptions() ConfigGeneratorOptions {
 		CorsMaxAge:                              480 * time.Hour,
 		HealthCheckGrpcBackendInterval:          1 * time.Second,
 		HealthCheckGrpcBackendNoTrafficInterval: 60 * time.Second,
+		BackendHealthCheckInterval:              5 * time.Second,
+		BackendHealthCheckTimeout:               1 * time.Second,
+		BackendOutlierBaseEjectionTime:          30 * time.Second,
 		APIAllowList:                            []string{},
 		AllowDiscoveryAPIs:                      false,
 		TranscodingRejectCollision:              false,
@@ -0,0 +1,195 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// routeexplain explains which route, backend and filters a request hits, to
+// debug unexpected 404 and 405 responses. The Envoy config is generated from
+// a service config with the same flags as the Config Manager, or read from
+// the output of configgen, with the service config to extract the path
+// variables:
+//
+//	routeexplain --service_config=service.yaml --method=GET --path=/v1/shelves/1
+//	routeexplain --listeners=listeners.json --routes=routes.json --method=POST --path=/v1/shelves --header='x-api-key: abc'
+//	routeexplain --listeners=listeners.json --service_config=service.yaml --method=GET --path=/v1/shelves/1
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configgen"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configmanager/flags"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/routeexplain"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+
+	listenerpb "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+)
+
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	return fmt.Sprint(map[string]string(h))
+}
+
+func (h headerFlags) Set(value string) error {
+	nameValue := strings.SplitN(value, ":", 2)
+	if len(nameValue) != 2 || strings.TrimSpace(nameValue[0]) == "" {
+		return fmt.Errorf("invalid header %q, should be in name: value format", value)
+	}
+	h[strings.ToLower(strings.TrimSpace(nameValue[0]))] = strings.TrimSpace(nameValue[1])
+	return nil
+}
+
+var (
+	serviceConfigPath = flag.String("service_config", "", "path to the service config in JSON, YAML (.yaml, .yml) or binary proto (.pb, .bin). With --listeners, only used to extract the path variables, and must be the one the listeners are generated from with the same flags")
+	listenersPath     = flag.String("listeners", "", "path to the listeners generated by `configgen --output=listeners`, instead of generating them from --service_config")
+	routesPath        = flag.String("routes", "", "with --listeners, path to the route configs generated by `configgen --output=routes`, if the routes are served by RDS")
+	routeConfigName   = flag.String("route_config_name", "", "with --routes, the name of the route config to explain, required if there are several")
+	method            = flag.String("method", "GET", "the HTTP method of the request")
+	path              = flag.String("path", "/", "the path of the request, with the query")
+	host              = flag.String("host", "", "the host of the request")
+	format            = flag.String("format", "text", `the output format, "text" or "json"`)
+	headers           = headerFlags{}
+)
+
+func main() {
+	flag.Var(headers, "header", "a header of the request in name: value format, can be repeated")
+	flag.Parse()
+
+	explainer, err := newExplainer()
+	if err != nil {
+		glog.Exitf("fail to read the Envoy config: %v", err)
+	}
+	explanation, err := explainer.Explain(&routeexplain.Request{
+		Method:  *method,
+		Path:    *path,
+		Host:    *host,
+		Headers: headers,
+	})
+	if err != nil {
+		glog.Exitf("fail to explain the request: %v", err)
+	}
+
+	switch *format {
+	case "text":
+		fmt.Print(explanation.Text())
+	case "json":
+		bytes, err := json.MarshalIndent(explanation, "", "  ")
+		if err != nil {
+			glog.Exitf("fail to marshal the explanation: %v", err)
+		}
+		fmt.Println(string(bytes))
+	default:
+		glog.Exitf(`unknown format %q, must be "text" or "json"`, *format)
+	}
+}
+
+func newExplainer() (*routeexplain.Explainer, error) {
+	switch {
+	case *listenersPath != "":
+		var listeners []*listenerpb.Listener
+		if err := readResources(*listenersPath, func() proto.Message {
+			listener := &listenerpb.Listener{}
+			listeners = append(listeners, listener)
+			return listener
+		}); err != nil {
+			return nil, err
+		}
+		var routeConfig *routepb.RouteConfiguration
+		if *routesPath != "" {
+			var routeConfigs []*routepb.RouteConfiguration
+			if err := readResources(*routesPath, func() proto.Message {
+				routeConfig := &routepb.RouteConfiguration{}
+				routeConfigs = append(routeConfigs, routeConfig)
+				return routeConfig
+			}); err != nil {
+				return nil, err
+			}
+			var err error
+			if routeConfig, err = selectRouteConfig(routeConfigs, *routeConfigName); err != nil {
+				return nil, fmt.Errorf("fail to select the route config of %s: %v", *routesPath, err)
+			}
+		}
+		// Without the service config, the routes only have the regexes of the
+		// URI templates, which do not name the path variables.
+		var uriTemplates map[string][]string
+		if *serviceConfigPath != "" {
+			serviceConfig, err := configgen.ReadServiceConfig(*serviceConfigPath)
+			if err != nil {
+				return nil, err
+			}
+			if uriTemplates, err = routeexplain.UriTemplatesFromServiceConfig(serviceConfig, flags.EnvoyConfigOptionsFromFlags()); err != nil {
+				return nil, err
+			}
+		}
+		return routeexplain.NewExplainer(routeConfig, listeners, uriTemplates)
+	case *serviceConfigPath != "":
+		serviceConfig, err := configgen.ReadServiceConfig(*serviceConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		return routeexplain.NewExplainerFromServiceConfig(serviceConfig, flags.EnvoyConfigOptionsFromFlags())
+	default:
+		return nil, fmt.Errorf("flag --service_config or --listeners is required")
+	}
+}
+
+// selectRouteConfig returns the route config of the name, or the only one if
+// the name is empty.
+func selectRouteConfig(routeConfigs []*routepb.RouteConfiguration, name string) (*routepb.RouteConfiguration, error) {
+	if name == "" {
+		if len(routeConfigs) != 1 {
+			var names []string
+			for _, routeConfig := range routeConfigs {
+				names = append(names, routeConfig.GetName())
+			}
+			return nil, fmt.Errorf("got %d route configs %v, set --route_config_name to select one", len(routeConfigs), names)
+		}
+		return routeConfigs[0], nil
+	}
+	for _, routeConfig := range routeConfigs {
+		if routeConfig.GetName() == name {
+			return routeConfig, nil
+		}
+	}
+	return nil, fmt.Errorf("no route config is named %s", name)
+}
+
+// readResources reads a JSON array of resources, each unmarshalled into a
+// new message.
+func readResources(path string, newMessage func() proto.Message) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("fail to read %s: %v", path, err)
+	}
+	var resources []json.RawMessage
+	if err := json.Unmarshal(data, &resources); err != nil {
+		return fmt.Errorf("fail to unmarshal %s: %v", path, err)
+	}
+	unmarshaler := &jsonpb.Unmarshaler{
+		AnyResolver: util.Resolver,
+	}
+	for i, resource := range resources {
+		if err := unmarshaler.Unmarshal(strings.NewReader(string(resource)), newMessage()); err != nil {
+			return fmt.Errorf("fail to unmarshal resource #%d of %s: %v", i, path, err)
+		}
+	}
+	return nil
+}
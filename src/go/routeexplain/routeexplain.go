@@ -0,0 +1,718 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package routeexplain explains which route, backend and filter configs of a
+// generated Envoy config a request hits, see routeexplain/main/main.go.
+package routeexplain
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util/httppattern"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	gen "github.com/GoogleCloudPlatform/esp-v2/src/go/configgenerator"
+	bapb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v11/http/backend_auth"
+	prpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v11/http/path_rewrite"
+	scpb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v11/http/service_control"
+	listenerpb "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routepb "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	jwtpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/jwt_authn/v3"
+	hcmpb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	anypb "github.com/golang/protobuf/ptypes/any"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+// The API key locations of the Service Control filter when a requirement has
+// none.
+var defaultApiKeyLocations = []string{"query=key", "query=api_key", "header=x-api-key"}
+
+// Request is the request to explain.
+type Request struct {
+	Method string
+	// The path with the query.
+	Path string
+	Host string
+	// Keyed by the header names in lower case.
+	Headers map[string]string
+}
+
+// Explanation is how the Envoy config handles a request.
+type Explanation struct {
+	VirtualHost string `json:"virtualHost"`
+	// The index of the matched route in the virtual host.
+	RouteIndex int `json:"routeIndex"`
+	// The operation of the matched backend route, empty for other routes.
+	Operation string `json:"operation,omitempty"`
+	// The span name of the matched route.
+	SpanName      string            `json:"spanName,omitempty"`
+	PathVariables map[string]string `json:"pathVariables,omitempty"`
+
+	// The backend, only for a route forwarding the request.
+	Clusters      []string `json:"clusters,omitempty"`
+	HostRewrite   string   `json:"hostRewrite,omitempty"`
+	RewrittenPath string   `json:"rewrittenPath,omitempty"`
+	// The audience of the token sent to the backend, empty without backend
+	// auth.
+	JwtAudience string `json:"jwtAudience,omitempty"`
+	Timeout     string `json:"timeout,omitempty"`
+	// The backends the traffic is split across, each with its own rewrite
+	// and backend auth in place of the ones above.
+	WeightedClusters []*WeightedCluster `json:"weightedClusters,omitempty"`
+
+	// The JWT requirement, empty if no JWT is required.
+	JwtRequirementName string `json:"jwtRequirementName,omitempty"`
+	JwtRequirement     string `json:"jwtRequirement,omitempty"`
+	// The API key locations, empty if no API key is required.
+	ApiKeyLocations []string `json:"apiKeyLocations,omitempty"`
+
+	// The direct response, only for a route responding without backend, such
+	// as the catch-all 404 or 405 routes.
+	Status int    `json:"status,omitempty"`
+	Body   string `json:"body,omitempty"`
+	// Why the catch-all route matched.
+	Reason string `json:"reason,omitempty"`
+}
+
+// WeightedCluster is how a backend of a traffic split handles a request.
+type WeightedCluster struct {
+	Cluster       string `json:"cluster"`
+	Weight        uint32 `json:"weight"`
+	HostRewrite   string `json:"hostRewrite,omitempty"`
+	RewrittenPath string `json:"rewrittenPath,omitempty"`
+	JwtAudience   string `json:"jwtAudience,omitempty"`
+}
+
+// Text formats the explanation for humans.
+func (e *Explanation) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Virtual host: %s\n", e.VirtualHost)
+	fmt.Fprintf(&b, "Route: #%d", e.RouteIndex)
+	if e.Operation != "" {
+		fmt.Fprintf(&b, " %s", e.Operation)
+	}
+	if e.SpanName != "" {
+		fmt.Fprintf(&b, " (span %q)", e.SpanName)
+	}
+	b.WriteString("\n")
+
+	if e.Status != 0 {
+		fmt.Fprintf(&b, "Direct response: %d %s\n", e.Status, e.Body)
+		if e.Reason != "" {
+			fmt.Fprintf(&b, "Reason: %s\n", e.Reason)
+		}
+		return b.String()
+	}
+
+	if len(e.PathVariables) > 0 {
+		var vars []string
+		for name, value := range e.PathVariables {
+			vars = append(vars, name+"="+value)
+		}
+		sort.Strings(vars)
+		fmt.Fprintf(&b, "Path variables: %s\n", strings.Join(vars, ", "))
+	}
+	if len(e.WeightedClusters) > 0 {
+		for _, cluster := range e.WeightedClusters {
+			fmt.Fprintf(&b, "Backend cluster: %s (weight %d)\n", cluster.Cluster, cluster.Weight)
+			if cluster.HostRewrite != "" {
+				fmt.Fprintf(&b, "  Host rewrite: %s\n", cluster.HostRewrite)
+			}
+			fmt.Fprintf(&b, "  Backend path: %s\n", cluster.RewrittenPath)
+			if cluster.JwtAudience != "" {
+				fmt.Fprintf(&b, "  Backend audience: %s\n", cluster.JwtAudience)
+			}
+		}
+	} else {
+		fmt.Fprintf(&b, "Backend cluster: %s\n", strings.Join(e.Clusters, ", "))
+		if e.HostRewrite != "" {
+			fmt.Fprintf(&b, "Host rewrite: %s\n", e.HostRewrite)
+		}
+		fmt.Fprintf(&b, "Backend path: %s\n", e.RewrittenPath)
+		if e.JwtAudience != "" {
+			fmt.Fprintf(&b, "Backend audience: %s\n", e.JwtAudience)
+		}
+	}
+	if e.Timeout != "" {
+		fmt.Fprintf(&b, "Timeout: %s\n", e.Timeout)
+	}
+	if e.JwtRequirementName != "" {
+		fmt.Fprintf(&b, "JWT requirement: %s: %s\n", e.JwtRequirementName, e.JwtRequirement)
+	} else {
+		b.WriteString("JWT requirement: none\n")
+	}
+	if len(e.ApiKeyLocations) > 0 {
+		fmt.Fprintf(&b, "API key: %s\n", strings.Join(e.ApiKeyLocations, ", "))
+	} else {
+		b.WriteString("API key: not required\n")
+	}
+	return b.String()
+}
+
+// Explainer explains requests against a route config, with the filter
+// configs of the listeners.
+type Explainer struct {
+	routeConfig *routepb.RouteConfiguration
+	// The JWT requirements and Service Control requirements of all the
+	// listeners.
+	jwtRequirements map[string]*jwtpb.JwtRequirement
+	scRequirements  map[string]*scpb.Requirement
+	// The URI templates by operation, to extract the path variables.
+	uriTemplates map[string][]string
+}
+
+// NewExplainer creates an Explainer of routeConfig. The listeners provide
+// the JWT and API key requirements, and the route config if routeConfig is
+// nil, i.e. the routes are not served by RDS. The URI templates of the
+// operations are optional, the path variables are extracted with them.
+func NewExplainer(routeConfig *routepb.RouteConfiguration, listeners []*listenerpb.Listener, uriTemplates map[string][]string) (*Explainer, error) {
+	e := &Explainer{
+		routeConfig:     routeConfig,
+		jwtRequirements: make(map[string]*jwtpb.JwtRequirement),
+		scRequirements:  make(map[string]*scpb.Requirement),
+		uriTemplates:    uriTemplates,
+	}
+	for _, listener := range listeners {
+		for _, filterChain := range listener.GetFilterChains() {
+			for _, filter := range filterChain.GetFilters() {
+				if filter.GetName() != util.HTTPConnectionManager {
+					continue
+				}
+				hcm := &hcmpb.HttpConnectionManager{}
+				if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), hcm); err != nil {
+					return nil, fmt.Errorf("fail to unmarshal http connection manager of listener %s: %v", listener.GetName(), err)
+				}
+				if e.routeConfig == nil && listener.GetName() == util.IngressListenerName {
+					e.routeConfig = hcm.GetRouteConfig()
+				}
+				if err := e.addHttpFilters(hcm.GetHttpFilters()); err != nil {
+					return nil, fmt.Errorf("fail to read http filters of listener %s: %v", listener.GetName(), err)
+				}
+			}
+		}
+	}
+	if e.routeConfig == nil {
+		return nil, fmt.Errorf("no route config is provided, and the ingress listener has none")
+	}
+	return e, nil
+}
+
+// NewExplainerFromServiceConfig generates the Envoy config of the service
+// config with opts, and creates an Explainer of it.
+func NewExplainerFromServiceConfig(serviceConfig *confpb.Service, opts options.ConfigGeneratorOptions) (*Explainer, error) {
+	opts.EnableRds = true
+	serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(serviceConfig, serviceConfig.GetId(), opts)
+	if err != nil {
+		return nil, fmt.Errorf("fail to initialize ServiceInfo, %s", err)
+	}
+	listeners, err := gen.MakeListeners(serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	routeConfigs, err := gen.MakeRouteConfigs([]*configinfo.ServiceInfo{serviceInfo})
+	if err != nil {
+		return nil, err
+	}
+	return NewExplainer(routeConfigs[0], listeners, makeUriTemplates(serviceInfo))
+}
+
+// UriTemplatesFromServiceConfig returns the URI templates by operation of the
+// service config, for NewExplainer to extract the path variables of an Envoy
+// config generated from it with the same options.
+func UriTemplatesFromServiceConfig(serviceConfig *confpb.Service, opts options.ConfigGeneratorOptions) (map[string][]string, error) {
+	serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(serviceConfig, serviceConfig.GetId(), opts)
+	if err != nil {
+		return nil, fmt.Errorf("fail to initialize ServiceInfo, %s", err)
+	}
+	return makeUriTemplates(serviceInfo), nil
+}
+
+func makeUriTemplates(serviceInfo *configinfo.ServiceInfo) map[string][]string {
+	uriTemplates := make(map[string][]string)
+	for operation, method := range serviceInfo.Methods {
+		for _, httpRule := range method.HttpRule {
+			if httpRule.UriTemplate != nil && httpRule.UriTemplate.Origin != "" {
+				uriTemplates[operation] = append(uriTemplates[operation], httpRule.UriTemplate.Origin)
+			}
+		}
+	}
+	return uriTemplates
+}
+
+func (e *Explainer) addHttpFilters(filters []*hcmpb.HttpFilter) error {
+	for _, filter := range filters {
+		switch filter.GetName() {
+		case util.JwtAuthn:
+			jwtAuthn := &jwtpb.JwtAuthentication{}
+			if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), jwtAuthn); err != nil {
+				return err
+			}
+			for name, requirement := range jwtAuthn.GetRequirementMap() {
+				e.jwtRequirements[name] = requirement
+			}
+		case util.ServiceControl:
+			sc := &scpb.FilterConfig{}
+			if err := ptypes.UnmarshalAny(filter.GetTypedConfig(), sc); err != nil {
+				return err
+			}
+			for _, requirement := range sc.GetRequirements() {
+				e.scRequirements[requirement.GetOperationName()] = requirement
+			}
+		}
+	}
+	return nil
+}
+
+// Explain returns how the request is routed, with the first matched route
+// like Envoy.
+func (e *Explainer) Explain(req *Request) (*Explanation, error) {
+	path, query := req.Path, ""
+	if i := strings.Index(path, "?"); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+	queryValues, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query %q: %v", query, err)
+	}
+	headers := map[string]string{
+		":method":    req.Method,
+		":path":      req.Path,
+		":authority": req.Host,
+	}
+	for name, value := range req.Headers {
+		headers[strings.ToLower(name)] = value
+	}
+
+	host := e.matchVirtualHost(req.Host)
+	if host == nil {
+		return nil, fmt.Errorf("no virtual host matches host %q", req.Host)
+	}
+	for i, route := range host.GetRoutes() {
+		ok, err := matchRoute(route.GetMatch(), path, headers, queryValues)
+		if err != nil {
+			return nil, fmt.Errorf("fail to match route #%d: %v", i, err)
+		}
+		if !ok {
+			continue
+		}
+		explanation := &Explanation{
+			VirtualHost: host.GetName(),
+			RouteIndex:  i,
+			Operation:   route.GetName(),
+			SpanName:    route.GetDecorator().GetOperation(),
+		}
+		if err := e.explainRoute(explanation, host, route, req, path, query); err != nil {
+			return nil, err
+		}
+		return explanation, nil
+	}
+	return nil, fmt.Errorf("no route of virtual host %s matches the request", host.GetName())
+}
+
+func (e *Explainer) explainRoute(explanation *Explanation, host *routepb.VirtualHost, route *routepb.Route, req *Request, path, query string) error {
+	switch action := route.GetAction().(type) {
+	case *routepb.Route_DirectResponse:
+		explanation.Status = int(action.DirectResponse.GetStatus())
+		explanation.Body = action.DirectResponse.GetBody().GetInlineString()
+		explanation.Reason = explainDirectResponse(host, route, req.Method, explanation.Status)
+		return nil
+	case *routepb.Route_Route:
+		routeAction := action.Route
+		if cluster := routeAction.GetCluster(); cluster != "" {
+			explanation.Clusters = []string{cluster}
+		}
+		for _, cluster := range routeAction.GetWeightedClusters().GetClusters() {
+			explanation.Clusters = append(explanation.Clusters, fmt.Sprintf("%s (weight %d)", cluster.GetName(), cluster.GetWeight().GetValue()))
+			weighted := &WeightedCluster{
+				Cluster:     cluster.GetName(),
+				Weight:      cluster.GetWeight().GetValue(),
+				HostRewrite: cluster.GetHostRewriteLiteral(),
+			}
+			var err error
+			weighted.RewrittenPath, weighted.JwtAudience, err = explainBackend(cluster.GetTypedPerFilterConfig(), req.Path, path, query)
+			if err != nil {
+				return fmt.Errorf("invalid weighted cluster %s of route %s: %v", cluster.GetName(), route.GetName(), err)
+			}
+			explanation.WeightedClusters = append(explanation.WeightedClusters, weighted)
+		}
+		explanation.HostRewrite = routeAction.GetHostRewriteLiteral()
+		if routeAction.GetTimeout() != nil {
+			timeout, err := ptypes.Duration(routeAction.GetTimeout())
+			if err != nil {
+				return fmt.Errorf("invalid timeout of route %s: %v", route.GetName(), err)
+			}
+			explanation.Timeout = timeout.String()
+		}
+	default:
+		return fmt.Errorf("unsupported action %T of route %s", action, route.GetName())
+	}
+
+	explanation.PathVariables = e.extractPathVariables(route.GetName(), path)
+	perFilterConfig := route.GetTypedPerFilterConfig()
+	var err error
+	explanation.RewrittenPath, explanation.JwtAudience, err = explainBackend(perFilterConfig, req.Path, path, query)
+	if err != nil {
+		return fmt.Errorf("invalid route %s: %v", route.GetName(), err)
+	}
+
+	if a, ok := perFilterConfig[util.JwtAuthn]; ok {
+		jwtPerRoute := &jwtpb.PerRouteConfig{}
+		if err := ptypes.UnmarshalAny(a, jwtPerRoute); err != nil {
+			return fmt.Errorf("fail to unmarshal jwt_authn config of route %s: %v", route.GetName(), err)
+		}
+		if name := jwtPerRoute.GetRequirementName(); name != "" {
+			explanation.JwtRequirementName = name
+			explanation.JwtRequirement = describeJwtRequirement(e.jwtRequirements[name])
+		}
+	}
+
+	if a, ok := perFilterConfig[util.ServiceControl]; ok {
+		scPerRoute := &scpb.PerRouteFilterConfig{}
+		if err := ptypes.UnmarshalAny(a, scPerRoute); err != nil {
+			return fmt.Errorf("fail to unmarshal service_control config of route %s: %v", route.GetName(), err)
+		}
+		if requirement, ok := e.scRequirements[scPerRoute.GetOperationName()]; ok && !requirement.GetSkipServiceControl() && !requirement.GetApiKey().GetAllowWithoutApiKey() {
+			explanation.ApiKeyLocations = describeApiKeyLocations(requirement.GetApiKey().GetLocations())
+		}
+	}
+	return nil
+}
+
+// explainBackend returns the path sent to the backend and the audience of its
+// backend auth token, from the per-filter configs of a route or of a weighted
+// cluster.
+func explainBackend(perFilterConfig map[string]*anypb.Any, reqPath, path, query string) (string, string, error) {
+	rewrittenPath, jwtAudience := reqPath, ""
+	if a, ok := perFilterConfig[util.PathRewrite]; ok {
+		pr := &prpb.PerRouteFilterConfig{}
+		if err := ptypes.UnmarshalAny(a, pr); err != nil {
+			return "", "", fmt.Errorf("fail to unmarshal path_rewrite config, %v", err)
+		}
+		rewrittenPath = rewritePath(pr, path, query)
+	}
+	if a, ok := perFilterConfig[util.BackendAuth]; ok {
+		ba := &bapb.PerRouteFilterConfig{}
+		if err := ptypes.UnmarshalAny(a, ba); err != nil {
+			return "", "", fmt.Errorf("fail to unmarshal backend_auth config, %v", err)
+		}
+		jwtAudience = ba.GetJwtAudience()
+	}
+	return rewrittenPath, jwtAudience, nil
+}
+
+// matchVirtualHost matches the domains like Envoy: exact domains first, then
+// suffix wildcards, prefix wildcards, and at last "*".
+func (e *Explainer) matchVirtualHost(host string) *routepb.VirtualHost {
+	host = strings.ToLower(host)
+	var best *routepb.VirtualHost
+	bestRank, bestLen := 0, 0
+	for _, vh := range e.routeConfig.GetVirtualHosts() {
+		for _, domain := range vh.GetDomains() {
+			domain = strings.ToLower(domain)
+			rank := 0
+			switch {
+			case domain == "*":
+				rank = 1
+			case domain == host:
+				rank = 4
+			case strings.HasPrefix(domain, "*") && strings.HasSuffix(host, domain[1:]):
+				rank = 3
+			case strings.HasSuffix(domain, "*") && strings.HasPrefix(host, domain[:len(domain)-1]):
+				rank = 2
+			}
+			if rank > bestRank || (rank == bestRank && rank > 0 && len(domain) > bestLen) {
+				best, bestRank, bestLen = vh, rank, len(domain)
+			}
+		}
+	}
+	return best
+}
+
+func matchRoute(match *routepb.RouteMatch, path string, headers map[string]string, query url.Values) (bool, error) {
+	caseSensitive := match.GetCaseSensitive() == nil || match.GetCaseSensitive().GetValue()
+	matchPath, matchCase := path, func(s string) string { return s }
+	if !caseSensitive {
+		matchPath, matchCase = strings.ToLower(path), strings.ToLower
+	}
+
+	switch specifier := match.GetPathSpecifier().(type) {
+	case *routepb.RouteMatch_Prefix:
+		if !strings.HasPrefix(matchPath, matchCase(specifier.Prefix)) {
+			return false, nil
+		}
+	case *routepb.RouteMatch_Path:
+		if matchPath != matchCase(specifier.Path) {
+			return false, nil
+		}
+	case *routepb.RouteMatch_SafeRegex:
+		ok, err := fullMatch(specifier.SafeRegex.GetRegex(), path)
+		if err != nil || !ok {
+			return false, err
+		}
+	default:
+		return false, fmt.Errorf("unsupported path specifier %T", specifier)
+	}
+
+	for _, header := range match.GetHeaders() {
+		ok, err := matchHeader(header, headers)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	for _, param := range match.GetQueryParameters() {
+		values, present := query[param.GetName()]
+		var ok bool
+		switch specifier := param.GetQueryParameterMatchSpecifier().(type) {
+		case *routepb.QueryParameterMatcher_PresentMatch:
+			ok = present == specifier.PresentMatch
+		case *routepb.QueryParameterMatcher_StringMatch:
+			if present {
+				var err error
+				if ok, err = matchString(specifier.StringMatch, values[0]); err != nil {
+					return false, err
+				}
+			}
+		default:
+			return false, fmt.Errorf("unsupported query parameter matcher %T", specifier)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func matchHeader(header *routepb.HeaderMatcher, headers map[string]string) (bool, error) {
+	value, present := headers[strings.ToLower(header.GetName())]
+	var ok bool
+	var err error
+	switch specifier := header.GetHeaderMatchSpecifier().(type) {
+	case nil:
+		ok = present
+	case *routepb.HeaderMatcher_PresentMatch:
+		ok = present == specifier.PresentMatch
+	case *routepb.HeaderMatcher_ExactMatch:
+		ok = present && value == specifier.ExactMatch
+	case *routepb.HeaderMatcher_PrefixMatch:
+		ok = present && strings.HasPrefix(value, specifier.PrefixMatch)
+	case *routepb.HeaderMatcher_SuffixMatch:
+		ok = present && strings.HasSuffix(value, specifier.SuffixMatch)
+	case *routepb.HeaderMatcher_ContainsMatch:
+		ok = present && strings.Contains(value, specifier.ContainsMatch)
+	case *routepb.HeaderMatcher_SafeRegexMatch:
+		if present {
+			ok, err = fullMatch(specifier.SafeRegexMatch.GetRegex(), value)
+		}
+	case *routepb.HeaderMatcher_StringMatch:
+		if present {
+			ok, err = matchString(specifier.StringMatch, value)
+		}
+	default:
+		return false, fmt.Errorf("unsupported header matcher %T for header %s", specifier, header.GetName())
+	}
+	if err != nil {
+		return false, err
+	}
+	return ok != header.GetInvertMatch(), nil
+}
+
+func matchString(m *matcher.StringMatcher, value string) (bool, error) {
+	if pattern, ok := m.GetMatchPattern().(*matcher.StringMatcher_SafeRegex); ok {
+		return fullMatch(pattern.SafeRegex.GetRegex(), value)
+	}
+	if m.GetIgnoreCase() {
+		value = strings.ToLower(value)
+	}
+	lower := func(s string) string {
+		if m.GetIgnoreCase() {
+			return strings.ToLower(s)
+		}
+		return s
+	}
+	switch pattern := m.GetMatchPattern().(type) {
+	case *matcher.StringMatcher_Exact:
+		return value == lower(pattern.Exact), nil
+	case *matcher.StringMatcher_Prefix:
+		return strings.HasPrefix(value, lower(pattern.Prefix)), nil
+	case *matcher.StringMatcher_Suffix:
+		return strings.HasSuffix(value, lower(pattern.Suffix)), nil
+	case *matcher.StringMatcher_Contains:
+		return strings.Contains(value, lower(pattern.Contains)), nil
+	default:
+		return false, fmt.Errorf("unsupported string matcher %T", pattern)
+	}
+}
+
+// fullMatch matches the whole value, like the Envoy safe regex matcher.
+func fullMatch(regex, value string) (bool, error) {
+	re, err := regexp.Compile("^(?:" + regex + ")$")
+	if err != nil {
+		return false, fmt.Errorf("invalid regex %q: %v", regex, err)
+	}
+	return re.MatchString(value), nil
+}
+
+// explainDirectResponse explains why a route without backend matched.
+func explainDirectResponse(host *routepb.VirtualHost, route *routepb.Route, method string, status int) string {
+	switch status {
+	case http.StatusMethodNotAllowed:
+		// The 405 routes have the path matchers of the backend routes, without
+		// the method.
+		var methods []string
+		for _, r := range host.GetRoutes() {
+			if r.GetRoute() == nil || !proto.Equal(&routepb.RouteMatch{PathSpecifier: r.GetMatch().GetPathSpecifier()}, &routepb.RouteMatch{PathSpecifier: route.GetMatch().GetPathSpecifier()}) {
+				continue
+			}
+			for _, header := range r.GetMatch().GetHeaders() {
+				if header.GetName() == ":method" {
+					methods = append(methods, header.GetStringMatch().GetExact())
+				}
+			}
+		}
+		return fmt.Sprintf("the path matches a URI template of the API, but method %s is not one of its methods %v", method, methods)
+	case http.StatusNotFound:
+		return "the path matches none of the URI templates of the API; the routes are matched in order, see httppattern.Sort"
+	}
+	return ""
+}
+
+// extractPathVariables extracts the path variables with the first URI
+// template of the operation matching the path.
+func (e *Explainer) extractPathVariables(operation, path string) map[string]string {
+	for _, origin := range e.uriTemplates[operation] {
+		if vars, ok := matchUriTemplate(origin, path); ok {
+			return vars
+		}
+	}
+	return nil
+}
+
+// matchUriTemplate returns the variables of the path if it matches the URI
+// template.
+func matchUriTemplate(origin, path string) (map[string]string, bool) {
+	// Parse again, httppattern.UriTemplate.ExactMatchString changes the
+	// variables of the parsed templates.
+	uriTemplate, err := httppattern.ParseUriTemplate(origin)
+	if err != nil {
+		return nil, false
+	}
+	if ok, _ := fullMatch(uriTemplate.Regex(false), path); !ok {
+		return nil, false
+	}
+
+	if uriTemplate.Verb != "" {
+		path = strings.TrimSuffix(path, ":"+uriTemplate.Verb)
+	}
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	vars := make(map[string]string)
+	for _, v := range uriTemplate.Variables {
+		end := v.EndSegment
+		if end < 0 {
+			// Relative to the end, where the verb counts as a segment.
+			end += len(segments) + 1
+			if uriTemplate.Verb != "" {
+				end++
+			}
+		}
+		if v.StartSegment > end || end > len(segments) {
+			continue
+		}
+		vars[strings.Join(v.FieldPath, ".")] = strings.Join(segments[v.StartSegment:end], "/")
+	}
+	return vars, true
+}
+
+// rewritePath applies the path_rewrite config like the path_rewrite filter.
+func rewritePath(pr *prpb.PerRouteFilterConfig, path, query string) string {
+	var newPath string
+	var params []string
+	switch {
+	case pr.GetPathPrefix() != "":
+		newPath = pr.GetPathPrefix() + path
+	case pr.GetConstantPath() != nil:
+		newPath = pr.GetConstantPath().GetPath()
+		if template := pr.GetConstantPath().GetUrlTemplate(); template != "" {
+			vars, _ := matchUriTemplate(template, path)
+			for name, value := range vars {
+				params = append(params, url.QueryEscape(name)+"="+url.QueryEscape(value))
+			}
+			sort.Strings(params)
+		}
+	default:
+		newPath = path
+	}
+	if query != "" {
+		params = append(params, query)
+	}
+	if len(params) == 0 {
+		return newPath
+	}
+	return newPath + "?" + strings.Join(params, "&")
+}
+
+func describeJwtRequirement(requirement *jwtpb.JwtRequirement) string {
+	describeAll := func(requirements []*jwtpb.JwtRequirement) string {
+		var descriptions []string
+		for _, r := range requirements {
+			descriptions = append(descriptions, describeJwtRequirement(r))
+		}
+		return strings.Join(descriptions, ", ")
+	}
+	switch r := requirement.GetRequiresType().(type) {
+	case *jwtpb.JwtRequirement_ProviderName:
+		return fmt.Sprintf("provider %s", r.ProviderName)
+	case *jwtpb.JwtRequirement_ProviderAndAudiences:
+		return fmt.Sprintf("provider %s with audiences %v", r.ProviderAndAudiences.GetProviderName(), r.ProviderAndAudiences.GetAudiences())
+	case *jwtpb.JwtRequirement_RequiresAny:
+		return fmt.Sprintf("any of (%s)", describeAll(r.RequiresAny.GetRequirements()))
+	case *jwtpb.JwtRequirement_RequiresAll:
+		return fmt.Sprintf("all of (%s)", describeAll(r.RequiresAll.GetRequirements()))
+	case *jwtpb.JwtRequirement_AllowMissing:
+		return "allow missing"
+	case *jwtpb.JwtRequirement_AllowMissingOrFailed:
+		return "allow missing or failed"
+	case nil:
+		return "unknown requirement"
+	default:
+		return fmt.Sprintf("%T", r)
+	}
+}
+
+func describeApiKeyLocations(locations []*scpb.ApiKeyLocation) []string {
+	if len(locations) == 0 {
+		return defaultApiKeyLocations
+	}
+	var descriptions []string
+	for _, location := range locations {
+		switch key := location.GetKey().(type) {
+		case *scpb.ApiKeyLocation_Query:
+			descriptions = append(descriptions, "query="+key.Query)
+		case *scpb.ApiKeyLocation_Header:
+			descriptions = append(descriptions, "header="+key.Header)
+		case *scpb.ApiKeyLocation_Cookie:
+			descriptions = append(descriptions, "cookie="+key.Cookie)
+		}
+	}
+	return descriptions
+}
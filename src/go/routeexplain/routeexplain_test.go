@@ -0,0 +1,323 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routeexplain
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/configinfo"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/options"
+
+	gen "github.com/GoogleCloudPlatform/esp-v2/src/go/configgenerator"
+	annotationspb "google.golang.org/genproto/googleapis/api/annotations"
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+	apipb "google.golang.org/genproto/protobuf/api"
+)
+
+const testApiName = "endpoints.examples.bookstore.Bookstore"
+
+var testServiceConfig = &confpb.Service{
+	Name: "bookstore.endpoints.project123.cloud.goog",
+	Id:   "2023-01-01r0",
+	Apis: []*apipb.Api{
+		{
+			Name: testApiName,
+			Methods: []*apipb.Method{
+				{Name: "ListShelves"},
+				{Name: "GetBook"},
+			},
+		},
+	},
+	Http: &annotationspb.Http{
+		Rules: []*annotationspb.HttpRule{
+			{
+				Selector: testApiName + ".ListShelves",
+				Pattern:  &annotationspb.HttpRule_Get{Get: "/v1/shelves"},
+			},
+			{
+				Selector: testApiName + ".GetBook",
+				Pattern:  &annotationspb.HttpRule_Get{Get: "/v1/shelves/{shelf}/books/{book=**}"},
+			},
+		},
+	},
+	Backend: &confpb.Backend{
+		Rules: []*confpb.BackendRule{
+			{
+				Selector:        testApiName + ".GetBook",
+				Address:         "https://books.run.app/getBook",
+				PathTranslation: confpb.BackendRule_CONSTANT_ADDRESS,
+				Authentication:  &confpb.BackendRule_DisableAuth{DisableAuth: true},
+			},
+		},
+	},
+	Authentication: &confpb.Authentication{
+		Providers: []*confpb.AuthProvider{
+			{
+				Id:      "auth0",
+				Issuer:  "https://auth0.com",
+				JwksUri: "https://auth0.com/jwks",
+			},
+		},
+		Rules: []*confpb.AuthenticationRule{
+			{
+				Selector:     testApiName + ".GetBook",
+				Requirements: []*confpb.AuthRequirement{{ProviderId: "auth0"}},
+			},
+		},
+	},
+	Control: &confpb.Control{
+		Environment: "servicecontrol.googleapis.com",
+	},
+}
+
+func TestExplain(t *testing.T) {
+	testData := []struct {
+		desc      string
+		req       *Request
+		check     func(t *testing.T, got *Explanation)
+		wantError string
+	}{
+		{
+			desc: "path variables and constant address backend",
+			req:  &Request{Method: "GET", Path: "/v1/shelves/1/books/a/b?view=full"},
+			check: func(t *testing.T, got *Explanation) {
+				if got.Operation != testApiName+".GetBook" {
+					t.Errorf("got operation %q", got.Operation)
+				}
+				if want := map[string]string{"shelf": "1", "book": "a/b"}; !reflect.DeepEqual(got.PathVariables, want) {
+					t.Errorf("got path variables %v, want %v", got.PathVariables, want)
+				}
+				if want := "/getBook?book=a%2Fb&shelf=1&view=full"; got.RewrittenPath != want {
+					t.Errorf("got rewritten path %q, want %q", got.RewrittenPath, want)
+				}
+				if got.HostRewrite != "books.run.app" {
+					t.Errorf("got host rewrite %q", got.HostRewrite)
+				}
+				if got.JwtRequirementName != testApiName+".GetBook" || !strings.Contains(got.JwtRequirement, "auth0") {
+					t.Errorf("got JWT requirement %q: %q", got.JwtRequirementName, got.JwtRequirement)
+				}
+			},
+		},
+		{
+			desc: "local backend with API key",
+			req:  &Request{Method: "GET", Path: "/v1/shelves/"},
+			check: func(t *testing.T, got *Explanation) {
+				if got.Operation != testApiName+".ListShelves" {
+					t.Errorf("got operation %q", got.Operation)
+				}
+				if got.RewrittenPath != "/v1/shelves/" || len(got.PathVariables) != 0 {
+					t.Errorf("got rewritten path %q, path variables %v", got.RewrittenPath, got.PathVariables)
+				}
+				if got.JwtRequirementName != "" {
+					t.Errorf("got JWT requirement %q, want none", got.JwtRequirementName)
+				}
+				if !reflect.DeepEqual(got.ApiKeyLocations, defaultApiKeyLocations) {
+					t.Errorf("got API key locations %v, want %v", got.ApiKeyLocations, defaultApiKeyLocations)
+				}
+			},
+		},
+		{
+			desc: "method not allowed",
+			req:  &Request{Method: "POST", Path: "/v1/shelves"},
+			check: func(t *testing.T, got *Explanation) {
+				if got.Status != 405 || !strings.Contains(got.Reason, "method POST is not one of its methods [GET]") {
+					t.Errorf("got status %d, reason %q", got.Status, got.Reason)
+				}
+			},
+		},
+		{
+			desc: "not found",
+			req:  &Request{Method: "GET", Path: "/v2/shelves"},
+			check: func(t *testing.T, got *Explanation) {
+				if got.Status != 404 || !strings.Contains(got.Reason, "matches none of the URI templates") {
+					t.Errorf("got status %d, reason %q", got.Status, got.Reason)
+				}
+			},
+		},
+		{
+			desc:      "invalid query",
+			req:       &Request{Method: "GET", Path: "/v1/shelves?a=%zz"},
+			wantError: "invalid query",
+		},
+	}
+
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.DisableTracing = true
+	explainer, err := NewExplainerFromServiceConfig(testServiceConfig, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := explainer.Explain(tc.req)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("want error: %v, got error: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.check(t, got)
+		})
+	}
+}
+
+func TestExplainWeightedClusters(t *testing.T) {
+	policy := `
+rules:
+- selector: endpoints.examples.bookstore.Bookstore.GetBook
+  weighted_backends:
+  - address: https://blue.example.com/blue
+    weight: 90
+    jwt_audience: https://blue.example.com
+  - address: https://green.example.com/green
+    weight: 10
+    disable_auth: true
+`
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.DisableTracing = true
+	opts.BackendPolicyPath = filepath.Join(t.TempDir(), "backend_policy.yaml")
+	if err := ioutil.WriteFile(opts.BackendPolicyPath, []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	explainer, err := NewExplainerFromServiceConfig(testServiceConfig, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := explainer.Explain(&Request{Method: "GET", Path: "/v1/shelves/1/books/a/b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*WeightedCluster{
+		{
+			Cluster:       "backend-cluster-blue.example.com:443",
+			Weight:        90,
+			HostRewrite:   "blue.example.com",
+			RewrittenPath: "/blue?book=a%2Fb&shelf=1",
+			JwtAudience:   "https://blue.example.com",
+		},
+		{
+			Cluster:       "backend-cluster-green.example.com:443",
+			Weight:        10,
+			HostRewrite:   "green.example.com",
+			RewrittenPath: "/green?book=a%2Fb&shelf=1",
+		},
+	}
+	if !reflect.DeepEqual(got.WeightedClusters, want) {
+		t.Errorf("got weighted clusters %+v, want %+v", got.WeightedClusters, want)
+	}
+	if text := got.Text(); !strings.Contains(text, "  Backend audience: https://blue.example.com\n") {
+		t.Errorf("got text without the backend audience of the weighted cluster: %s", text)
+	}
+}
+
+func TestExplainListenersWithUriTemplates(t *testing.T) {
+	opts := options.DefaultConfigGeneratorOptions()
+	opts.DisableTracing = true
+	serviceInfo, err := configinfo.NewServiceInfoFromServiceConfig(testServiceConfig, testServiceConfig.GetId(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners, err := gen.MakeListeners(serviceInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uriTemplates, err := UriTemplatesFromServiceConfig(testServiceConfig, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testData := []struct {
+		desc         string
+		uriTemplates map[string][]string
+		want         map[string]string
+	}{
+		{
+			desc:         "path variables from the URI templates of the service config",
+			uriTemplates: uriTemplates,
+			want:         map[string]string{"shelf": "1", "book": "a/b"},
+		},
+		{
+			desc: "no path variables without the URI templates",
+		},
+	}
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			explainer, err := NewExplainer(nil, listeners, tc.uriTemplates)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := explainer.Explain(&Request{Method: "GET", Path: "/v1/shelves/1/books/a/b"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Operation != testApiName+".GetBook" || !reflect.DeepEqual(got.PathVariables, tc.want) {
+				t.Errorf("got operation %q, path variables %v, want %v", got.Operation, got.PathVariables, tc.want)
+			}
+		})
+	}
+}
+
+func TestMatchUriTemplate(t *testing.T) {
+	testData := []struct {
+		desc     string
+		template string
+		path     string
+		wantVars map[string]string
+		wantOk   bool
+	}{
+		{
+			desc:     "single wildcard",
+			template: "/v1/shelves/{shelf}",
+			path:     "/v1/shelves/1",
+			wantVars: map[string]string{"shelf": "1"},
+			wantOk:   true,
+		},
+		{
+			desc:     "double wildcard with verb",
+			template: "/v1/{name=shelves/**}:publish",
+			path:     "/v1/shelves/1/books/2:publish",
+			wantVars: map[string]string{"name": "shelves/1/books/2"},
+			wantOk:   true,
+		},
+		{
+			desc:     "field path",
+			template: "/v1/{shelf.id}/books",
+			path:     "/v1/1/books/",
+			wantVars: map[string]string{"shelf.id": "1"},
+			wantOk:   true,
+		},
+		{
+			desc:     "no match",
+			template: "/v1/shelves/{shelf}",
+			path:     "/v1/shelves",
+		},
+	}
+	for _, tc := range testData {
+		t.Run(tc.desc, func(t *testing.T) {
+			gotVars, gotOk := matchUriTemplate(tc.template, tc.path)
+			if gotOk != tc.wantOk || (tc.wantOk && !reflect.DeepEqual(gotVars, tc.wantVars)) {
+				t.Errorf("got %v, %v, want %v, %v", gotVars, gotOk, tc.wantVars, tc.wantOk)
+			}
+		})
+	}
+}
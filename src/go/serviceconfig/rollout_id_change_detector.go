@@ -15,8 +15,11 @@
 package serviceconfig
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
@@ -24,13 +27,25 @@ import (
 	scpb "google.golang.org/genproto/googleapis/api/servicecontrol/v1"
 )
 
+const (
+	// The check interval is randomized by +/- rolloutCheckJitter, so that
+	// the proxies started together do not call Service Control together.
+	rolloutCheckJitter = 0.2
+	// The max interval between two checks while the checks keep failing.
+	maxRolloutCheckBackoff = 10 * time.Minute
+)
+
 type RolloutIdChangeDetector struct {
-	serviceName           string
-	serviceControlUrl     string
-	client                *http.Client
-	curRolloutId          string
-	accessToken           util.GetAccessTokenFunc
-	detectRolloutIdTicker *time.Ticker
+	serviceName       string
+	serviceControlUrl string
+	client            *http.Client
+	accessToken       util.GetAccessTokenFunc
+	// Returns a random number in [0, 1), overridden in tests.
+	rand func() float64
+
+	mu                  sync.Mutex
+	curRolloutId        string
+	consecutiveFailures int
 }
 
 func NewRolloutIdChangeDetector(client *http.Client, serviceControlUrl, serviceName string,
@@ -40,41 +55,106 @@ func NewRolloutIdChangeDetector(client *http.Client, serviceControlUrl, serviceN
 		serviceName:       serviceName,
 		serviceControlUrl: serviceControlUrl,
 		accessToken:       accessToken,
+		rand:              rand.Float64,
 	}
 
 }
 
-func (c *RolloutIdChangeDetector) fetchLatestRolloutId() (string, error) {
+// CurRolloutId returns the latest rollout id seen by the detector.
+func (c *RolloutIdChangeDetector) CurRolloutId() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.curRolloutId
+}
+
+// ConsecutiveFailures returns the number of the rollout checks failed in a
+// row, either to fetch the rollout id or to apply the new rollout.
+func (c *RolloutIdChangeDetector) ConsecutiveFailures() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.consecutiveFailures
+}
+
+func (c *RolloutIdChangeDetector) fetchLatestRolloutId(ctx context.Context) (string, error) {
 	reportResponse := new(scpb.ReportResponse)
 	fetchRolloutIdUrl := util.FetchRolloutIdURL(c.serviceControlUrl, c.serviceName)
 	util.CallGoogleapisMu.RLock()
 	callGoogleapis := util.CallGoogleapis
 	util.CallGoogleapisMu.RUnlock()
-	if err := callGoogleapis(c.client, fetchRolloutIdUrl, util.POST, c.accessToken, nil, reportResponse); err != nil {
+	if err := callGoogleapis(ctx, c.client, fetchRolloutIdUrl, util.POST, c.accessToken, nil, reportResponse); err != nil {
 		return "", fmt.Errorf("fail to fetch new rollout id, %v", err)
 	}
 
 	return reportResponse.ServiceRolloutId, nil
 }
 
-func (c *RolloutIdChangeDetector) SetDetectRolloutIdChangeTimer(interval time.Duration, callback func()) {
+// WatchRolloutIdChange checks the latest rollout id about every interval
+// until ctx is done, and calls callback when it changes. The first check is
+// at a random time within the first interval. If the check or the callback
+// fails, the interval is doubled up to maxRolloutCheckBackoff, and the
+// rollout is retried.
+func (c *RolloutIdChangeDetector) WatchRolloutIdChange(ctx context.Context, interval time.Duration, callback func() error) {
 	go func() {
 		glog.Infof("start detect latest rollout id every %v", interval)
-		c.detectRolloutIdTicker = time.NewTicker(interval)
+		timer := time.NewTimer(time.Duration(c.rand() * float64(interval)))
+		defer timer.Stop()
 
-		for range c.detectRolloutIdTicker.C {
-			latestRolloutId, err := c.fetchLatestRolloutId()
-			if err != nil {
-				glog.Errorf("error occurred when checking new rollout id, %v", err)
-				continue
+		for {
+			select {
+			case <-ctx.Done():
+				glog.Infof("stop detecting latest rollout id, %v", ctx.Err())
+				return
+			case <-timer.C:
 			}
 
-			if latestRolloutId == c.curRolloutId {
-				continue
+			err := c.checkRolloutIdChange(ctx, callback)
+			c.mu.Lock()
+			if err != nil {
+				c.consecutiveFailures++
+				glog.Errorf("error occurred when checking new rollout id, %d failures in a row, %v", c.consecutiveFailures, err)
+			} else {
+				c.consecutiveFailures = 0
 			}
+			failures := c.consecutiveFailures
+			c.mu.Unlock()
 
-			c.curRolloutId = latestRolloutId
-			callback()
+			timer.Reset(c.nextCheckDelay(interval, failures))
 		}
 	}()
 }
+
+// checkRolloutIdChange calls callback if the rollout id changed. The new
+// rollout id is only recorded if callback succeeds, so it is retried.
+func (c *RolloutIdChangeDetector) checkRolloutIdChange(ctx context.Context, callback func() error) error {
+	latestRolloutId, err := c.fetchLatestRolloutId(ctx)
+	if err != nil {
+		return err
+	}
+	if latestRolloutId == c.CurRolloutId() {
+		return nil
+	}
+	if err := callback(); err != nil {
+		return fmt.Errorf("fail to apply rollout %s, %v", latestRolloutId, err)
+	}
+	c.mu.Lock()
+	c.curRolloutId = latestRolloutId
+	c.mu.Unlock()
+	return nil
+}
+
+// nextCheckDelay returns the jittered delay of the next check after the
+// given number of consecutive failures.
+func (c *RolloutIdChangeDetector) nextCheckDelay(interval time.Duration, failures int) time.Duration {
+	maxDelay := maxRolloutCheckBackoff
+	if interval > maxDelay {
+		maxDelay = interval
+	}
+	delay := interval
+	for i := 0; i < failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return time.Duration(float64(delay) * (1 - rolloutCheckJitter + 2*rolloutCheckJitter*c.rand()))
+}
@@ -15,6 +15,7 @@
 package serviceconfig
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"sync/atomic"
@@ -34,7 +35,7 @@ func genFakeReport(serviceRolloutId string) string {
 	return string(reportRespBytes)
 }
 
-type getCallGoogleapisFunc func(client *http.Client, path, method string, getTokenFunc util.GetAccessTokenFunc, retryConfigs map[int]util.RetryConfig, output proto.Message) error
+type getCallGoogleapisFunc func(ctx context.Context, client *http.Client, path, method string, getTokenFunc util.GetAccessTokenFunc, retryConfigs map[int]util.RetryConfig, output proto.Message) error
 
 func TestFetchLatestRolloutId(t *testing.T) {
 	serviceRolloutId := "service-config-id"
@@ -58,7 +59,7 @@ func TestFetchLatestRolloutId(t *testing.T) {
 		},
 		{
 			desc: "failure due to call googleapis",
-			callGoogleapis: func(client *http.Client, path, method string, getTokenFunc util.GetAccessTokenFunc, retryConfigs map[int]util.RetryConfig, output proto.Message) error {
+			callGoogleapis: func(ctx context.Context, client *http.Client, path, method string, getTokenFunc util.GetAccessTokenFunc, retryConfigs map[int]util.RetryConfig, output proto.Message) error {
 				return fmt.Errorf("error-from-CallGoogleapis")
 			},
 			wantError: "fail to fetch new rollout id, error-from-CallGoogleapis",
@@ -68,7 +69,7 @@ func TestFetchLatestRolloutId(t *testing.T) {
 		util.CallGoogleapisMu.RLock()
 		util.CallGoogleapis = tc.callGoogleapis
 		util.CallGoogleapisMu.RUnlock()
-		rolloutId, err := cif.fetchLatestRolloutId()
+		rolloutId, err := cif.fetchLatestRolloutId(context.Background())
 		if tc.wantRolloutId != "" && tc.wantRolloutId != rolloutId {
 			t.Errorf("Test(%s): fail in fetchLatestRolloutId, want rolloutId %s, get rolloutId %s", tc.desc, tc.wantRolloutId, rolloutId)
 		}
@@ -86,7 +87,7 @@ func TestFetchLatestRolloutId(t *testing.T) {
 	util.CallGoogleapisMu.RUnlock()
 }
 
-func TestSetDetectRolloutIdChangeTimer(t *testing.T) {
+func TestWatchRolloutIdChange(t *testing.T) {
 	serviceRolloutId := "service-config-id"
 	serviceControlServer := util.InitMockServer(genFakeReport(serviceRolloutId))
 	accessToken := func() (string, time.Duration, error) { return "token", time.Duration(60), nil }
@@ -96,8 +97,15 @@ func TestSetDetectRolloutIdChangeTimer(t *testing.T) {
 	cnt = 0
 	wantCnt = 3
 
+	ctx, cancel := context.WithCancel(context.Background())
 	wantRolloutId := fmt.Sprintf("test-rollout-id-%v", wantCnt)
-	cif.SetDetectRolloutIdChangeTimer(time.Millisecond*50, func() {
+	failed := false
+	cif.WatchRolloutIdChange(ctx, time.Millisecond*50, func() error {
+		// Fail the first rollout once, it should be retried.
+		if !failed {
+			failed = true
+			return fmt.Errorf("error-from-callback")
+		}
 		atomic.AddInt32(&cnt, 1)
 
 		// Update rolloutId so the callback will be called.
@@ -106,16 +114,79 @@ func TestSetDetectRolloutIdChangeTimer(t *testing.T) {
 			serviceRolloutId = fmt.Sprintf("test-rollout-id-%v", atomic.LoadInt32(&cnt)+1)
 			serviceControlServer.SetResp(genFakeReport(serviceRolloutId))
 		}
+		return nil
 	})
 
 	// Sleep long enough to make sure the callback is called 3 times.
 	time.Sleep(time.Millisecond * 1000)
+	cancel()
 
 	if atomic.LoadInt32(&cnt) != wantCnt {
 		t.Fatalf("want callback called by %v times, get %v times", wantCnt, cnt)
 	}
 
-	if cif.curRolloutId != wantRolloutId {
-		t.Errorf("want curRolloutId: %s, get curRolloutId: %s", wantRolloutId, cif.curRolloutId)
+	if cif.CurRolloutId() != wantRolloutId {
+		t.Errorf("want curRolloutId: %s, get curRolloutId: %s", wantRolloutId, cif.CurRolloutId())
+	}
+	if cif.ConsecutiveFailures() != 0 {
+		t.Errorf("want no consecutive failures after the rollouts are applied, get %v", cif.ConsecutiveFailures())
+	}
+
+	// No more checks once ctx is done.
+	time.Sleep(time.Millisecond * 100)
+	serviceControlServer.SetResp(genFakeReport("test-rollout-id-after-cancel"))
+	time.Sleep(time.Millisecond * 200)
+	if cif.CurRolloutId() != wantRolloutId {
+		t.Errorf("want no rollout checked after cancel, get curRolloutId: %s", cif.CurRolloutId())
+	}
+}
+
+func TestNextCheckDelay(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		interval  time.Duration
+		failures  int
+		rand      float64
+		wantDelay time.Duration
+	}{
+		{
+			desc:      "no failure, no jitter",
+			interval:  time.Minute,
+			rand:      0.5,
+			wantDelay: time.Minute,
+		},
+		{
+			desc:      "no failure, min jitter",
+			interval:  time.Minute,
+			rand:      0,
+			wantDelay: 48 * time.Second,
+		},
+		{
+			desc:      "exponential backoff on failures",
+			interval:  time.Minute,
+			failures:  3,
+			rand:      0.5,
+			wantDelay: 8 * time.Minute,
+		},
+		{
+			desc:      "backoff is capped",
+			interval:  time.Minute,
+			failures:  100,
+			rand:      0.5,
+			wantDelay: maxRolloutCheckBackoff,
+		},
+		{
+			desc:      "interval longer than the backoff cap",
+			interval:  time.Hour,
+			failures:  2,
+			rand:      0.5,
+			wantDelay: time.Hour,
+		},
+	}
+	for _, tc := range testCases {
+		cif := &RolloutIdChangeDetector{rand: func() float64 { return tc.rand }}
+		if got := cif.nextCheckDelay(tc.interval, tc.failures); got != tc.wantDelay {
+			t.Errorf("Test(%s): want delay %v, get delay %v", tc.desc, tc.wantDelay, got)
+		}
 	}
 }
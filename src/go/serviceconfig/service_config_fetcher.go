@@ -15,6 +15,7 @@
 package serviceconfig
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"time"
@@ -53,13 +54,13 @@ func NewServiceConfigFetcher(client *http.Client, serviceManagementUrl,
 }
 
 // Fetch the service config by given configId.
-func (s *ServiceConfigFetcher) FetchConfig(configId string) (*confpb.Service, error) {
+func (s *ServiceConfigFetcher) FetchConfig(ctx context.Context, configId string) (*confpb.Service, error) {
 	serviceConfig := new(confpb.Service)
 	fetchConfigUrl := util.FetchConfigURL(s.serviceManagementUrl, s.serviceName, configId)
 	util.CallGoogleapisMu.RLock()
 	callGoogleapis := util.CallGoogleapis
 	util.CallGoogleapisMu.RUnlock()
-	if err := callGoogleapis(s.client, fetchConfigUrl, util.GET, s.accessToken, s.retryConfigs, serviceConfig); err != nil {
+	if err := callGoogleapis(ctx, s.client, fetchConfigUrl, util.GET, s.accessToken, s.retryConfigs, serviceConfig); err != nil {
 		return nil, err
 	}
 
@@ -68,17 +69,40 @@ func (s *ServiceConfigFetcher) FetchConfig(configId string) (*confpb.Service, er
 
 // Fetch all the rollouts and use the latest success rollout. Among its all
 // service configs, pick up the one with highest traffic percentage.
-func (s *ServiceConfigFetcher) LoadConfigIdFromRollouts() (string, error) {
+func (s *ServiceConfigFetcher) LoadConfigIdFromRollouts(ctx context.Context) (string, error) {
+	rollouts, err := s.fetchRollouts(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return highestTrafficConfigIdInLatestRollout(rollouts)
+}
+
+// Fetch all the rollouts and return the id of the latest success rollout,
+// with the traffic percentages of all its service configs keyed by config id.
+func (s *ServiceConfigFetcher) LoadTrafficPercentagesFromRollouts(ctx context.Context) (string, map[string]float64, error) {
+	rollouts, err := s.fetchRollouts(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	percentages, err := trafficPercentagesInLatestRollout(rollouts)
+	if err != nil {
+		return "", nil, err
+	}
+	return rollouts.GetRollouts()[0].GetRolloutId(), percentages, nil
+}
+
+func (s *ServiceConfigFetcher) fetchRollouts(ctx context.Context) (*smpb.ListServiceRolloutsResponse, error) {
 	rollouts := new(smpb.ListServiceRolloutsResponse)
 	fetchRolloutUrl := util.FetchRolloutsURL(s.serviceManagementUrl, s.serviceName)
 	util.CallGoogleapisMu.RLock()
 	callGoogleapis := util.CallGoogleapis
 	util.CallGoogleapisMu.RUnlock()
-	if err := callGoogleapis(s.client, fetchRolloutUrl, util.GET, s.accessToken, s.retryConfigs, rollouts); err != nil {
-		return "", err
+	if err := callGoogleapis(ctx, s.client, fetchRolloutUrl, util.GET, s.accessToken, s.retryConfigs, rollouts); err != nil {
+		return nil, err
 	}
-
-	return highestTrafficConfigIdInLatestRollout(rollouts)
+	return rollouts, nil
 }
 
 func highestTrafficConfigIdInLatestRollout(rollouts *smpb.ListServiceRolloutsResponse) (string, error) {
@@ -102,3 +126,20 @@ func highestTrafficConfigIdInLatestRollout(rollouts *smpb.ListServiceRolloutsRes
 	}
 	return highTrafficConfigId, nil
 }
+
+func trafficPercentagesInLatestRollout(rollouts *smpb.ListServiceRolloutsResponse) (map[string]float64, error) {
+	if rollouts == nil || len(rollouts.GetRollouts()) == 0 {
+		return nil, fmt.Errorf("problematic rollouts: %v", rollouts)
+	}
+
+	percentages := make(map[string]float64)
+	for configId, percent := range rollouts.GetRollouts()[0].GetTrafficPercentStrategy().GetPercentages() {
+		if percent > 0 {
+			percentages[configId] = percent
+		}
+	}
+	if len(percentages) == 0 {
+		return nil, fmt.Errorf("no service config receives traffic in the latest rollout: %v", rollouts.GetRollouts()[0])
+	}
+	return percentages, nil
+}
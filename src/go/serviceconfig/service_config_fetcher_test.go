@@ -15,9 +15,12 @@
 package serviceconfig
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -110,7 +113,7 @@ func TestServiceConfigFetcherFetchConfig(t *testing.T) {
 			if callGoogleapisOverridden {
 				oldCallGoogleapis := util.CallGoogleapis
 				util.CallGoogleapisMu.Lock()
-				util.CallGoogleapis = func(client *http.Client, path, method string, getTokenFunc util.GetAccessTokenFunc, retryConfigs map[int]util.RetryConfig, output proto.Message) error {
+				util.CallGoogleapis = func(ctx context.Context, client *http.Client, path, method string, getTokenFunc util.GetAccessTokenFunc, retryConfigs map[int]util.RetryConfig, output proto.Message) error {
 					return fmt.Errorf("error-from-CallGoogleapis")
 				}
 				util.CallGoogleapisMu.Unlock()
@@ -121,7 +124,7 @@ func TestServiceConfigFetcherFetchConfig(t *testing.T) {
 				}()
 			}
 
-			getConfig, err := scf.FetchConfig(configId)
+			getConfig, err := scf.FetchConfig(context.Background(), configId)
 			if err != nil {
 				if wantError == "" {
 					t.Fatalf("test(%s), fail to fetch config: %v", desc, err)
@@ -206,7 +209,7 @@ func TestServiceConfigFetcherLoadConfigIdFromRollouts(t *testing.T) {
 			if callGoogleapisOverridden {
 				util.CallGoogleapisMu.Lock()
 				oldCallGoogleapis := util.CallGoogleapis
-				util.CallGoogleapis = func(client *http.Client, path, method string, getTokenFunc util.GetAccessTokenFunc, retryConfigs map[int]util.RetryConfig, output proto.Message) error {
+				util.CallGoogleapis = func(ctx context.Context, client *http.Client, path, method string, getTokenFunc util.GetAccessTokenFunc, retryConfigs map[int]util.RetryConfig, output proto.Message) error {
 					return fmt.Errorf("error-from-CallGoogleapis")
 				}
 				util.CallGoogleapisMu.Unlock()
@@ -223,7 +226,7 @@ func TestServiceConfigFetcherLoadConfigIdFromRollouts(t *testing.T) {
 				defer func() { listServiceRolloutsResponse.Rollouts = oldserviceRollouts }()
 			}
 
-			getConfigId, err := scf.LoadConfigIdFromRollouts()
+			getConfigId, err := scf.LoadConfigIdFromRollouts(context.Background())
 
 			if err != nil {
 				if err.Error() != wantError {
@@ -240,3 +243,69 @@ func TestServiceConfigFetcherLoadConfigIdFromRollouts(t *testing.T) {
 		_test(tc.desc, tc.callGoogleapisOverridden, tc.serviceRollouts, tc.wantConfigId, tc.wantError)
 	}
 }
+
+func TestTrafficPercentagesInLatestRollout(t *testing.T) {
+	testCase := []struct {
+		desc            string
+		rollouts        *smpb.ListServiceRolloutsResponse
+		wantPercentages map[string]float64
+		wantError       string
+	}{
+		{
+			desc: "Success, configs without traffic are dropped",
+			rollouts: &smpb.ListServiceRolloutsResponse{
+				Rollouts: []*smpb.Rollout{
+					{
+						Strategy: &smpb.Rollout_TrafficPercentStrategy_{
+							TrafficPercentStrategy: &smpb.Rollout_TrafficPercentStrategy{
+								Percentages: map[string]float64{
+									"config-a": 80,
+									"config-b": 20,
+									"config-c": 0,
+								},
+							},
+						},
+					},
+				},
+			},
+			wantPercentages: map[string]float64{
+				"config-a": 80,
+				"config-b": 20,
+			},
+		},
+		{
+			desc:      "Failure, no rollout",
+			rollouts:  &smpb.ListServiceRolloutsResponse{},
+			wantError: "problematic rollouts: ",
+		},
+		{
+			desc: "Failure, no config receives traffic",
+			rollouts: &smpb.ListServiceRolloutsResponse{
+				Rollouts: []*smpb.Rollout{
+					{
+						RolloutId: "rollout-id",
+					},
+				},
+			},
+			wantError: "no service config receives traffic in the latest rollout",
+		},
+	}
+
+	for _, tc := range testCase {
+		t.Run(tc.desc, func(t *testing.T) {
+			gotPercentages, err := trafficPercentagesInLatestRollout(tc.rollouts)
+			if tc.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+					t.Fatalf("want error: %s, get error: %v", tc.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotPercentages, tc.wantPercentages) {
+				t.Errorf("want percentages: %v, get percentages: %v", tc.wantPercentages, gotPercentages)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serviceconfig
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/gcsrunner"
+	"github.com/GoogleCloudPlatform/esp-v2/src/go/util"
+
+	confpb "google.golang.org/genproto/googleapis/api/serviceconfig"
+)
+
+// ServiceConfigSource is where the service config of a service is fetched
+// from.
+type ServiceConfigSource interface {
+	// FetchServiceConfig fetches the service config. It returns nil without
+	// error if the service config is the same as the last committed one.
+	FetchServiceConfig(ctx context.Context) (*confpb.Service, error)
+	// Commit records the service config last fetched as applied. Until then,
+	// it is returned again by the next fetch.
+	Commit()
+	// String describes the source in logs.
+	String() string
+}
+
+// ServiceConfigSourceOptions are the dependencies of the sources made by
+// NewServiceConfigSource.
+type ServiceConfigSourceOptions struct {
+	Client               *http.Client
+	ServiceManagementUrl string
+	// Required by the Service Management source.
+	AccessToken util.GetAccessTokenFunc
+	// The file with the bearer token of the HTTPS source, read on every fetch
+	// so that the token can be rotated. No token is sent if empty. The HTTP
+	// sources are rejected with it, the token would be sent in the clear.
+	BearerTokenFile string
+}
+
+// NewServiceConfigSource makes the source of a URI:
+//   - servicemanagement://SERVICE_NAME[/CONFIG_ID]: the config of CONFIG_ID,
+//     or the one with the most traffic in the latest rollout if not set.
+//   - gs://BUCKET/OBJECT: a JSON service config in GCS, read with the default
+//     credentials.
+//   - https://HOST/PATH or http://HOST/PATH: a JSON service config served
+//     over HTTP(S).
+//   - file:///PATH or PATH: a local JSON service config file.
+func NewServiceConfigSource(uri string, opts ServiceConfigSourceOptions) (ServiceConfigSource, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("fail to parse service config source %s, %v", uri, err)
+	}
+
+	switch u.Scheme {
+	case "servicemanagement":
+		if u.Host == "" {
+			return nil, fmt.Errorf("service config source %s has no service name", uri)
+		}
+		if opts.AccessToken == nil {
+			return nil, fmt.Errorf("service config source %s requires an access token", uri)
+		}
+		return &ServiceManagementSource{
+			fetcher:  NewServiceConfigFetcher(opts.Client, opts.ServiceManagementUrl, u.Host, opts.AccessToken),
+			configId: strings.Trim(u.Path, "/"),
+		}, nil
+	case "gs":
+		object := strings.TrimPrefix(u.Path, "/")
+		if u.Host == "" || object == "" {
+			return nil, fmt.Errorf("service config source %s must be gs://BUCKET/OBJECT", uri)
+		}
+		return &GCSSource{
+			opts: gcsrunner.FetchConfigOptions{
+				BucketName:                    u.Host,
+				ConfigFileName:                object,
+				FetchGCSObjectInitialInterval: time.Second,
+				FetchGCSObjectTimeout:         time.Minute,
+			},
+		}, nil
+	case "https", "http":
+		if u.Scheme == "http" && opts.BearerTokenFile != "" {
+			return nil, fmt.Errorf("service config source %s must be https to be sent the bearer token", uri)
+		}
+		return &HTTPSource{
+			url:             uri,
+			client:          opts.Client,
+			bearerTokenFile: opts.BearerTokenFile,
+		}, nil
+	case "file", "":
+		return &FileSource{path: u.Path}, nil
+	default:
+		return nil, fmt.Errorf("service config source %s has unsupported scheme %q", uri, u.Scheme)
+	}
+}
+
+// contentTracker skips the service config whose content is the same as the
+// last committed one.
+type contentTracker struct {
+	hash        [sha256.Size]byte
+	fetchedHash [sha256.Size]byte
+}
+
+// unmarshalIfChanged returns nil if data is the same as the last committed one.
+func (t *contentTracker) unmarshalIfChanged(data []byte) (*confpb.Service, error) {
+	hash := sha256.Sum256(data)
+	if hash == t.hash {
+		return nil, nil
+	}
+	serviceConfig, err := util.UnmarshalServiceConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("fail to unmarshal service config with error: %s", err)
+	}
+	t.fetchedHash = hash
+	return serviceConfig, nil
+}
+
+func (t *contentTracker) Commit() {
+	t.hash = t.fetchedHash
+}
+
+// ServiceManagementSource fetches the service config from Service
+// Management.
+type ServiceManagementSource struct {
+	fetcher *ServiceConfigFetcher
+	// The latest rollout is used if empty.
+	configId        string
+	lastConfigId    string
+	fetchedConfigId string
+}
+
+func (s *ServiceManagementSource) FetchServiceConfig(ctx context.Context) (*confpb.Service, error) {
+	configId := s.configId
+	if configId == "" {
+		var err error
+		if configId, err = s.fetcher.LoadConfigIdFromRollouts(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if configId == s.lastConfigId {
+		return nil, nil
+	}
+	serviceConfig, err := s.fetcher.FetchConfig(ctx, configId)
+	if err != nil {
+		return nil, err
+	}
+	s.fetchedConfigId = configId
+	return serviceConfig, nil
+}
+
+func (s *ServiceManagementSource) Commit() {
+	s.lastConfigId = s.fetchedConfigId
+}
+
+func (s *ServiceManagementSource) String() string {
+	if s.configId == "" {
+		return fmt.Sprintf("servicemanagement://%s", s.fetcher.serviceName)
+	}
+	return fmt.Sprintf("servicemanagement://%s/%s", s.fetcher.serviceName, s.configId)
+}
+
+// FileSource reads the service config from a local file.
+type FileSource struct {
+	path string
+	contentTracker
+}
+
+func (s *FileSource) FetchServiceConfig(ctx context.Context) (*confpb.Service, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read service config file: %s, error: %s", s.path, err)
+	}
+	return s.unmarshalIfChanged(data)
+}
+
+func (s *FileSource) String() string {
+	return s.path
+}
+
+// HTTPSource fetches the service config from an HTTP(S) URL. The ETag of the
+// last committed response is sent in If-None-Match, a 304 response means no
+// change.
+type HTTPSource struct {
+	url             string
+	client          *http.Client
+	bearerTokenFile string
+	etag            string
+	fetchedEtag     string
+	contentTracker
+}
+
+func (s *HTTPSource) FetchServiceConfig(ctx context.Context) (*confpb.Service, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.bearerTokenFile != "" {
+		token, err := ioutil.ReadFile(s.bearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("fail to read bearer token file %s, %v", s.bearerTokenFile, err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fail to fetch service config from %s, %v", s.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fail to fetch service config from %s, got status %s", s.url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read service config from %s, %v", s.url, err)
+	}
+
+	serviceConfig, err := s.unmarshalIfChanged(data)
+	if err != nil {
+		return nil, err
+	}
+	// The same content under a new ETag has nothing to apply.
+	if serviceConfig == nil {
+		s.etag = resp.Header.Get("ETag")
+		return nil, nil
+	}
+	s.fetchedEtag = resp.Header.Get("ETag")
+	return serviceConfig, nil
+}
+
+func (s *HTTPSource) Commit() {
+	s.contentTracker.Commit()
+	s.etag = s.fetchedEtag
+}
+
+func (s *HTTPSource) String() string {
+	return s.url
+}
+
+// GCSSource reads the service config from a GCS object.
+type GCSSource struct {
+	opts gcsrunner.FetchConfigOptions
+	contentTracker
+}
+
+func (s *GCSSource) FetchServiceConfig(ctx context.Context) (*confpb.Service, error) {
+	data, err := gcsrunner.ReadConfigFromGCS(s.opts)
+	if err != nil {
+		return nil, fmt.Errorf("fail to fetch service config from %s, %v", s, err)
+	}
+	return s.unmarshalIfChanged(data)
+}
+
+func (s *GCSSource) String() string {
+	return fmt.Sprintf("gs://%s/%s", s.opts.BucketName, s.opts.ConfigFileName)
+}
@@ -0,0 +1,268 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serviceconfig
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewServiceConfigSource(t *testing.T) {
+	accessToken := func() (string, time.Duration, error) { return "token", time.Duration(60), nil }
+	testCases := []struct {
+		desc            string
+		uri             string
+		noToken         bool
+		bearerTokenFile string
+		wantSource      string
+		wantError       string
+	}{
+		{
+			desc:       "service management with config id",
+			uri:        "servicemanagement://bookstore.endpoints.project123.cloud.goog/2023-01-01r0",
+			wantSource: "servicemanagement://bookstore.endpoints.project123.cloud.goog/2023-01-01r0",
+		},
+		{
+			desc:       "service management with latest rollout",
+			uri:        "servicemanagement://bookstore.endpoints.project123.cloud.goog",
+			wantSource: "servicemanagement://bookstore.endpoints.project123.cloud.goog",
+		},
+		{
+			desc:      "service management without access token",
+			uri:       "servicemanagement://bookstore.endpoints.project123.cloud.goog",
+			noToken:   true,
+			wantError: "requires an access token",
+		},
+		{
+			desc:       "gcs object",
+			uri:        "gs://bucket/path/service.json",
+			wantSource: "gs://bucket/path/service.json",
+		},
+		{
+			desc:      "gcs bucket without object",
+			uri:       "gs://bucket",
+			wantError: "must be gs://BUCKET/OBJECT",
+		},
+		{
+			desc:       "https url",
+			uri:        "https://artifacts.example.com/service.json?version=3",
+			wantSource: "https://artifacts.example.com/service.json?version=3",
+		},
+		{
+			desc:            "https url with bearer token",
+			uri:             "https://artifacts.example.com/service.json",
+			bearerTokenFile: "/etc/espv2/token",
+			wantSource:      "https://artifacts.example.com/service.json",
+		},
+		{
+			desc:            "http url with bearer token",
+			uri:             "http://artifacts.example.com/service.json",
+			bearerTokenFile: "/etc/espv2/token",
+			wantError:       "must be https to be sent the bearer token",
+		},
+		{
+			desc:       "file url",
+			uri:        "file:///etc/espv2/service.json",
+			wantSource: "/etc/espv2/service.json",
+		},
+		{
+			desc:       "file path",
+			uri:        "/etc/espv2/service.json",
+			wantSource: "/etc/espv2/service.json",
+		},
+		{
+			desc:      "unsupported scheme",
+			uri:       "ftp://example.com/service.json",
+			wantError: `unsupported scheme "ftp"`,
+		},
+	}
+	for _, tc := range testCases {
+		opts := ServiceConfigSourceOptions{Client: &http.Client{}, BearerTokenFile: tc.bearerTokenFile}
+		if !tc.noToken {
+			opts.AccessToken = accessToken
+		}
+		source, err := NewServiceConfigSource(tc.uri, opts)
+		if tc.wantError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantError) {
+				t.Errorf("Test(%s): want error %v, get error %v", tc.desc, tc.wantError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test(%s): %v", tc.desc, err)
+		}
+		if source.String() != tc.wantSource {
+			t.Errorf("Test(%s): want source %s, get source %s", tc.desc, tc.wantSource, source)
+		}
+	}
+}
+
+func TestHTTPSource(t *testing.T) {
+	config := `{"name": "bookstore.endpoints.project123.cloud.goog", "id": "2023-01-01r0"}`
+	etag := `"v1"`
+	var gotAuth, gotIfNoneMatch string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth, gotIfNoneMatch = r.Header.Get("Authorization"), r.Header.Get("If-None-Match")
+		if gotIfNoneMatch == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(config))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "service-config-source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := NewServiceConfigSource(server.URL, ServiceConfigSourceOptions{Client: server.Client(), BearerTokenFile: tokenFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serviceConfig, err := source.FetchServiceConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serviceConfig.GetId() != "2023-01-01r0" {
+		t.Errorf("want service config 2023-01-01r0, get %v", serviceConfig)
+	}
+	if gotAuth != "Bearer secret" || gotIfNoneMatch != "" {
+		t.Errorf("first fetch got Authorization %q and If-None-Match %q", gotAuth, gotIfNoneMatch)
+	}
+
+	// The service config is not applied yet, it is fetched again.
+	if serviceConfig, err = source.FetchServiceConfig(context.Background()); err != nil || serviceConfig.GetId() != "2023-01-01r0" || gotIfNoneMatch != "" {
+		t.Errorf("fetch before commit want service config 2023-01-01r0 without If-None-Match, get service config %v with If-None-Match %q, error %v", serviceConfig, gotIfNoneMatch, err)
+	}
+	source.Commit()
+
+	// The ETag is the same, nothing changed.
+	serviceConfig, err = source.FetchServiceConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serviceConfig != nil || gotIfNoneMatch != etag {
+		t.Errorf("second fetch want no change with If-None-Match %s, get service config %v with If-None-Match %q", etag, serviceConfig, gotIfNoneMatch)
+	}
+
+	// A new ETag with the same content is no change either.
+	etag = `"v2"`
+	if serviceConfig, err = source.FetchServiceConfig(context.Background()); err != nil || serviceConfig != nil {
+		t.Errorf("third fetch want no change, get service config %v, error %v", serviceConfig, err)
+	}
+
+	etag = `"v3"`
+	config = `{"name": "bookstore.endpoints.project123.cloud.goog", "id": "2023-01-02r0"}`
+	if serviceConfig, err = source.FetchServiceConfig(context.Background()); err != nil || serviceConfig.GetId() != "2023-01-02r0" {
+		t.Errorf("fourth fetch want service config 2023-01-02r0, get service config %v, error %v", serviceConfig, err)
+	}
+	// Not committed, i.e. failed to apply, so the committed ETag is still sent.
+	if serviceConfig, err = source.FetchServiceConfig(context.Background()); err != nil || serviceConfig.GetId() != "2023-01-02r0" || gotIfNoneMatch != `"v2"` {
+		t.Errorf("fifth fetch want service config 2023-01-02r0 with If-None-Match \"v2\", get service config %v with If-None-Match %q, error %v", serviceConfig, gotIfNoneMatch, err)
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service-config-source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "service.json")
+	source, err := NewServiceConfigSource("file://"+path, ServiceConfigSourceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := source.FetchServiceConfig(context.Background()); err == nil || !strings.Contains(err.Error(), "fail to read service config file") {
+		t.Errorf("want error reading the missing file, get %v", err)
+	}
+
+	for i, tc := range []struct {
+		config string
+		wantId string
+	}{
+		{config: `{"name": "bookstore.endpoints.project123.cloud.goog", "id": "2023-01-01r0"}`, wantId: "2023-01-01r0"},
+		// Unchanged.
+		{config: `{"name": "bookstore.endpoints.project123.cloud.goog", "id": "2023-01-01r0"}`},
+		{config: `{"name": "bookstore.endpoints.project123.cloud.goog", "id": "2023-01-02r0"}`, wantId: "2023-01-02r0"},
+	} {
+		if err := ioutil.WriteFile(path, []byte(tc.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		serviceConfig, err := source.FetchServiceConfig(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serviceConfig.GetId() != tc.wantId {
+			t.Errorf("fetch %d: want service config %q, get %v", i, tc.wantId, serviceConfig)
+		}
+		source.Commit()
+	}
+}
+
+func TestServiceManagementSourceCancelled(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	accessToken := func() (string, time.Duration, error) { return "token", time.Duration(60), nil }
+	source, err := NewServiceConfigSource("servicemanagement://bookstore.endpoints.project123.cloud.goog/2023-01-01r0", ServiceConfigSourceOptions{
+		Client:               &http.Client{},
+		ServiceManagementUrl: server.URL,
+		AccessToken:          accessToken,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := source.FetchServiceConfig(ctx)
+		done <- err
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("want error once the context is cancelled, get nil")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("fetch is not interrupted by the cancelled context")
+	}
+}
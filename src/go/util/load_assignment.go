@@ -22,6 +22,7 @@ import (
 	httppb "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
 	"github.com/golang/protobuf/ptypes"
 	anypb "github.com/golang/protobuf/ptypes/any"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
 )
 
 const (
@@ -54,31 +55,73 @@ func CreateUpstreamProtocolOptions() map[string]*anypb.Any {
 
 // CreateLoadAssignment creates a cluster for a TCP/IP port.
 func CreateLoadAssignment(hostname string, port uint32) *endpointpb.ClusterLoadAssignment {
-	return &endpointpb.ClusterLoadAssignment{
-		ClusterName: hostname,
-		Endpoints: []*endpointpb.LocalityLbEndpoints{
-			{
-				LbEndpoints: []*endpointpb.LbEndpoint{
-					{
-						HostIdentifier: &endpointpb.LbEndpoint_Endpoint{
-							Endpoint: &endpointpb.Endpoint{
-								Address: &corepb.Address{
-									Address: &corepb.Address_SocketAddress{
-										SocketAddress: &corepb.SocketAddress{
-											Address: hostname,
-											PortSpecifier: &corepb.SocketAddress_PortValue{
-												PortValue: port,
-											},
-										},
+	return CreateLocalityLoadAssignment(hostname, []*LoadAssignmentLocality{
+		{
+			Endpoints: []*LoadAssignmentEndpoint{
+				{
+					Hostname: hostname,
+					Port:     port,
+				},
+			},
+		},
+	})
+}
+
+// LoadAssignmentLocality is a group of endpoints in the same zone. The
+// locality and its weight are not set if empty.
+type LoadAssignmentLocality struct {
+	Region    string
+	Zone      string
+	Weight    uint32
+	Endpoints []*LoadAssignmentEndpoint
+}
+
+// LoadAssignmentEndpoint is a TCP/IP port of a load assignment.
+type LoadAssignmentEndpoint struct {
+	Hostname string
+	Port     uint32
+}
+
+// CreateLocalityLoadAssignment creates a cluster for the TCP/IP ports of the
+// localities.
+func CreateLocalityLoadAssignment(clusterName string, localities []*LoadAssignmentLocality) *endpointpb.ClusterLoadAssignment {
+	loadAssignment := &endpointpb.ClusterLoadAssignment{
+		ClusterName: clusterName,
+	}
+	for _, locality := range localities {
+		localityEndpoints := &endpointpb.LocalityLbEndpoints{}
+		if locality.Region != "" || locality.Zone != "" {
+			localityEndpoints.Locality = &corepb.Locality{
+				Region: locality.Region,
+				Zone:   locality.Zone,
+			}
+		}
+		if locality.Weight > 0 {
+			localityEndpoints.LoadBalancingWeight = &wrapperspb.UInt32Value{
+				Value: locality.Weight,
+			}
+		}
+		for _, endpoint := range locality.Endpoints {
+			localityEndpoints.LbEndpoints = append(localityEndpoints.LbEndpoints, &endpointpb.LbEndpoint{
+				HostIdentifier: &endpointpb.LbEndpoint_Endpoint{
+					Endpoint: &endpointpb.Endpoint{
+						Address: &corepb.Address{
+							Address: &corepb.Address_SocketAddress{
+								SocketAddress: &corepb.SocketAddress{
+									Address: endpoint.Hostname,
+									PortSpecifier: &corepb.SocketAddress_PortValue{
+										PortValue: endpoint.Port,
 									},
 								},
 							},
 						},
 					},
 				},
-			},
-		},
+			})
+		}
+		loadAssignment.Endpoints = append(loadAssignment.Endpoints, localityEndpoints)
 	}
+	return loadAssignment
 }
 
 // CreateUdsLoadAssignment creates a cluster for a unix domain socket.
@@ -15,11 +15,13 @@
 package util
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
+	"gopkg.in/yaml.v3"
 
 	bapb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v11/http/backend_auth"
 	gmspb "github.com/GoogleCloudPlatform/esp-v2/src/go/proto/api/envoy/v11/http/grpc_metadata_scrubber"
@@ -185,6 +187,40 @@ func UnmarshalServiceConfig(config io.Reader) (*confpb.Service, error) {
 	return &serviceConfig, nil
 }
 
+// YamlToJson converts YAML to JSON, so that it can be unmarshalled by jsonpb.
+// Non-string keys, such as the status codes of OpenAPI responses, become
+// strings.
+func YamlToJson(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("fail to unmarshal yaml: %v", err)
+	}
+	return json.Marshal(stringifyYamlKeys(v))
+}
+
+func stringifyYamlKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = stringifyYamlKeys(value)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = stringifyYamlKeys(value)
+		}
+		return m
+	case []interface{}:
+		for i, value := range v {
+			v[i] = stringifyYamlKeys(value)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
 func ProtoToJson(msg proto.Message) (string, error) {
 	marshaler := &jsonpb.Marshaler{}
 	return marshaler.MarshalToString(msg)
@@ -15,6 +15,7 @@
 package util
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -30,8 +31,8 @@ type RetryConfig struct {
 	RetryInterval time.Duration
 }
 
-func callWithAccessToken(client *http.Client, path, method, token string) ([]byte, int, error) {
-	req, _ := http.NewRequest(method, path, nil)
+func callWithAccessToken(ctx context.Context, client *http.Client, path, method, token string) ([]byte, int, error) {
+	req, _ := http.NewRequestWithContext(ctx, method, path, nil)
 	req.Header.Add("Authorization", "Bearer "+token)
 	req.Header.Set("Content-Type", "application/x-protobuf")
 
@@ -56,7 +57,8 @@ func callWithAccessToken(client *http.Client, path, method, token string) ([]byt
 var CallGoogleapisMu sync.RWMutex
 
 // Method to call servicecontrol for latest service rolloutId and servicecontrol for service rollout and service config.
-var CallGoogleapis = func(client *http.Client, path, method string, getTokenFunc GetAccessTokenFunc, retryConfigs map[int]RetryConfig, output proto.Message) error {
+// The call and its retries stop when ctx is done.
+var CallGoogleapis = func(ctx context.Context, client *http.Client, path, method string, getTokenFunc GetAccessTokenFunc, retryConfigs map[int]RetryConfig, output proto.Message) error {
 	token, _, err := getTokenFunc()
 	if err != nil {
 		return fmt.Errorf("fail to get access token: %v", err)
@@ -68,7 +70,7 @@ var CallGoogleapis = func(client *http.Client, path, method string, getTokenFunc
 	callStatusCnts := map[int]int{}
 
 	for {
-		respBytes, statusCode, err = callWithAccessToken(client, path, method, token)
+		respBytes, statusCode, err = callWithAccessToken(ctx, client, path, method, token)
 		if retryConfigs == nil {
 			break
 		} else if retryConfig, ok := retryConfigs[statusCode]; !ok {
@@ -79,7 +81,11 @@ var CallGoogleapis = func(client *http.Client, path, method string, getTokenFunc
 			callStatusCnts[statusCode] += 1
 			glog.Warningf("after %v failures on status %v, retrying http call %s with %v remaining chances", callStatusCnts[statusCode], statusCode, path, retryConfig.RetryNum-callStatusCnts[statusCode])
 
-			time.Sleep(retryConfig.RetryInterval)
+			select {
+			case <-time.After(retryConfig.RetryInterval):
+			case <-ctx.Done():
+				return fmt.Errorf("http call %s is cancelled, %v", path, ctx.Err())
+			}
 		}
 	}
 
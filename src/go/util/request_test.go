@@ -15,6 +15,7 @@
 package util
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -201,7 +202,7 @@ func TestCallGoogleapis(t *testing.T) {
 			UnmarshalBytesToPbMessage = tc.unmarshalFunc
 		}
 
-		err := CallGoogleapis(&http.Client{}, s.URL, tc.method, tc.token, tc.retryConfigs, nil)
+		err := CallGoogleapis(context.Background(), &http.Client{}, s.URL, tc.method, tc.token, tc.retryConfigs, nil)
 
 		if err != nil {
 			if tc.wantError == "" {
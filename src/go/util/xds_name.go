@@ -71,6 +71,9 @@ const (
 	// The service control server cluster name.
 	ServiceControlClusterName = "service-control-cluster"
 
+	// The cluster never created, failing the health checks while draining.
+	DrainingHealthCheckCluster = "draining-health-check-cluster"
+
 	IngressListenerName  = "ingress_listener"
 	LoopbackListenerName = "loopback_listener"
 )